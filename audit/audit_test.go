@@ -0,0 +1,64 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testEvent = Event{
+	Time:   time.Date(2026, time.October, 18, 12, 0, 0, 0, time.UTC),
+	Action: PasswordResetCompleted,
+	UserID: "66f0c2a1e4b0a1b2c3d4e5f6",
+	IP:     "203.0.113.7",
+}
+
+func TestNew(t *testing.T) {
+	logger, err := New("")
+	require.NoError(t, err)
+	assert.Equal(t, Log{}, logger)
+
+	_, err = New(filepath.Join(t.TempDir(), "missing", "audit.log"))
+	assert.Error(t, err)
+}
+
+func TestLog_Record(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	require.NoError(t, Log{}.Record(testEvent))
+
+	assert.Contains(t, buf.String(), `audit: {"time":"2026-10-18T12:00:00Z","action":"password_reset.completed","user_id":"66f0c2a1e4b0a1b2c3d4e5f6","ip":"203.0.113.7"}`)
+}
+
+func TestFile_Record(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	file, err := NewFile(path)
+	require.NoError(t, err)
+
+	require.NoError(t, file.Record(testEvent))
+	require.NoError(t, file.Record(Event{Action: PasswordResetRequested, Details: map[string]string{"reason": "test"}}))
+	require.NoError(t, file.Close())
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	require.Len(t, lines, 2)
+	var second Event
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &second))
+	assert.Equal(t, PasswordResetRequested, second.Action)
+	assert.Equal(t, "test", second.Details["reason"])
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+}
@@ -0,0 +1,352 @@
+// Package client is a typed Go client for the users API.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lep13/golang-restful-api/models"
+)
+
+const (
+	defaultMaxRetries = 3
+	defaultBackoff    = 100 * time.Millisecond
+	maxBackoff        = 5 * time.Second
+	userAgent         = "golang-restful-api-client"
+)
+
+// TokenSource returns the bearer token sent with each request.
+type TokenSource func(ctx context.Context) (string, error)
+
+// Client calls the users API. It is safe for concurrent use.
+type Client struct {
+	baseURL     *url.URL
+	httpClient  *http.Client
+	tokenSource TokenSource
+	maxRetries  int
+	backoff     time.Duration
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithHTTPClient sets the HTTP client used for requests, for example one
+// configured with a client certificate for mutual TLS.
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+// WithToken sends a static bearer token with every request.
+func WithToken(token string) Option {
+	return WithTokenSource(func(context.Context) (string, error) {
+		return token, nil
+	})
+}
+
+// WithTokenSource fetches the bearer token before every request, which
+// allows tokens to be refreshed.
+func WithTokenSource(source TokenSource) Option {
+	return func(c *Client) {
+		c.tokenSource = source
+	}
+}
+
+// WithRetries sets how many times a failed request is retried and the
+// backoff before the first retry. The backoff doubles after each attempt.
+// A maxRetries of zero disables retries.
+func WithRetries(maxRetries int, backoff time.Duration) Option {
+	return func(c *Client) {
+		c.maxRetries = maxRetries
+		c.backoff = backoff
+	}
+}
+
+// New creates a client for the API served at baseURL, e.g. "https://api.example.com".
+func New(baseURL string, opts ...Option) (*Client, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid base URL: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid base URL %q: scheme must be http or https", baseURL)
+	}
+	c := &Client{
+		baseURL:    u,
+		httpClient: http.DefaultClient,
+		maxRetries: defaultMaxRetries,
+		backoff:    defaultBackoff,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c, nil
+}
+
+// CreateUser creates a user and returns it with its assigned ID.
+func (c *Client) CreateUser(ctx context.Context, user models.User) (models.User, error) {
+	var created models.User
+	_, err := c.do(ctx, http.MethodPost, "/v1/users", nil, user, &created)
+	return created, err
+}
+
+// GetUser returns the user with the given ID.
+func (c *Client) GetUser(ctx context.Context, id string) (models.User, error) {
+	var user models.User
+	_, err := c.do(ctx, http.MethodGet, "/v1/users/"+url.PathEscape(id), nil, nil, &user)
+	return user, err
+}
+
+// UpdateUser sets the non-empty fields of user on the user with the given ID.
+func (c *Client) UpdateUser(ctx context.Context, id string, user models.User) error {
+	_, err := c.do(ctx, http.MethodPut, "/v1/users/"+url.PathEscape(id), nil, user, nil)
+	return err
+}
+
+// DeleteUser deletes the user with the given ID.
+func (c *Client) DeleteUser(ctx context.Context, id string) error {
+	_, err := c.do(ctx, http.MethodDelete, "/v1/users/"+url.PathEscape(id), nil, nil, nil)
+	return err
+}
+
+// ListOptions selects a page of users.
+type ListOptions struct {
+	// Limit is the page size. Zero returns every user in a single page.
+	Limit int
+	// Cursor is the NextCursor of the previous page.
+	Cursor string
+}
+
+// UserPage is one page of users.
+type UserPage struct {
+	Users []models.User
+	// NextCursor is empty on the last page.
+	NextCursor string
+}
+
+// ListUsersPage returns a single page of users ordered by ID.
+func (c *Client) ListUsersPage(ctx context.Context, opts ListOptions) (UserPage, error) {
+	query := url.Values{}
+	if opts.Limit > 0 {
+		query.Set("limit", strconv.Itoa(opts.Limit))
+	}
+	if opts.Cursor != "" {
+		query.Set("cursor", opts.Cursor)
+	}
+	var page UserPage
+	header, err := c.do(ctx, http.MethodGet, "/v1/users", query, nil, &page.Users)
+	if err != nil {
+		return UserPage{}, err
+	}
+	page.NextCursor = header.Get("X-Next-Cursor")
+	return page, nil
+}
+
+// ListUsers returns an iterator over every user, fetching pages of pageSize
+// users as needed.
+func (c *Client) ListUsers(ctx context.Context, pageSize int) *UserIterator {
+	return &UserIterator{client: c, ctx: ctx, pageSize: pageSize}
+}
+
+// UserIterator walks through the users page by page.
+//
+//	it := c.ListUsers(ctx, 50)
+//	for it.Next() {
+//		user := it.User()
+//	}
+//	if err := it.Err(); err != nil {
+//	}
+type UserIterator struct {
+	client   *Client
+	ctx      context.Context
+	pageSize int
+	cursor   string
+	buffer   []models.User
+	current  models.User
+	started  bool
+	err      error
+}
+
+// Next advances to the next user, fetching the next page when needed. It
+// returns false when there are no more users or a request failed.
+func (it *UserIterator) Next() bool {
+	for len(it.buffer) == 0 {
+		if it.err != nil || (it.started && it.cursor == "") {
+			return false
+		}
+		page, err := it.client.ListUsersPage(it.ctx, ListOptions{Limit: it.pageSize, Cursor: it.cursor})
+		if err != nil {
+			it.err = err
+			return false
+		}
+		it.started = true
+		it.buffer = page.Users
+		it.cursor = page.NextCursor
+	}
+	it.current = it.buffer[0]
+	it.buffer = it.buffer[1:]
+	return true
+}
+
+// User returns the current user.
+func (it *UserIterator) User() models.User {
+	return it.current
+}
+
+// Err returns the error that stopped the iteration, if any.
+func (it *UserIterator) Err() error {
+	return it.err
+}
+
+// do sends a request, retrying transient failures, and decodes a successful
+// JSON response into out. It returns the response headers.
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, body, out interface{}) (http.Header, error) {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return nil, fmt.Errorf("encoding request body: %w", err)
+		}
+	}
+	endpoint := c.baseURL.JoinPath(path)
+	endpoint.RawQuery = query.Encode()
+
+	for attempt := 0; ; attempt++ {
+		header, err := c.send(ctx, method, endpoint.String(), payload, out)
+		if err == nil {
+			return header, nil
+		}
+		if attempt >= c.maxRetries || !retryable(method, err) {
+			return nil, err
+		}
+		if err := sleep(ctx, c.delay(attempt, err)); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (c *Client) send(ctx context.Context, method, endpoint string, payload []byte, out interface{}) (http.Header, error) {
+	var body io.Reader
+	if payload != nil {
+		body = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", userAgent)
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.tokenSource != nil {
+		token, err := c.tokenSource(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("fetching token: %w", err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, decodeError(resp)
+	}
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return nil, fmt.Errorf("decoding response: %w", err)
+		}
+	}
+	return resp.Header, nil
+}
+
+// retryable reports whether a failed request may be sent again. A 429 means
+// the request was never processed, so it is always safe to retry. Server
+// errors and network failures are only retried for idempotent methods.
+func retryable(method string, err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		if apiErr.StatusCode == http.StatusTooManyRequests {
+			return true
+		}
+		return apiErr.StatusCode >= 500 && idempotent(method)
+	}
+	return idempotent(method)
+}
+
+func idempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete, http.MethodOptions:
+		return true
+	}
+	return false
+}
+
+// delay is an exponential backoff with full jitter, overridden by the
+// server's Retry-After when that is longer.
+func (c *Client) delay(attempt int, err error) time.Duration {
+	backoff := c.backoff << attempt
+	if backoff <= 0 || backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+	wait := time.Duration(rand.Int63n(int64(backoff) + 1))
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && apiErr.RetryAfter > wait {
+		wait = apiErr.RetryAfter
+	}
+	return wait
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// decodeError builds an APIError from an error response. Bodies that are
+// not in the API's error format fall back to the status text.
+func decodeError(resp *http.Response) error {
+	apiErr := &APIError{StatusCode: resp.StatusCode}
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+		apiErr.RetryAfter = time.Duration(seconds) * time.Second
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	var payload struct {
+		Error   string      `json:"error"`
+		Details []Violation `json:"details"`
+	}
+	if err := json.Unmarshal(body, &payload); err == nil && payload.Error != "" {
+		apiErr.Message = payload.Error
+		apiErr.Details = payload.Details
+	} else if text := strings.TrimSpace(string(body)); text != "" && len(text) < 200 {
+		apiErr.Message = text
+	} else {
+		apiErr.Message = http.StatusText(resp.StatusCode)
+	}
+	return apiErr
+}
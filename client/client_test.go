@@ -0,0 +1,454 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lep13/golang-restful-api/config"
+	"github.com/lep13/golang-restful-api/db"
+	"github.com/lep13/golang-restful-api/handlers"
+	"github.com/lep13/golang-restful-api/middleware"
+	"github.com/lep13/golang-restful-api/models"
+	"github.com/lep13/golang-restful-api/router"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// memoryCollection is an in-memory stand-in for the users collection that
+// understands the queries issued by the handlers.
+type memoryCollection struct {
+	mu    sync.Mutex
+	users map[primitive.ObjectID]models.User
+}
+
+func newMemoryCollection() *memoryCollection {
+	return &memoryCollection{users: map[primitive.ObjectID]models.User{}}
+}
+
+func (m *memoryCollection) InsertOne(ctx context.Context, document interface{}) (*mongo.InsertOneResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	user := document.(models.User)
+	m.users[user.ID] = user
+	return &mongo.InsertOneResult{InsertedID: user.ID}, nil
+}
+
+func (m *memoryCollection) Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var after primitive.ObjectID
+	var in map[primitive.ObjectID]bool
+	if condition, ok := filter.(bson.M)["_id"].(bson.M); ok {
+		if gt, ok := condition["$gt"].(primitive.ObjectID); ok {
+			after = gt
+		}
+		if ids, ok := condition["$in"].([]primitive.ObjectID); ok {
+			in = make(map[primitive.ObjectID]bool)
+			for _, id := range ids {
+				in[id] = true
+			}
+		}
+	}
+	var users []models.User
+	for id, user := range m.users {
+		if id.Hex() > after.Hex() && (in == nil || in[id]) {
+			users = append(users, user)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID.Hex() < users[j].ID.Hex() })
+	for _, opt := range opts {
+		if opt.Limit != nil && int(*opt.Limit) < len(users) {
+			users = users[:*opt.Limit]
+		}
+	}
+	docs := make([]interface{}, len(users))
+	for i, user := range users {
+		docs[i] = user
+	}
+	return mongo.NewCursorFromDocuments(docs, nil, nil)
+}
+
+func (m *memoryCollection) FindOne(ctx context.Context, filter interface{}) db.MongoSingleResultInterface {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if email, ok := filter.(bson.M)["email"].(string); ok {
+		for _, user := range m.users {
+			if user.Email == email {
+				return singleResult{user: user, found: true}
+			}
+		}
+		return singleResult{}
+	}
+	user, ok := m.users[filter.(bson.M)["_id"].(primitive.ObjectID)]
+	return singleResult{user: user, found: ok}
+}
+
+func (m *memoryCollection) DeleteOne(ctx context.Context, filter interface{}) (*mongo.DeleteResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id := filter.(bson.M)["_id"].(primitive.ObjectID)
+	if _, ok := m.users[id]; !ok {
+		return &mongo.DeleteResult{}, nil
+	}
+	delete(m.users, id)
+	return &mongo.DeleteResult{DeletedCount: 1}, nil
+}
+
+func (m *memoryCollection) UpdateOne(ctx context.Context, filter interface{}, update interface{}) (*mongo.UpdateResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id := filter.(bson.M)["_id"].(primitive.ObjectID)
+	user, ok := m.users[id]
+	if !ok {
+		return &mongo.UpdateResult{}, nil
+	}
+	if push, ok := update.(bson.M)["$push"].(bson.M); ok {
+		if sessions, ok := push["sessions"].(bson.M); ok {
+			user.Sessions = append(user.Sessions, sessions["$each"].([]models.Session)...)
+		}
+	}
+	if changes, ok := update.(bson.M)["$set"].(models.User); ok {
+		if changes.Name != "" {
+			user.Name = changes.Name
+		}
+		if changes.Email != "" {
+			user.Email = changes.Email
+		}
+		if changes.Password != "" {
+			user.Password = changes.Password
+		}
+	}
+	m.users[id] = user
+	return &mongo.UpdateResult{MatchedCount: 1, ModifiedCount: 1}, nil
+}
+
+func (m *memoryCollection) InsertMany(ctx context.Context, documents []interface{}, opts ...*options.InsertManyOptions) (*mongo.InsertManyResult, error) {
+	result := &mongo.InsertManyResult{}
+	for _, document := range documents {
+		inserted, _ := m.InsertOne(ctx, document)
+		result.InsertedIDs = append(result.InsertedIDs, inserted.InsertedID)
+	}
+	return result, nil
+}
+
+func (m *memoryCollection) BulkWrite(ctx context.Context, models []mongo.WriteModel, opts ...*options.BulkWriteOptions) (*mongo.BulkWriteResult, error) {
+	result := &mongo.BulkWriteResult{}
+	for _, model := range models {
+		switch model := model.(type) {
+		case *mongo.UpdateOneModel:
+			updated, _ := m.UpdateOne(ctx, model.Filter, model.Update)
+			result.MatchedCount += updated.MatchedCount
+		case *mongo.DeleteOneModel:
+			deleted, _ := m.DeleteOne(ctx, model.Filter)
+			result.DeletedCount += deleted.DeletedCount
+		}
+	}
+	return result, nil
+}
+
+func (m *memoryCollection) CountDocuments(ctx context.Context, filter interface{}) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return int64(len(m.users)), nil
+}
+
+// WithTransaction restores the previous contents when fn fails.
+func (m *memoryCollection) WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	m.mu.Lock()
+	snapshot := make(map[primitive.ObjectID]models.User, len(m.users))
+	for id, user := range m.users {
+		snapshot[id] = user
+	}
+	m.mu.Unlock()
+	if err := fn(ctx); err != nil {
+		m.mu.Lock()
+		m.users = snapshot
+		m.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+type singleResult struct {
+	user  models.User
+	found bool
+}
+
+func (r singleResult) Decode(v interface{}) error {
+	if !r.found {
+		return mongo.ErrNoDocuments
+	}
+	*v.(*models.User) = r.user
+	return nil
+}
+
+// The admin newTestServer stores, for tests to log in as
+const (
+	adminEmail    = "admin@example.com"
+	adminPassword = "correct horse"
+)
+
+// newTestServer serves the real router on top of an in-memory collection
+// holding one admin.
+func newTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	password, err := bcrypt.GenerateFromPassword([]byte(adminPassword), bcrypt.MinCost)
+	require.NoError(t, err)
+	collection := newMemoryCollection()
+	collection.InsertOne(context.Background(), models.User{
+		ID:       primitive.NewObjectID(),
+		Name:     "Admin",
+		Email:    adminEmail,
+		Password: string(password),
+		Admin:    true,
+	})
+	handlers.Initialize(collection)
+	cfg := config.Config{
+		RateLimit:         config.RateLimitConfig{Default: config.RateLimit{Requests: 1000, Period: time.Minute}},
+		Security:          config.SecurityConfig{MaxBodyBytes: 1 << 20},
+		ValidateResponses: true,
+	}
+	r, err := router.New(cfg, middleware.NewMemoryStore())
+	require.NoError(t, err)
+	server := httptest.NewServer(r)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// login logs in through the server and returns the access token
+func login(t *testing.T, server *httptest.Server, email, password string) string {
+	t.Helper()
+	body, err := json.Marshal(map[string]string{"email": email, "password": password})
+	require.NoError(t, err)
+	resp, err := http.Post(server.URL+"/v1/auth/login", "application/json", bytes.NewReader(body))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var token handlers.TokenResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&token))
+	return token.AccessToken
+}
+
+func TestClient_CRUD(t *testing.T) {
+	server := newTestServer(t)
+	c, err := New(server.URL, WithToken(login(t, server, adminEmail, adminPassword)))
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	// Anyone may sign up
+	anonymous, err := New(server.URL)
+	require.NoError(t, err)
+	created, err := anonymous.CreateUser(ctx, models.User{Name: "John Doe", Email: "john@example.com", Password: "correct horse"})
+	require.NoError(t, err)
+	assert.False(t, created.ID.IsZero())
+	assert.Equal(t, "John Doe", created.Name)
+	assert.Empty(t, created.Password)
+	// Users may only read, change and delete themselves
+	john, err := New(server.URL, WithToken(login(t, server, "john@example.com", "correct horse")))
+	require.NoError(t, err)
+
+	fetched, err := john.GetUser(ctx, created.ID.Hex())
+	require.NoError(t, err)
+	assert.Equal(t, created, fetched)
+	_, err = john.ListUsersPage(ctx, ListOptions{})
+	assert.ErrorIs(t, err, ErrForbidden)
+
+	require.NoError(t, john.UpdateUser(ctx, created.ID.Hex(), models.User{Name: "Johnny Doe"}))
+	fetched, err = c.GetUser(ctx, created.ID.Hex())
+	require.NoError(t, err)
+	assert.Equal(t, "Johnny Doe", fetched.Name)
+	assert.Equal(t, "john@example.com", fetched.Email)
+
+	require.NoError(t, john.DeleteUser(ctx, created.ID.Hex()))
+	_, err = c.GetUser(ctx, created.ID.Hex())
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestClient_ListUsers(t *testing.T) {
+	server := newTestServer(t)
+	c, err := New(server.URL, WithToken(login(t, server, adminEmail, adminPassword)))
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	// The admin comes first
+	page, err := c.ListUsersPage(ctx, ListOptions{Limit: 1})
+	require.NoError(t, err)
+	ids := []string{page.Users[0].ID.Hex()}
+	for _, name := range []string{"Ann", "Bob", "Cat", "Dan", "Eve"} {
+		user, err := c.CreateUser(ctx, models.User{Name: name})
+		require.NoError(t, err)
+		ids = append(ids, user.ID.Hex())
+	}
+
+	page, err = c.ListUsersPage(ctx, ListOptions{Limit: 2})
+	require.NoError(t, err)
+	assert.Len(t, page.Users, 2)
+	assert.Equal(t, ids[1], page.NextCursor)
+
+	var names []string
+	it := c.ListUsers(ctx, 2)
+	for it.Next() {
+		names = append(names, it.User().Name)
+	}
+	require.NoError(t, it.Err())
+	assert.Equal(t, []string{"Admin", "Ann", "Bob", "Cat", "Dan", "Eve"}, names)
+
+	page, err = c.ListUsersPage(ctx, ListOptions{})
+	require.NoError(t, err)
+	assert.Len(t, page.Users, 6)
+	assert.Empty(t, page.NextCursor)
+}
+
+func TestClient_TypedErrors(t *testing.T) {
+	server := newTestServer(t)
+	c, err := New(server.URL)
+	require.NoError(t, err)
+
+	_, err = c.GetUser(context.Background(), "not-an-id")
+	var apiErr *APIError
+	require.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, http.StatusBadRequest, apiErr.StatusCode)
+	assert.Equal(t, "Request validation failed", apiErr.Message)
+	require.NotEmpty(t, apiErr.Details)
+	assert.Equal(t, "path.id", apiErr.Details[0].Field)
+	assert.ErrorIs(t, err, ErrBadRequest)
+	assert.NotErrorIs(t, err, ErrNotFound)
+
+	_, err = c.CreateUser(context.Background(), models.User{Email: "not-an-email"})
+	require.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, "body.email", apiErr.Details[0].Field)
+}
+
+func TestClient_SendsToken(t *testing.T) {
+	var auth atomic.Value
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth.Store(r.Header.Get("Authorization"))
+		w.Write([]byte(`{"message":"User deleted successfully"}`))
+	}))
+	defer server.Close()
+
+	c, err := New(server.URL, WithToken("abc123"))
+	require.NoError(t, err)
+	require.NoError(t, c.DeleteUser(context.Background(), "66f0c2a1e4b0a1b2c3d4e5f6"))
+	assert.Equal(t, "Bearer abc123", auth.Load())
+
+	c, err = New(server.URL, WithTokenSource(func(context.Context) (string, error) {
+		return "", errors.New("token expired")
+	}))
+	require.NoError(t, err)
+	assert.ErrorContains(t, c.DeleteUser(context.Background(), "66f0c2a1e4b0a1b2c3d4e5f6"), "token expired")
+}
+
+// flakyServer fails the first failures requests with status.
+func flakyServer(t *testing.T, failures int32, status int, attempts *int32) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if atomic.AddInt32(attempts, 1) <= failures {
+			w.WriteHeader(status)
+			w.Write([]byte(`{"error":"Database unavailable"}`))
+			return
+		}
+		w.Write([]byte(`{"_id":"66f0c2a1e4b0a1b2c3d4e5f6","name":"John Doe"}`))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestClient_RetriesServerErrors(t *testing.T) {
+	var attempts int32
+	server := flakyServer(t, 2, http.StatusServiceUnavailable, &attempts)
+	c, err := New(server.URL, WithRetries(3, time.Millisecond))
+	require.NoError(t, err)
+
+	user, err := c.GetUser(context.Background(), "66f0c2a1e4b0a1b2c3d4e5f6")
+	require.NoError(t, err)
+	assert.Equal(t, "John Doe", user.Name)
+	assert.Equal(t, int32(3), attempts)
+}
+
+func TestClient_GivesUpAfterMaxRetries(t *testing.T) {
+	var attempts int32
+	server := flakyServer(t, 10, http.StatusServiceUnavailable, &attempts)
+	c, err := New(server.URL, WithRetries(2, time.Millisecond))
+	require.NoError(t, err)
+
+	_, err = c.GetUser(context.Background(), "66f0c2a1e4b0a1b2c3d4e5f6")
+	assert.ErrorIs(t, err, ErrUnavailable)
+	assert.Equal(t, int32(3), attempts)
+}
+
+func TestClient_DoesNotRetryCreateOnServerError(t *testing.T) {
+	var attempts int32
+	server := flakyServer(t, 1, http.StatusInternalServerError, &attempts)
+	c, err := New(server.URL, WithRetries(3, time.Millisecond))
+	require.NoError(t, err)
+
+	_, err = c.CreateUser(context.Background(), models.User{Name: "John Doe"})
+	assert.ErrorIs(t, err, ErrServer)
+	assert.Equal(t, int32(1), attempts)
+}
+
+func TestClient_RetriesCreateWhenRateLimited(t *testing.T) {
+	var attempts int32
+	server := flakyServer(t, 1, http.StatusTooManyRequests, &attempts)
+	c, err := New(server.URL, WithRetries(3, time.Millisecond))
+	require.NoError(t, err)
+
+	_, err = c.CreateUser(context.Background(), models.User{Name: "John Doe"})
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), attempts)
+}
+
+func TestClient_BackoffHonorsContext(t *testing.T) {
+	var attempts int32
+	server := flakyServer(t, 10, http.StatusServiceUnavailable, &attempts)
+	c, err := New(server.URL, WithRetries(5, time.Hour))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = c.GetUser(ctx, "66f0c2a1e4b0a1b2c3d4e5f6")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestClient_DecodesRetryAfter(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "7")
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte("slow down"))
+	}))
+	defer server.Close()
+	c, err := New(server.URL, WithRetries(0, 0))
+	require.NoError(t, err)
+
+	_, err = c.GetUser(context.Background(), "66f0c2a1e4b0a1b2c3d4e5f6")
+	var apiErr *APIError
+	require.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, 7*time.Second, apiErr.RetryAfter)
+	assert.Equal(t, "slow down", apiErr.Message)
+	assert.ErrorIs(t, err, ErrRateLimited)
+}
+
+func TestNew_InvalidBaseURL(t *testing.T) {
+	_, err := New("ftp://example.com")
+	assert.Error(t, err)
+	_, err = New("://")
+	assert.Error(t, err)
+}
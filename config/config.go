@@ -0,0 +1,539 @@
+package config
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the runtime settings of the API, read from environment variables.
+type Config struct {
+	MongoURI string
+	Port     string
+
+	// MongoOperationTimeout bounds every individual database call made by a handler.
+	MongoOperationTimeout time.Duration
+
+	// MaxBatchItems caps the number of items accepted by one batch request.
+	MaxBatchItems int
+
+	// TrustedProxies lists the IPs or CIDR ranges whose X-Forwarded-For header is honored.
+	TrustedProxies []string
+
+	RateLimit RateLimitConfig
+	CORS      CORSConfig
+	Security  SecurityConfig
+	TLS       TLSConfig
+
+	// LegacyRoutes schedules the retirement of the unversioned /users aliases.
+	LegacyRoutes DeprecationConfig
+
+	Mail              MailConfig
+	EmailVerification EmailVerificationConfig
+	PasswordReset     PasswordResetConfig
+	MagicLink         MagicLinkConfig
+	Auth              AuthConfig
+	Lockout           LockoutConfig
+	OAuth             OAuthConfig
+
+	// OIDCProviders are the upstream OpenID Connect providers users may sign
+	// in with, such as a corporate SSO.
+	OIDCProviders []OIDCProviderConfig
+
+	// SCIMTokens are the bearer tokens identity providers provision users
+	// with over SCIM. Several may be valid at once, to rotate them. SCIM is
+	// disabled when there are none.
+	SCIMTokens []string
+
+	// PasswordMinLength is the shortest password accepted by a password reset.
+	PasswordMinLength int
+
+	// AuditLogFile receives the audit events, one JSON object per line. Empty
+	// writes them to the standard logger.
+	AuditLogFile string
+
+	// ValidateResponses checks every response against the OpenAPI document.
+	// Meant for development and tests; responses are buffered while enabled.
+	ValidateResponses bool
+}
+
+// RateLimit allows Requests per Period, refilled continuously (token bucket).
+type RateLimit struct {
+	Requests int
+	Period   time.Duration
+}
+
+// RateLimitConfig holds the default limit and per-route overrides keyed by
+// "METHOD /path/template", e.g. "POST /v1/users". Client limits each client IP
+// across all routes, before its credentials are checked.
+type RateLimitConfig struct {
+	Default RateLimit
+	Routes  map[string]RateLimit
+	Client  RateLimit
+}
+
+// CORSConfig controls which browser origins may call the API. An empty
+// AllowedOrigins list disables CORS. Origins are matched exactly, "*" allows any
+// origin and "https://*.example.com" allows any subdomain of example.com.
+type CORSConfig struct {
+	AllowedOrigins   []string
+	AllowedMethods   []string
+	AllowedHeaders   []string
+	ExposedHeaders   []string
+	AllowCredentials bool
+	MaxAge           time.Duration
+}
+
+// SecurityConfig holds request limits and hardening headers.
+type SecurityConfig struct {
+	// MaxBodyBytes caps the size of request bodies; larger bodies are rejected with 413.
+	MaxBodyBytes int64
+	// MaxUploadBytes caps the size of file uploads such as user imports.
+	MaxUploadBytes int64
+	// HSTSMaxAge is sent in Strict-Transport-Security; 0 omits the header.
+	HSTSMaxAge            time.Duration
+	ContentSecurityPolicy string
+}
+
+// TLSConfig enables HTTPS when CertFile and KeyFile are set. Setting
+// ClientCAFile turns on client certificate verification (mutual TLS).
+type TLSConfig struct {
+	CertFile string
+	KeyFile  string
+	// MinVersion is "1.2" or "1.3".
+	MinVersion string
+	// CipherSuites lists Go cipher suite names, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256.
+	// They only apply to TLS 1.2; empty keeps Go's defaults.
+	CipherSuites []string
+	ClientCAFile string
+	// ClientAuth is "require" or "optional" and only applies when ClientCAFile is set.
+	ClientAuth string
+	// RedirectPort, when set, serves a plaintext listener redirecting to HTTPS.
+	RedirectPort string
+	// ReloadInterval is how often the certificate files are checked for changes.
+	ReloadInterval time.Duration
+}
+
+// MailConfig selects how email is sent. Driver is "smtp", "file", which writes
+// each message to Dir, or "log", which only logs messages. When it is empty the
+// server falls back to "log" with a warning.
+type MailConfig struct {
+	Driver       string
+	From         string
+	SMTPHost     string
+	SMTPPort     int
+	SMTPUsername string
+	SMTPPassword string
+	Dir          string
+}
+
+// EmailVerificationConfig controls the tokens that confirm a user's email address.
+type EmailVerificationConfig struct {
+	// TokenTTL is how long a verification token stays valid.
+	TokenTTL time.Duration
+	// ResendInterval is the least time between two verification emails to a user.
+	ResendInterval time.Duration
+	// URL is the client page completing the verification; the user ID and token
+	// are appended as the user and token query parameters. Empty sends the
+	// token and the API endpoint instead.
+	URL string
+}
+
+// PasswordResetConfig controls the tokens mailed to users who forgot their password.
+type PasswordResetConfig struct {
+	// TokenTTL is how long a reset token stays valid.
+	TokenTTL time.Duration
+	// ResendInterval is the least time between two reset emails to a user;
+	// requests within it are ignored.
+	ResendInterval time.Duration
+	// URL is the client page where the user picks a new password; the token is
+	// appended as the token query parameter. Empty sends the token and the API
+	// endpoint instead.
+	URL string
+}
+
+// MagicLinkConfig controls the links mailed to users logging in without a password.
+type MagicLinkConfig struct {
+	// TokenTTL is how long a link stays valid.
+	TokenTTL time.Duration
+	// ResendInterval is the least time between two links mailed to an email;
+	// requests within it are ignored.
+	ResendInterval time.Duration
+	// URL is the client page completing the login; the token is appended as
+	// the token query parameter. Empty sends the token and the API endpoint
+	// instead.
+	URL string
+}
+
+// AuthConfig controls the tokens issued at login.
+type AuthConfig struct {
+	// TokenSecret signs the access tokens. Empty signs them with a random key,
+	// so tokens do not survive a restart nor work across instances.
+	TokenSecret string
+	// TokenTTL is how long an access token stays valid.
+	TokenTTL time.Duration
+	// MFAIssuer names the service in authenticator apps.
+	MFAIssuer string
+	// SessionCacheTTL is how long a session found valid is trusted without
+	// looking it up again, so revocations on other instances take up to this
+	// long. 0 looks sessions up on every request.
+	SessionCacheTTL time.Duration
+}
+
+// LockoutConfig slows down and locks out repeated failed logins. Failures are
+// counted per account, and separately per client IP.
+type LockoutConfig struct {
+	// MaxAttempts is the number of failed logins that locks an account; 0
+	// disables account lockouts.
+	MaxAttempts int
+	// Duration is how long a lockout lasts.
+	Duration time.Duration
+	// IPMaxAttempts is the number of failed logins, to any account, that locks
+	// out a client IP; 0 disables IP lockouts.
+	IPMaxAttempts int
+	// Window is how long a failure counts; the count starts over after a
+	// window without failures.
+	Window time.Duration
+	// Delay is the wait imposed on an account after its first failed login,
+	// doubled by each further failure; 0 disables delays.
+	Delay time.Duration
+}
+
+// OAuthConfig controls the OAuth 2.0 and OpenID Connect provider.
+type OAuthConfig struct {
+	// Issuer is the public base URL of the API, e.g. https://api.example.com,
+	// named in ID tokens and the discovery document and prefixing SCIM
+	// locations and upstream redirect URIs. Empty disables the provider.
+	Issuer string
+	// SigningKeyFile is a PEM RSA private key signing the ID tokens. Empty
+	// signs them with a random key, so they cannot be verified after a
+	// restart nor across instances.
+	SigningKeyFile string
+	// CodeTTL is how long a client has to redeem an authorization code.
+	CodeTTL time.Duration
+}
+
+// OIDCProviderConfig is an upstream OpenID Connect provider, registered with
+// it as a confidential client using the authorization code flow.
+type OIDCProviderConfig struct {
+	// Name identifies the provider in the API paths, e.g. "corp".
+	Name string
+	// Issuer is the issuer URL of the provider, exactly as in its ID tokens;
+	// its discovery document is read from
+	// Issuer + "/.well-known/openid-configuration".
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// Scopes are requested at the provider; openid is always included.
+	Scopes []string
+	// RedirectURL is registered at the provider. Empty uses the API's own
+	// callback endpoint under the OAuth issuer, and is only allowed with one;
+	// a client page receiving the redirect instead must pass the query on to
+	// that endpoint.
+	RedirectURL string
+	// Provision creates an account for a user of the provider with a
+	// verified email no account uses. When false, such users are rejected.
+	Provision bool
+}
+
+// DeprecationConfig describes when a set of routes was deprecated and when
+// it will be removed.
+type DeprecationConfig struct {
+	Deprecated time.Time
+	// Sunset is the planned removal date; zero omits the Sunset header.
+	Sunset time.Time
+}
+
+// Enabled reports whether the server should serve HTTPS.
+func (c TLSConfig) Enabled() bool {
+	return c.CertFile != "" && c.KeyFile != ""
+}
+
+// Load reads the configuration from the environment, applying defaults where a value is missing.
+func Load() Config {
+	return Config{
+		MongoURI:              os.Getenv("MONGO_URI"),
+		Port:                  getString("PORT", "5000"),
+		MongoOperationTimeout: getDuration("MONGO_OPERATION_TIMEOUT", 5*time.Second),
+		MaxBatchItems:         int(getInt64("BATCH_MAX_ITEMS", 500)),
+		TrustedProxies:        getList("TRUSTED_PROXIES"),
+		RateLimit: RateLimitConfig{
+			Default: getRateLimit("RATE_LIMIT_DEFAULT", RateLimit{Requests: 300, Period: time.Minute}),
+			Routes:  getRateLimitRoutes("RATE_LIMIT_ROUTES"),
+			Client:  getRateLimit("RATE_LIMIT_CLIENT", RateLimit{Requests: 1200, Period: time.Minute}),
+		},
+		CORS: CORSConfig{
+			AllowedOrigins:   getList("CORS_ALLOWED_ORIGINS"),
+			AllowedMethods:   getListOr("CORS_ALLOWED_METHODS", []string{"GET", "POST", "PUT", "PATCH", "DELETE"}),
+			AllowedHeaders:   getListOr("CORS_ALLOWED_HEADERS", []string{"Content-Type", "Authorization"}),
+			ExposedHeaders:   getListOr("CORS_EXPOSED_HEADERS", []string{"Link", "X-Next-Cursor", "Deprecation", "Sunset", "Retry-After", "RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset"}),
+			AllowCredentials: getBool("CORS_ALLOW_CREDENTIALS", false),
+			MaxAge:           getDuration("CORS_MAX_AGE", 10*time.Minute),
+		},
+		Security: SecurityConfig{
+			MaxBodyBytes:          getInt64("MAX_BODY_BYTES", 1<<20),
+			MaxUploadBytes:        getInt64("MAX_UPLOAD_BYTES", 50<<20),
+			HSTSMaxAge:            getDurationOrZero("HSTS_MAX_AGE", 365*24*time.Hour),
+			ContentSecurityPolicy: getString("CONTENT_SECURITY_POLICY", "default-src 'none'; frame-ancestors 'none'"),
+		},
+		TLS: TLSConfig{
+			CertFile:       os.Getenv("TLS_CERT_FILE"),
+			KeyFile:        os.Getenv("TLS_KEY_FILE"),
+			MinVersion:     getString("TLS_MIN_VERSION", "1.2"),
+			CipherSuites:   getList("TLS_CIPHER_SUITES"),
+			ClientCAFile:   os.Getenv("TLS_CLIENT_CA_FILE"),
+			ClientAuth:     getString("TLS_CLIENT_AUTH", "require"),
+			RedirectPort:   os.Getenv("HTTP_REDIRECT_PORT"),
+			ReloadInterval: getDuration("TLS_RELOAD_INTERVAL", 30*time.Second),
+		},
+		LegacyRoutes: DeprecationConfig{
+			Deprecated: getDate("LEGACY_ROUTES_DEPRECATED", time.Date(2026, time.October, 18, 0, 0, 0, 0, time.UTC)),
+			Sunset:     getDate("LEGACY_ROUTES_SUNSET", time.Date(2027, time.April, 30, 0, 0, 0, 0, time.UTC)),
+		},
+		Mail: MailConfig{
+			Driver:       os.Getenv("MAIL_DRIVER"),
+			From:         getString("MAIL_FROM", "no-reply@localhost"),
+			SMTPHost:     os.Getenv("SMTP_HOST"),
+			SMTPPort:     int(getInt64("SMTP_PORT", 587)),
+			SMTPUsername: os.Getenv("SMTP_USERNAME"),
+			SMTPPassword: os.Getenv("SMTP_PASSWORD"),
+			Dir:          getString("MAIL_DIR", "mail"),
+		},
+		EmailVerification: EmailVerificationConfig{
+			TokenTTL:       getDuration("EMAIL_VERIFICATION_TTL", 24*time.Hour),
+			ResendInterval: getDuration("EMAIL_VERIFICATION_RESEND_INTERVAL", time.Minute),
+			URL:            os.Getenv("EMAIL_VERIFICATION_URL"),
+		},
+		PasswordReset: PasswordResetConfig{
+			TokenTTL:       getDuration("PASSWORD_RESET_TTL", 30*time.Minute),
+			ResendInterval: getDuration("PASSWORD_RESET_RESEND_INTERVAL", time.Minute),
+			URL:            os.Getenv("PASSWORD_RESET_URL"),
+		},
+		MagicLink: MagicLinkConfig{
+			TokenTTL:       getDuration("MAGIC_LINK_TTL", 15*time.Minute),
+			ResendInterval: getDuration("MAGIC_LINK_RESEND_INTERVAL", time.Minute),
+			URL:            os.Getenv("MAGIC_LINK_URL"),
+		},
+		Auth: AuthConfig{
+			TokenSecret:     os.Getenv("AUTH_TOKEN_SECRET"),
+			TokenTTL:        getDuration("AUTH_TOKEN_TTL", time.Hour),
+			MFAIssuer:       getString("MFA_ISSUER", "Golang RESTful API"),
+			SessionCacheTTL: getDurationOrZero("AUTH_SESSION_CACHE_TTL", 30*time.Second),
+		},
+		Lockout: LockoutConfig{
+			MaxAttempts:   int(getInt64OrZero("LOCKOUT_MAX_ATTEMPTS", 5)),
+			Duration:      getDuration("LOCKOUT_DURATION", 15*time.Minute),
+			IPMaxAttempts: int(getInt64OrZero("LOCKOUT_IP_MAX_ATTEMPTS", 50)),
+			Window:        getDuration("LOCKOUT_WINDOW", 15*time.Minute),
+			Delay:         getDurationOrZero("LOCKOUT_DELAY", time.Second),
+		},
+		OAuth: OAuthConfig{
+			Issuer:         strings.TrimSuffix(os.Getenv("OAUTH_ISSUER"), "/"),
+			SigningKeyFile: os.Getenv("OAUTH_SIGNING_KEY_FILE"),
+			CodeTTL:        getDuration("OAUTH_CODE_TTL", time.Minute),
+		},
+		OIDCProviders:     getOIDCProviders("OIDC_PROVIDERS"),
+		SCIMTokens:        getList("SCIM_TOKENS"),
+		PasswordMinLength: int(getInt64("PASSWORD_MIN_LENGTH", 8)),
+		AuditLogFile:      os.Getenv("AUDIT_LOG_FILE"),
+		ValidateResponses: getBool("OPENAPI_VALIDATE_RESPONSES", false),
+	}
+}
+
+// ParseRateLimit parses a limit written as "<requests>/<period>", e.g. "10/1m".
+// A request count of 0 disables limiting.
+func ParseRateLimit(value string) (RateLimit, error) {
+	requests, period, ok := strings.Cut(strings.TrimSpace(value), "/")
+	if !ok {
+		return RateLimit{}, fmt.Errorf("rate limit %q must have the form <requests>/<period>", value)
+	}
+	n, err := strconv.Atoi(requests)
+	if err != nil || n < 0 {
+		return RateLimit{}, fmt.Errorf("invalid request count in rate limit %q", value)
+	}
+	d, err := time.ParseDuration(period)
+	if err != nil || d <= 0 {
+		return RateLimit{}, fmt.Errorf("invalid period in rate limit %q", value)
+	}
+	return RateLimit{Requests: n, Period: d}, nil
+}
+
+// getString returns the value of the environment variable or the fallback if it is unset.
+func getString(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// getDuration parses the environment variable as a time.Duration (e.g. "5s", "250ms").
+// Invalid or non-positive values are logged and replaced by the fallback.
+func getDuration(key string, fallback time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		log.Printf("Invalid value %q for %s, using default %s", value, key, fallback)
+		return fallback
+	}
+	return d
+}
+
+// getDurationOrZero is getDuration but accepts "0" to disable a feature.
+func getDurationOrZero(key string, fallback time.Duration) time.Duration {
+	if os.Getenv(key) == "0" {
+		return 0
+	}
+	return getDuration(key, fallback)
+}
+
+// getDate parses the environment variable as a date ("2006-01-02") or an
+// RFC 3339 timestamp.
+func getDate(key string, fallback time.Time) time.Time {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	for _, layout := range []string{"2006-01-02", time.RFC3339} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t
+		}
+	}
+	log.Printf("Invalid value %q for %s, using default %s", value, key, fallback.Format("2006-01-02"))
+	return fallback
+}
+
+// getInt64 parses the environment variable as a positive integer.
+func getInt64(key string, fallback int64) int64 {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n <= 0 {
+		log.Printf("Invalid value %q for %s, using default %d", value, key, fallback)
+		return fallback
+	}
+	return n
+}
+
+// getInt64OrZero is getInt64 but accepts "0" to disable a feature.
+func getInt64OrZero(key string, fallback int64) int64 {
+	if os.Getenv(key) == "0" {
+		return 0
+	}
+	return getInt64(key, fallback)
+}
+
+// getList splits a comma separated environment variable, dropping empty entries.
+func getList(key string) []string {
+	var values []string
+	for _, value := range strings.Split(os.Getenv(key), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// getListOr is getList with a fallback used when the variable is unset.
+func getListOr(key string, fallback []string) []string {
+	if values := getList(key); len(values) > 0 {
+		return values
+	}
+	return fallback
+}
+
+// getBool parses the environment variable with strconv.ParseBool.
+func getBool(key string, fallback bool) bool {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("Invalid value %q for %s, using default %t", value, key, fallback)
+		return fallback
+	}
+	return b
+}
+
+// getRateLimit parses the environment variable with ParseRateLimit.
+func getRateLimit(key string, fallback RateLimit) RateLimit {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	limit, err := ParseRateLimit(value)
+	if err != nil {
+		log.Printf("Invalid value for %s, using default: %v", key, err)
+		return fallback
+	}
+	return limit
+}
+
+// getRateLimitRoutes parses per-route limits written as
+// "POST /v1/users=10/1m,GET /v1/users=100/1m".
+func getRateLimitRoutes(key string) map[string]RateLimit {
+	routes := make(map[string]RateLimit)
+	for _, entry := range getList(key) {
+		route, value, ok := strings.Cut(entry, "=")
+		if !ok {
+			log.Printf("Ignoring malformed %s entry %q", key, entry)
+			continue
+		}
+		limit, err := ParseRateLimit(value)
+		if err != nil {
+			log.Printf("Ignoring %s entry %q: %v", key, entry, err)
+			continue
+		}
+		routes[strings.Join(strings.Fields(route), " ")] = limit
+	}
+	return routes
+}
+
+// getOIDCProviders reads the providers named in a comma separated list, each
+// configured by OIDC_<NAME>_ISSUER, OIDC_<NAME>_CLIENT_ID,
+// OIDC_<NAME>_CLIENT_SECRET, OIDC_<NAME>_SCOPES, OIDC_<NAME>_REDIRECT_URL and
+// OIDC_<NAME>_PROVISION, with NAME upper-cased and dashes replaced by
+// underscores. Providers with an invalid name or without an issuer or client
+// ID are logged and skipped.
+func getOIDCProviders(key string) []OIDCProviderConfig {
+	var providers []OIDCProviderConfig
+	for _, name := range getList(key) {
+		if !validProviderName(name) {
+			log.Printf("Ignoring %s entry %q: names use lowercase letters, digits and dashes", key, name)
+			continue
+		}
+		prefix := "OIDC_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+		provider := OIDCProviderConfig{
+			Name:         name,
+			Issuer:       os.Getenv(prefix + "ISSUER"),
+			ClientID:     os.Getenv(prefix + "CLIENT_ID"),
+			ClientSecret: os.Getenv(prefix + "CLIENT_SECRET"),
+			Scopes:       getListOr(prefix+"SCOPES", []string{"openid", "email", "profile"}),
+			RedirectURL:  os.Getenv(prefix + "REDIRECT_URL"),
+			Provision:    getBool(prefix+"PROVISION", true),
+		}
+		if provider.Issuer == "" || provider.ClientID == "" {
+			log.Printf("Ignoring OIDC provider %q: %sISSUER and %sCLIENT_ID are required", name, prefix, prefix)
+			continue
+		}
+		providers = append(providers, provider)
+	}
+	return providers
+}
+
+func validProviderName(name string) bool {
+	for _, c := range name {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+			return false
+		}
+	}
+	return name != ""
+}
@@ -0,0 +1,286 @@
+package config
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoad_Defaults(t *testing.T) {
+	t.Setenv("MONGO_URI", "mongodb://localhost:27017")
+	t.Setenv("PORT", "")
+	t.Setenv("MONGO_OPERATION_TIMEOUT", "")
+
+	cfg := Load()
+
+	assert.Equal(t, "mongodb://localhost:27017", cfg.MongoURI)
+	assert.Equal(t, "5000", cfg.Port)
+	assert.Equal(t, 5*time.Second, cfg.MongoOperationTimeout)
+	assert.Equal(t, 500, cfg.MaxBatchItems)
+}
+
+func TestLoad_Overrides(t *testing.T) {
+	t.Setenv("PORT", "8080")
+	t.Setenv("MONGO_OPERATION_TIMEOUT", "750ms")
+	t.Setenv("BATCH_MAX_ITEMS", "50")
+
+	cfg := Load()
+
+	assert.Equal(t, "8080", cfg.Port)
+	assert.Equal(t, 50, cfg.MaxBatchItems)
+	assert.Equal(t, 750*time.Millisecond, cfg.MongoOperationTimeout)
+}
+
+func TestLoad_InvalidDuration(t *testing.T) {
+	t.Setenv("MONGO_OPERATION_TIMEOUT", "soon")
+
+	cfg := Load()
+
+	assert.Equal(t, 5*time.Second, cfg.MongoOperationTimeout)
+}
+
+func TestParseRateLimit(t *testing.T) {
+	limit, err := ParseRateLimit("10/1m")
+	assert.NoError(t, err)
+	assert.Equal(t, RateLimit{Requests: 10, Period: time.Minute}, limit)
+
+	for _, value := range []string{"10", "x/1m", "-1/1m", "10/never", "10/0s"} {
+		_, err := ParseRateLimit(value)
+		assert.Error(t, err, value)
+	}
+}
+
+func TestLoad_RateLimits(t *testing.T) {
+	t.Setenv("RATE_LIMIT_DEFAULT", "50/30s")
+	t.Setenv("RATE_LIMIT_ROUTES", "POST  /users=5/1m, GET /users=bad ,broken")
+	t.Setenv("RATE_LIMIT_CLIENT", "")
+	t.Setenv("TRUSTED_PROXIES", "10.0.0.0/8, 127.0.0.1,")
+
+	cfg := Load()
+
+	assert.Equal(t, RateLimit{Requests: 50, Period: 30 * time.Second}, cfg.RateLimit.Default)
+	assert.Equal(t, map[string]RateLimit{"POST /users": {Requests: 5, Period: time.Minute}}, cfg.RateLimit.Routes)
+	assert.Equal(t, RateLimit{Requests: 1200, Period: time.Minute}, cfg.RateLimit.Client)
+	assert.Equal(t, []string{"10.0.0.0/8", "127.0.0.1"}, cfg.TrustedProxies)
+}
+
+func TestLoad_CORS(t *testing.T) {
+	t.Setenv("CORS_ALLOWED_ORIGINS", "https://app.example.com,https://*.example.org")
+	t.Setenv("CORS_ALLOWED_METHODS", "")
+	t.Setenv("CORS_ALLOW_CREDENTIALS", "true")
+	t.Setenv("CORS_MAX_AGE", "1h")
+
+	cfg := Load()
+
+	assert.Equal(t, []string{"https://app.example.com", "https://*.example.org"}, cfg.CORS.AllowedOrigins)
+	assert.Equal(t, []string{"GET", "POST", "PUT", "PATCH", "DELETE"}, cfg.CORS.AllowedMethods)
+	assert.Contains(t, cfg.CORS.ExposedHeaders, "X-Next-Cursor")
+	assert.True(t, cfg.CORS.AllowCredentials)
+	assert.Equal(t, time.Hour, cfg.CORS.MaxAge)
+}
+
+func TestLoad_Security(t *testing.T) {
+	t.Setenv("MAX_BODY_BYTES", "2048")
+	t.Setenv("MAX_UPLOAD_BYTES", "4096")
+	t.Setenv("HSTS_MAX_AGE", "0")
+	t.Setenv("CONTENT_SECURITY_POLICY", "")
+
+	cfg := Load()
+
+	assert.Equal(t, int64(2048), cfg.Security.MaxBodyBytes)
+	assert.Equal(t, int64(4096), cfg.Security.MaxUploadBytes)
+	assert.Zero(t, cfg.Security.HSTSMaxAge)
+	assert.Equal(t, "default-src 'none'; frame-ancestors 'none'", cfg.Security.ContentSecurityPolicy)
+
+	t.Setenv("MAX_BODY_BYTES", "-1")
+	t.Setenv("MAX_UPLOAD_BYTES", "")
+	t.Setenv("HSTS_MAX_AGE", "")
+	cfg = Load()
+	assert.Equal(t, int64(1<<20), cfg.Security.MaxBodyBytes)
+	assert.Equal(t, int64(50<<20), cfg.Security.MaxUploadBytes)
+	assert.Equal(t, 365*24*time.Hour, cfg.Security.HSTSMaxAge)
+}
+
+func TestLoad_TLS(t *testing.T) {
+	t.Setenv("TLS_CERT_FILE", "")
+	t.Setenv("TLS_KEY_FILE", "")
+	assert.False(t, Load().TLS.Enabled())
+
+	t.Setenv("TLS_CERT_FILE", "server.crt")
+	t.Setenv("TLS_KEY_FILE", "server.key")
+	t.Setenv("TLS_CIPHER_SUITES", "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256")
+
+	cfg := Load()
+
+	assert.True(t, cfg.TLS.Enabled())
+	assert.Equal(t, "1.2", cfg.TLS.MinVersion)
+	assert.Equal(t, "require", cfg.TLS.ClientAuth)
+	assert.Equal(t, []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}, cfg.TLS.CipherSuites)
+	assert.Equal(t, 30*time.Second, cfg.TLS.ReloadInterval)
+}
+
+func TestLoad_LegacyRoutes(t *testing.T) {
+	t.Setenv("LEGACY_ROUTES_DEPRECATED", "2026-01-15")
+	t.Setenv("LEGACY_ROUTES_SUNSET", "2026-07-01T12:00:00Z")
+
+	cfg := Load()
+
+	assert.Equal(t, time.Date(2026, time.January, 15, 0, 0, 0, 0, time.UTC), cfg.LegacyRoutes.Deprecated)
+	assert.Equal(t, time.Date(2026, time.July, 1, 12, 0, 0, 0, time.UTC), cfg.LegacyRoutes.Sunset)
+
+	t.Setenv("LEGACY_ROUTES_SUNSET", "next year")
+	assert.Equal(t, time.Date(2027, time.April, 30, 0, 0, 0, 0, time.UTC), Load().LegacyRoutes.Sunset)
+}
+
+func TestLoad_Mail(t *testing.T) {
+	t.Setenv("MAIL_DRIVER", "")
+	t.Setenv("SMTP_PORT", "")
+	t.Setenv("EMAIL_VERIFICATION_TTL", "")
+
+	cfg := Load()
+
+	assert.Equal(t, "", cfg.Mail.Driver)
+	assert.Equal(t, 587, cfg.Mail.SMTPPort)
+	assert.Equal(t, 24*time.Hour, cfg.EmailVerification.TokenTTL)
+	assert.Equal(t, time.Minute, cfg.EmailVerification.ResendInterval)
+
+	t.Setenv("MAIL_DRIVER", "smtp")
+	t.Setenv("MAIL_FROM", "accounts@example.com")
+	t.Setenv("SMTP_HOST", "smtp.example.com")
+	t.Setenv("SMTP_PORT", "465")
+	t.Setenv("EMAIL_VERIFICATION_TTL", "2h")
+	t.Setenv("EMAIL_VERIFICATION_URL", "https://app.example.com/verify")
+
+	cfg = Load()
+
+	assert.Equal(t, MailConfig{Driver: "smtp", From: "accounts@example.com", SMTPHost: "smtp.example.com", SMTPPort: 465, Dir: "mail"}, cfg.Mail)
+	assert.Equal(t, 2*time.Hour, cfg.EmailVerification.TokenTTL)
+	assert.Equal(t, "https://app.example.com/verify", cfg.EmailVerification.URL)
+}
+
+func TestLoad_PasswordReset(t *testing.T) {
+	t.Setenv("PASSWORD_RESET_TTL", "")
+	t.Setenv("PASSWORD_MIN_LENGTH", "")
+
+	cfg := Load()
+
+	assert.Equal(t, PasswordResetConfig{TokenTTL: 30 * time.Minute, ResendInterval: time.Minute}, cfg.PasswordReset)
+	assert.Equal(t, 8, cfg.PasswordMinLength)
+
+	t.Setenv("PASSWORD_RESET_TTL", "15m")
+	t.Setenv("PASSWORD_RESET_URL", "https://app.example.com/reset")
+	t.Setenv("PASSWORD_MIN_LENGTH", "12")
+	t.Setenv("AUDIT_LOG_FILE", "/var/log/api/audit.log")
+
+	cfg = Load()
+
+	assert.Equal(t, 15*time.Minute, cfg.PasswordReset.TokenTTL)
+	assert.Equal(t, "https://app.example.com/reset", cfg.PasswordReset.URL)
+	assert.Equal(t, 12, cfg.PasswordMinLength)
+	assert.Equal(t, "/var/log/api/audit.log", cfg.AuditLogFile)
+}
+
+func TestLoad_MagicLink(t *testing.T) {
+	t.Setenv("MAGIC_LINK_TTL", "")
+
+	cfg := Load()
+
+	assert.Equal(t, MagicLinkConfig{TokenTTL: 15 * time.Minute, ResendInterval: time.Minute}, cfg.MagicLink)
+
+	t.Setenv("MAGIC_LINK_TTL", "5m")
+	t.Setenv("MAGIC_LINK_RESEND_INTERVAL", "2m")
+	t.Setenv("MAGIC_LINK_URL", "https://app.example.com/magic-link")
+
+	cfg = Load()
+
+	assert.Equal(t, MagicLinkConfig{TokenTTL: 5 * time.Minute, ResendInterval: 2 * time.Minute, URL: "https://app.example.com/magic-link"}, cfg.MagicLink)
+}
+
+func TestLoad_Auth(t *testing.T) {
+	t.Setenv("AUTH_TOKEN_SECRET", "")
+	t.Setenv("AUTH_TOKEN_TTL", "")
+	t.Setenv("MFA_ISSUER", "")
+	t.Setenv("AUTH_SESSION_CACHE_TTL", "")
+
+	cfg := Load()
+
+	assert.Equal(t, AuthConfig{TokenTTL: time.Hour, MFAIssuer: "Golang RESTful API", SessionCacheTTL: 30 * time.Second}, cfg.Auth)
+
+	t.Setenv("AUTH_TOKEN_SECRET", "s3cret")
+	t.Setenv("AUTH_TOKEN_TTL", "15m")
+	t.Setenv("MFA_ISSUER", "Example")
+	t.Setenv("AUTH_SESSION_CACHE_TTL", "0")
+
+	cfg = Load()
+
+	assert.Equal(t, AuthConfig{TokenSecret: "s3cret", TokenTTL: 15 * time.Minute, MFAIssuer: "Example"}, cfg.Auth)
+}
+
+func TestLoad_Lockout(t *testing.T) {
+	for _, key := range []string{"LOCKOUT_MAX_ATTEMPTS", "LOCKOUT_DURATION", "LOCKOUT_IP_MAX_ATTEMPTS", "LOCKOUT_WINDOW", "LOCKOUT_DELAY"} {
+		t.Setenv(key, "")
+	}
+
+	cfg := Load()
+
+	assert.Equal(t, LockoutConfig{MaxAttempts: 5, Duration: 15 * time.Minute, IPMaxAttempts: 50, Window: 15 * time.Minute, Delay: time.Second}, cfg.Lockout)
+
+	t.Setenv("LOCKOUT_MAX_ATTEMPTS", "0")
+	t.Setenv("LOCKOUT_DURATION", "1h")
+	t.Setenv("LOCKOUT_IP_MAX_ATTEMPTS", "100")
+	t.Setenv("LOCKOUT_DELAY", "0")
+
+	cfg = Load()
+
+	assert.Equal(t, LockoutConfig{Duration: time.Hour, IPMaxAttempts: 100, Window: 15 * time.Minute}, cfg.Lockout)
+}
+
+func TestLoad_OAuth(t *testing.T) {
+	t.Setenv("OAUTH_ISSUER", "")
+	t.Setenv("OAUTH_SIGNING_KEY_FILE", "")
+	t.Setenv("OAUTH_CODE_TTL", "")
+
+	cfg := Load()
+
+	assert.Equal(t, OAuthConfig{CodeTTL: time.Minute}, cfg.OAuth)
+
+	t.Setenv("OAUTH_ISSUER", "https://api.example.com/")
+	t.Setenv("OAUTH_SIGNING_KEY_FILE", "/etc/api/oauth.pem")
+	t.Setenv("OAUTH_CODE_TTL", "30s")
+
+	cfg = Load()
+
+	assert.Equal(t, OAuthConfig{Issuer: "https://api.example.com", SigningKeyFile: "/etc/api/oauth.pem", CodeTTL: 30 * time.Second}, cfg.OAuth)
+}
+
+func TestLoad_OIDCProviders(t *testing.T) {
+	t.Setenv("OIDC_PROVIDERS", "corp, Bad_Name, partner-sso, missing")
+	t.Setenv("OIDC_CORP_ISSUER", "https://sso.example.com/")
+	t.Setenv("OIDC_CORP_CLIENT_ID", "api")
+	t.Setenv("OIDC_CORP_CLIENT_SECRET", "s3cret")
+	t.Setenv("OIDC_CORP_SCOPES", "")
+	t.Setenv("OIDC_CORP_REDIRECT_URL", "")
+	t.Setenv("OIDC_CORP_PROVISION", "")
+	t.Setenv("OIDC_PARTNER_SSO_ISSUER", "https://login.partner.example")
+	t.Setenv("OIDC_PARTNER_SSO_CLIENT_ID", "partner")
+	t.Setenv("OIDC_PARTNER_SSO_SCOPES", "openid,email")
+	t.Setenv("OIDC_PARTNER_SSO_REDIRECT_URL", "https://app.example.com/sso/callback")
+	t.Setenv("OIDC_PARTNER_SSO_PROVISION", "false")
+	t.Setenv("OIDC_MISSING_ISSUER", "https://missing.example.com")
+
+	cfg := Load()
+
+	assert.Equal(t, []OIDCProviderConfig{
+		{Name: "corp", Issuer: "https://sso.example.com/", ClientID: "api", ClientSecret: "s3cret", Scopes: []string{"openid", "email", "profile"}, Provision: true},
+		{Name: "partner-sso", Issuer: "https://login.partner.example", ClientID: "partner", Scopes: []string{"openid", "email"}, RedirectURL: "https://app.example.com/sso/callback"},
+	}, cfg.OIDCProviders)
+}
+
+func TestLoad_SCIMTokens(t *testing.T) {
+	t.Setenv("SCIM_TOKENS", "")
+	assert.Empty(t, Load().SCIMTokens)
+
+	t.Setenv("SCIM_TOKENS", "current, next")
+	assert.Equal(t, []string{"current", "next"}, Load().SCIMTokens)
+}
@@ -5,6 +5,7 @@ import (
     "log"
     "time"
 
+    "go.mongodb.org/mongo-driver/bson"
     "go.mongodb.org/mongo-driver/mongo"
     "go.mongodb.org/mongo-driver/mongo/options"
     "go.mongodb.org/mongo-driver/mongo/readpref"
@@ -40,10 +41,17 @@ type MongoDatabaseInterface interface {
 // MongoCollectionInterface defines the interface for MongoDB collection methods.
 type MongoCollectionInterface interface {
     InsertOne(ctx context.Context, document interface{}) (*mongo.InsertOneResult, error)
-    Find(ctx context.Context, filter interface{}) (*mongo.Cursor, error)
+    Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error)
     FindOne(ctx context.Context, filter interface{}) MongoSingleResultInterface
     DeleteOne(ctx context.Context, filter interface{}) (*mongo.DeleteResult, error)
     UpdateOne(ctx context.Context, filter interface{}, update interface{}) (*mongo.UpdateResult, error)
+    InsertMany(ctx context.Context, documents []interface{}, opts ...*options.InsertManyOptions) (*mongo.InsertManyResult, error)
+    BulkWrite(ctx context.Context, models []mongo.WriteModel, opts ...*options.BulkWriteOptions) (*mongo.BulkWriteResult, error)
+    CountDocuments(ctx context.Context, filter interface{}) (int64, error)
+    // WithTransaction runs fn in a multi-document transaction, committing when fn
+    // returns nil and aborting otherwise. Operations inside fn must use the context
+    // passed to it. Transactions require MongoDB to run as a replica set.
+    WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error
 }
 
 // MongoSingleResultInterface defines the interface for MongoDB single result methods.
@@ -65,8 +73,8 @@ func (w *MongoCollectionWrapper) InsertOne(ctx context.Context, document interfa
     return w.collection.InsertOne(ctx, document)
 }
 
-func (w *MongoCollectionWrapper) Find(ctx context.Context, filter interface{}) (*mongo.Cursor, error) {
-    return w.collection.Find(ctx, filter)
+func (w *MongoCollectionWrapper) Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error) {
+    return w.collection.Find(ctx, filter, opts...)
 }
 
 func (w *MongoCollectionWrapper) FindOne(ctx context.Context, filter interface{}) MongoSingleResultInterface {
@@ -81,6 +89,30 @@ func (w *MongoCollectionWrapper) UpdateOne(ctx context.Context, filter interface
     return w.collection.UpdateOne(ctx, filter, update)
 }
 
+func (w *MongoCollectionWrapper) InsertMany(ctx context.Context, documents []interface{}, opts ...*options.InsertManyOptions) (*mongo.InsertManyResult, error) {
+    return w.collection.InsertMany(ctx, documents, opts...)
+}
+
+func (w *MongoCollectionWrapper) BulkWrite(ctx context.Context, models []mongo.WriteModel, opts ...*options.BulkWriteOptions) (*mongo.BulkWriteResult, error) {
+    return w.collection.BulkWrite(ctx, models, opts...)
+}
+
+func (w *MongoCollectionWrapper) CountDocuments(ctx context.Context, filter interface{}) (int64, error) {
+    return w.collection.CountDocuments(ctx, filter)
+}
+
+func (w *MongoCollectionWrapper) WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+    session, err := w.collection.Database().Client().StartSession()
+    if err != nil {
+        return err
+    }
+    defer session.EndSession(context.Background())
+    _, err = session.WithTransaction(ctx, func(sessionCtx mongo.SessionContext) (interface{}, error) {
+        return nil, fn(sessionCtx)
+    })
+    return err
+}
+
 // MongoSingleResultWrapper wraps mongo.SingleResult to implement MongoSingleResultInterface
 type MongoSingleResultWrapper struct {
     result *mongo.SingleResult
@@ -112,8 +144,128 @@ func ConnectDB(mongoURI string) MongoClientInterface {
 }
 
 // GetCollection returns a MongoDB collection from the "pipeline_task" database
+// and creates the unique index over emails, the text index used by user search
+// and the indexes API keys, OAuth clients, authorization codes and linked
+// identities are looked up by. Search falls back to matching in the
+// application when the text index cannot be created.
 func GetCollection(client MongoClientInterface) *mongo.Collection {
     db := client.Database("pipeline_task")
     collection := db.Collection("users")
+
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+    if err := EnsureEmailIndex(ctx, collection); err != nil {
+        log.Printf("Failed to create the email index: %v", err)
+    }
+    if err := EnsureTextIndex(ctx, collection); err != nil {
+        log.Printf("Failed to create the users text index: %v", err)
+    }
+    if err := EnsureAPIKeyIndex(ctx, collection); err != nil {
+        log.Printf("Failed to create the API key index: %v", err)
+    }
+    if err := EnsureOAuthIndexes(ctx, collection); err != nil {
+        log.Printf("Failed to create the OAuth indexes: %v", err)
+    }
+    if err := EnsureIdentityIndex(ctx, collection); err != nil {
+        log.Printf("Failed to create the identity index: %v", err)
+    }
     return collection
 }
+
+// EmailIndexName is the name of the unique index over user emails
+const EmailIndexName = "users_email"
+
+// EnsureEmailIndex creates the unique index over user emails if it does not
+// exist, so an email, which users log in with, names one user at most. The
+// handlers store emails in lower case, which makes the index case insensitive.
+// Only users with an email are indexed.
+func EnsureEmailIndex(ctx context.Context, collection *mongo.Collection) error {
+    _, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+        Keys: bson.D{{Key: "email", Value: 1}},
+        Options: options.Index().
+            SetName(EmailIndexName).
+            SetUnique(true).
+            SetPartialFilterExpression(bson.M{"email": bson.M{"$exists": true}}),
+    })
+    return err
+}
+
+// TextIndexName is the name of the text index over user names and emails
+const TextIndexName = "users_text"
+
+// EnsureTextIndex creates the text index over user names and emails if it does
+// not exist. Names weigh more than emails, and the language "none" disables
+// stemming and stop words, which make no sense for names and addresses.
+func EnsureTextIndex(ctx context.Context, collection *mongo.Collection) error {
+    _, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+        Keys: bson.D{{Key: "name", Value: "text"}, {Key: "email", Value: "text"}},
+        Options: options.Index().
+            SetName(TextIndexName).
+            SetWeights(bson.D{{Key: "name", Value: 2}, {Key: "email", Value: 1}}).
+            SetDefaultLanguage("none"),
+    })
+    return err
+}
+
+// APIKeyIndexName is the name of the index over the prefixes of API keys
+const APIKeyIndexName = "users_api_key_prefix"
+
+// EnsureAPIKeyIndex creates the unique index over the prefixes of API keys if
+// it does not exist, so authenticating a key does not scan the collection.
+// Only users with keys are indexed.
+func EnsureAPIKeyIndex(ctx context.Context, collection *mongo.Collection) error {
+    _, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+        Keys: bson.D{{Key: "api_keys.prefix", Value: 1}},
+        Options: options.Index().
+            SetName(APIKeyIndexName).
+            SetUnique(true).
+            SetPartialFilterExpression(bson.M{"api_keys.prefix": bson.M{"$exists": true}}),
+    })
+    return err
+}
+
+// Names of the indexes over OAuth clients and authorization codes
+const (
+    OAuthClientIndexName = "users_oauth_client_id"
+    OAuthCodeIndexName   = "users_oauth_code_hash"
+)
+
+// EnsureOAuthIndexes creates the unique index over the IDs of OAuth clients
+// and the index over the hashes of authorization codes if they do not exist.
+// Only users with clients or pending codes are indexed.
+func EnsureOAuthIndexes(ctx context.Context, collection *mongo.Collection) error {
+    _, err := collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+        {
+            Keys: bson.D{{Key: "oauth_clients.client_id", Value: 1}},
+            Options: options.Index().
+                SetName(OAuthClientIndexName).
+                SetUnique(true).
+                SetPartialFilterExpression(bson.M{"oauth_clients.client_id": bson.M{"$exists": true}}),
+        },
+        {
+            Keys: bson.D{{Key: "oauth_codes.hash", Value: 1}},
+            Options: options.Index().
+                SetName(OAuthCodeIndexName).
+                SetPartialFilterExpression(bson.M{"oauth_codes.hash": bson.M{"$exists": true}}),
+        },
+    })
+    return err
+}
+
+// IdentityIndexName is the name of the index over the identities linked at
+// upstream OpenID Connect providers
+const IdentityIndexName = "users_identity"
+
+// EnsureIdentityIndex creates the unique index over the issuers and subjects
+// of linked identities if it does not exist, so an identity is linked to one
+// user at most. Only users with identities are indexed.
+func EnsureIdentityIndex(ctx context.Context, collection *mongo.Collection) error {
+    _, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+        Keys: bson.D{{Key: "identities.issuer", Value: 1}, {Key: "identities.subject", Value: 1}},
+        Options: options.Index().
+            SetName(IdentityIndexName).
+            SetUnique(true).
+            SetPartialFilterExpression(bson.M{"identities.subject": bson.M{"$exists": true}}),
+    })
+    return err
+}
@@ -50,7 +50,7 @@ func (m *MockCollection) InsertOne(ctx context.Context, document interface{}) (*
 	return args.Get(0).(*mongo.InsertOneResult), args.Error(1)
 }
 
-func (m *MockCollection) Find(ctx context.Context, filter interface{}) (*mongo.Cursor, error) {
+func (m *MockCollection) Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error) {
 	args := m.Called(ctx, filter)
 	return args.Get(0).(*mongo.Cursor), args.Error(1)
 }
@@ -0,0 +1,205 @@
+package filter
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"regexp"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// FieldType tells Compile which operators and values a field accepts.
+type FieldType int
+
+const (
+	// String fields accept every operator. eq, ne, co, sw and ew ignore case,
+	// as for SCIM attributes that are not caseExact; gt, ge, lt and le compare
+	// byte by byte.
+	String FieldType = iota
+	// ObjectID fields accept eq, ne, gt, ge, lt, le and pr with a hex ID.
+	ObjectID
+	// CreationTime is the creation time embedded in an ObjectID field, with
+	// one second precision. It accepts gt, ge, lt, le and pr with an RFC 3339
+	// timestamp or a 2006-01-02 date, which means midnight UTC.
+	CreationTime
+)
+
+// Field maps a filter attribute to a document field.
+type Field struct {
+	Path string
+	Type FieldType
+}
+
+// Fields is the allowlist of attributes a filter may use, keyed by lower case name.
+type Fields map[string]Field
+
+// Compile converts a parsed filter into a MongoDB query. Attributes missing
+// from fields are rejected, so sensitive fields cannot be probed, and values
+// only ever appear as literals or quoted regular expressions.
+func Compile(expr Expr, fields Fields) (bson.M, error) {
+	switch e := expr.(type) {
+	case *Logical:
+		left, err := Compile(e.Left, fields)
+		if err != nil {
+			return nil, err
+		}
+		right, err := Compile(e.Right, fields)
+		if err != nil {
+			return nil, err
+		}
+		op := "$" + e.Operator
+		return bson.M{op: append(flatten(op, left), flatten(op, right)...)}, nil
+	case *Not:
+		inner, err := Compile(e.Expr, fields)
+		if err != nil {
+			return nil, err
+		}
+		return bson.M{"$nor": bson.A{inner}}, nil
+	case *Comparison:
+		field, ok := fields[e.Field]
+		if !ok {
+			return nil, fmt.Errorf("unknown attribute %q", e.Field)
+		}
+		switch field.Type {
+		case ObjectID:
+			return compileObjectID(e, field.Path)
+		case CreationTime:
+			return compileCreationTime(e, field.Path)
+		default:
+			return compileString(e, field.Path)
+		}
+	}
+	return nil, fmt.Errorf("unsupported expression %T", expr)
+}
+
+// flatten merges nested $and or $or clauses, so "a and b and c" compiles to
+// a single $and
+func flatten(op string, clause bson.M) bson.A {
+	if nested, ok := clause[op].(bson.A); ok && len(clause) == 1 {
+		return nested
+	}
+	return bson.A{clause}
+}
+
+func compileString(c *Comparison, path string) (bson.M, error) {
+	if c.Operator == Present {
+		return bson.M{path: bson.M{"$exists": true, "$nin": bson.A{nil, ""}}}, nil
+	}
+	if c.Value == nil && (c.Operator == Equal || c.Operator == NotEqual) {
+		// Empty strings are omitted when users are stored, so they count as null
+		if c.Operator == Equal {
+			return bson.M{path: bson.M{"$in": bson.A{nil, ""}}}, nil
+		}
+		return bson.M{path: bson.M{"$nin": bson.A{nil, ""}}}, nil
+	}
+	value, ok := c.Value.(string)
+	if !ok {
+		return nil, fmt.Errorf("%s expects a string", c.Field)
+	}
+	quoted := regexp.QuoteMeta(value)
+	switch c.Operator {
+	case Equal:
+		return bson.M{path: caseInsensitive("^" + quoted + "$")}, nil
+	case NotEqual:
+		return bson.M{path: bson.M{"$not": caseInsensitive("^" + quoted + "$")}}, nil
+	case Contains:
+		return bson.M{path: caseInsensitive(quoted)}, nil
+	case StartsWith:
+		return bson.M{path: caseInsensitive("^" + quoted)}, nil
+	case EndsWith:
+		return bson.M{path: caseInsensitive(quoted + "$")}, nil
+	}
+	return bson.M{path: bson.M{comparisonOperator(c.Operator): value}}, nil
+}
+
+func caseInsensitive(pattern string) primitive.Regex {
+	return primitive.Regex{Pattern: pattern, Options: "i"}
+}
+
+func compileObjectID(c *Comparison, path string) (bson.M, error) {
+	switch c.Operator {
+	case Present:
+		return bson.M{path: bson.M{"$exists": true}}, nil
+	case Contains, StartsWith, EndsWith:
+		return nil, fmt.Errorf("%s does not support %s", c.Field, c.Operator)
+	}
+	raw, _ := c.Value.(string)
+	id, err := primitive.ObjectIDFromHex(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%s expects a 24 digit hex ID", c.Field)
+	}
+	if c.Operator == Equal {
+		return bson.M{path: id}, nil
+	}
+	return bson.M{path: bson.M{comparisonOperator(c.Operator): id}}, nil
+}
+
+// compileCreationTime compares the timestamp of ObjectIDs, rounding the bound
+// so that comparisons hold at the timestamp's one second precision
+func compileCreationTime(c *Comparison, path string) (bson.M, error) {
+	switch c.Operator {
+	case Present:
+		return bson.M{path: bson.M{"$exists": true}}, nil
+	case Greater, GreaterOrEqual, Less, LessOrEqual:
+	default:
+		return nil, fmt.Errorf("%s only supports gt, ge, lt, le and pr", c.Field)
+	}
+	raw, _ := c.Value.(string)
+	t, err := parseTime(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%s expects an RFC 3339 timestamp or a date such as 2026-01-31", c.Field)
+	}
+	floor := t.Truncate(time.Second)
+	ceil := floor
+	if !t.Equal(floor) {
+		ceil = floor.Add(time.Second)
+	}
+	switch c.Operator {
+	case Greater:
+		return bson.M{path: bson.M{"$gte": firstObjectID(floor.Add(time.Second))}}, nil
+	case GreaterOrEqual:
+		return bson.M{path: bson.M{"$gte": firstObjectID(ceil)}}, nil
+	case Less:
+		return bson.M{path: bson.M{"$lt": firstObjectID(ceil)}}, nil
+	default:
+		return bson.M{path: bson.M{"$lt": firstObjectID(floor.Add(time.Second))}}, nil
+	}
+}
+
+// firstObjectID returns the smallest ObjectID of the second t falls in, which
+// sorts before every ID created during that second
+func firstObjectID(t time.Time) primitive.ObjectID {
+	var id primitive.ObjectID
+	binary.BigEndian.PutUint32(id[:4], uint32(t.Unix()))
+	return id
+}
+
+func parseTime(raw string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339Nano, raw)
+	if err != nil {
+		t, err = time.Parse("2006-01-02", raw)
+	}
+	if err == nil && (t.Unix() < 0 || t.Unix() > math.MaxUint32) {
+		err = fmt.Errorf("%s is outside the range of ObjectID timestamps", raw)
+	}
+	return t, err
+}
+
+func comparisonOperator(op Operator) string {
+	switch op {
+	case NotEqual:
+		return "$ne"
+	case Greater:
+		return "$gt"
+	case GreaterOrEqual:
+		return "$gte"
+	case Less:
+		return "$lt"
+	case LessOrEqual:
+		return "$lte"
+	}
+	return "$eq"
+}
@@ -0,0 +1,111 @@
+package filter
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var testFields = Fields{
+	"id":         {Path: "_id", Type: ObjectID},
+	"name":       {Path: "name", Type: String},
+	"created_at": {Path: "_id", Type: CreationTime},
+}
+
+func compile(t *testing.T, input string) (bson.M, error) {
+	expr, err := Parse(input)
+	require.NoError(t, err, input)
+	return Compile(expr, testFields)
+}
+
+func regex(pattern string) primitive.Regex {
+	return primitive.Regex{Pattern: pattern, Options: "i"}
+}
+
+func TestCompile_String(t *testing.T) {
+	for input, want := range map[string]bson.M{
+		`name eq "J.Doe"`: {"name": regex(`^J\.Doe$`)},
+		`name ne "J.Doe"`: {"name": bson.M{"$not": regex(`^J\.Doe$`)}},
+		`name co "(a|b)"`: {"name": regex(`\(a\|b\)`)},
+		`name sw "^J"`:    {"name": regex(`^\^J`)},
+		`name ew "$"`:     {"name": regex(`\$$`)},
+		`name gt "M"`:     {"name": bson.M{"$gt": "M"}},
+		`name le "M"`:     {"name": bson.M{"$lte": "M"}},
+		`name pr`:         {"name": bson.M{"$exists": true, "$nin": bson.A{nil, ""}}},
+		`name eq null`:    {"name": bson.M{"$in": bson.A{nil, ""}}},
+		`name ne null`:    {"name": bson.M{"$nin": bson.A{nil, ""}}},
+	} {
+		got, err := compile(t, input)
+		require.NoError(t, err, input)
+		assert.Equal(t, want, got, input)
+	}
+}
+
+func TestCompile_ObjectID(t *testing.T) {
+	id, _ := primitive.ObjectIDFromHex("66f0c2a1e4b0a1b2c3d4e5f6")
+
+	got, err := compile(t, `id eq "66f0c2a1e4b0a1b2c3d4e5f6"`)
+	require.NoError(t, err)
+	assert.Equal(t, bson.M{"_id": id}, got)
+
+	got, err = compile(t, `id gt "66f0c2a1e4b0a1b2c3d4e5f6"`)
+	require.NoError(t, err)
+	assert.Equal(t, bson.M{"_id": bson.M{"$gt": id}}, got)
+}
+
+func TestCompile_CreationTime(t *testing.T) {
+	second := func(s string) primitive.ObjectID {
+		t, _ := time.Parse(time.RFC3339, s)
+		id, _ := primitive.ObjectIDFromHex(fmt.Sprintf("%08x0000000000000000", t.Unix()))
+		return id
+	}
+	for input, want := range map[string]bson.M{
+		`created_at gt "2026-01-01"`:                {"_id": bson.M{"$gte": second("2026-01-01T00:00:01Z")}},
+		`created_at ge "2026-01-01"`:                {"_id": bson.M{"$gte": second("2026-01-01T00:00:00Z")}},
+		`created_at lt "2026-01-01T10:00:00+02:00"`: {"_id": bson.M{"$lt": second("2026-01-01T08:00:00Z")}},
+		`created_at le "2026-01-01T00:00:00Z"`:      {"_id": bson.M{"$lt": second("2026-01-01T00:00:01Z")}},
+		`created_at gt "2026-01-01T00:00:00.5Z"`:    {"_id": bson.M{"$gte": second("2026-01-01T00:00:01Z")}},
+		`created_at ge "2026-01-01T00:00:00.5Z"`:    {"_id": bson.M{"$gte": second("2026-01-01T00:00:01Z")}},
+		`created_at lt "2026-01-01T00:00:00.5Z"`:    {"_id": bson.M{"$lt": second("2026-01-01T00:00:01Z")}},
+		`created_at le "2026-01-01T00:00:00.5Z"`:    {"_id": bson.M{"$lt": second("2026-01-01T00:00:01Z")}},
+	} {
+		got, err := compile(t, input)
+		require.NoError(t, err, input)
+		assert.Equal(t, want, got, input)
+	}
+}
+
+func TestCompile_Logical(t *testing.T) {
+	got, err := compile(t, `name sw "a" and name sw "b" and not (name pr or name ew "c")`)
+	require.NoError(t, err)
+	assert.Equal(t, bson.M{"$and": bson.A{
+		bson.M{"name": regex("^a")},
+		bson.M{"name": regex("^b")},
+		bson.M{"$nor": bson.A{bson.M{"$or": bson.A{
+			bson.M{"name": bson.M{"$exists": true, "$nin": bson.A{nil, ""}}},
+			bson.M{"name": regex("c$")},
+		}}}},
+	}}, got)
+}
+
+func TestCompile_Errors(t *testing.T) {
+	for input, want := range map[string]string{
+		`password eq "secret"`:       `unknown attribute "password"`,
+		`name eq "x" or password pr`: `unknown attribute "password"`,
+		`name eq 5`:                  "name expects a string",
+		`name co true`:               "name expects a string",
+		`id co "66f0"`:               "id does not support co",
+		`id eq "66f0"`:               "id expects a 24 digit hex ID",
+		`created_at eq "2026-01-01"`: "created_at only supports gt, ge, lt, le and pr",
+		`created_at gt "yesterday"`:  "created_at expects an RFC 3339 timestamp or a date such as 2026-01-31",
+		`created_at gt "1969-12-31"`: "created_at expects an RFC 3339 timestamp or a date such as 2026-01-31",
+	} {
+		_, err := compile(t, input)
+		assert.EqualError(t, err, want, input)
+	}
+}
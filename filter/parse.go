@@ -0,0 +1,330 @@
+// Package filter parses SCIM style filter expressions (RFC 7644, section
+// 3.4.2.2) such as
+//
+//	email ew "@acme.com" and (name sw "J" or not (created_at lt "2026-01-01"))
+//
+// into an AST, and compiles the AST into a MongoDB query over an allowlist of
+// fields. Values are always compiled as literals, so a filter cannot inject
+// query operators.
+package filter
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+const (
+	// MaxLength caps the length of a filter expression
+	MaxLength = 1024
+	// maxDepth caps the nesting of parentheses and not
+	maxDepth = 16
+)
+
+// Operator is a comparison operator.
+type Operator string
+
+// The comparison operators of the grammar.
+const (
+	Equal          Operator = "eq"
+	NotEqual       Operator = "ne"
+	Contains       Operator = "co"
+	StartsWith     Operator = "sw"
+	EndsWith       Operator = "ew"
+	Greater        Operator = "gt"
+	GreaterOrEqual Operator = "ge"
+	Less           Operator = "lt"
+	LessOrEqual    Operator = "le"
+	Present        Operator = "pr"
+)
+
+var operators = map[string]Operator{
+	"eq": Equal, "ne": NotEqual, "co": Contains, "sw": StartsWith, "ew": EndsWith,
+	"gt": Greater, "ge": GreaterOrEqual, "lt": Less, "le": LessOrEqual, "pr": Present,
+}
+
+// Expr is a node of a parsed filter: *Comparison, *Logical or *Not.
+type Expr interface {
+	String() string
+}
+
+// Comparison compares a field with a value. Field is lower case. Value is a
+// string, a float64, a bool or nil; it is nil for Present.
+type Comparison struct {
+	Field    string
+	Operator Operator
+	Value    interface{}
+}
+
+// Logical joins two expressions with "and" or "or".
+type Logical struct {
+	Operator string
+	Left     Expr
+	Right    Expr
+}
+
+// Not negates an expression.
+type Not struct {
+	Expr Expr
+}
+
+func (c *Comparison) String() string {
+	if c.Operator == Present {
+		return c.Field + " pr"
+	}
+	value, _ := json.Marshal(c.Value)
+	return fmt.Sprintf("%s %s %s", c.Field, c.Operator, value)
+}
+
+func (l *Logical) String() string {
+	return fmt.Sprintf("(%s %s %s)", l.Left, l.Operator, l.Right)
+}
+
+func (n *Not) String() string {
+	return fmt.Sprintf("not (%s)", n.Expr)
+}
+
+// SyntaxError reports where a filter expression is malformed. Pos is the byte
+// offset of the offending token.
+type SyntaxError struct {
+	Pos int
+	Msg string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("%s at position %d", e.Msg, e.Pos)
+}
+
+// Parse parses a filter expression. Operators and keywords are case
+// insensitive; "not" binds tighter than "and", which binds tighter than "or".
+func Parse(input string) (Expr, error) {
+	if len(input) > MaxLength {
+		return nil, &SyntaxError{Pos: MaxLength, Msg: fmt.Sprintf("filter longer than %d bytes", MaxLength)}
+	}
+	tokens, err := lex(input)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	expr, err := p.parseOr(0)
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokenEOF {
+		return nil, &SyntaxError{Pos: tok.pos, Msg: fmt.Sprintf("unexpected %s", tok)}
+	}
+	return expr, nil
+}
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenWord
+	tokenString
+	tokenNumber
+	tokenLeftParen
+	tokenRightParen
+)
+
+type token struct {
+	kind  tokenKind
+	text  string
+	value interface{}
+	pos   int
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokenEOF:
+		return "end of filter"
+	case tokenString:
+		return "string " + t.text
+	}
+	return fmt.Sprintf("%q", t.text)
+}
+
+func lex(input string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(input); {
+		c := input[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(':
+			tokens = append(tokens, token{kind: tokenLeftParen, text: "(", pos: i})
+			i++
+		case c == ')':
+			tokens = append(tokens, token{kind: tokenRightParen, text: ")", pos: i})
+			i++
+		case c == '"':
+			end := i + 1
+			for end < len(input) && input[end] != '"' {
+				if input[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(input) {
+				return nil, &SyntaxError{Pos: i, Msg: "unterminated string"}
+			}
+			var value string
+			if err := json.Unmarshal([]byte(input[i:end+1]), &value); err != nil {
+				return nil, &SyntaxError{Pos: i, Msg: "invalid string"}
+			}
+			tokens = append(tokens, token{kind: tokenString, text: input[i : end+1], value: value, pos: i})
+			i = end + 1
+		case c == '-' || (c >= '0' && c <= '9'):
+			end := i + 1
+			for end < len(input) && strings.IndexByte("0123456789.eE+-", input[end]) >= 0 {
+				end++
+			}
+			var value float64
+			if err := json.Unmarshal([]byte(input[i:end]), &value); err != nil {
+				return nil, &SyntaxError{Pos: i, Msg: fmt.Sprintf("invalid number %q", input[i:end])}
+			}
+			tokens = append(tokens, token{kind: tokenNumber, text: input[i:end], value: value, pos: i})
+			i = end
+		case isWordByte(c):
+			end := i + 1
+			for end < len(input) && isWordByte(input[end]) {
+				end++
+			}
+			tokens = append(tokens, token{kind: tokenWord, text: input[i:end], pos: i})
+			i = end
+		default:
+			return nil, &SyntaxError{Pos: i, Msg: fmt.Sprintf("unexpected character %q", rune(c))}
+		}
+	}
+	return append(tokens, token{kind: tokenEOF, pos: len(input)}), nil
+}
+
+// isWordByte accepts the characters of attribute names and keywords. Colons
+// belong to attribute names qualified with their schema URN, such as
+// urn:ietf:params:scim:schemas:core:2.0:User:userName.
+func isWordByte(c byte) bool {
+	return c == '_' || c == '.' || c == ':' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokenEOF {
+		p.pos++
+	}
+	return tok
+}
+
+// keyword consumes the next token when it is the given keyword
+func (p *parser) keyword(keyword string) bool {
+	if tok := p.peek(); tok.kind == tokenWord && strings.EqualFold(tok.text, keyword) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) parseOr(depth int) (Expr, error) {
+	left, err := p.parseAnd(depth)
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("or") {
+		right, err := p.parseAnd(depth)
+		if err != nil {
+			return nil, err
+		}
+		left = &Logical{Operator: "or", Left: left, Right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd(depth int) (Expr, error) {
+	left, err := p.parseUnary(depth)
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("and") {
+		right, err := p.parseUnary(depth)
+		if err != nil {
+			return nil, err
+		}
+		left = &Logical{Operator: "and", Left: left, Right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseUnary(depth int) (Expr, error) {
+	if depth >= maxDepth {
+		return nil, &SyntaxError{Pos: p.peek().pos, Msg: "filter nested too deeply"}
+	}
+	if p.keyword("not") {
+		if tok := p.peek(); tok.kind != tokenLeftParen {
+			return nil, &SyntaxError{Pos: tok.pos, Msg: fmt.Sprintf("expected ( after not, got %s", tok)}
+		}
+		expr, err := p.parseUnary(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		return &Not{Expr: expr}, nil
+	}
+	if tok := p.peek(); tok.kind == tokenLeftParen {
+		p.next()
+		expr, err := p.parseOr(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		if tok := p.next(); tok.kind != tokenRightParen {
+			return nil, &SyntaxError{Pos: tok.pos, Msg: fmt.Sprintf("expected ), got %s", tok)}
+		}
+		return expr, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *parser) parseComparison() (Expr, error) {
+	field := p.next()
+	if field.kind != tokenWord || isKeyword(field.text) {
+		return nil, &SyntaxError{Pos: field.pos, Msg: fmt.Sprintf("expected attribute name, got %s", field)}
+	}
+	opToken := p.next()
+	op, ok := operators[strings.ToLower(opToken.text)]
+	if opToken.kind != tokenWord || !ok {
+		return nil, &SyntaxError{Pos: opToken.pos, Msg: fmt.Sprintf("expected operator, got %s", opToken)}
+	}
+	comparison := &Comparison{Field: strings.ToLower(field.text), Operator: op}
+	if op == Present {
+		return comparison, nil
+	}
+
+	value := p.next()
+	switch {
+	case value.kind == tokenString || value.kind == tokenNumber:
+		comparison.Value = value.value
+	case value.kind == tokenWord && strings.EqualFold(value.text, "true"):
+		comparison.Value = true
+	case value.kind == tokenWord && strings.EqualFold(value.text, "false"):
+		comparison.Value = false
+	case value.kind == tokenWord && strings.EqualFold(value.text, "null"):
+		comparison.Value = nil
+	default:
+		return nil, &SyntaxError{Pos: value.pos, Msg: fmt.Sprintf("expected value, got %s", value)}
+	}
+	return comparison, nil
+}
+
+func isKeyword(word string) bool {
+	switch strings.ToLower(word) {
+	case "and", "or", "not":
+		return true
+	}
+	return false
+}
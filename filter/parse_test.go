@@ -0,0 +1,70 @@
+package filter
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	for input, want := range map[string]string{
+		`email ew "@acme.com"`:                            `email ew "@acme.com"`,
+		`Email EW "@acme.com"`:                            `email ew "@acme.com"`,
+		`name pr`:                                         `name pr`,
+		`age gt 30.5`:                                     `age gt 30.5`,
+		`active eq true and manager eq null`:              `(active eq true and manager eq null)`,
+		`a eq "1" or b eq "2" and c eq "3"`:               `(a eq "1" or (b eq "2" and c eq "3"))`,
+		`(a eq "1" or b eq "2") and c eq "3"`:             `((a eq "1" or b eq "2") and c eq "3")`,
+		`not (a eq "1") and b pr`:                         `(not (a eq "1") and b pr)`,
+		`name eq "say \"hi\" é"`:                          `name eq "say \"hi\" é"`,
+		`meta.created gt "2026-01-01T00:00:00Z" AND x pr`: `(meta.created gt "2026-01-01T00:00:00Z" and x pr)`,
+	} {
+		expr, err := Parse(input)
+		require.NoError(t, err, input)
+		assert.Equal(t, want, expr.String(), input)
+	}
+}
+
+func TestParse_QualifiedAttribute(t *testing.T) {
+	expr, err := Parse(`urn:ietf:params:scim:schemas:core:2.0:User:userName eq "x"`)
+	require.NoError(t, err)
+	assert.Equal(t, `urn:ietf:params:scim:schemas:core:2.0:user:username eq "x"`, expr.String())
+}
+
+func TestParse_SyntaxErrors(t *testing.T) {
+	for input, want := range map[string]string{
+		``:                        "expected attribute name, got end of filter at position 0",
+		`name`:                    "expected operator, got end of filter at position 4",
+		`name is "x"`:             `expected operator, got "is" at position 5`,
+		`name eq`:                 "expected value, got end of filter at position 7",
+		`name eq john`:            `expected value, got "john" at position 8`,
+		`name eq "john`:           "unterminated string at position 8",
+		`name eq "\q"`:            "invalid string at position 8",
+		`age gt 1.2.3`:            `invalid number "1.2.3" at position 7`,
+		`name eq "x" and`:         "expected attribute name, got end of filter at position 15",
+		`and eq "x"`:              `expected attribute name, got "and" at position 0`,
+		`(name eq "x"`:            "expected ), got end of filter at position 12",
+		`name eq "x")`:            `unexpected ")" at position 11`,
+		`not name eq "x"`:         `expected ( after not, got "name" at position 4`,
+		`name eq "x" $where`:      `unexpected character '$' at position 12`,
+		`name eq "x" name eq "y"`: `unexpected "name" at position 12`,
+	} {
+		_, err := Parse(input)
+		var syntaxErr *SyntaxError
+		require.ErrorAs(t, err, &syntaxErr, input)
+		assert.Equal(t, want, err.Error(), input)
+	}
+}
+
+func TestParse_Limits(t *testing.T) {
+	_, err := Parse(`name eq "` + strings.Repeat("a", MaxLength) + `"`)
+	assert.EqualError(t, err, "filter longer than 1024 bytes at position 1024")
+
+	_, err = Parse(strings.Repeat("(", maxDepth) + `a pr` + strings.Repeat(")", maxDepth))
+	assert.EqualError(t, err, "filter nested too deeply at position 16")
+
+	_, err = Parse(strings.Repeat("(", maxDepth-1) + `a pr` + strings.Repeat(")", maxDepth-1))
+	assert.NoError(t, err)
+}
@@ -0,0 +1,132 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/lep13/golang-restful-api/middleware"
+	"github.com/lep13/golang-restful-api/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// authenticatedUser returns the ID of the user the request was authenticated
+// as, writing 401 when it was anonymous
+func authenticatedUser(w http.ResponseWriter, r *http.Request) (string, bool) {
+	userID, ok := middleware.UserIDFromContext(r.Context())
+	if !ok {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, "Authentication required", http.StatusUnauthorized)
+	}
+	return userID, ok
+}
+
+// requireSelf checks that the request was authenticated as the user with id,
+// writing 401 or 403 when it was not
+func requireSelf(w http.ResponseWriter, r *http.Request, id primitive.ObjectID) bool {
+	userID, ok := authenticatedUser(w, r)
+	if !ok {
+		return false
+	}
+	if userID != id.Hex() {
+		writeError(w, "Not allowed to manage this user", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// selfUser parses the user ID of a request on a user's own settings, checks
+// the caller is that user and loads them, writing the error response when any
+// step fails
+func selfUser(w http.ResponseWriter, r *http.Request) (models.User, bool) {
+	var user models.User
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, "Invalid ID format", http.StatusBadRequest)
+		return user, false
+	}
+	if !requireSelf(w, r, id) {
+		return user, false
+	}
+	ctx, cancel := dbContext(r)
+	defer cancel()
+	if err := mongoCollection.FindOne(ctx, bson.M{"_id": id}).Decode(&user); err != nil {
+		if err == mongo.ErrNoDocuments {
+			writeError(w, "User not found", http.StatusNotFound)
+		} else {
+			writeDBError(w, err)
+		}
+		return user, false
+	}
+	return user, true
+}
+
+// requireAdmin checks that the request was authenticated as an admin and
+// returns them, writing 401 or 403 when it was not
+func requireAdmin(w http.ResponseWriter, r *http.Request) (models.User, bool) {
+	var admin models.User
+	userID, ok := authenticatedUser(w, r)
+	if !ok {
+		return admin, false
+	}
+	id, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		writeError(w, "Admin access required", http.StatusForbidden)
+		return admin, false
+	}
+	ctx, cancel := dbContext(r)
+	defer cancel()
+	if err := mongoCollection.FindOne(ctx, bson.M{"_id": id}).Decode(&admin); err != nil {
+		if err == mongo.ErrNoDocuments {
+			writeError(w, "Admin access required", http.StatusForbidden)
+		} else {
+			writeDBError(w, err)
+		}
+		return admin, false
+	}
+	if !admin.Admin {
+		writeError(w, "Admin access required", http.StatusForbidden)
+		return admin, false
+	}
+	return admin, true
+}
+
+// requireSelfOrAdmin checks that the request was authenticated as the user
+// with id or as an admin, writing 401 or 403 when it was not
+func requireSelfOrAdmin(w http.ResponseWriter, r *http.Request, id primitive.ObjectID) bool {
+	if userID, ok := middleware.UserIDFromContext(r.Context()); ok && userID == id.Hex() {
+		return true
+	}
+	_, ok := requireAdmin(w, r)
+	return ok
+}
+
+// userManager returns whether the caller may manage the user with an ID, as
+// requireSelfOrAdmin checks it: admins may manage anyone, and other users only
+// themselves. It writes 401 when the request was anonymous.
+func userManager(w http.ResponseWriter, r *http.Request) (func(id primitive.ObjectID) bool, bool) {
+	userID, ok := authenticatedUser(w, r)
+	if !ok {
+		return nil, false
+	}
+	self := func(id primitive.ObjectID) bool { return id.Hex() == userID }
+	callerID, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return self, true
+	}
+	ctx, cancel := dbContext(r)
+	defer cancel()
+	var caller models.User
+	err = mongoCollection.FindOne(ctx, bson.M{"_id": callerID}).Decode(&caller)
+	switch {
+	case err == mongo.ErrNoDocuments:
+		return self, true
+	case err != nil:
+		writeDBError(w, err)
+		return nil, false
+	case caller.Admin:
+		return func(primitive.ObjectID) bool { return true }, true
+	}
+	return self, true
+}
@@ -0,0 +1,305 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lep13/golang-restful-api/audit"
+	"github.com/lep13/golang-restful-api/middleware"
+	"github.com/lep13/golang-restful-api/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Scopes API keys can be granted
+const (
+	ScopeUsersRead  = "users:read"
+	ScopeUsersWrite = "users:write"
+)
+
+var apiKeyScopes = map[string]bool{ScopeUsersRead: true, ScopeUsersWrite: true}
+
+const (
+	// apiKeyMarker starts every API key, so leaked keys are easy to spot
+	apiKeyMarker = "ak_"
+	// apiKeyPrefixLength is the length of the part of a key it is looked up by
+	apiKeyPrefixLength = 8
+
+	maxAPIKeys          = 20
+	maxAPIKeyNameLength = 100
+
+	// apiKeyUsageInterval is how precisely the last use of a key is recorded;
+	// a key used again within it is not written to
+	apiKeyUsageInterval = time.Minute
+)
+
+// APIKeyInfo describes an API key without the key itself
+type APIKeyInfo struct {
+	ID        primitive.ObjectID `json:"id"`
+	Name      string             `json:"name"`
+	Prefix    string             `json:"prefix"`
+	Scopes    []string           `json:"scopes"`
+	CreatedAt time.Time          `json:"created_at"`
+	// ExpiresAt and LastUsedAt are omitted when unset
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+// NewAPIKey is a created API key, the only response that contains the key
+type NewAPIKey struct {
+	APIKeyInfo
+	Key string `json:"key"`
+}
+
+func apiKeyInfo(key models.APIKey) APIKeyInfo {
+	info := APIKeyInfo{ID: key.ID, Name: key.Name, Prefix: key.Prefix, Scopes: key.Scopes, CreatedAt: key.CreatedAt}
+	if !key.ExpiresAt.IsZero() {
+		info.ExpiresAt = &key.ExpiresAt
+	}
+	if !key.LastUsedAt.IsZero() {
+		info.LastUsedAt = &key.LastUsedAt
+	}
+	return info
+}
+
+// newAPIKey returns a random key, written ak_<prefix>_<secret>, and its prefix
+func newAPIKey() (key, prefix string, err error) {
+	raw := make([]byte, apiKeyPrefixLength*5/8)
+	if _, err := rand.Read(raw); err != nil {
+		return "", "", err
+	}
+	prefix = recoveryCodeEncoding.EncodeToString(raw)
+	secret, _, err := newToken()
+	if err != nil {
+		return "", "", err
+	}
+	return apiKeyMarker + prefix + "_" + secret, prefix, nil
+}
+
+// apiKeyPrefix returns the prefix of a key, and false when it is malformed
+func apiKeyPrefix(key string) (string, bool) {
+	rest, ok := strings.CutPrefix(key, apiKeyMarker)
+	if !ok || len(rest) <= apiKeyPrefixLength+1 || rest[apiKeyPrefixLength] != '_' {
+		return "", false
+	}
+	return rest[:apiKeyPrefixLength], true
+}
+
+// validateAPIKey checks the name and scopes requested for a new key, returning
+// the scopes without duplicates
+func validateAPIKey(name string, scopes []string, expiresAt *time.Time) ([]string, error) {
+	switch {
+	case strings.TrimSpace(name) == "":
+		return nil, fmt.Errorf("Name is required")
+	case len(name) > maxAPIKeyNameLength:
+		return nil, fmt.Errorf("Name must be at most %d characters", maxAPIKeyNameLength)
+	case len(scopes) == 0:
+		return nil, fmt.Errorf("At least one scope is required")
+	case expiresAt != nil && !expiresAt.After(time.Now()):
+		return nil, fmt.Errorf("Expiry must be in the future")
+	}
+	var unique []string
+	seen := make(map[string]bool)
+	for _, scope := range scopes {
+		if !apiKeyScopes[scope] {
+			return nil, fmt.Errorf("Unknown scope %q", scope)
+		}
+		if !seen[scope] {
+			seen[scope] = true
+			unique = append(unique, scope)
+		}
+	}
+	return unique, nil
+}
+
+// CreateAPIKey creates an API key for the user, with a name, scopes and an
+// optional expiry. The key is only returned in this response; it is stored
+// hashed. Users may only create keys for themselves.
+func CreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var body struct {
+		Name      string     `json:"name"`
+		Scopes    []string   `json:"scopes"`
+		ExpiresAt *time.Time `json:"expires_at"`
+	}
+	if !decodeBody(w, r, &body) {
+		return
+	}
+	user, ok := selfUser(w, r)
+	if !ok {
+		return
+	}
+	scopes, err := validateAPIKey(body.Name, body.Scopes, body.ExpiresAt)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(user.APIKeys) >= maxAPIKeys {
+		writeError(w, fmt.Sprintf("A user may have at most %d API keys", maxAPIKeys), http.StatusConflict)
+		return
+	}
+	raw, prefix, err := newAPIKey()
+	if err != nil {
+		writeError(w, "Failed to create API key", http.StatusInternalServerError)
+		return
+	}
+	key := models.APIKey{
+		ID:        primitive.NewObjectID(),
+		Name:      strings.TrimSpace(body.Name),
+		Prefix:    prefix,
+		Hash:      hashToken(raw),
+		Scopes:    scopes,
+		CreatedAt: time.Now().UTC().Truncate(time.Millisecond),
+	}
+	if body.ExpiresAt != nil {
+		key.ExpiresAt = body.ExpiresAt.UTC()
+	}
+
+	ctx, cancel := dbContext(r)
+	defer cancel()
+	// Only pushing while below the limit keeps concurrent requests from exceeding it
+	res, err := mongoCollection.UpdateOne(ctx,
+		bson.M{"_id": user.ID, "api_keys." + strconv.Itoa(maxAPIKeys-1): bson.M{"$exists": false}},
+		bson.M{"$push": bson.M{"api_keys": key}})
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if res.MatchedCount == 0 {
+		writeError(w, fmt.Sprintf("A user may have at most %d API keys", maxAPIKeys), http.StatusConflict)
+		return
+	}
+	recordAudit(audit.APIKeyCreated, user.ID.Hex(), clientIP(r), map[string]string{
+		"key_id": key.ID.Hex(),
+		"name":   key.Name,
+		"scopes": strings.Join(key.Scopes, " "),
+	})
+	w.WriteHeader(http.StatusCreated)
+	writeJSON(w, NewAPIKey{APIKeyInfo: apiKeyInfo(key), Key: raw})
+}
+
+// ListAPIKeys lists the API keys of the user, without the keys themselves.
+// Users may list their own keys, and admins those of any user.
+func ListAPIKeys(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, "Invalid ID format", http.StatusBadRequest)
+		return
+	}
+	if !requireSelfOrAdmin(w, r, id) {
+		return
+	}
+
+	ctx, cancel := dbContext(r)
+	defer cancel()
+	var user models.User
+	if err := mongoCollection.FindOne(ctx, bson.M{"_id": id}).Decode(&user); err != nil {
+		if err == mongo.ErrNoDocuments {
+			writeError(w, "User not found", http.StatusNotFound)
+		} else {
+			writeDBError(w, err)
+		}
+		return
+	}
+	keys := make([]APIKeyInfo, 0, len(user.APIKeys))
+	for _, key := range user.APIKeys {
+		keys = append(keys, apiKeyInfo(key))
+	}
+	writeJSON(w, keys)
+}
+
+// DeleteAPIKey revokes an API key of the user. Users may revoke their own
+// keys, and admins those of any user.
+func DeleteAPIKey(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, "Invalid ID format", http.StatusBadRequest)
+		return
+	}
+	keyID, err := primitive.ObjectIDFromHex(mux.Vars(r)["key_id"])
+	if err != nil {
+		writeError(w, "Invalid API key ID format", http.StatusBadRequest)
+		return
+	}
+	if !requireSelfOrAdmin(w, r, id) {
+		return
+	}
+
+	ctx, cancel := dbContext(r)
+	defer cancel()
+	res, err := mongoCollection.UpdateOne(ctx,
+		bson.M{"_id": id, "api_keys._id": keyID},
+		bson.M{"$pull": bson.M{"api_keys": bson.M{"_id": keyID}}})
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if res.MatchedCount == 0 {
+		writeError(w, "API key not found", http.StatusNotFound)
+		return
+	}
+	callerID, _ := middleware.UserIDFromContext(r.Context())
+	recordAudit(audit.APIKeyRevoked, id.Hex(), clientIP(r), map[string]string{"key_id": keyID.Hex(), "by": callerID})
+	writeJSON(w, map[string]string{"message": "API key revoked"})
+}
+
+// AuthenticateAPIKey is the middleware.APIKeyVerifier of the keys created by
+// CreateAPIKey. Expired and revoked keys are rejected, and so are the keys of
+// deleted users. Keys are not revoked by a password reset; they are revoked
+// one by one with DeleteAPIKey, and stop working while their user is
+// deactivated.
+func AuthenticateAPIKey(ctx context.Context, key string) (string, []string, error) {
+	prefix, ok := apiKeyPrefix(key)
+	if !ok {
+		return "", nil, middleware.ErrInvalidCredentials
+	}
+	ctx, cancel := context.WithTimeout(ctx, operationTimeout)
+	defer cancel()
+	var user models.User
+	if err := mongoCollection.FindOne(ctx, bson.M{"api_keys.prefix": prefix}).Decode(&user); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return "", nil, middleware.ErrInvalidCredentials
+		}
+		return "", nil, err
+	}
+	if user.Deactivated {
+		return "", nil, middleware.ErrInvalidCredentials
+	}
+	hash := hashToken(key)
+	now := time.Now()
+	for _, k := range user.APIKeys {
+		if k.Prefix != prefix || subtle.ConstantTimeCompare([]byte(k.Hash), []byte(hash)) != 1 {
+			continue
+		}
+		if !k.ExpiresAt.IsZero() && !now.Before(k.ExpiresAt) {
+			break
+		}
+		if now.Sub(k.LastUsedAt) >= apiKeyUsageInterval {
+			touchAPIKey(ctx, user.ID, k.ID, now)
+		}
+		return user.ID.Hex(), k.Scopes, nil
+	}
+	return "", nil, middleware.ErrInvalidCredentials
+}
+
+// touchAPIKey records the last use of a key. Failures are logged; the key
+// works regardless.
+func touchAPIKey(ctx context.Context, userID, keyID primitive.ObjectID, now time.Time) {
+	_, err := mongoCollection.UpdateOne(ctx,
+		bson.M{"_id": userID, "api_keys._id": keyID},
+		bson.M{"$set": bson.M{"api_keys.$.last_used_at": now.UTC()}})
+	if err != nil {
+		log.Printf("Failed to record the use of API key %s: %v", keyID.Hex(), err)
+	}
+}
@@ -0,0 +1,240 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lep13/golang-restful-api/audit"
+	"github.com/lep13/golang-restful-api/middleware"
+	"github.com/lep13/golang-restful-api/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// findByAPIKeyPrefix makes FindOne by API key prefix return user, or err when it is set
+func findByAPIKeyPrefix(mockCollection *MockCollection, prefix string, user models.User, err error) {
+	result := new(MockSingleResult)
+	result.On("Decode", mock.AnythingOfType("*models.User")).Run(func(args mock.Arguments) {
+		*args.Get(0).(*models.User) = user
+	}).Return(err)
+	mockCollection.On("FindOne", mock.Anything, bson.M{"api_keys.prefix": prefix}).Return(result)
+}
+
+func TestCreateAPIKey(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	auditLog := new(recordingAuditLogger)
+	defer setupAuditLogger(auditLog)()
+	id := primitive.NewObjectID()
+	findUser(mockCollection, id, models.User{ID: id}, nil)
+	var stored models.APIKey
+	mockCollection.On("UpdateOne", mock.Anything, bson.M{"_id": id, "api_keys.19": bson.M{"$exists": false}}, mock.Anything).Run(func(args mock.Arguments) {
+		stored = args.Get(2).(bson.M)["$push"].(bson.M)["api_keys"].(models.APIKey)
+	}).Return(&mongo.UpdateResult{MatchedCount: 1}, nil)
+	expiresAt := time.Now().Add(24 * time.Hour).UTC().Truncate(time.Second)
+
+	rr := serve(CreateAPIKey, "POST", "/v1/users/"+id.Hex()+"/api-keys", `{"name": " nightly sync ", "scopes": ["users:read", "users:read"], "expires_at": "`+expiresAt.Format(time.RFC3339)+`"}`, withVars("id", id.Hex()), as(id.Hex()))
+
+	require.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+	var created NewAPIKey
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &created))
+	assert.Regexp(t, `^ak_[a-z2-7]{8}_[A-Za-z0-9_-]{43}$`, created.Key)
+	assert.Equal(t, "nightly sync", created.Name)
+	assert.Equal(t, []string{"users:read"}, created.Scopes)
+	assert.Equal(t, expiresAt, *created.ExpiresAt)
+	assert.Nil(t, created.LastUsedAt)
+
+	// Only the hash of the key is stored, under its prefix
+	assert.Equal(t, created.ID, stored.ID)
+	assert.Equal(t, created.Key[3:11], stored.Prefix)
+	assert.Equal(t, created.Prefix, stored.Prefix)
+	assert.Equal(t, hashToken(created.Key), stored.Hash)
+	assert.Equal(t, expiresAt, stored.ExpiresAt)
+	events := auditLog.recorded()
+	require.Len(t, events, 1)
+	assert.Equal(t, audit.APIKeyCreated, events[0].Action)
+	assert.Equal(t, map[string]string{"key_id": created.ID.Hex(), "name": "nightly sync", "scopes": "users:read"}, events[0].Details)
+	assert.NotContains(t, events[0].Details, created.Key)
+}
+
+func TestCreateAPIKey_Rejected(t *testing.T) {
+	id := primitive.NewObjectID()
+	full := models.User{ID: id, APIKeys: make([]models.APIKey, 20)}
+	past := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+
+	for _, tc := range []struct {
+		name     string
+		callerID string
+		user     models.User
+		body     string
+		matched  int64
+		status   int
+		error    string
+	}{
+		{"no name", id.Hex(), models.User{ID: id}, `{"name": " ", "scopes": ["users:read"]}`, 1, http.StatusBadRequest, "Name is required"},
+		{"long name", id.Hex(), models.User{ID: id}, `{"name": "` + strings.Repeat("a", 101) + `", "scopes": ["users:read"]}`, 1, http.StatusBadRequest, "Name must be at most 100 characters"},
+		{"no scopes", id.Hex(), models.User{ID: id}, `{"name": "sync", "scopes": []}`, 1, http.StatusBadRequest, "At least one scope is required"},
+		{"unknown scope", id.Hex(), models.User{ID: id}, `{"name": "sync", "scopes": ["users:admin"]}`, 1, http.StatusBadRequest, `Unknown scope \"users:admin\"`},
+		{"expired", id.Hex(), models.User{ID: id}, `{"name": "sync", "scopes": ["users:read"], "expires_at": "` + past + `"}`, 1, http.StatusBadRequest, "Expiry must be in the future"},
+		{"too many keys", id.Hex(), full, `{"name": "sync", "scopes": ["users:read"]}`, 1, http.StatusConflict, "A user may have at most 20 API keys"},
+		{"filled meanwhile", id.Hex(), models.User{ID: id}, `{"name": "sync", "scopes": ["users:read"]}`, 0, http.StatusConflict, "A user may have at most 20 API keys"},
+		{"other user", primitive.NewObjectID().Hex(), models.User{ID: id}, `{"name": "sync", "scopes": ["users:read"]}`, 1, http.StatusForbidden, "Not allowed to manage this user"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mockCollection := new(MockCollection)
+			defer SetupMockCollection(mockCollection)()
+			findUser(mockCollection, id, tc.user, nil)
+			mockCollection.On("UpdateOne", mock.Anything, mock.Anything, mock.Anything).Return(&mongo.UpdateResult{MatchedCount: tc.matched}, nil)
+
+			rr := serve(CreateAPIKey, "POST", "/v1/users/"+id.Hex()+"/api-keys", tc.body, withVars("id", id.Hex()), as(tc.callerID))
+
+			assert.Equal(t, tc.status, rr.Code)
+			assert.Contains(t, rr.Body.String(), tc.error)
+			assert.NotContains(t, rr.Body.String(), "ak_")
+		})
+	}
+}
+
+func TestListAPIKeys(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	id := primitive.NewObjectID()
+	adminID := primitive.NewObjectID()
+	createdAt := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	key := models.APIKey{ID: primitive.NewObjectID(), Name: "sync", Prefix: "abcdefgh", Hash: hashToken("ak_abcdefgh_secret"), Scopes: []string{"users:read"}, CreatedAt: createdAt, LastUsedAt: createdAt.Add(time.Hour)}
+	findUser(mockCollection, id, models.User{ID: id, APIKeys: []models.APIKey{key}}, nil)
+	findUser(mockCollection, adminID, models.User{ID: adminID, Admin: true}, nil)
+
+	for _, callerID := range []string{id.Hex(), adminID.Hex()} {
+		rr := serve(ListAPIKeys, "GET", "/v1/users/"+id.Hex()+"/api-keys", "", withVars("id", id.Hex()), as(callerID))
+
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.JSONEq(t, `[{
+			"id": "`+key.ID.Hex()+`",
+			"name": "sync",
+			"prefix": "abcdefgh",
+			"scopes": ["users:read"],
+			"created_at": "2026-01-02T03:04:05Z",
+			"last_used_at": "2026-01-02T04:04:05Z"
+		}]`, rr.Body.String())
+	}
+}
+
+func TestListAPIKeys_None(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	id := primitive.NewObjectID()
+	findUser(mockCollection, id, models.User{ID: id}, nil)
+
+	rr := serve(ListAPIKeys, "GET", "/v1/users/"+id.Hex()+"/api-keys", "", withVars("id", id.Hex()), as(id.Hex()))
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, `[]`, rr.Body.String())
+}
+
+func TestDeleteAPIKey(t *testing.T) {
+	id := primitive.NewObjectID()
+	keyID := primitive.NewObjectID()
+
+	for _, tc := range []struct {
+		name    string
+		matched int64
+		status  int
+		body    string
+	}{
+		{"revoked", 1, http.StatusOK, `{"message":"API key revoked"}`},
+		{"unknown key", 0, http.StatusNotFound, `{"error":"API key not found"}`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mockCollection := new(MockCollection)
+			defer SetupMockCollection(mockCollection)()
+			auditLog := new(recordingAuditLogger)
+			defer setupAuditLogger(auditLog)()
+			mockCollection.On("UpdateOne", mock.Anything,
+				bson.M{"_id": id, "api_keys._id": keyID},
+				bson.M{"$pull": bson.M{"api_keys": bson.M{"_id": keyID}}}).Return(&mongo.UpdateResult{MatchedCount: tc.matched}, nil)
+
+			req, _ := http.NewRequest("DELETE", "/v1/users/"+id.Hex()+"/api-keys/"+keyID.Hex(), nil)
+			req = mux.SetURLVars(req, map[string]string{"id": id.Hex(), "key_id": keyID.Hex()})
+			req = req.WithContext(middleware.WithUserID(req.Context(), id.Hex()))
+			rr := httptest.NewRecorder()
+			DeleteAPIKey(rr, req)
+
+			assert.Equal(t, tc.status, rr.Code)
+			assert.JSONEq(t, tc.body, rr.Body.String())
+			if tc.matched == 1 {
+				events := auditLog.recorded()
+				require.Len(t, events, 1)
+				assert.Equal(t, audit.APIKeyRevoked, events[0].Action)
+				assert.Equal(t, keyID.Hex(), events[0].Details["key_id"])
+			}
+		})
+	}
+}
+
+func TestAuthenticateAPIKey(t *testing.T) {
+	id := primitive.NewObjectID()
+	raw, prefix, err := newAPIKey()
+	require.NoError(t, err)
+	key := models.APIKey{ID: primitive.NewObjectID(), Prefix: prefix, Hash: hashToken(raw), Scopes: []string{"users:read", "users:write"}}
+
+	for _, tc := range []struct {
+		name    string
+		key     string
+		user    models.User
+		err     error
+		scopes  []string
+		want    error
+		touched bool
+	}{
+		{"valid", raw, models.User{ID: id, APIKeys: []models.APIKey{key}}, nil, key.Scopes, nil, true},
+		{"used recently", raw, models.User{ID: id, APIKeys: []models.APIKey{withLastUse(key, time.Now())}}, nil, key.Scopes, nil, false},
+		{"expired", raw, models.User{ID: id, APIKeys: []models.APIKey{withExpiry(key, time.Now().Add(-time.Minute))}}, nil, nil, middleware.ErrInvalidCredentials, false},
+		{"not expired", raw, models.User{ID: id, APIKeys: []models.APIKey{withExpiry(key, time.Now().Add(time.Minute))}}, nil, key.Scopes, nil, true},
+		{"wrong secret", raw + "x", models.User{ID: id, APIKeys: []models.APIKey{key}}, nil, nil, middleware.ErrInvalidCredentials, false},
+		{"revoked", raw, models.User{}, mongo.ErrNoDocuments, nil, middleware.ErrInvalidCredentials, false},
+		{"deactivated user", raw, models.User{ID: id, APIKeys: []models.APIKey{key}, Deactivated: true}, nil, nil, middleware.ErrInvalidCredentials, false},
+		{"malformed", "ak_short", models.User{}, nil, nil, middleware.ErrInvalidCredentials, false},
+		{"login token", "eyJhbGciOiJIUzI1NiJ9.e30.sig", models.User{}, nil, nil, middleware.ErrInvalidCredentials, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mockCollection := new(MockCollection)
+			defer SetupMockCollection(mockCollection)()
+			findByAPIKeyPrefix(mockCollection, prefix, tc.user, tc.err)
+			mockCollection.On("UpdateOne", mock.Anything, bson.M{"_id": id, "api_keys._id": key.ID}, mock.Anything).Return(&mongo.UpdateResult{MatchedCount: 1}, nil)
+
+			userID, scopes, err := AuthenticateAPIKey(context.Background(), tc.key)
+
+			assert.Equal(t, tc.want, err)
+			assert.Equal(t, tc.scopes, scopes)
+			if tc.want == nil {
+				assert.Equal(t, id.Hex(), userID)
+			}
+			if tc.touched {
+				mockCollection.AssertCalled(t, "UpdateOne", mock.Anything, bson.M{"_id": id, "api_keys._id": key.ID}, mock.Anything)
+			} else {
+				mockCollection.AssertNotCalled(t, "UpdateOne", mock.Anything, mock.Anything, mock.Anything)
+			}
+		})
+	}
+}
+
+func withLastUse(key models.APIKey, at time.Time) models.APIKey {
+	key.LastUsedAt = at
+	return key
+}
+
+func withExpiry(key models.APIKey, at time.Time) models.APIKey {
+	key.ExpiresAt = at
+	return key
+}
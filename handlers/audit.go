@@ -0,0 +1,37 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/lep13/golang-restful-api/audit"
+	"github.com/lep13/golang-restful-api/middleware"
+)
+
+var auditLogger audit.Logger = audit.Log{}
+
+// SetAuditLogger sets where audit events are recorded
+func SetAuditLogger(l audit.Logger) {
+	if l != nil {
+		auditLogger = l
+	}
+}
+
+// clientIP returns the address of the client that sent the request, as
+// resolved by the router from trusted proxies
+func clientIP(r *http.Request) string {
+	if ip, ok := middleware.ClientIPFromContext(r.Context()); ok {
+		return ip
+	}
+	return r.RemoteAddr
+}
+
+// recordAudit records an action on a user. Failures are logged rather than
+// failing the request, which has already taken effect.
+func recordAudit(action, userID, ip string, details map[string]string) {
+	event := audit.Event{Time: time.Now().UTC(), Action: action, UserID: userID, IP: ip, Details: details}
+	if err := auditLogger.Record(event); err != nil {
+		log.Printf("Failed to record audit event %s for user %s: %v", action, userID, err)
+	}
+}
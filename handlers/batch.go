@@ -0,0 +1,430 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/lep13/golang-restful-api/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// maxBatchItems caps the number of items accepted by one batch request
+var maxBatchItems = 500
+
+// errRolledBack aborts the transaction of an atomic batch after an item failed
+var errRolledBack = errors.New("batch rolled back")
+
+// SetMaxBatchItems sets the largest number of items accepted by the batch endpoints
+func SetMaxBatchItems(n int) {
+	if n > 0 {
+		maxBatchItems = n
+	}
+}
+
+// BatchItemResult is the outcome of one item of a batch request. Status is the
+// HTTP status the item would have received as an individual request.
+type BatchItemResult struct {
+	Index  int    `json:"index"`
+	Status int    `json:"status"`
+	ID     string `json:"id,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// BatchResponse is returned by the batch endpoints, with one result per item
+// in request order
+type BatchResponse struct {
+	Error     string            `json:"error,omitempty"`
+	Succeeded int               `json:"succeeded"`
+	Failed    int               `json:"failed"`
+	Results   []BatchItemResult `json:"results"`
+}
+
+// rejection is why an item of a batch is not written; a zero status lets it
+// be written
+type rejection struct {
+	status  int
+	message string
+}
+
+// batchFunc applies a batch and returns a result per item. ordered stops at the
+// first failing write, which is required inside a transaction.
+type batchFunc func(ctx context.Context, ordered bool) ([]BatchItemResult, error)
+
+// BatchCreateUsers creates several users with a single InsertMany. Like
+// CreateUser, it hashes their passwords, rejecting the items whose password
+// breaks the policy, and mails a verification token to each created user with
+// an email.
+func BatchCreateUsers(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if _, ok := authenticatedUser(w, r); !ok {
+		return
+	}
+	atomic, ok := parseAtomic(w, r)
+	if !ok {
+		return
+	}
+	var body struct {
+		Items []models.User `json:"items"`
+	}
+	if !decodeBody(w, r, &body) || !checkBatchSize(w, len(body.Items)) {
+		return
+	}
+	// IDs, password hashes and verification tokens are assigned up front so
+	// a retried transaction inserts the same documents
+	rejections := make([]rejection, len(body.Items))
+	var docs []interface{}
+	var positions []int
+	tokens := make([]string, len(body.Items))
+	now := time.Now()
+	for i := range body.Items {
+		user := &body.Items[i]
+		if status, message := hashNewPassword(user); status != 0 {
+			rejections[i] = rejection{status, message}
+			continue
+		}
+		user.ID = primitive.NewObjectID()
+		user.Email = normalizeEmail(user.Email)
+		user.EmailVerified = false
+		if user.Email != "" {
+			var err error
+			if user.EmailVerification, tokens[i], err = newEmailVerification(now); err != nil {
+				writeError(w, "Failed to create verification token", http.StatusInternalServerError)
+				return
+			}
+		}
+		docs = append(docs, *user)
+		positions = append(positions, i)
+	}
+
+	results := runBatch(w, r, atomic, func(ctx context.Context, ordered bool) ([]BatchItemResult, error) {
+		results := make([]BatchItemResult, len(body.Items))
+		for i, user := range body.Items {
+			if rejections[i].status != 0 {
+				results[i] = BatchItemResult{Index: i, Status: rejections[i].status, Error: rejections[i].message}
+			} else {
+				results[i] = BatchItemResult{Index: i, Status: http.StatusCreated, ID: user.ID.Hex()}
+			}
+		}
+		// An ordered batch stops at the first failure, so nothing is written
+		if len(docs) == 0 || (ordered && len(docs) < len(body.Items)) {
+			return results, nil
+		}
+		_, err := mongoCollection.InsertMany(ctx, docs, options.InsertMany().SetOrdered(ordered))
+		err = applyWriteErrors(results, positions, err)
+		// Users that failed to insert were never stored, so their IDs mean nothing
+		for i := range results {
+			if results[i].Status != http.StatusCreated {
+				results[i].ID = ""
+			}
+		}
+		return results, err
+	})
+	// The emails go out after responding, so a large batch is not held up by them
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		for i, result := range results {
+			if result.Status == http.StatusCreated && tokens[i] != "" {
+				sendVerificationEmail(context.Background(), body.Items[i], tokens[i])
+			}
+		}
+	}()
+}
+
+// BatchUpdateUsers sets the fields of several users, identified by their _id,
+// with a single BulkWrite. As with UpdateUser, callers may update themselves
+// and admins anyone; setting an email marks it unverified and mails a
+// verification token to it, and setting a password revokes the sessions of
+// the user.
+func BatchUpdateUsers(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	atomic, ok := parseAtomic(w, r)
+	if !ok {
+		return
+	}
+	var body struct {
+		Items []models.User `json:"items"`
+	}
+	if !decodeBody(w, r, &body) || !checkBatchSize(w, len(body.Items)) {
+		return
+	}
+	mayManage, ok := userManager(w, r)
+	if !ok {
+		return
+	}
+	// Passwords are hashed and verification tokens assigned up front so a
+	// retried transaction writes the same updates
+	ids := make([]primitive.ObjectID, len(body.Items))
+	rejections := make([]rejection, len(body.Items))
+	tokens := make([]string, len(body.Items))
+	now := time.Now()
+	for i := range body.Items {
+		user := &body.Items[i]
+		ids[i] = user.ID
+		user.Email = normalizeEmail(user.Email)
+		user.EmailVerification = nil
+		if user.ID.IsZero() {
+			continue
+		}
+		if !mayManage(user.ID) {
+			rejections[i] = rejection{http.StatusForbidden, "Not allowed to manage this user"}
+		} else if status, message := hashNewPassword(user); status != 0 {
+			rejections[i] = rejection{status, message}
+		} else if user.Email != "" {
+			var err error
+			if user.EmailVerification, tokens[i], err = newEmailVerification(now); err != nil {
+				writeError(w, "Failed to create verification token", http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+
+	results := runBatch(w, r, atomic, func(ctx context.Context, ordered bool) ([]BatchItemResult, error) {
+		return bulkWriteExisting(ctx, ids, rejections, ordered, func(i int) mongo.WriteModel {
+			update := body.Items[i]
+			update.ID = primitive.NilObjectID
+			update.EmailVerified = false
+			var unset bson.M
+			if update.Email != "" {
+				unset = bson.M{"email_verified": ""}
+			}
+			return mongo.NewUpdateOneModel().SetFilter(bson.M{"_id": ids[i]}).SetUpdate(userUpdate(update, unset))
+		})
+	})
+	for _, result := range results {
+		if result.Status == http.StatusOK && body.Items[result.Index].Password != "" {
+			validSessions.forgetUser(result.ID)
+		}
+	}
+	// As for created users, the emails go out after responding
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		for _, result := range results {
+			if result.Status == http.StatusOK && tokens[result.Index] != "" {
+				sendVerificationEmail(context.Background(), body.Items[result.Index], tokens[result.Index])
+			}
+		}
+	}()
+}
+
+// BatchDeleteUsers deletes several users by ID with a single BulkWrite. As
+// with DeleteUser, callers may delete themselves and admins anyone.
+func BatchDeleteUsers(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	atomic, ok := parseAtomic(w, r)
+	if !ok {
+		return
+	}
+	var body struct {
+		IDs []string `json:"ids"`
+	}
+	if !decodeBody(w, r, &body) || !checkBatchSize(w, len(body.IDs)) {
+		return
+	}
+	mayManage, ok := userManager(w, r)
+	if !ok {
+		return
+	}
+	// Malformed IDs are reported per item; their ObjectID stays nil and never matches
+	ids := make([]primitive.ObjectID, len(body.IDs))
+	rejections := make([]rejection, len(body.IDs))
+	for i, raw := range body.IDs {
+		if id, err := primitive.ObjectIDFromHex(raw); err == nil {
+			ids[i] = id
+			if !mayManage(id) {
+				rejections[i] = rejection{http.StatusForbidden, "Not allowed to manage this user"}
+			}
+		}
+	}
+
+	results := runBatch(w, r, atomic, func(ctx context.Context, ordered bool) ([]BatchItemResult, error) {
+		return bulkWriteExisting(ctx, ids, rejections, ordered, func(i int) mongo.WriteModel {
+			return mongo.NewDeleteOneModel().SetFilter(bson.M{"_id": ids[i]})
+		})
+	})
+	for _, result := range results {
+		if result.Status == http.StatusOK {
+			validSessions.forgetUser(result.ID)
+		}
+	}
+}
+
+// parseAtomic reads the optional atomic query parameter
+func parseAtomic(w http.ResponseWriter, r *http.Request) (bool, bool) {
+	return parseBoolQuery(w, r, "atomic")
+}
+
+// parseBoolQuery reads an optional boolean query parameter, writing 400 when
+// it is malformed
+func parseBoolQuery(w http.ResponseWriter, r *http.Request, name string) (bool, bool) {
+	raw := r.URL.Query().Get(name)
+	if raw == "" {
+		return false, true
+	}
+	value, err := strconv.ParseBool(raw)
+	if err != nil {
+		writeError(w, "Invalid "+name+" parameter", http.StatusBadRequest)
+		return false, false
+	}
+	return value, true
+}
+
+func checkBatchSize(w http.ResponseWriter, n int) bool {
+	if n == 0 {
+		writeError(w, "Batch must contain at least one item", http.StatusBadRequest)
+		return false
+	}
+	if n > maxBatchItems {
+		writeError(w, fmt.Sprintf("Batch exceeds the limit of %d items", maxBatchItems), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// bulkWriteExisting builds one write model per ID that refers to a stored user
+// and runs them as a single BulkWrite. Rejected items and missing IDs are
+// reported without being written; an ID removed concurrently after the lookup
+// is not detected.
+func bulkWriteExisting(ctx context.Context, ids []primitive.ObjectID, rejections []rejection, ordered bool, model func(i int) mongo.WriteModel) ([]BatchItemResult, error) {
+	found, err := existingIDs(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]BatchItemResult, len(ids))
+	var writes []mongo.WriteModel
+	var positions []int
+	for i, id := range ids {
+		switch {
+		case id.IsZero():
+			results[i] = BatchItemResult{Index: i, Status: http.StatusBadRequest, Error: "Invalid ID format"}
+		case rejections[i].status != 0:
+			results[i] = BatchItemResult{Index: i, Status: rejections[i].status, ID: id.Hex(), Error: rejections[i].message}
+		case !found[id]:
+			results[i] = BatchItemResult{Index: i, Status: http.StatusNotFound, ID: id.Hex(), Error: "User not found"}
+		default:
+			results[i] = BatchItemResult{Index: i, Status: http.StatusOK, ID: id.Hex()}
+			writes = append(writes, model(i))
+			positions = append(positions, i)
+		}
+	}
+	// An ordered batch stops at the first failure, so nothing is written
+	if len(writes) == 0 || (ordered && len(writes) < len(ids)) {
+		return results, nil
+	}
+	_, err = mongoCollection.BulkWrite(ctx, writes, options.BulkWrite().SetOrdered(ordered))
+	return results, applyWriteErrors(results, positions, err)
+}
+
+// existingIDs returns the subset of ids stored in the collection
+func existingIDs(ctx context.Context, ids []primitive.ObjectID) (map[primitive.ObjectID]bool, error) {
+	cur, err := mongoCollection.Find(ctx, bson.M{"_id": bson.M{"$in": ids}}, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(context.Background())
+	found := make(map[primitive.ObjectID]bool, len(ids))
+	for cur.Next(ctx) {
+		var doc struct {
+			ID primitive.ObjectID `bson:"_id"`
+		}
+		if err := cur.Decode(&doc); err != nil {
+			return nil, err
+		}
+		found[doc.ID] = true
+	}
+	return found, cur.Err()
+}
+
+// applyWriteErrors records the per-document failures of an InsertMany or
+// BulkWrite on the item results. positions maps the index of each write to the
+// index of its item. Errors that are not tied to a document are returned.
+func applyWriteErrors(results []BatchItemResult, positions []int, err error) error {
+	var bulkErr mongo.BulkWriteException
+	if err == nil || !errors.As(err, &bulkErr) || len(bulkErr.WriteErrors) == 0 || bulkErr.WriteConcernError != nil {
+		return err
+	}
+	for _, writeErr := range bulkErr.WriteErrors {
+		if writeErr.Index < 0 || writeErr.Index >= len(positions) {
+			return err
+		}
+		result := &results[positions[writeErr.Index]]
+		if mongo.IsDuplicateKeyError(writeErr) {
+			result.Status, result.Error = http.StatusConflict, errEmailInUse
+		} else {
+			result.Status, result.Error = http.StatusInternalServerError, writeErr.Message
+		}
+	}
+	return nil
+}
+
+// runBatch applies the batch, inside a transaction when atomic is set, and
+// writes the results. A non-atomic batch always answers 200 and reports
+// failures per item. An atomic batch with any failed item is rolled back and
+// answers 409, marking the items that did not fail with 424 Failed Dependency.
+// It returns the results of an applied batch, or nil when nothing was applied.
+func runBatch(w http.ResponseWriter, r *http.Request, atomic bool, apply batchFunc) []BatchItemResult {
+	ctx, cancel := dbContext(r)
+	defer cancel()
+
+	var results []BatchItemResult
+	var err error
+	if atomic {
+		err = mongoCollection.WithTransaction(ctx, func(txCtx context.Context) error {
+			var applyErr error
+			results, applyErr = apply(txCtx, true)
+			if applyErr != nil {
+				return applyErr
+			}
+			for _, result := range results {
+				if result.Status >= 300 {
+					return errRolledBack
+				}
+			}
+			return nil
+		})
+	} else {
+		results, err = apply(ctx, false)
+	}
+	if err != nil && !errors.Is(err, errRolledBack) {
+		writeDBError(w, err)
+		return nil
+	}
+
+	response := BatchResponse{Results: results}
+	status := http.StatusOK
+	if err != nil {
+		response.Error = "Batch rolled back"
+		status = http.StatusConflict
+		for i := range response.Results {
+			if response.Results[i].Status < 300 {
+				response.Results[i].Status = http.StatusFailedDependency
+				response.Results[i].Error = "Not applied because another item failed"
+			}
+		}
+	}
+	for _, result := range response.Results {
+		if result.Status < 300 {
+			response.Succeeded++
+		} else {
+			response.Failed++
+		}
+	}
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Println("Failed to encode batch response:", err)
+	}
+	if status != http.StatusOK {
+		return nil
+	}
+	return response.Results
+}
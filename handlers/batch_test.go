@@ -0,0 +1,389 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lep13/golang-restful-api/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func serveBatch(handler http.HandlerFunc, url, body string, opts ...requestOption) (*httptest.ResponseRecorder, BatchResponse) {
+	rr := serve(handler, "POST", url, body, opts...)
+	var response BatchResponse
+	json.Unmarshal(rr.Body.Bytes(), &response)
+	return rr, response
+}
+
+func duplicateKeyAt(index int) error {
+	return mongo.BulkWriteException{WriteErrors: []mongo.BulkWriteError{
+		{WriteError: mongo.WriteError{Index: index, Code: 11000, Message: "E11000 duplicate key error"}},
+	}}
+}
+
+// asAdmin authenticates the request as an admin
+func asAdmin(mockCollection *MockCollection) requestOption {
+	adminID := primitive.NewObjectID()
+	findUser(mockCollection, adminID, models.User{ID: adminID, Admin: true}, nil)
+	return as(adminID.Hex())
+}
+
+// idCursor returns a cursor over documents holding only the given IDs
+func idCursor(ids ...primitive.ObjectID) *mongo.Cursor {
+	docs := make([]interface{}, len(ids))
+	for i, id := range ids {
+		docs[i] = bson.M{"_id": id}
+	}
+	cursor, _ := mongo.NewCursorFromDocuments(docs, nil, nil)
+	return cursor
+}
+
+func TestBatchCreateUsers(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	mockCollection.On("InsertMany", mock.Anything, mock.MatchedBy(func(docs []interface{}) bool {
+		return len(docs) == 2
+	})).Return(&mongo.InsertManyResult{}, nil)
+
+	rr, response := serveBatch(BatchCreateUsers, "/v1/users:batchCreate", `{"items": [{"name": "John Doe"}, {"name": "Jane Doe"}]}`, signedIn())
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, 2, response.Succeeded)
+	assert.Equal(t, 0, response.Failed)
+	for i, result := range response.Results {
+		assert.Equal(t, i, result.Index)
+		assert.Equal(t, http.StatusCreated, result.Status)
+		assert.Len(t, result.ID, 24)
+	}
+	mockCollection.AssertNotCalled(t, "WithTransaction", mock.Anything)
+}
+
+func TestBatchCreateUsers_MailsVerification(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	sender := new(recordingMailer)
+	defer setupMailer(sender)()
+	var docs []interface{}
+	mockCollection.On("InsertMany", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		docs = args.Get(1).([]interface{})
+	}).Return(nil, duplicateKeyAt(2))
+
+	_, response := serveBatch(BatchCreateUsers, "/v1/users:batchCreate",
+		`{"items": [{"name": "John", "email": "john@example.com"}, {"name": "No Email"}, {"name": "Jane", "email": "jane@example.com"}]}`, signedIn())
+
+	assert.Equal(t, 2, response.Succeeded)
+	// Only the created user with an email is mailed; the duplicate was never stored
+	messages := sender.sent()
+	require.Len(t, messages, 1)
+	assert.Equal(t, "john@example.com", messages[0].To)
+	assert.Contains(t, messages[0].Body, "/v1/users/"+response.Results[0].ID+"/verify-email")
+	john := docs[0].(models.User)
+	assert.Equal(t, hashToken(tokenPattern.FindString(messages[0].Body)), john.EmailVerification.TokenHash)
+	assert.Nil(t, docs[1].(models.User).EmailVerification)
+}
+
+func TestBatchCreateUsers_AtomicRollbackMailsNothing(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	sender := new(recordingMailer)
+	defer setupMailer(sender)()
+	mockCollection.On("WithTransaction", mock.Anything).Return()
+	mockCollection.On("InsertMany", mock.Anything, mock.Anything).Return(nil, duplicateKeyAt(1))
+
+	rr, _ := serveBatch(BatchCreateUsers, "/v1/users:batchCreate?atomic=true",
+		`{"items": [{"email": "john@example.com"}, {"email": "jane@example.com"}]}`, signedIn())
+
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	assert.Empty(t, sender.sent())
+}
+
+func TestBatchCreateUsers_PartialFailure(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	mockCollection.On("InsertMany", mock.Anything, mock.Anything).Return(nil, duplicateKeyAt(1))
+
+	rr, response := serveBatch(BatchCreateUsers, "/v1/users:batchCreate", `{"items": [{"name": "John Doe"}, {"name": "Jane Doe"}]}`, signedIn())
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, 1, response.Succeeded)
+	assert.Equal(t, 1, response.Failed)
+	assert.Equal(t, http.StatusCreated, response.Results[0].Status)
+	assert.Equal(t, BatchItemResult{Index: 1, Status: http.StatusConflict, Error: "Email is already in use"}, response.Results[1])
+}
+
+func TestBatchCreateUsers_AtomicRollback(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	mockCollection.On("WithTransaction", mock.Anything).Return()
+	mockCollection.On("InsertMany", mock.Anything, mock.Anything).Return(nil, duplicateKeyAt(1))
+
+	rr, response := serveBatch(BatchCreateUsers, "/v1/users:batchCreate?atomic=true", `{"items": [{"name": "John Doe"}, {"name": "Jane Doe"}]}`, signedIn())
+
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	assert.Equal(t, "Batch rolled back", response.Error)
+	assert.Equal(t, 0, response.Succeeded)
+	assert.Equal(t, 2, response.Failed)
+	assert.Equal(t, http.StatusFailedDependency, response.Results[0].Status)
+	assert.Equal(t, http.StatusConflict, response.Results[1].Status)
+	mockCollection.AssertCalled(t, "WithTransaction", mock.Anything)
+}
+
+func TestBatchCreateUsers_DatabaseError(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	mockCollection.On("InsertMany", mock.Anything, mock.Anything).Return(nil, errors.New("insert failed"))
+
+	rr, _ := serveBatch(BatchCreateUsers, "/v1/users:batchCreate", `{"items": [{"name": "John Doe"}]}`, signedIn())
+
+	assert.Equal(t, http.StatusInternalServerError, rr.Code)
+	assert.Contains(t, rr.Body.String(), "insert failed")
+}
+
+func TestBatchCreateUsers_InvalidBatch(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	defer SetMaxBatchItems(maxBatchItems)
+	SetMaxBatchItems(2)
+
+	for _, tc := range []struct{ url, body, message string }{
+		{"/v1/users:batchCreate", `{"items": []}`, "Batch must contain at least one item"},
+		{"/v1/users:batchCreate", `{"items": [{}, {}, {}]}`, "Batch exceeds the limit of 2 items"},
+		{"/v1/users:batchCreate?atomic=maybe", `{"items": [{}]}`, "Invalid atomic parameter"},
+		{"/v1/users:batchCreate", `{"items": `, "Failed to decode request body"},
+	} {
+		rr, _ := serveBatch(BatchCreateUsers, tc.url, tc.body, signedIn())
+
+		assert.Equal(t, http.StatusBadRequest, rr.Code, tc.body)
+		assert.Contains(t, rr.Body.String(), tc.message)
+	}
+	mockCollection.AssertNotCalled(t, "InsertMany", mock.Anything, mock.Anything)
+}
+
+func TestBatchUpdateUsers(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	existing, missing := primitive.NewObjectID(), primitive.NewObjectID()
+	mockCollection.On("Find", mock.Anything, bson.M{"_id": bson.M{"$in": []primitive.ObjectID{existing, missing}}}).Return(idCursor(existing), nil)
+	mockCollection.On("BulkWrite", mock.Anything, mock.MatchedBy(func(models []mongo.WriteModel) bool {
+		if len(models) != 1 {
+			return false
+		}
+		update := models[0].(*mongo.UpdateOneModel)
+		return update.Filter.(bson.M)["_id"] == existing && !strings.Contains(fmt.Sprint(update.Update), existing.Hex())
+	})).Return(&mongo.BulkWriteResult{MatchedCount: 1}, nil)
+
+	body := fmt.Sprintf(`{"items": [{"_id": "%s", "name": "Johnny"}, {"_id": "%s", "name": "Ghost"}]}`, existing.Hex(), missing.Hex())
+	rr, response := serveBatch(BatchUpdateUsers, "/v1/users:batchUpdate", body, asAdmin(mockCollection))
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, []BatchItemResult{
+		{Index: 0, Status: http.StatusOK, ID: existing.Hex()},
+		{Index: 1, Status: http.StatusNotFound, ID: missing.Hex(), Error: "User not found"},
+	}, response.Results)
+	mockCollection.AssertExpectations(t)
+}
+
+func TestBatchUpdateUsers_AtomicSkipsWritesAfterFailure(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	existing, missing := primitive.NewObjectID(), primitive.NewObjectID()
+	mockCollection.On("WithTransaction", mock.Anything).Return()
+	mockCollection.On("Find", mock.Anything, mock.Anything).Return(idCursor(existing), nil)
+
+	body := fmt.Sprintf(`{"items": [{"_id": "%s", "name": "Johnny"}, {"_id": "%s", "name": "Ghost"}]}`, existing.Hex(), missing.Hex())
+	rr, response := serveBatch(BatchUpdateUsers, "/v1/users:batchUpdate?atomic=true", body, asAdmin(mockCollection))
+
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	assert.Equal(t, http.StatusFailedDependency, response.Results[0].Status)
+	assert.Equal(t, http.StatusNotFound, response.Results[1].Status)
+	mockCollection.AssertNotCalled(t, "BulkWrite", mock.Anything, mock.Anything)
+}
+
+func TestBatchDeleteUsers(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	defer setupSessionCache(time.Minute)()
+	first, second := primitive.NewObjectID(), primitive.NewObjectID()
+	validSessions.add("session-1", first.Hex(), time.Now())
+	validSessions.add("session-2", second.Hex(), time.Now())
+	mockCollection.On("Find", mock.Anything, mock.Anything).Return(idCursor(first, second), nil)
+	mockCollection.On("BulkWrite", mock.Anything, mock.MatchedBy(func(models []mongo.WriteModel) bool {
+		return len(models) == 2
+	})).Return(nil, mongo.BulkWriteException{WriteErrors: []mongo.BulkWriteError{
+		{WriteError: mongo.WriteError{Index: 1, Code: 2, Message: "delete failed"}},
+	}})
+
+	body := fmt.Sprintf(`{"ids": ["%s", "not-an-id", "%s"]}`, first.Hex(), second.Hex())
+	rr, response := serveBatch(BatchDeleteUsers, "/v1/users:batchDelete", body, asAdmin(mockCollection))
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, []BatchItemResult{
+		{Index: 0, Status: http.StatusOK, ID: first.Hex()},
+		{Index: 1, Status: http.StatusBadRequest, Error: "Invalid ID format"},
+		{Index: 2, Status: http.StatusInternalServerError, ID: second.Hex(), Error: "delete failed"},
+	}, response.Results)
+	assert.Equal(t, 1, response.Succeeded)
+	assert.Equal(t, 2, response.Failed)
+	// Only the sessions of the deleted user are dropped
+	assert.False(t, validSessions.valid("session-1", first.Hex(), time.Now()))
+	assert.True(t, validSessions.valid("session-2", second.Hex(), time.Now()))
+}
+
+func TestBatchDeleteUsers_FindFailure(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	mockCollection.On("Find", mock.Anything, mock.Anything).Return(nil, mongo.CommandError{Labels: []string{"NetworkError"}})
+
+	rr, _ := serveBatch(BatchDeleteUsers, "/v1/users:batchDelete", `{"ids": ["66f0c2a1e4b0a1b2c3d4e5f6"]}`, asAdmin(mockCollection))
+
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+}
+
+func TestBatchUpdateUsers_EmailChangeMailsVerification(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	sender := new(recordingMailer)
+	defer setupMailer(sender)()
+	renamed, moved := primitive.NewObjectID(), primitive.NewObjectID()
+	mockCollection.On("Find", mock.Anything, mock.Anything).Return(idCursor(renamed, moved), nil)
+	var writes []mongo.WriteModel
+	mockCollection.On("BulkWrite", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		writes = args.Get(1).([]mongo.WriteModel)
+	}).Return(&mongo.BulkWriteResult{MatchedCount: 2}, nil)
+
+	body := fmt.Sprintf(`{"items": [{"_id": "%s", "name": "Johnny"}, {"_id": "%s", "email": "New@Example.com", "email_verified": true}]}`, renamed.Hex(), moved.Hex())
+	rr, _ := serveBatch(BatchUpdateUsers, "/v1/users:batchUpdate", body, asAdmin(mockCollection))
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	require.Len(t, writes, 2)
+	first := writes[0].(*mongo.UpdateOneModel).Update.(bson.M)
+	assert.NotContains(t, first, "$unset")
+	assert.Nil(t, first["$set"].(models.User).EmailVerification)
+	second := writes[1].(*mongo.UpdateOneModel).Update.(bson.M)
+	assert.Equal(t, bson.M{"email_verified": ""}, second["$unset"])
+	set := second["$set"].(models.User)
+	assert.False(t, set.EmailVerified)
+	require.NotNil(t, set.EmailVerification)
+	// Only the new address is mailed, with the token whose hash was stored
+	messages := sender.sent()
+	require.Len(t, messages, 1)
+	assert.Equal(t, "new@example.com", messages[0].To)
+	assert.Contains(t, messages[0].Body, "/v1/users/"+moved.Hex()+"/verify-email")
+	assert.Equal(t, hashToken(tokenPattern.FindString(messages[0].Body)), set.EmailVerification.TokenHash)
+}
+
+func TestBatchUpdateUsers_AtomicRollbackMailsNothing(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	sender := new(recordingMailer)
+	defer setupMailer(sender)()
+	existing, missing := primitive.NewObjectID(), primitive.NewObjectID()
+	mockCollection.On("WithTransaction", mock.Anything).Return()
+	mockCollection.On("Find", mock.Anything, mock.Anything).Return(idCursor(existing), nil)
+
+	body := fmt.Sprintf(`{"items": [{"_id": "%s", "email": "john@example.com"}, {"_id": "%s", "email": "ghost@example.com"}]}`, existing.Hex(), missing.Hex())
+	rr, _ := serveBatch(BatchUpdateUsers, "/v1/users:batchUpdate?atomic=true", body, asAdmin(mockCollection))
+
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	assert.Empty(t, sender.sent())
+}
+
+func TestBatchCreateUsers_RejectsInvalidPasswords(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	var docs []interface{}
+	mockCollection.On("InsertMany", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		docs = args.Get(1).([]interface{})
+	}).Return(&mongo.InsertManyResult{}, nil)
+
+	rr, response := serveBatch(BatchCreateUsers, "/v1/users:batchCreate",
+		`{"items": [{"name": "John", "password": "correct horse"}, {"name": "Jane", "password": "short"}]}`, signedIn())
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, http.StatusCreated, response.Results[0].Status)
+	assert.Equal(t, BatchItemResult{Index: 1, Status: http.StatusBadRequest, Error: "Password must be at least 8 characters"}, response.Results[1])
+	require.Len(t, docs, 1)
+	assert.True(t, checkPassword(docs[0].(models.User).Password, "correct horse"))
+}
+
+func TestBatchCreateUsers_AtomicWithInvalidPasswordWritesNothing(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	mockCollection.On("WithTransaction", mock.Anything).Return()
+
+	rr, response := serveBatch(BatchCreateUsers, "/v1/users:batchCreate?atomic=true",
+		`{"items": [{"name": "John"}, {"name": "Jane", "password": "short"}]}`, signedIn())
+
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	assert.Equal(t, http.StatusFailedDependency, response.Results[0].Status)
+	assert.Equal(t, http.StatusBadRequest, response.Results[1].Status)
+	mockCollection.AssertNotCalled(t, "InsertMany", mock.Anything, mock.Anything)
+}
+
+func TestBatchUpdateUsers_OnlyOwnUserWithoutAdmin(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	self, other := primitive.NewObjectID(), primitive.NewObjectID()
+	findUser(mockCollection, self, models.User{ID: self}, nil)
+	mockCollection.On("Find", mock.Anything, mock.Anything).Return(idCursor(self, other), nil)
+	mockCollection.On("BulkWrite", mock.Anything, mock.MatchedBy(func(writes []mongo.WriteModel) bool {
+		return len(writes) == 1 && writes[0].(*mongo.UpdateOneModel).Filter.(bson.M)["_id"] == self
+	})).Return(&mongo.BulkWriteResult{MatchedCount: 1}, nil)
+
+	body := fmt.Sprintf(`{"items": [{"_id": "%s", "name": "Johnny"}, {"_id": "%s", "password": "correct horse"}]}`, self.Hex(), other.Hex())
+	rr, response := serveBatch(BatchUpdateUsers, "/v1/users:batchUpdate", body, as(self.Hex()))
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, []BatchItemResult{
+		{Index: 0, Status: http.StatusOK, ID: self.Hex()},
+		{Index: 1, Status: http.StatusForbidden, ID: other.Hex(), Error: "Not allowed to manage this user"},
+	}, response.Results)
+	mockCollection.AssertExpectations(t)
+}
+
+func TestBatchUpdateUsers_PasswordRevokesSessions(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	defer setupSessionCache(time.Minute)()
+	id := primitive.NewObjectID()
+	validSessions.add("session-1", id.Hex(), time.Now())
+	mockCollection.On("Find", mock.Anything, mock.Anything).Return(idCursor(id), nil)
+	var update bson.M
+	mockCollection.On("BulkWrite", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		update = args.Get(1).([]mongo.WriteModel)[0].(*mongo.UpdateOneModel).Update.(bson.M)
+	}).Return(&mongo.BulkWriteResult{MatchedCount: 1}, nil)
+
+	body := fmt.Sprintf(`{"items": [{"_id": "%s", "password": "correct horse"}]}`, id.Hex())
+	rr, _ := serveBatch(BatchUpdateUsers, "/v1/users:batchUpdate", body, asAdmin(mockCollection))
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	set := update["$set"].(models.User)
+	assert.True(t, checkPassword(set.Password, "correct horse"))
+	assert.WithinDuration(t, time.Now(), set.SessionsRevokedAt, time.Minute)
+	assert.Equal(t, bson.M{"sessions": ""}, update["$unset"])
+	assert.False(t, validSessions.valid("session-1", id.Hex(), time.Now()))
+}
+
+func TestBatchUsers_Anonymous(t *testing.T) {
+	for _, handler := range []http.HandlerFunc{BatchCreateUsers, BatchUpdateUsers, BatchDeleteUsers} {
+		mockCollection := new(MockCollection)
+		defer SetupMockCollection(mockCollection)()
+
+		rr, _ := serveBatch(handler, "/v1/users:batch", `{"items": [{"name": "John"}], "ids": ["66f0c2a1e4b0a1b2c3d4e5f6"]}`)
+
+		assert.Equal(t, http.StatusUnauthorized, rr.Code)
+		mockCollection.AssertNotCalled(t, "InsertMany", mock.Anything, mock.Anything)
+		mockCollection.AssertNotCalled(t, "BulkWrite", mock.Anything, mock.Anything)
+	}
+}
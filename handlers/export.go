@@ -0,0 +1,257 @@
+package handlers
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/lep13/golang-restful-api/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// exportFlushEvery is the number of users written between flushes to the client
+const exportFlushEvery = 100
+
+// exportFormat is an output format of ExportUsers
+type exportFormat struct {
+	name        string
+	contentType string
+	mediaTypes  []string
+	newWriter   func(w io.Writer) userWriter
+}
+
+// userWriter encodes users one at a time; flush pushes buffered output to the
+// underlying writer
+type userWriter interface {
+	write(user models.User) error
+	flush() error
+}
+
+var exportFormats = []exportFormat{
+	{
+		name:        "ndjson",
+		contentType: "application/x-ndjson",
+		mediaTypes:  []string{"application/x-ndjson", "application/ndjson", "application/jsonl"},
+		newWriter:   newNDJSONWriter,
+	},
+	{
+		name:        "csv",
+		contentType: "text/csv; charset=utf-8",
+		mediaTypes:  []string{"text/csv"},
+		newWriter:   newCSVWriter,
+	},
+}
+
+// ExportUsers streams the users matching the list filters as NDJSON or CSV,
+// chosen by the format query parameter or else the Accept header. Users are
+// written straight from the cursor, so memory use does not grow with the
+// collection, and the cursor is closed as soon as the client disconnects.
+// Passwords are excluded by the query and never reach the response. Only
+// admins may export users.
+func ExportUsers(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireAdmin(w, r); !ok {
+		return
+	}
+	format, ok := negotiateExportFormat(w, r)
+	if !ok {
+		return
+	}
+	filter, ok := listFilter(w, r.URL.Query())
+	if !ok {
+		return
+	}
+
+	findCtx, cancel := dbContext(r)
+	defer cancel()
+	findOptions := options.Find().
+		SetSort(bson.D{{Key: "_id", Value: 1}}).
+		SetProjection(bson.M{"password": 0})
+	cur, err := mongoCollection.Find(findCtx, filter, findOptions)
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	// Close with a fresh context so the server-side cursor is killed even after cancellation
+	defer cur.Close(context.Background())
+
+	w.Header().Set("Content-Type", format.contentType)
+	w.Header().Set("Content-Disposition", `attachment; filename="users.`+format.name+`"`)
+	controller := http.NewResponseController(w)
+	writer := format.newWriter(w)
+
+	// The export lasts as long as the client keeps reading, so the cursor is
+	// bound to the request rather than to the per-operation timeout
+	ctx := r.Context()
+	written := 0
+	for ctx.Err() == nil && cur.Next(ctx) {
+		var user models.User
+		if err := cur.Decode(&user); err != nil {
+			log.Println("Failed to decode user:", err)
+			continue
+		}
+		user.Password = ""
+		if err := writer.write(user); err != nil {
+			log.Println("Export aborted while writing:", err)
+			return
+		}
+		written++
+		if written%exportFlushEvery == 0 {
+			if err := writer.flush(); err != nil {
+				log.Println("Export aborted while flushing:", err)
+				return
+			}
+			// Flushing is best effort; some wrappers cannot flush
+			_ = controller.Flush()
+		}
+	}
+	if ctx.Err() != nil {
+		log.Printf("Client went away after %d exported users: %v", written, ctx.Err())
+		return
+	}
+	if err := cur.Err(); err != nil {
+		// The status line is already sent, so the truncated export is only logged
+		log.Printf("Export failed after %d users: %v", written, err)
+		return
+	}
+	if err := writer.flush(); err != nil {
+		log.Println("Failed to flush export:", err)
+	}
+}
+
+// negotiateExportFormat picks the format from the format query parameter or
+// the Accept header, defaulting to NDJSON. It writes 400 for an unknown format
+// parameter and 406 when the Accept header allows none of the formats.
+func negotiateExportFormat(w http.ResponseWriter, r *http.Request) (exportFormat, bool) {
+	if name := r.URL.Query().Get("format"); name != "" {
+		for _, format := range exportFormats {
+			if format.name == name {
+				return format, true
+			}
+		}
+		writeError(w, "Invalid format", http.StatusBadRequest)
+		return exportFormat{}, false
+	}
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return exportFormats[0], true
+	}
+	for _, mediaRange := range acceptedMediaRanges(accept) {
+		for _, format := range exportFormats {
+			for _, mediaType := range format.mediaTypes {
+				if matchesMediaRange(mediaRange, mediaType) {
+					return format, true
+				}
+			}
+		}
+	}
+	writeError(w, "Export is available as application/x-ndjson or text/csv", http.StatusNotAcceptable)
+	return exportFormat{}, false
+}
+
+// acceptedMediaRanges returns the media ranges of an Accept header ordered by
+// preference, dropping those with q=0
+func acceptedMediaRanges(accept string) []string {
+	type weighted struct {
+		mediaRange string
+		q          float64
+	}
+	var ranges []weighted
+	for _, part := range strings.Split(accept, ",") {
+		mediaRange, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if raw, ok := params["q"]; ok {
+			if parsed, err := strconv.ParseFloat(raw, 64); err == nil {
+				q = parsed
+			}
+		}
+		if q > 0 {
+			ranges = append(ranges, weighted{mediaRange, q})
+		}
+	}
+	sort.SliceStable(ranges, func(i, j int) bool { return ranges[i].q > ranges[j].q })
+	result := make([]string, len(ranges))
+	for i, r := range ranges {
+		result[i] = r.mediaRange
+	}
+	return result
+}
+
+func matchesMediaRange(mediaRange, mediaType string) bool {
+	if mediaRange == "*/*" || mediaRange == mediaType {
+		return true
+	}
+	prefix, ok := strings.CutSuffix(mediaRange, "/*")
+	return ok && strings.HasPrefix(mediaType, prefix+"/")
+}
+
+type ndjsonWriter struct {
+	encoder *json.Encoder
+}
+
+func newNDJSONWriter(w io.Writer) userWriter {
+	return &ndjsonWriter{encoder: json.NewEncoder(w)}
+}
+
+func (n *ndjsonWriter) write(user models.User) error {
+	return n.encoder.Encode(user)
+}
+
+func (n *ndjsonWriter) flush() error {
+	return nil
+}
+
+// csvColumns are the exported fields, in order; passwords are never exported
+var csvColumns = []string{"_id", "name", "email"}
+
+type csvWriter struct {
+	writer        *csv.Writer
+	headerWritten bool
+}
+
+func newCSVWriter(w io.Writer) userWriter {
+	return &csvWriter{writer: csv.NewWriter(w)}
+}
+
+func (c *csvWriter) write(user models.User) error {
+	if err := c.writeHeader(); err != nil {
+		return err
+	}
+	return c.writer.Write([]string{user.ID.Hex(), csvSafe(user.Name), csvSafe(user.Email)})
+}
+
+func (c *csvWriter) flush() error {
+	// An empty export still gets its header row
+	if err := c.writeHeader(); err != nil {
+		return err
+	}
+	c.writer.Flush()
+	return c.writer.Error()
+}
+
+func (c *csvWriter) writeHeader() error {
+	if c.headerWritten {
+		return nil
+	}
+	c.headerWritten = true
+	return c.writer.Write(csvColumns)
+}
+
+// csvSafe prefixes values that spreadsheets would evaluate as formulas with a
+// single quote (CSV injection)
+func csvSafe(value string) string {
+	if value != "" && strings.ContainsAny(value[:1], "=+-@\t\r") {
+		return "'" + value
+	}
+	return value
+}
@@ -0,0 +1,171 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/lep13/golang-restful-api/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func usersCursor(users ...models.User) *mongo.Cursor {
+	docs := make([]interface{}, len(users))
+	for i, user := range users {
+		docs[i] = user
+	}
+	cursor, _ := mongo.NewCursorFromDocuments(docs, nil, nil)
+	return cursor
+}
+
+func TestExportUsers_NDJSON(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	john := models.User{ID: primitive.NewObjectID(), Name: "John Doe", Email: "john@example.com", Password: "secret"}
+	jane := models.User{ID: primitive.NewObjectID(), Name: "Jane Doe"}
+	mockCollection.On("Find", mock.Anything, bson.M{}).Return(usersCursor(john, jane), nil)
+
+	req, _ := http.NewRequest("GET", "/v1/users/export", nil)
+	rr := httptest.NewRecorder()
+	req = asAdmin(mockCollection)(req)
+	http.HandlerFunc(ExportUsers).ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "application/x-ndjson", rr.Header().Get("Content-Type"))
+	assert.Equal(t, `attachment; filename="users.ndjson"`, rr.Header().Get("Content-Disposition"))
+	lines := strings.Split(strings.TrimSpace(rr.Body.String()), "\n")
+	assert.Equal(t, []string{
+		fmt.Sprintf(`{"_id":"%s","name":"John Doe","email":"john@example.com"}`, john.ID.Hex()),
+		fmt.Sprintf(`{"_id":"%s","name":"Jane Doe"}`, jane.ID.Hex()),
+	}, lines)
+	assert.NotContains(t, rr.Body.String(), "secret")
+}
+
+func TestExportUsers_CSV(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	john := models.User{ID: primitive.NewObjectID(), Name: "Doe, John", Email: "john@example.com", Password: "secret"}
+	mallory := models.User{ID: primitive.NewObjectID(), Name: "=HYPERLINK(\"http://evil\")"}
+	mockCollection.On("Find", mock.Anything, mock.Anything).Return(usersCursor(john, mallory), nil)
+
+	req, _ := http.NewRequest("GET", "/v1/users/export", nil)
+	req.Header.Set("Accept", "application/json;q=0.5, text/csv")
+	rr := httptest.NewRecorder()
+	req = asAdmin(mockCollection)(req)
+	http.HandlerFunc(ExportUsers).ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "text/csv; charset=utf-8", rr.Header().Get("Content-Type"))
+	assert.Equal(t, "_id,name,email\n"+
+		john.ID.Hex()+",\"Doe, John\",john@example.com\n"+
+		mallory.ID.Hex()+",\"'=HYPERLINK(\"\"http://evil\"\")\",\n", rr.Body.String())
+}
+
+func TestExportUsers_EmptyCSVHasHeader(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	mockCollection.On("Find", mock.Anything, mock.Anything).Return(usersCursor(), nil)
+
+	req, _ := http.NewRequest("GET", "/v1/users/export?format=csv", nil)
+	req.Header.Set("Accept", "application/x-ndjson")
+	rr := httptest.NewRecorder()
+	req = asAdmin(mockCollection)(req)
+	http.HandlerFunc(ExportUsers).ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "_id,name,email\n", rr.Body.String())
+}
+
+func TestExportUsers_Flushes(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	users := make([]models.User, exportFlushEvery+1)
+	for i := range users {
+		users[i] = models.User{ID: primitive.NewObjectID(), Name: "User"}
+	}
+	mockCollection.On("Find", mock.Anything, mock.Anything).Return(usersCursor(users...), nil)
+
+	req, _ := http.NewRequest("GET", "/v1/users/export", nil)
+	rr := httptest.NewRecorder()
+	req = asAdmin(mockCollection)(req)
+	http.HandlerFunc(ExportUsers).ServeHTTP(rr, req)
+
+	assert.True(t, rr.Flushed)
+	assert.Equal(t, exportFlushEvery+1, strings.Count(rr.Body.String(), "\n"))
+}
+
+func TestExportUsers_UsesListFilters(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	after := primitive.NewObjectID()
+	mockCollection.On("Find", mock.Anything, bson.M{"_id": bson.M{"$gt": after}}).Return(usersCursor(), nil)
+
+	req, _ := http.NewRequest("GET", "/v1/users/export?cursor="+after.Hex(), nil)
+	rr := httptest.NewRecorder()
+	req = asAdmin(mockCollection)(req)
+	http.HandlerFunc(ExportUsers).ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	mockCollection.AssertExpectations(t)
+}
+
+func TestExportUsers_InvalidRequests(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+
+	for _, tc := range []struct {
+		url, accept string
+		status      int
+	}{
+		{"/v1/users/export?format=xml", "", http.StatusBadRequest},
+		{"/v1/users/export?cursor=nope", "", http.StatusBadRequest},
+		{"/v1/users/export", "application/xml", http.StatusNotAcceptable},
+		{"/v1/users/export", "text/csv;q=0", http.StatusNotAcceptable},
+	} {
+		req, _ := http.NewRequest("GET", tc.url, nil)
+		req.Header.Set("Accept", tc.accept)
+		rr := httptest.NewRecorder()
+		req = asAdmin(mockCollection)(req)
+		http.HandlerFunc(ExportUsers).ServeHTTP(rr, req)
+
+		assert.Equal(t, tc.status, rr.Code, tc.url+" "+tc.accept)
+		assert.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+	}
+	mockCollection.AssertNotCalled(t, "Find", mock.Anything, mock.Anything)
+}
+
+func TestExportUsers_FindFailure(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	mockCollection.On("Find", mock.Anything, mock.Anything).Return(nil, errors.New("find failed"))
+
+	req, _ := http.NewRequest("GET", "/v1/users/export", nil)
+	rr := httptest.NewRecorder()
+	req = asAdmin(mockCollection)(req)
+	http.HandlerFunc(ExportUsers).ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusInternalServerError, rr.Code)
+}
+
+func TestExportUsers_ClientGone(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	mockCollection.On("Find", mock.Anything, mock.Anything).Return(usersCursor(models.User{ID: primitive.NewObjectID(), Name: "John Doe"}), nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", "/v1/users/export", nil)
+	rr := httptest.NewRecorder()
+	req = asAdmin(mockCollection)(req)
+	http.HandlerFunc(ExportUsers).ServeHTTP(rr, req)
+
+	assert.Empty(t, rr.Body.String())
+}
@@ -0,0 +1,706 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lep13/golang-restful-api/audit"
+	"github.com/lep13/golang-restful-api/config"
+	"github.com/lep13/golang-restful-api/jwt"
+	"github.com/lep13/golang-restful-api/middleware"
+	"github.com/lep13/golang-restful-api/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	// oidcStatePurpose marks the state of sign-ins at upstream providers
+	oidcStatePurpose = "oidc_state"
+	// oidcLoginTTL is how long a user has to sign in at the provider
+	oidcLoginTTL = 10 * time.Minute
+	// oidcBindingCookie binds a sign-in to the browser that started it
+	oidcBindingCookie = "oidc_binding"
+	// oidcMetadataTTL is how long discovery documents and keys are cached
+	oidcMetadataTTL = time.Hour
+	// oidcKeyRefreshInterval is the least time between two fetches of the
+	// keys of a provider prompted by an unknown key ID
+	oidcKeyRefreshInterval = time.Minute
+	// maxOIDCResponseBytes bounds the documents read from providers
+	maxOIDCResponseBytes = 1 << 20
+	// maxIdentities is the number of identities a user may link
+	maxIdentities = 10
+	// maxProviderErrorLength truncates the error codes providers redirect with
+	maxProviderErrorLength = 64
+)
+
+var (
+	// errProviderUnavailable is returned when a provider cannot be reached or
+	// answers with something other than what the protocol expects
+	errProviderUnavailable = errors.New("identity provider unavailable")
+	// errCodeRejected is returned when the provider refuses the code
+	errCodeRejected = errors.New("identity provider rejected the code")
+	// errInvalidIDToken is returned for ID tokens that do not verify
+	errInvalidIDToken = errors.New("invalid ID token")
+)
+
+var (
+	oidcProviders = map[string]*oidcProvider{}
+	// oidcProviderNames keeps the configured order of oidcProviders
+	oidcProviderNames []string
+	// oidcHTTPClient calls the providers
+	oidcHTTPClient = &http.Client{Timeout: 10 * time.Second}
+)
+
+// oidcProvider is an upstream OpenID Connect provider with its discovery
+// document and keys, fetched on first use and cached
+type oidcProvider struct {
+	config.OIDCProviderConfig
+
+	mu            sync.Mutex
+	metadata      *oidcMetadata
+	fetchedAt     time.Time
+	keys          map[string]*rsa.PublicKey
+	keysFetchedAt time.Time
+}
+
+// oidcMetadata is the part of a provider's discovery document the API uses
+type oidcMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// SetOIDCProviders sets the upstream OpenID Connect providers users may sign
+// in with. Their discovery documents are fetched on first use, so a provider
+// that is down does not stop the API from starting. Call it after SetOAuth,
+// whose issuer the default redirect URLs are built on.
+func SetOIDCProviders(providers []config.OIDCProviderConfig) error {
+	configured := make(map[string]*oidcProvider, len(providers))
+	names := make([]string, 0, len(providers))
+	for _, provider := range providers {
+		if _, ok := configured[provider.Name]; ok {
+			return fmt.Errorf("provider %q is configured twice", provider.Name)
+		}
+		// Issuers follow the rules of redirect URIs: HTTPS, or HTTP on the
+		// loopback interface
+		if !validRedirectURI(provider.Issuer) {
+			return fmt.Errorf("provider %q: invalid issuer %q", provider.Name, provider.Issuer)
+		}
+		if provider.RedirectURL != "" && !validRedirectURI(provider.RedirectURL) {
+			return fmt.Errorf("provider %q: invalid redirect URL %q", provider.Name, provider.RedirectURL)
+		}
+		// The default redirect URL is built on the issuer, set by SetOAuth
+		if provider.RedirectURL == "" && oauthIssuer == "" {
+			return fmt.Errorf("provider %q: a redirect URL is required without an OAuth issuer", provider.Name)
+		}
+		if !containsString(provider.Scopes, ScopeOpenID) {
+			provider.Scopes = append([]string{ScopeOpenID}, provider.Scopes...)
+		}
+		configured[provider.Name] = &oidcProvider{OIDCProviderConfig: provider}
+		names = append(names, provider.Name)
+	}
+	oidcProviders, oidcProviderNames = configured, names
+	return nil
+}
+
+// discover returns the discovery document of the provider
+func (p *oidcProvider) discover(ctx context.Context) (*oidcMetadata, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.metadata != nil && time.Since(p.fetchedAt) < oidcMetadataTTL {
+		return p.metadata, nil
+	}
+	var metadata oidcMetadata
+	if err := fetchJSON(ctx, strings.TrimSuffix(p.Issuer, "/")+"/.well-known/openid-configuration", &metadata); err != nil {
+		return nil, err
+	}
+	// The document must name the issuer it was fetched from (OpenID Connect
+	// Discovery, section 4.3)
+	switch {
+	case metadata.Issuer != p.Issuer:
+		return nil, fmt.Errorf("%w: discovery document names issuer %q", errProviderUnavailable, metadata.Issuer)
+	case !validRedirectURI(metadata.AuthorizationEndpoint), !validRedirectURI(metadata.TokenEndpoint), !validRedirectURI(metadata.JWKSURI):
+		return nil, fmt.Errorf("%w: discovery document lacks valid endpoints", errProviderUnavailable)
+	}
+	p.metadata, p.fetchedAt = &metadata, time.Now()
+	return p.metadata, nil
+}
+
+// key returns the key of the provider with the key ID kid. The keys are
+// fetched again when kid is unknown, as after a key rotation, but at most
+// once per oidcKeyRefreshInterval.
+func (p *oidcProvider) key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	metadata, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	age := time.Since(p.keysFetchedAt)
+	if key, ok := p.lookupKey(kid); ok && age < oidcMetadataTTL {
+		return key, nil
+	}
+	if p.keys != nil && age < oidcKeyRefreshInterval {
+		return nil, fmt.Errorf("%w: unknown key %q", errInvalidIDToken, kid)
+	}
+	var set jwt.JWKSet
+	if err := fetchJSON(ctx, metadata.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]*rsa.PublicKey, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if jwk.KeyType != "RSA" || (jwk.Use != "" && jwk.Use != "sig") {
+			continue
+		}
+		if key, err := jwk.PublicKey(); err == nil {
+			keys[jwk.KeyID] = key
+		}
+	}
+	p.keys, p.keysFetchedAt = keys, time.Now()
+	if key, ok := p.lookupKey(kid); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("%w: unknown key %q", errInvalidIDToken, kid)
+}
+
+// lookupKey finds a cached key by ID. Tokens without a key ID are accepted
+// from providers with a single key.
+func (p *oidcProvider) lookupKey(kid string) (*rsa.PublicKey, bool) {
+	if kid == "" && len(p.keys) == 1 {
+		for _, key := range p.keys {
+			return key, true
+		}
+	}
+	key, ok := p.keys[kid]
+	return key, ok
+}
+
+// fetchJSON reads a JSON document from a provider
+func fetchJSON(ctx context.Context, uri string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", uri, nil)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errProviderUnavailable, err)
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := oidcHTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errProviderUnavailable, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: GET %s: %s", errProviderUnavailable, uri, resp.Status)
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxOIDCResponseBytes)).Decode(v); err != nil {
+		return fmt.Errorf("%w: GET %s: %v", errProviderUnavailable, uri, err)
+	}
+	return nil
+}
+
+// redirectURI is where the provider sends the user back with a code
+func (p *oidcProvider) redirectURI() string {
+	if p.RedirectURL != "" {
+		return p.RedirectURL
+	}
+	return issuerURL() + "/v1/auth/oidc/" + p.Name + "/callback"
+}
+
+// cookiePath limits the binding cookie to the sign-in routes of the provider
+func (p *oidcProvider) cookiePath() string {
+	return "/v1/auth/oidc/" + p.Name + "/"
+}
+
+// oidcState is the state passed through the provider during a sign-in,
+// signed like the login tokens
+type oidcState struct {
+	jwt.Claims
+	Purpose  string `json:"purpose"`
+	Provider string `json:"provider"`
+	Nonce    string `json:"nonce"`
+	// Binding is the hash of the value of the binding cookie
+	Binding string `json:"binding"`
+}
+
+// pkceVerifier derives the PKCE code verifier of a sign-in from its binding
+// cookie, so the verifier is never exposed in a URL nor stored
+func pkceVerifier(binding string) string {
+	sum := sha256.Sum256([]byte("pkce:" + binding))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// upstreamClaims are the claims read from the ID tokens of providers
+type upstreamClaims struct {
+	jwt.Claims
+	Nonce           string `json:"nonce"`
+	AuthorizedParty string `json:"azp"`
+	Name            string `json:"name"`
+	Email           string `json:"email"`
+	// EmailVerified is a boolean, or the string "true" for some providers
+	EmailVerified json.RawMessage `json:"email_verified"`
+}
+
+func (c upstreamClaims) emailVerified() bool {
+	value := string(c.EmailVerified)
+	return value == "true" || value == `"true"`
+}
+
+// OIDCProvider describes an upstream provider users may sign in with
+type OIDCProvider struct {
+	Name   string `json:"name"`
+	Issuer string `json:"issuer"`
+}
+
+// OIDCAuthorization is where to send the user to sign in at a provider
+type OIDCAuthorization struct {
+	AuthorizationURL string `json:"authorization_url"`
+}
+
+// Identity describes an account at an upstream provider linked to a user
+type Identity struct {
+	ID       primitive.ObjectID `json:"id"`
+	Provider string             `json:"provider"`
+	Issuer   string             `json:"issuer"`
+	Subject  string             `json:"subject"`
+	Email    string             `json:"email,omitempty"`
+	LinkedAt time.Time          `json:"linked_at"`
+	// LastLoginAt is omitted when the identity was never used since linking
+	LastLoginAt *time.Time `json:"last_login_at,omitempty"`
+}
+
+func identityInfo(identity models.Identity) Identity {
+	info := Identity{
+		ID:       identity.ID,
+		Provider: identity.Provider,
+		Issuer:   identity.Issuer,
+		Subject:  identity.Subject,
+		Email:    identity.Email,
+		LinkedAt: identity.LinkedAt,
+	}
+	if !identity.LastLoginAt.IsZero() {
+		info.LastLoginAt = &identity.LastLoginAt
+	}
+	return info
+}
+
+// ListOIDCProviders lists the upstream providers users may sign in with
+func ListOIDCProviders(w http.ResponseWriter, r *http.Request) {
+	providers := make([]OIDCProvider, 0, len(oidcProviderNames))
+	for _, name := range oidcProviderNames {
+		providers = append(providers, OIDCProvider{Name: name, Issuer: oidcProviders[name].Issuer})
+	}
+	writeJSON(w, providers)
+}
+
+// oidcProviderFor returns the provider named in the request path, writing
+// 404 when it is not configured
+func oidcProviderFor(w http.ResponseWriter, r *http.Request) (*oidcProvider, bool) {
+	provider, ok := oidcProviders[mux.Vars(r)["provider"]]
+	if !ok {
+		writeError(w, "Unknown identity provider", http.StatusNotFound)
+	}
+	return provider, ok
+}
+
+// StartOIDCLogin starts a sign-in at an upstream provider with the
+// authorization code flow and PKCE, returning the URL to send the user to.
+// The sign-in is bound to the browser by a cookie, which OIDCCallback
+// requires, so a code cannot be replayed into another browser.
+func StartOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	provider, ok := oidcProviderFor(w, r)
+	if !ok {
+		return
+	}
+	metadata, err := provider.discover(r.Context())
+	if err != nil {
+		log.Printf("OIDC provider %s: %v", provider.Name, err)
+		writeError(w, "Identity provider unavailable", http.StatusBadGateway)
+		return
+	}
+	binding, bindingHash, err := newToken()
+	if err != nil {
+		writeError(w, "Failed to start sign-in", http.StatusInternalServerError)
+		return
+	}
+	nonce, _, err := newToken()
+	if err != nil {
+		writeError(w, "Failed to start sign-in", http.StatusInternalServerError)
+		return
+	}
+	now := time.Now()
+	state, err := tokenSigner.Sign(oidcState{
+		Claims:   jwt.Claims{IssuedAt: now.Unix(), ExpiresAt: now.Add(oidcLoginTTL).Unix()},
+		Purpose:  oidcStatePurpose,
+		Provider: provider.Name,
+		Nonce:    nonce,
+		Binding:  bindingHash,
+	})
+	if err != nil {
+		writeError(w, "Failed to start sign-in", http.StatusInternalServerError)
+		return
+	}
+	redirectURI := provider.redirectURI()
+	challenge := sha256.Sum256([]byte(pkceVerifier(binding)))
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcBindingCookie,
+		Value:    binding,
+		Path:     provider.cookiePath(),
+		MaxAge:   int(oidcLoginTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil || strings.HasPrefix(redirectURI, "https://"),
+		// Lax lets the cookie follow the redirect back from the provider
+		SameSite: http.SameSiteLaxMode,
+	})
+	writeJSON(w, OIDCAuthorization{AuthorizationURL: withQuery(metadata.AuthorizationEndpoint, url.Values{
+		"response_type":         {"code"},
+		"client_id":             {provider.ClientID},
+		"redirect_uri":          {redirectURI},
+		"scope":                 {strings.Join(provider.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	})})
+}
+
+// OIDCCallback completes a sign-in at an upstream provider. It exchanges the
+// code for an ID token, verifies the token with the provider's keys and
+// signs in the user linked to the identity. An identity seen for the first
+// time is linked to the user with its email, which the provider must have
+// verified, or provisions a new user when the provider allows it. The
+// response is that of Login: an access token, or an MFA challenge for users
+// with MFA.
+func OIDCCallback(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	provider, ok := oidcProviderFor(w, r)
+	if !ok {
+		return
+	}
+	// The binding cookie is good for one attempt
+	http.SetCookie(w, &http.Cookie{Name: oidcBindingCookie, Path: provider.cookiePath(), MaxAge: -1, HttpOnly: true})
+	query := r.URL.Query()
+	if code := query.Get("error"); code != "" {
+		if len(code) > maxProviderErrorLength {
+			code = code[:maxProviderErrorLength]
+		}
+		writeError(w, "Sign-in failed at the identity provider: "+code, http.StatusUnauthorized)
+		return
+	}
+	var state oidcState
+	if err := tokenSigner.Verify(query.Get("state"), &state); err != nil ||
+		state.Valid(time.Now()) != nil || state.Purpose != oidcStatePurpose || state.Provider != provider.Name {
+		writeError(w, "Invalid or expired sign-in state", http.StatusBadRequest)
+		return
+	}
+	cookie, err := r.Cookie(oidcBindingCookie)
+	if err != nil || subtle.ConstantTimeCompare([]byte(hashToken(cookie.Value)), []byte(state.Binding)) != 1 {
+		writeError(w, "Sign-in was started in another browser", http.StatusBadRequest)
+		return
+	}
+	code := query.Get("code")
+	if code == "" {
+		writeError(w, "Code is required", http.StatusBadRequest)
+		return
+	}
+
+	claims, err := provider.exchange(r.Context(), code, provider.redirectURI(), pkceVerifier(cookie.Value))
+	if err == nil && subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(state.Nonce)) != 1 {
+		err = fmt.Errorf("%w: nonce mismatch", errInvalidIDToken)
+	}
+	if err != nil {
+		log.Printf("OIDC provider %s: %v", provider.Name, err)
+		switch {
+		case errors.Is(err, errCodeRejected):
+			writeError(w, "The identity provider rejected the code", http.StatusUnauthorized)
+		case errors.Is(err, errInvalidIDToken):
+			writeError(w, "Invalid ID token", http.StatusUnauthorized)
+		default:
+			writeError(w, "Identity provider unavailable", http.StatusBadGateway)
+		}
+		return
+	}
+
+	ctx, cancel := dbContext(r)
+	defer cancel()
+	user, ok := federatedUser(ctx, w, r, provider, claims)
+	if !ok {
+		return
+	}
+	if user.MFA != nil && user.MFA.Enabled {
+		writeMFAChallenge(w, user.ID, []string{"fed"})
+		return
+	}
+	writeAccessToken(ctx, w, r, user.ID, []string{"fed"})
+}
+
+// exchange redeems a code at the token endpoint of the provider and returns
+// the claims of the verified ID token
+func (p *oidcProvider) exchange(ctx context.Context, code, redirectURI, verifier string) (upstreamClaims, error) {
+	var claims upstreamClaims
+	metadata, err := p.discover(ctx)
+	if err != nil {
+		return claims, err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {redirectURI},
+		"code_verifier": {verifier},
+	}
+	if p.ClientSecret == "" {
+		form.Set("client_id", p.ClientID)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", metadata.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return claims, fmt.Errorf("%w: %v", errProviderUnavailable, err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.ClientSecret != "" {
+		// client_secret_basic encodes the credentials first (RFC 6749, section 2.3.1)
+		req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	}
+	resp, err := oidcHTTPClient.Do(req)
+	if err != nil {
+		return claims, fmt.Errorf("%w: %v", errProviderUnavailable, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxOIDCResponseBytes))
+	switch {
+	case err != nil:
+		return claims, fmt.Errorf("%w: %v", errProviderUnavailable, err)
+	case resp.StatusCode >= http.StatusInternalServerError:
+		return claims, fmt.Errorf("%w: token endpoint: %s", errProviderUnavailable, resp.Status)
+	case resp.StatusCode != http.StatusOK:
+		return claims, fmt.Errorf("%w: %s %s", errCodeRejected, resp.Status, body)
+	}
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.Unmarshal(body, &tokens); err != nil {
+		return claims, fmt.Errorf("%w: token endpoint: %v", errProviderUnavailable, err)
+	}
+	return p.verifyIDToken(ctx, tokens.IDToken, time.Now())
+}
+
+// verifyIDToken checks the signature of an ID token with the keys of the
+// provider and its claims (OpenID Connect Core, section 3.1.3.7). The nonce
+// is left to the caller.
+func (p *oidcProvider) verifyIDToken(ctx context.Context, token string, now time.Time) (upstreamClaims, error) {
+	var claims upstreamClaims
+	header, err := jwt.ParseHeader(token)
+	if err != nil {
+		return claims, fmt.Errorf("%w: malformed", errInvalidIDToken)
+	}
+	if header.Algorithm != "RS256" {
+		return claims, fmt.Errorf("%w: unsupported algorithm %q", errInvalidIDToken, header.Algorithm)
+	}
+	key, err := p.key(ctx, header.KeyID)
+	if err != nil {
+		return claims, err
+	}
+	if err := jwt.VerifyRS256(token, key, &claims); err != nil {
+		return claims, fmt.Errorf("%w: bad signature", errInvalidIDToken)
+	}
+	switch {
+	case claims.Issuer != p.Issuer:
+		return claims, fmt.Errorf("%w: issuer %q", errInvalidIDToken, claims.Issuer)
+	case !claims.Audience.Contains(p.ClientID):
+		return claims, fmt.Errorf("%w: audience %q", errInvalidIDToken, claims.Audience)
+	case len(claims.Audience) > 1 && claims.AuthorizedParty != p.ClientID:
+		return claims, fmt.Errorf("%w: authorized party %q", errInvalidIDToken, claims.AuthorizedParty)
+	case claims.ExpiresAt == 0 || claims.Valid(now) != nil:
+		return claims, fmt.Errorf("%w: expired", errInvalidIDToken)
+	case claims.Subject == "":
+		return claims, fmt.Errorf("%w: no subject", errInvalidIDToken)
+	}
+	return claims, nil
+}
+
+// federatedUser returns the user linked to the identity of claims, linking it
+// to the user with its verified email or provisioning a user when it is new.
+// It writes the error response when there is no such user.
+func federatedUser(ctx context.Context, w http.ResponseWriter, r *http.Request, provider *oidcProvider, claims upstreamClaims) (models.User, bool) {
+	var user models.User
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	linked := bson.M{"$elemMatch": bson.M{"issuer": provider.Issuer, "subject": claims.Subject}}
+	err := mongoCollection.FindOne(ctx, bson.M{"identities": linked}).Decode(&user)
+	if err == nil {
+		if rejectDeactivated(w, user) {
+			return user, false
+		}
+		// Recording the sign-in is best effort
+		if _, err := mongoCollection.UpdateOne(ctx,
+			bson.M{"_id": user.ID, "identities": linked},
+			bson.M{"$set": bson.M{"identities.$.last_login_at": now}}); err != nil {
+			log.Printf("Failed to record the sign-in of user %s: %v", user.ID.Hex(), err)
+		}
+		return user, true
+	}
+	if err != mongo.ErrNoDocuments {
+		writeDBError(w, err)
+		return user, false
+	}
+
+	if claims.Email == "" || !claims.emailVerified() {
+		writeError(w, "The identity provider did not supply a verified email", http.StatusForbidden)
+		return user, false
+	}
+	identity := models.Identity{
+		ID:          primitive.NewObjectID(),
+		Provider:    provider.Name,
+		Issuer:      provider.Issuer,
+		Subject:     claims.Subject,
+		Email:       claims.Email,
+		LinkedAt:    now,
+		LastLoginAt: now,
+	}
+	details := map[string]string{"provider": provider.Name, "identity_id": identity.ID.Hex(), "subject": claims.Subject}
+	email := normalizeEmail(claims.Email)
+	err = mongoCollection.FindOne(ctx, bson.M{"email": email}).Decode(&user)
+	switch {
+	case err == nil:
+		if rejectDeactivated(w, user) {
+			return user, false
+		}
+		// An unverified email may have been claimed by someone else, who
+		// would get the account of whoever signs in with it
+		if !user.EmailVerified {
+			writeError(w, "An account uses this email but has not verified it; verify the email to sign in with the identity provider", http.StatusConflict)
+			return user, false
+		}
+		// Matching on the email and the number of identities makes the
+		// checks and the link atomic
+		res, err := mongoCollection.UpdateOne(ctx, bson.M{
+			"_id":            user.ID,
+			"email":          email,
+			"email_verified": true,
+			fmt.Sprintf("identities.%d", maxIdentities-1): bson.M{"$exists": false},
+		}, bson.M{"$push": bson.M{"identities": identity}})
+		if mongo.IsDuplicateKeyError(err) {
+			writeError(w, "The identity is already linked to a user", http.StatusConflict)
+			return user, false
+		}
+		if err != nil {
+			writeDBError(w, err)
+			return user, false
+		}
+		if res.MatchedCount == 0 {
+			writeError(w, fmt.Sprintf("A user may link at most %d identities", maxIdentities), http.StatusConflict)
+			return user, false
+		}
+		recordAudit(audit.IdentityLinked, user.ID.Hex(), clientIP(r), details)
+	case err == mongo.ErrNoDocuments:
+		if !provider.Provision {
+			writeError(w, "No account uses this email", http.StatusForbidden)
+			return user, false
+		}
+		name := strings.TrimSpace(claims.Name)
+		if name == "" {
+			name = claims.Email
+		}
+		user = models.User{
+			ID:            primitive.NewObjectID(),
+			Name:          name,
+			Email:         email,
+			EmailVerified: true,
+			Identities:    []models.Identity{identity},
+		}
+		if _, err := mongoCollection.InsertOne(ctx, user); err != nil {
+			if mongo.IsDuplicateKeyError(err) {
+				writeError(w, "The identity is already linked to a user", http.StatusConflict)
+			} else {
+				writeDBError(w, err)
+			}
+			return user, false
+		}
+		recordAudit(audit.UserProvisioned, user.ID.Hex(), clientIP(r), details)
+	default:
+		writeDBError(w, err)
+		return user, false
+	}
+	return user, true
+}
+
+// ListIdentities lists the identities linked to the user. Users may list
+// their own identities, and admins those of any user.
+func ListIdentities(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, "Invalid ID format", http.StatusBadRequest)
+		return
+	}
+	if !requireSelfOrAdmin(w, r, id) {
+		return
+	}
+
+	ctx, cancel := dbContext(r)
+	defer cancel()
+	var user models.User
+	if err := mongoCollection.FindOne(ctx, bson.M{"_id": id}).Decode(&user); err != nil {
+		if err == mongo.ErrNoDocuments {
+			writeError(w, "User not found", http.StatusNotFound)
+		} else {
+			writeDBError(w, err)
+		}
+		return
+	}
+	identities := make([]Identity, 0, len(user.Identities))
+	for _, identity := range user.Identities {
+		identities = append(identities, identityInfo(identity))
+	}
+	writeJSON(w, identities)
+}
+
+// UnlinkIdentity unlinks an identity from the user; signing in with it again
+// links it anew by email. Users may unlink their own identities, and admins
+// those of any user. Sessions started with the identity are left alone.
+func UnlinkIdentity(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, "Invalid ID format", http.StatusBadRequest)
+		return
+	}
+	identityID, err := primitive.ObjectIDFromHex(mux.Vars(r)["identity_id"])
+	if err != nil {
+		writeError(w, "Invalid identity ID format", http.StatusBadRequest)
+		return
+	}
+	if !requireSelfOrAdmin(w, r, id) {
+		return
+	}
+
+	ctx, cancel := dbContext(r)
+	defer cancel()
+	res, err := mongoCollection.UpdateOne(ctx,
+		bson.M{"_id": id, "identities._id": identityID},
+		bson.M{"$pull": bson.M{"identities": bson.M{"_id": identityID}}})
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if res.MatchedCount == 0 {
+		writeError(w, "Identity not found", http.StatusNotFound)
+		return
+	}
+	callerID, _ := middleware.UserIDFromContext(r.Context())
+	recordAudit(audit.IdentityUnlinked, id.Hex(), clientIP(r), map[string]string{"identity_id": identityID.Hex(), "by": callerID})
+	writeJSON(w, map[string]string{"message": "Identity unlinked"})
+}
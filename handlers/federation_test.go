@@ -0,0 +1,634 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lep13/golang-restful-api/audit"
+	"github.com/lep13/golang-restful-api/config"
+	"github.com/lep13/golang-restful-api/jwt"
+	"github.com/lep13/golang-restful-api/middleware"
+	"github.com/lep13/golang-restful-api/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const fakeSubject = "248289761001"
+
+var (
+	fakeIssuerKeys    [2]*rsa.PrivateKey
+	fakeIssuerKeysErr error
+	fakeIssuerKeyOnce sync.Once
+)
+
+// issuerKey returns one of two RSA keys shared by the tests, which are slow
+// to generate
+func issuerKey(t *testing.T, i int) *rsa.PrivateKey {
+	fakeIssuerKeyOnce.Do(func() {
+		for j := range fakeIssuerKeys {
+			fakeIssuerKeys[j], fakeIssuerKeysErr = rsa.GenerateKey(rand.Reader, 2048)
+		}
+	})
+	require.NoError(t, fakeIssuerKeysErr)
+	return fakeIssuerKeys[i]
+}
+
+// fakeIssuer is a local OpenID Connect provider. It serves its discovery
+// document, its keys and a token endpoint redeeming the codes handed out by
+// signIn for client "api" with secret "s3cret".
+type fakeIssuer struct {
+	*httptest.Server
+	mu     sync.Mutex
+	signer *jwt.RS256
+	issuer string
+	// forger, when set, signs the ID tokens instead of the published key
+	forger      *jwt.RS256
+	codes       map[string]fakeGrant
+	jwksFetches int
+}
+
+type fakeGrant struct {
+	redirectURI string
+	challenge   string
+	claims      map[string]interface{}
+}
+
+func newFakeIssuer(t *testing.T) *fakeIssuer {
+	f := &fakeIssuer{signer: jwt.NewRS256(issuerKey(t, 0)), codes: map[string]fakeGrant{}}
+	routes := http.NewServeMux()
+	routes.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 f.issuer,
+			"authorization_endpoint": f.URL + "/authorize",
+			"token_endpoint":         f.URL + "/token",
+			"jwks_uri":               f.URL + "/jwks",
+		})
+	})
+	routes.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.jwksFetches++
+		json.NewEncoder(w).Encode(jwt.JWKSet{Keys: []jwt.JWK{f.signer.JWK()}})
+	})
+	routes.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		f.mu.Lock()
+		code := r.PostForm.Get("code")
+		grant, found := f.codes[code]
+		delete(f.codes, code)
+		signer := f.signer
+		if f.forger != nil {
+			signer = f.forger
+		}
+		f.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		clientID, secret, ok := r.BasicAuth()
+		if !ok || clientID != "api" || secret != "s3cret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error":"invalid_client"}`))
+			return
+		}
+		verifier := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if !found || r.PostForm.Get("grant_type") != "authorization_code" ||
+			r.PostForm.Get("redirect_uri") != grant.redirectURI ||
+			base64.RawURLEncoding.EncodeToString(verifier[:]) != grant.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+		idToken, _ := signer.Sign(grant.claims)
+		json.NewEncoder(w).Encode(map[string]string{"access_token": "upstream", "token_type": "Bearer", "id_token": idToken})
+	})
+	f.Server = httptest.NewServer(routes)
+	f.issuer = f.URL
+	return f
+}
+
+// signIn plays the user signing in at the issuer with the authorization URL
+// and returns the code the issuer redirects back with. The ID token of the
+// code carries the claims of Jane, overridden by claims; nil values remove a
+// claim.
+func (f *fakeIssuer) signIn(t *testing.T, authorizationURL string, claims map[string]interface{}) string {
+	u, err := url.Parse(authorizationURL)
+	require.NoError(t, err)
+	require.Equal(t, f.URL+"/authorize", u.Scheme+"://"+u.Host+u.Path)
+	query := u.Query()
+	now := time.Now().Unix()
+	idClaims := map[string]interface{}{
+		"iss":            f.URL,
+		"sub":            fakeSubject,
+		"aud":            "api",
+		"iat":            now,
+		"exp":            now + 300,
+		"nonce":          query.Get("nonce"),
+		"name":           "Jane Doe",
+		"email":          "jane@corp.example",
+		"email_verified": true,
+	}
+	for name, value := range claims {
+		if value == nil {
+			delete(idClaims, name)
+		} else {
+			idClaims[name] = value
+		}
+	}
+	code, _, err := newToken()
+	require.NoError(t, err)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.codes[code] = fakeGrant{redirectURI: query.Get("redirect_uri"), challenge: query.Get("code_challenge"), claims: idClaims}
+	return code
+}
+
+// setupOIDCProvider configures the issuer as provider "corp", redirecting to
+// the API at https://api.example.com
+func setupOIDCProvider(t *testing.T, issuer *fakeIssuer, provision bool) func() {
+	providers, names := oidcProviders, oidcProviderNames
+	restoreIssuer := setupIssuer("https://api.example.com")
+	require.NoError(t, SetOIDCProviders([]config.OIDCProviderConfig{{
+		Name:         "corp",
+		Issuer:       issuer.URL,
+		ClientID:     "api",
+		ClientSecret: "s3cret",
+		Scopes:       []string{"email", "profile"},
+		Provision:    provision,
+	}}))
+	return func() {
+		oidcProviders, oidcProviderNames = providers, names
+		restoreIssuer()
+	}
+}
+
+// startOIDC starts a sign-in at provider corp, returning the authorization
+// URL and the binding cookie
+func startOIDC(t *testing.T) (string, *http.Cookie) {
+	req := mux.SetURLVars(httptest.NewRequest("GET", "/v1/auth/oidc/corp/authorize", nil), map[string]string{"provider": "corp"})
+	rr := httptest.NewRecorder()
+	StartOIDCLogin(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var authorization OIDCAuthorization
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &authorization))
+	cookies := rr.Result().Cookies()
+	require.Len(t, cookies, 1)
+	return authorization.AuthorizationURL, cookies[0]
+}
+
+// completeOIDC calls the callback of provider corp with query, sending
+// cookie when it is set
+func completeOIDC(query url.Values, cookie *http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/v1/auth/oidc/corp/callback?"+query.Encode(), nil)
+	req = mux.SetURLVars(req, map[string]string{"provider": "corp"})
+	if cookie != nil {
+		req.AddCookie(&http.Cookie{Name: cookie.Name, Value: cookie.Value})
+	}
+	rr := httptest.NewRecorder()
+	OIDCCallback(rr, req)
+	return rr
+}
+
+// callbackQuery is the query the issuer redirects back with
+func callbackQuery(authorizationURL, code string) url.Values {
+	u, _ := url.Parse(authorizationURL)
+	return url.Values{"code": {code}, "state": {u.Query().Get("state")}}
+}
+
+// findByIdentity makes FindOne by Jane's identity at the issuer return user,
+// or err when it is set
+func findByIdentity(mockCollection *MockCollection, issuer string, user models.User, err error) {
+	result := new(MockSingleResult)
+	result.On("Decode", mock.AnythingOfType("*models.User")).Run(func(args mock.Arguments) {
+		*args.Get(0).(*models.User) = user
+	}).Return(err)
+	mockCollection.On("FindOne", mock.Anything, bson.M{"identities": bson.M{"$elemMatch": bson.M{"issuer": issuer, "subject": fakeSubject}}}).Return(result)
+}
+
+func TestStartOIDCLogin(t *testing.T) {
+	issuer := newFakeIssuer(t)
+	defer issuer.Close()
+	defer setupOIDCProvider(t, issuer, true)()
+	defer setupIssuer("https://api.example.com")()
+
+	authorizationURL, cookie := startOIDC(t)
+
+	u, err := url.Parse(authorizationURL)
+	require.NoError(t, err)
+	query := u.Query()
+	assert.Equal(t, "code", query.Get("response_type"))
+	assert.Equal(t, "api", query.Get("client_id"))
+	assert.Equal(t, "https://api.example.com/v1/auth/oidc/corp/callback", query.Get("redirect_uri"))
+	assert.Equal(t, "openid email profile", query.Get("scope"))
+	assert.NotEmpty(t, query.Get("nonce"))
+	challenge := sha256.Sum256([]byte(pkceVerifier(cookie.Value)))
+	assert.Equal(t, base64.RawURLEncoding.EncodeToString(challenge[:]), query.Get("code_challenge"))
+	assert.Equal(t, "S256", query.Get("code_challenge_method"))
+	assert.NotContains(t, authorizationURL, cookie.Value, "the binding never leaves the browser")
+
+	assert.Equal(t, oidcBindingCookie, cookie.Name)
+	assert.Equal(t, "/v1/auth/oidc/corp/", cookie.Path)
+	assert.True(t, cookie.HttpOnly)
+	assert.Equal(t, http.SameSiteLaxMode, cookie.SameSite)
+	assert.Equal(t, 600, cookie.MaxAge)
+}
+
+func TestStartOIDCLogin_ProviderErrors(t *testing.T) {
+	t.Run("unknown provider", func(t *testing.T) {
+		req := mux.SetURLVars(httptest.NewRequest("GET", "/v1/auth/oidc/other/authorize", nil), map[string]string{"provider": "other"})
+		rr := httptest.NewRecorder()
+		StartOIDCLogin(rr, req)
+
+		assert.Equal(t, http.StatusNotFound, rr.Code)
+		assert.JSONEq(t, `{"error":"Unknown identity provider"}`, rr.Body.String())
+	})
+
+	t.Run("issuer mismatch", func(t *testing.T) {
+		issuer := newFakeIssuer(t)
+		defer issuer.Close()
+		defer setupOIDCProvider(t, issuer, true)()
+		issuer.issuer = "https://evil.example.com"
+
+		req := mux.SetURLVars(httptest.NewRequest("GET", "/v1/auth/oidc/corp/authorize", nil), map[string]string{"provider": "corp"})
+		rr := httptest.NewRecorder()
+		StartOIDCLogin(rr, req)
+
+		assert.Equal(t, http.StatusBadGateway, rr.Code)
+		assert.JSONEq(t, `{"error":"Identity provider unavailable"}`, rr.Body.String())
+	})
+
+	t.Run("issuer down", func(t *testing.T) {
+		issuer := newFakeIssuer(t)
+		defer setupOIDCProvider(t, issuer, true)()
+		issuer.Close()
+
+		req := mux.SetURLVars(httptest.NewRequest("GET", "/v1/auth/oidc/corp/authorize", nil), map[string]string{"provider": "corp"})
+		rr := httptest.NewRecorder()
+		StartOIDCLogin(rr, req)
+
+		assert.Equal(t, http.StatusBadGateway, rr.Code)
+	})
+}
+
+func TestOIDCCallback_LinkedIdentity(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	issuer := newFakeIssuer(t)
+	defer issuer.Close()
+	defer setupOIDCProvider(t, issuer, false)()
+	id := primitive.NewObjectID()
+	findByIdentity(mockCollection, issuer.URL, models.User{ID: id, Email: "jane@corp.example"}, nil)
+	linked := bson.M{"$elemMatch": bson.M{"issuer": issuer.URL, "subject": fakeSubject}}
+	mockCollection.On("UpdateOne", mock.Anything, bson.M{"_id": id, "identities": linked}, mock.Anything).
+		Return(&mongo.UpdateResult{MatchedCount: 1}, nil)
+	sessions := acceptSessions(mockCollection, id)
+
+	authorizationURL, cookie := startOIDC(t)
+	code := issuer.signIn(t, authorizationURL, nil)
+	rr := completeOIDC(callbackQuery(authorizationURL, code), cookie)
+
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	claims, userID, err := parseToken(decodeTokenResponse(t, rr.Body.Bytes()).AccessToken, accessTokenPurpose)
+	require.NoError(t, err)
+	assert.Equal(t, id, userID)
+	assert.Equal(t, []string{"fed"}, claims.AMR)
+	require.Len(t, *sessions, 1)
+	assert.Equal(t, (*sessions)[0].ID.Hex(), claims.SessionID)
+	// The binding cookie is cleared
+	cleared := rr.Result().Cookies()
+	require.Len(t, cleared, 1)
+	assert.Equal(t, oidcBindingCookie, cleared[0].Name)
+	assert.Equal(t, -1, cleared[0].MaxAge)
+	mockCollection.AssertCalled(t, "UpdateOne", mock.Anything, bson.M{"_id": id, "identities": linked}, mock.Anything)
+}
+
+func TestOIDCCallback_LinksByVerifiedEmail(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	logger := new(recordingAuditLogger)
+	defer setupAuditLogger(logger)()
+	issuer := newFakeIssuer(t)
+	defer issuer.Close()
+	defer setupOIDCProvider(t, issuer, false)()
+	id := primitive.NewObjectID()
+	findByIdentity(mockCollection, issuer.URL, models.User{}, mongo.ErrNoDocuments)
+	findByEmail(mockCollection, "jane@corp.example", models.User{ID: id, Email: "jane@corp.example", EmailVerified: true}, nil)
+	var identity models.Identity
+	mockCollection.On("UpdateOne", mock.Anything, bson.M{
+		"_id":            id,
+		"email":          "jane@corp.example",
+		"email_verified": true,
+		"identities.9":   bson.M{"$exists": false},
+	}, mock.Anything).Run(func(args mock.Arguments) {
+		identity = args.Get(2).(bson.M)["$push"].(bson.M)["identities"].(models.Identity)
+	}).Return(&mongo.UpdateResult{MatchedCount: 1}, nil)
+	acceptSessions(mockCollection, id)
+
+	authorizationURL, cookie := startOIDC(t)
+	code := issuer.signIn(t, authorizationURL, nil)
+	rr := completeOIDC(callbackQuery(authorizationURL, code), cookie)
+
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.Equal(t, "corp", identity.Provider)
+	assert.Equal(t, issuer.URL, identity.Issuer)
+	assert.Equal(t, fakeSubject, identity.Subject)
+	assert.Equal(t, "jane@corp.example", identity.Email)
+	events := logger.recorded()
+	require.NotEmpty(t, events)
+	assert.Equal(t, audit.IdentityLinked, events[0].Action)
+	assert.Equal(t, id.Hex(), events[0].UserID)
+	assert.Equal(t, identity.ID.Hex(), events[0].Details["identity_id"])
+}
+
+func TestOIDCCallback_ProvisionsUser(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	logger := new(recordingAuditLogger)
+	defer setupAuditLogger(logger)()
+	issuer := newFakeIssuer(t)
+	defer issuer.Close()
+	defer setupOIDCProvider(t, issuer, true)()
+	findByIdentity(mockCollection, issuer.URL, models.User{}, mongo.ErrNoDocuments)
+	findByEmail(mockCollection, "jane@corp.example", models.User{}, mongo.ErrNoDocuments)
+	var provisioned models.User
+	mockCollection.On("InsertOne", mock.Anything, mock.AnythingOfType("models.User")).Run(func(args mock.Arguments) {
+		provisioned = args.Get(1).(models.User)
+	}).Return(&mongo.InsertOneResult{}, nil)
+	mockCollection.On("UpdateOne", mock.Anything, mock.Anything, mock.Anything).Return(&mongo.UpdateResult{MatchedCount: 1}, nil)
+
+	authorizationURL, cookie := startOIDC(t)
+	code := issuer.signIn(t, authorizationURL, map[string]interface{}{"email_verified": "true"})
+	rr := completeOIDC(callbackQuery(authorizationURL, code), cookie)
+
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.Equal(t, "Jane Doe", provisioned.Name)
+	assert.Equal(t, "jane@corp.example", provisioned.Email)
+	assert.True(t, provisioned.EmailVerified)
+	assert.Empty(t, provisioned.Password, "provisioned users cannot log in with a password until they reset it")
+	require.Len(t, provisioned.Identities, 1)
+	assert.Equal(t, fakeSubject, provisioned.Identities[0].Subject)
+	_, userID, err := parseToken(decodeTokenResponse(t, rr.Body.Bytes()).AccessToken, accessTokenPurpose)
+	require.NoError(t, err)
+	assert.Equal(t, provisioned.ID, userID)
+	assert.Equal(t, audit.UserProvisioned, logger.recorded()[0].Action)
+}
+
+func TestOIDCCallback_MFA(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	issuer := newFakeIssuer(t)
+	defer issuer.Close()
+	defer setupOIDCProvider(t, issuer, false)()
+	id := primitive.NewObjectID()
+	findByIdentity(mockCollection, issuer.URL, models.User{ID: id, MFA: &models.MFA{Enabled: true, Secret: "JBSWY3DPEHPK3PXP"}}, nil)
+	mockCollection.On("UpdateOne", mock.Anything, mock.Anything, mock.Anything).Return(&mongo.UpdateResult{MatchedCount: 1}, nil)
+
+	authorizationURL, cookie := startOIDC(t)
+	code := issuer.signIn(t, authorizationURL, nil)
+	rr := completeOIDC(callbackQuery(authorizationURL, code), cookie)
+
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var challenge MFAChallenge
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &challenge))
+	assert.True(t, challenge.MFARequired)
+	claims, userID, err := parseToken(challenge.MFAToken, mfaTokenPurpose)
+	require.NoError(t, err)
+	assert.Equal(t, id, userID)
+	assert.Equal(t, []string{"fed"}, claims.AMR)
+}
+
+func TestOIDCCallback_Rejects(t *testing.T) {
+	otherKey := jwt.NewRS256(issuerKey(t, 1))
+	for _, tc := range []struct {
+		name   string
+		claims map[string]interface{}
+		// tamper changes the callback request
+		tamper    func(query url.Values, cookie *http.Cookie) *http.Cookie
+		emailUser *models.User
+		provision bool
+		sign      *jwt.RS256
+		status    int
+		message   string
+	}{
+		{name: "error at the provider", tamper: func(q url.Values, c *http.Cookie) *http.Cookie { q.Set("error", "access_denied"); return c },
+			status: http.StatusUnauthorized, message: "Sign-in failed at the identity provider: access_denied"},
+		{name: "no cookie", tamper: func(q url.Values, c *http.Cookie) *http.Cookie { return nil },
+			status: http.StatusBadRequest, message: "Sign-in was started in another browser"},
+		{name: "cookie of another sign-in", tamper: func(q url.Values, c *http.Cookie) *http.Cookie { return &http.Cookie{Name: c.Name, Value: "other"} },
+			status: http.StatusBadRequest, message: "Sign-in was started in another browser"},
+		{name: "forged state", tamper: func(q url.Values, c *http.Cookie) *http.Cookie { q.Set("state", q.Get("state")+"x"); return c },
+			status: http.StatusBadRequest, message: "Invalid or expired sign-in state"},
+		{name: "no code", tamper: func(q url.Values, c *http.Cookie) *http.Cookie { q.Del("code"); return c },
+			status: http.StatusBadRequest, message: "Code is required"},
+		{name: "unknown code", tamper: func(q url.Values, c *http.Cookie) *http.Cookie { q.Set("code", "guess"); return c },
+			status: http.StatusUnauthorized, message: "The identity provider rejected the code"},
+		{name: "wrong nonce", claims: map[string]interface{}{"nonce": "replayed"},
+			status: http.StatusUnauthorized, message: "Invalid ID token"},
+		{name: "no nonce", claims: map[string]interface{}{"nonce": nil},
+			status: http.StatusUnauthorized, message: "Invalid ID token"},
+		{name: "other audience", claims: map[string]interface{}{"aud": "other-client"},
+			status: http.StatusUnauthorized, message: "Invalid ID token"},
+		{name: "other authorized party", claims: map[string]interface{}{"aud": []string{"api", "other-client"}, "azp": "other-client"},
+			status: http.StatusUnauthorized, message: "Invalid ID token"},
+		{name: "other issuer", claims: map[string]interface{}{"iss": "https://evil.example.com"},
+			status: http.StatusUnauthorized, message: "Invalid ID token"},
+		{name: "expired", claims: map[string]interface{}{"exp": time.Now().Add(-time.Minute).Unix()},
+			status: http.StatusUnauthorized, message: "Invalid ID token"},
+		{name: "no expiry", claims: map[string]interface{}{"exp": nil},
+			status: http.StatusUnauthorized, message: "Invalid ID token"},
+		{name: "signed with another key", sign: otherKey,
+			status: http.StatusUnauthorized, message: "Invalid ID token"},
+		{name: "unverified email", claims: map[string]interface{}{"email_verified": false},
+			status: http.StatusForbidden, message: "The identity provider did not supply a verified email"},
+		{name: "no email", claims: map[string]interface{}{"email": nil},
+			status: http.StatusForbidden, message: "The identity provider did not supply a verified email"},
+		{name: "provisioning disabled",
+			status: http.StatusForbidden, message: "No account uses this email"},
+		{name: "account with unverified email", emailUser: &models.User{ID: primitive.NewObjectID(), Email: "jane@corp.example"}, provision: true,
+			status: http.StatusConflict, message: "An account uses this email but has not verified it; verify the email to sign in with the identity provider"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mockCollection := new(MockCollection)
+			defer SetupMockCollection(mockCollection)()
+			issuer := newFakeIssuer(t)
+			defer issuer.Close()
+			defer setupOIDCProvider(t, issuer, tc.provision)()
+			findByIdentity(mockCollection, issuer.URL, models.User{}, mongo.ErrNoDocuments)
+			if tc.emailUser != nil {
+				findByEmail(mockCollection, "jane@corp.example", *tc.emailUser, nil)
+			} else {
+				findByEmail(mockCollection, "jane@corp.example", models.User{}, mongo.ErrNoDocuments)
+			}
+
+			authorizationURL, cookie := startOIDC(t)
+			if tc.sign != nil {
+				issuer.forger = tc.sign
+			}
+			code := issuer.signIn(t, authorizationURL, tc.claims)
+			query := callbackQuery(authorizationURL, code)
+			if tc.tamper != nil {
+				cookie = tc.tamper(query, cookie)
+			}
+			rr := completeOIDC(query, cookie)
+
+			assert.Equal(t, tc.status, rr.Code)
+			assert.JSONEq(t, `{"error":`+jsonString(tc.message)+`}`, rr.Body.String())
+			mockCollection.AssertNotCalled(t, "InsertOne", mock.Anything, mock.Anything)
+			mockCollection.AssertNotCalled(t, "UpdateOne", mock.Anything, mock.Anything, mock.Anything)
+		})
+	}
+}
+
+func TestOIDCCallback_ExpiredState(t *testing.T) {
+	issuer := newFakeIssuer(t)
+	defer issuer.Close()
+	defer setupOIDCProvider(t, issuer, true)()
+	binding, bindingHash, err := newToken()
+	require.NoError(t, err)
+	state, err := tokenSigner.Sign(oidcState{
+		Claims:   jwt.Claims{ExpiresAt: time.Now().Add(-time.Second).Unix()},
+		Purpose:  oidcStatePurpose,
+		Provider: "corp",
+		Binding:  bindingHash,
+	})
+	require.NoError(t, err)
+
+	rr := completeOIDC(url.Values{"code": {"code"}, "state": {state}}, &http.Cookie{Name: oidcBindingCookie, Value: binding})
+
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.JSONEq(t, `{"error":"Invalid or expired sign-in state"}`, rr.Body.String())
+}
+
+func TestOIDCCallback_KeyRotation(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	issuer := newFakeIssuer(t)
+	defer issuer.Close()
+	defer setupOIDCProvider(t, issuer, false)()
+	id := primitive.NewObjectID()
+	findByIdentity(mockCollection, issuer.URL, models.User{ID: id}, nil)
+	mockCollection.On("UpdateOne", mock.Anything, mock.Anything, mock.Anything).Return(&mongo.UpdateResult{MatchedCount: 1}, nil)
+	signIn := func() *httptest.ResponseRecorder {
+		authorizationURL, cookie := startOIDC(t)
+		return completeOIDC(callbackQuery(authorizationURL, issuer.signIn(t, authorizationURL, nil)), cookie)
+	}
+
+	require.Equal(t, http.StatusOK, signIn().Code)
+	require.Equal(t, http.StatusOK, signIn().Code)
+	assert.Equal(t, 1, issuer.jwksFetches, "keys are cached")
+
+	// A new key is only looked up once the last fetch is a minute old, so
+	// tokens with made up key IDs cannot hammer the provider
+	issuer.mu.Lock()
+	issuer.signer = jwt.NewRS256(issuerKey(t, 1))
+	issuer.mu.Unlock()
+	assert.Equal(t, http.StatusUnauthorized, signIn().Code)
+	assert.Equal(t, 1, issuer.jwksFetches)
+
+	provider := oidcProviders["corp"]
+	provider.keysFetchedAt = provider.keysFetchedAt.Add(-oidcKeyRefreshInterval)
+	assert.Equal(t, http.StatusOK, signIn().Code)
+	assert.Equal(t, 2, issuer.jwksFetches)
+}
+
+func TestOIDCCallback_DatabaseError(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	issuer := newFakeIssuer(t)
+	defer issuer.Close()
+	defer setupOIDCProvider(t, issuer, true)()
+	findByIdentity(mockCollection, issuer.URL, models.User{}, errors.New("connection refused"))
+
+	authorizationURL, cookie := startOIDC(t)
+	rr := completeOIDC(callbackQuery(authorizationURL, issuer.signIn(t, authorizationURL, nil)), cookie)
+
+	assert.Equal(t, http.StatusInternalServerError, rr.Code)
+}
+
+func TestSetOIDCProviders(t *testing.T) {
+	defer func(providers map[string]*oidcProvider, names []string) {
+		oidcProviders, oidcProviderNames = providers, names
+	}(oidcProviders, oidcProviderNames)
+	defer setupIssuer("https://api.example.com")()
+	corp := config.OIDCProviderConfig{Name: "corp", Issuer: "https://sso.example.com", ClientID: "api"}
+
+	require.NoError(t, SetOIDCProviders([]config.OIDCProviderConfig{corp}))
+	assert.Equal(t, []string{"openid"}, oidcProviders["corp"].Scopes)
+
+	rr := httptest.NewRecorder()
+	ListOIDCProviders(rr, httptest.NewRequest("GET", "/v1/auth/oidc/providers", nil))
+	assert.JSONEq(t, `[{"name":"corp","issuer":"https://sso.example.com"}]`, rr.Body.String())
+
+	assert.EqualError(t, SetOIDCProviders([]config.OIDCProviderConfig{corp, corp}), `provider "corp" is configured twice`)
+	insecure := corp
+	insecure.Issuer = "http://sso.example.com"
+	assert.EqualError(t, SetOIDCProviders([]config.OIDCProviderConfig{insecure}), `provider "corp": invalid issuer "http://sso.example.com"`)
+	redirect := corp
+	redirect.RedirectURL = "/callback"
+	assert.EqualError(t, SetOIDCProviders([]config.OIDCProviderConfig{redirect}), `provider "corp": invalid redirect URL "/callback"`)
+
+	// The default redirect URL needs the issuer
+	setupIssuer("")
+	assert.EqualError(t, SetOIDCProviders([]config.OIDCProviderConfig{corp}), `provider "corp": a redirect URL is required without an OAuth issuer`)
+	redirect.RedirectURL = "https://app.example.com/callback"
+	require.NoError(t, SetOIDCProviders([]config.OIDCProviderConfig{redirect}))
+}
+
+func TestListIdentities(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	id := primitive.NewObjectID()
+	linkedAt := time.Date(2026, 10, 1, 9, 0, 0, 0, time.UTC)
+	identityID := primitive.NewObjectID()
+	findUser(mockCollection, id, models.User{ID: id, Identities: []models.Identity{{
+		ID: identityID, Provider: "corp", Issuer: "https://sso.example.com", Subject: fakeSubject, Email: "jane@corp.example", LinkedAt: linkedAt,
+	}}}, nil)
+
+	rr := serve(ListIdentities, "GET", "/v1/users/"+id.Hex()+"/identities", "", withVars("id", id.Hex()), as(id.Hex()))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, `[{"id":"`+identityID.Hex()+`","provider":"corp","issuer":"https://sso.example.com","subject":"`+fakeSubject+`","email":"jane@corp.example","linked_at":"2026-10-01T09:00:00Z"}]`, rr.Body.String())
+
+	rr = serve(ListIdentities, "GET", "/v1/users/"+id.Hex()+"/identities", "", withVars("id", id.Hex()))
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+}
+
+func TestUnlinkIdentity(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	logger := new(recordingAuditLogger)
+	defer setupAuditLogger(logger)()
+	id := primitive.NewObjectID()
+	identityID := primitive.NewObjectID()
+	unknownID := primitive.NewObjectID()
+	mockCollection.On("UpdateOne", mock.Anything, bson.M{"_id": id, "identities._id": identityID}, mock.Anything).
+		Return(&mongo.UpdateResult{MatchedCount: 1}, nil)
+	mockCollection.On("UpdateOne", mock.Anything, bson.M{"_id": id, "identities._id": unknownID}, mock.Anything).
+		Return(&mongo.UpdateResult{MatchedCount: 0}, nil)
+
+	for identity, status := range map[string]int{identityID.Hex(): http.StatusOK, unknownID.Hex(): http.StatusNotFound, "bad": http.StatusBadRequest} {
+		req := httptest.NewRequest("DELETE", "/v1/users/"+id.Hex()+"/identities/"+identity, nil)
+		req = mux.SetURLVars(req, map[string]string{"id": id.Hex(), "identity_id": identity})
+		req = req.WithContext(middleware.WithUserID(req.Context(), id.Hex()))
+		rr := httptest.NewRecorder()
+		UnlinkIdentity(rr, req)
+		assert.Equal(t, status, rr.Code, identity)
+	}
+	events := logger.recorded()
+	require.Len(t, events, 1)
+	assert.Equal(t, audit.IdentityUnlinked, events[0].Action)
+	assert.Equal(t, identityID.Hex(), events[0].Details["identity_id"])
+}
@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+
+	"github.com/lep13/golang-restful-api/models"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// sensitiveUserFields are never returned, whatever the client asks for
+var sensitiveUserFields = map[string]bool{"password": true}
+
+// userFields maps the JSON names of the public fields of models.User to their
+// BSON names
+var userFields = publicFields(reflect.TypeOf(models.User{}), sensitiveUserFields)
+
+// publicFields reads the JSON and BSON names of the fields of a struct,
+// leaving out the sensitive ones
+func publicFields(t reflect.Type, sensitive map[string]bool) map[string]string {
+	fields := make(map[string]string)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		jsonName, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		bsonName, _, _ := strings.Cut(field.Tag.Get("bson"), ",")
+		if !field.IsExported() || jsonName == "-" || bsonName == "-" {
+			continue
+		}
+		if jsonName == "" {
+			jsonName = field.Name
+		}
+		if bsonName == "" {
+			bsonName = strings.ToLower(field.Name)
+		}
+		if !sensitive[jsonName] {
+			fields[jsonName] = bsonName
+		}
+	}
+	return fields
+}
+
+// userProjection reads the fields and exclude parameters into the projection
+// of a users query, writing 400 when they are invalid. fields lists the only
+// fields to return and exclude the fields to leave out; _id is always returned
+// since it is the pagination cursor, and sensitive fields never are.
+func userProjection(w http.ResponseWriter, query url.Values) (bson.M, bool) {
+	include, exclude := query.Get("fields"), query.Get("exclude")
+	if include != "" && exclude != "" {
+		writeError(w, "fields and exclude cannot be combined", http.StatusBadRequest)
+		return nil, false
+	}
+
+	projection := bson.M{}
+	if include != "" {
+		for _, name := range strings.Split(include, ",") {
+			field, ok := lookupUserField(w, "fields", strings.TrimSpace(name))
+			if !ok {
+				return nil, false
+			}
+			projection[field] = 1
+		}
+		return projection, true
+	}
+
+	for name := range sensitiveUserFields {
+		projection[name] = 0
+	}
+	if exclude != "" {
+		for _, name := range strings.Split(exclude, ",") {
+			field, ok := lookupUserField(w, "exclude", strings.TrimSpace(name))
+			if !ok {
+				return nil, false
+			}
+			if field == "_id" {
+				writeError(w, "Invalid exclude: _id cannot be excluded", http.StatusBadRequest)
+				return nil, false
+			}
+			projection[field] = 0
+		}
+	}
+	return projection, true
+}
+
+func lookupUserField(w http.ResponseWriter, param, name string) (string, bool) {
+	if sensitiveUserFields[name] {
+		writeError(w, "Invalid "+param+": "+name+" cannot be selected", http.StatusBadRequest)
+		return "", false
+	}
+	field, ok := userFields[name]
+	if !ok {
+		writeError(w, "Invalid "+param+": unknown field \""+name+"\"", http.StatusBadRequest)
+		return "", false
+	}
+	return field, true
+}
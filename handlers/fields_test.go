@@ -0,0 +1,88 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/lep13/golang-restful-api/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// findOptionsRecorder records the options of Find, which MockCollection ignores
+type findOptionsRecorder struct {
+	*MockCollection
+	opts []*options.FindOptions
+}
+
+func (r *findOptionsRecorder) Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error) {
+	r.opts = opts
+	return r.MockCollection.Find(ctx, filter, opts...)
+}
+
+func TestPublicFields(t *testing.T) {
+	assert.Equal(t, map[string]string{"_id": "_id", "name": "name", "email": "email", "email_verified": "email_verified"}, userFields)
+
+	type sample struct {
+		Plain   string
+		Renamed string `json:"renamed" bson:"stored"`
+		Skipped string `json:"-"`
+		Secret  string `json:"secret"`
+		private string
+	}
+	assert.Equal(t, map[string]string{"Plain": "plain", "renamed": "stored"}, publicFields(reflect.TypeOf(sample{}), map[string]bool{"secret": true}))
+}
+
+func TestGetUsers_Fields(t *testing.T) {
+	for query, want := range map[string]bson.M{
+		"":                       {"password": 0},
+		"fields=name":            {"name": 1},
+		"fields=_id,+name,email": {"_id": 1, "name": 1, "email": 1},
+		"exclude=email":          {"password": 0, "email": 0},
+	} {
+		recorder := &findOptionsRecorder{MockCollection: new(MockCollection)}
+		restore := SetupMockCollection(recorder)
+		recorder.On("Find", mock.Anything, mock.Anything).Return(usersCursor(models.User{ID: primitive.NewObjectID(), Name: "John Doe"}), nil)
+
+		req, _ := http.NewRequest("GET", "/users?"+query, nil)
+		rr := httptest.NewRecorder()
+		req = asAdmin(recorder.MockCollection)(req)
+		http.HandlerFunc(GetUsers).ServeHTTP(rr, req)
+
+		assert.Equal(t, http.StatusOK, rr.Code, query)
+		require.Len(t, recorder.opts, 1, query)
+		assert.Equal(t, want, recorder.opts[0].Projection, query)
+		restore()
+	}
+}
+
+func TestGetUsers_InvalidFields(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+
+	for query, message := range map[string]string{
+		"fields=name&exclude=email": "fields and exclude cannot be combined",
+		"fields=name,password":      "Invalid fields: password cannot be selected",
+		"exclude=password":          "Invalid exclude: password cannot be selected",
+		"fields=name,age":           `Invalid fields: unknown field \"age\"`,
+		"fields=name,":              `Invalid fields: unknown field \"\"`,
+		"exclude=_id":               "Invalid exclude: _id cannot be excluded",
+	} {
+		req, _ := http.NewRequest("GET", "/users?"+query, nil)
+		rr := httptest.NewRecorder()
+		req = asAdmin(mockCollection)(req)
+		http.HandlerFunc(GetUsers).ServeHTTP(rr, req)
+
+		assert.Equal(t, http.StatusBadRequest, rr.Code, query)
+		assert.Contains(t, rr.Body.String(), message, query)
+	}
+	mockCollection.AssertNotCalled(t, "Find", mock.Anything, mock.Anything)
+}
@@ -0,0 +1,689 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lep13/golang-restful-api/models"
+	"github.com/lep13/golang-restful-api/openapi"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// importChunkSize is the number of rows written with one BulkWrite
+	importChunkSize = 500
+	// importMaxReportedErrors caps the row errors kept for the error report;
+	// further failures are only counted
+	importMaxReportedErrors = 10000
+	// importMaxLineBytes caps the length of one NDJSON line
+	importMaxLineBytes = 1 << 20
+	// importWorkers is the number of imports processed at the same time
+	importWorkers = 2
+	// importRetention is how long finished imports can still be queried
+	importRetention = 24 * time.Hour
+)
+
+// Import job statuses
+const (
+	ImportQueued    = "queued"
+	ImportRunning   = "running"
+	ImportCompleted = "completed"
+	ImportFailed    = "failed"
+)
+
+// ImportRowError describes why one row of an import was not applied. Row is
+// the line of the uploaded file the row starts on.
+type ImportRowError struct {
+	Row     int    `json:"row"`
+	Field   string `json:"field,omitempty"`
+	Message string `json:"message"`
+}
+
+// ImportJob reports the progress of an import. In a dry run Created and
+// Updated count the users that would have been written.
+type ImportJob struct {
+	ID          string     `json:"id"`
+	Status      string     `json:"status"`
+	Format      string     `json:"format"`
+	DryRun      bool       `json:"dryRun"`
+	Upsert      bool       `json:"upsert"`
+	Processed   int        `json:"processed"`
+	Created     int        `json:"created"`
+	Updated     int        `json:"updated"`
+	Failed      int        `json:"failed"`
+	Error       string     `json:"error,omitempty"`
+	ErrorReport string     `json:"errorReport"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	StartedAt   *time.Time `json:"startedAt,omitempty"`
+	FinishedAt  *time.Time `json:"finishedAt,omitempty"`
+
+	rowErrors []ImportRowError
+}
+
+// importStore keeps the jobs of this instance in memory
+type importStore struct {
+	mu   sync.Mutex
+	jobs map[string]*ImportJob
+}
+
+var (
+	imports     = &importStore{jobs: make(map[string]*ImportJob)}
+	importSlots = make(chan struct{}, importWorkers)
+)
+
+// errEmptyImport reports an upload without content
+var errEmptyImport = errors.New("empty import")
+
+// specValidator checks imported rows with the schema applied to CreateUser bodies
+var specValidator = sync.OnceValues(func() (*openapi.Validator, error) {
+	return openapi.NewValidator(openapi.Spec)
+})
+
+// create registers a queued job and forgets jobs that finished more than
+// importRetention ago
+func (s *importStore) create(job *ImportJob) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, old := range s.jobs {
+		if old.FinishedAt != nil && time.Since(*old.FinishedAt) > importRetention {
+			delete(s.jobs, id)
+		}
+	}
+	s.jobs[job.ID] = job
+}
+
+// get returns a copy of a job, which is safe to read while the import runs
+func (s *importStore) get(id string) (ImportJob, []ImportRowError, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[id]
+	if !ok {
+		return ImportJob{}, nil, false
+	}
+	rowErrors := append([]ImportRowError(nil), job.rowErrors...)
+	snapshot := *job
+	snapshot.rowErrors = nil
+	return snapshot, rowErrors, true
+}
+
+// update applies fn to a job under the store lock
+func (s *importStore) update(id string, fn func(job *ImportJob)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if job, ok := s.jobs[id]; ok {
+		fn(job)
+	}
+}
+
+// importFormat is an input format of CreateImport
+type importFormat struct {
+	name       string
+	mediaTypes []string
+	newReader  func(r io.Reader) (rowReader, error)
+}
+
+// rowReader yields the rows of an upload as JSON-like objects. A row that
+// cannot be parsed is returned as a rowError; any other error ends the import.
+type rowReader interface {
+	next() (row int, value map[string]interface{}, err error)
+}
+
+type rowError struct {
+	row     int
+	message string
+}
+
+func (e *rowError) Error() string {
+	return fmt.Sprintf("row %d: %s", e.row, e.message)
+}
+
+var importFormats = []importFormat{
+	{
+		name:       "csv",
+		mediaTypes: []string{"text/csv"},
+		newReader:  newCSVRowReader,
+	},
+	{
+		name:       "ndjson",
+		mediaTypes: []string{"application/x-ndjson", "application/ndjson", "application/jsonl"},
+		newReader:  newNDJSONRowReader,
+	},
+}
+
+// CreateImport accepts a CSV or NDJSON file of users and imports it in the
+// background. The upload is spooled to a temporary file so the request ends as
+// soon as it is received; the response is 202 with the job, whose progress is
+// reported by GetImport. dryRun validates the file without writing, and
+// upsert updates the user with the same email instead of creating another.
+func CreateImport(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if _, ok := authenticatedUser(w, r); !ok {
+		return
+	}
+	format, ok := importFormatFor(r.Header.Get("Content-Type"))
+	if !ok {
+		writeError(w, "Content-Type must be text/csv or application/x-ndjson", http.StatusUnsupportedMediaType)
+		return
+	}
+	dryRun, ok := parseBoolQuery(w, r, "dryRun")
+	if !ok {
+		return
+	}
+	upsert, ok := parseBoolQuery(w, r, "upsert")
+	if !ok {
+		return
+	}
+
+	file, err := os.CreateTemp("", "user-import-*")
+	if err != nil {
+		log.Println("Failed to create import file:", err)
+		writeError(w, "Failed to store upload", http.StatusInternalServerError)
+		return
+	}
+	n, err := io.Copy(file, r.Body)
+	if err == nil && n == 0 {
+		err = errEmptyImport
+	}
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		var maxBytesErr *http.MaxBytesError
+		switch {
+		case errors.As(err, &maxBytesErr):
+			writeError(w, "Request body too large", http.StatusRequestEntityTooLarge)
+		case errors.Is(err, errEmptyImport):
+			writeError(w, "Import file is empty", http.StatusBadRequest)
+		default:
+			writeError(w, "Failed to read request body", http.StatusBadRequest)
+		}
+		return
+	}
+
+	id := primitive.NewObjectID().Hex()
+	location := path.Join(r.URL.Path, id)
+	job := &ImportJob{
+		ID:          id,
+		Status:      ImportQueued,
+		Format:      format.name,
+		DryRun:      dryRun,
+		Upsert:      upsert,
+		ErrorReport: location + "/errors",
+		CreatedAt:   time.Now().UTC(),
+	}
+	imports.create(job)
+	snapshot, _, _ := imports.get(id)
+	go runImport(id, file, format)
+
+	w.Header().Set("Location", location)
+	w.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(w).Encode(snapshot); err != nil {
+		log.Println("Failed to encode import job:", err)
+	}
+}
+
+// GetImport returns the progress of an import
+func GetImport(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if _, ok := authenticatedUser(w, r); !ok {
+		return
+	}
+	job, _, ok := imports.get(mux.Vars(r)["id"])
+	if !ok {
+		writeError(w, "Import not found", http.StatusNotFound)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(job); err != nil {
+		writeError(w, "Failed to encode response", http.StatusInternalServerError)
+	}
+}
+
+// GetImportErrors downloads the rows an import rejected so far as CSV with the
+// columns row, field and message
+func GetImportErrors(w http.ResponseWriter, r *http.Request) {
+	if _, ok := authenticatedUser(w, r); !ok {
+		return
+	}
+	id := mux.Vars(r)["id"]
+	_, rowErrors, ok := imports.get(id)
+	if !ok {
+		writeError(w, "Import not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="import-`+id+`-errors.csv"`)
+	writer := csv.NewWriter(w)
+	records := make([][]string, 0, len(rowErrors)+1)
+	records = append(records, []string{"row", "field", "message"})
+	for _, rowErr := range rowErrors {
+		records = append(records, []string{strconv.Itoa(rowErr.Row), csvSafe(rowErr.Field), csvSafe(rowErr.Message)})
+	}
+	if err := writer.WriteAll(records); err != nil {
+		log.Println("Failed to write import error report:", err)
+	}
+}
+
+func importFormatFor(contentType string) (importFormat, bool) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return importFormat{}, false
+	}
+	for _, format := range importFormats {
+		for _, candidate := range format.mediaTypes {
+			if candidate == mediaType {
+				return format, true
+			}
+		}
+	}
+	return importFormat{}, false
+}
+
+// importRow is a validated row waiting to be written
+type importRow struct {
+	row  int
+	user models.User
+}
+
+// runImport processes an uploaded file and removes it when done. At most
+// importWorkers imports run at once; the others stay queued.
+func runImport(id string, file *os.File, format importFormat) {
+	defer func() {
+		file.Close()
+		os.Remove(file.Name())
+	}()
+	importSlots <- struct{}{}
+	defer func() { <-importSlots }()
+
+	var dryRun, upsert bool
+	imports.update(id, func(job *ImportJob) {
+		started := time.Now().UTC()
+		job.Status, job.StartedAt = ImportRunning, &started
+		dryRun, upsert = job.DryRun, job.Upsert
+	})
+	importer := &importer{id: id, dryRun: dryRun, upsert: upsert, seenEmails: make(map[string]bool)}
+	err := importer.run(file, format)
+
+	imports.update(id, func(job *ImportJob) {
+		finished := time.Now().UTC()
+		job.Status, job.FinishedAt = ImportCompleted, &finished
+		if err != nil {
+			job.Status, job.Error = ImportFailed, err.Error()
+		}
+	})
+	if err != nil {
+		log.Printf("Import %s failed: %v", id, err)
+	}
+}
+
+type importer struct {
+	id     string
+	dryRun bool
+	upsert bool
+	// seenEmails holds the emails of earlier rows of a dry run with upsert,
+	// which a later row with the same email would update
+	seenEmails map[string]bool
+}
+
+// run reads, validates and writes the rows chunk by chunk, publishing the
+// counts after each chunk
+func (im *importer) run(file io.Reader, format importFormat) error {
+	validator, err := specValidator()
+	if err != nil {
+		return err
+	}
+	reader, err := format.newReader(file)
+	if err != nil {
+		return err
+	}
+
+	var pending []importRow
+	var rowErrors []ImportRowError
+	processed := 0
+	for {
+		row, value, err := reader.next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		var parseErr *rowError
+		switch {
+		case errors.As(err, &parseErr):
+			processed++
+			rowErrors = append(rowErrors, ImportRowError{Row: parseErr.row, Message: parseErr.message})
+		case err != nil:
+			return err
+		default:
+			processed++
+			if user, violations := toImportUser(validator, value); len(violations) > 0 {
+				for _, violation := range violations {
+					rowErrors = append(rowErrors, ImportRowError{Row: row, Field: violation.Field, Message: violation.Message})
+				}
+			} else {
+				pending = append(pending, importRow{row: row, user: user})
+			}
+		}
+		if len(pending) == importChunkSize {
+			if err := im.flush(pending, processed, rowErrors); err != nil {
+				return err
+			}
+			pending, rowErrors, processed = pending[:0], nil, 0
+		}
+	}
+	return im.flush(pending, processed, rowErrors)
+}
+
+// toImportUser checks a row against the User schema and the password policy,
+// as CreateUser bodies are checked, and converts it with its password hashed.
+// The ID is always assigned by the server.
+func toImportUser(validator *openapi.Validator, value map[string]interface{}) (models.User, []openapi.Violation) {
+	delete(value, "_id")
+	if violations := validator.ValidateSchema("User", value); len(violations) > 0 {
+		return models.User{}, violations
+	}
+	var user models.User
+	data, err := json.Marshal(value)
+	if err == nil {
+		err = json.Unmarshal(data, &user)
+	}
+	if err != nil {
+		return models.User{}, []openapi.Violation{{Message: err.Error()}}
+	}
+	user.Email = normalizeEmail(user.Email)
+	user.EmailVerified = false
+	if status, message := hashNewPassword(&user); status != 0 {
+		return models.User{}, []openapi.Violation{{Field: "password", Message: message}}
+	}
+	return user, nil
+}
+
+// flush writes a chunk of valid rows and adds the chunk's counts and errors to the job
+func (im *importer) flush(rows []importRow, processed int, rowErrors []ImportRowError) error {
+	ctx, cancel := context.WithTimeout(context.Background(), operationTimeout)
+	defer cancel()
+
+	var created, updated int
+	var err error
+	if im.dryRun {
+		created, updated, err = im.preview(ctx, rows)
+	} else {
+		var writeErrors []ImportRowError
+		created, updated, writeErrors, err = im.write(ctx, rows)
+		rowErrors = append(rowErrors, writeErrors...)
+	}
+	if err != nil {
+		return err
+	}
+
+	imports.update(im.id, func(job *ImportJob) {
+		job.Processed += processed
+		job.Created += created
+		job.Updated += updated
+		failedRows := make(map[int]bool)
+		for _, rowErr := range rowErrors {
+			failedRows[rowErr.Row] = true
+			if len(job.rowErrors) < importMaxReportedErrors {
+				job.rowErrors = append(job.rowErrors, rowErr)
+			}
+		}
+		job.Failed += len(failedRows)
+	})
+	return nil
+}
+
+// preview counts the users a chunk would create and update without writing
+func (im *importer) preview(ctx context.Context, rows []importRow) (created, updated int, err error) {
+	if !im.upsert {
+		return len(rows), 0, nil
+	}
+	var emails []string
+	for _, row := range rows {
+		if row.user.Email != "" {
+			emails = append(emails, row.user.Email)
+		}
+	}
+	existing, err := existingEmails(ctx, emails)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, row := range rows {
+		email := row.user.Email
+		if email != "" && (existing[email] || im.seenEmails[email]) {
+			updated++
+		} else {
+			created++
+		}
+		if email != "" {
+			im.seenEmails[email] = true
+		}
+	}
+	return created, updated, nil
+}
+
+// existingEmails returns the subset of emails used by stored users
+func existingEmails(ctx context.Context, emails []string) (map[string]bool, error) {
+	found := make(map[string]bool, len(emails))
+	if len(emails) == 0 {
+		return found, nil
+	}
+	cur, err := mongoCollection.Find(ctx, bson.M{"email": bson.M{"$in": emails}}, options.Find().SetProjection(bson.M{"email": 1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(context.Background())
+	for cur.Next(ctx) {
+		var doc struct {
+			Email string `bson:"email"`
+		}
+		if err := cur.Decode(&doc); err != nil {
+			return nil, err
+		}
+		found[doc.Email] = true
+	}
+	return found, cur.Err()
+}
+
+// write stores a chunk with an ordered BulkWrite, so rows sharing an email are
+// applied in file order. A failed row is reported and the writes after it are
+// resubmitted. Like CreateUser, it mails a verification token to each created
+// user with an email once the chunk is written.
+func (im *importer) write(ctx context.Context, rows []importRow) (created, updated int, rowErrors []ImportRowError, err error) {
+	writes := make([]mongo.WriteModel, len(rows))
+	upserts := make([]bool, len(rows))
+	users := make([]models.User, len(rows))
+	tokens := make([]string, len(rows))
+	now := time.Now()
+	for i, row := range rows {
+		user := row.user
+		if user.Email != "" {
+			if user.EmailVerification, tokens[i], err = newEmailVerification(now); err != nil {
+				return 0, 0, nil, err
+			}
+		}
+		if im.upsert && user.Email != "" {
+			upserts[i] = true
+			// Users that already exist keep their password and the
+			// verification of their email
+			update := user
+			update.Password, update.EmailVerification = "", nil
+			onInsert := bson.M{"email_verification": user.EmailVerification}
+			if user.Password != "" {
+				onInsert["password"] = user.Password
+			}
+			writes[i] = mongo.NewUpdateOneModel().
+				SetFilter(bson.M{"email": user.Email}).
+				SetUpdate(bson.M{"$set": update, "$setOnInsert": onInsert}).
+				SetUpsert(true)
+		} else {
+			user.ID = primitive.NewObjectID()
+			writes[i] = mongo.NewInsertOneModel().SetDocument(user)
+		}
+		users[i] = user
+	}
+
+	var inserted []int
+
+	for start := 0; start < len(writes); {
+		result, err := mongoCollection.BulkWrite(ctx, writes[start:], options.BulkWrite().SetOrdered(true))
+		applied := len(writes) - start
+		if err != nil {
+			var bulkErr mongo.BulkWriteException
+			if !errors.As(err, &bulkErr) || len(bulkErr.WriteErrors) == 0 || bulkErr.WriteConcernError != nil {
+				return 0, 0, nil, err
+			}
+			writeErr := bulkErr.WriteErrors[0]
+			if writeErr.Index < 0 || writeErr.Index >= applied {
+				return 0, 0, nil, err
+			}
+			applied = writeErr.Index
+			message := writeErr.Message
+			if mongo.IsDuplicateKeyError(writeErr) {
+				message = errEmailInUse
+			}
+			rowErrors = append(rowErrors, ImportRowError{Row: rows[start+applied].row, Message: message})
+		}
+		for i := 0; i < applied; i++ {
+			if !upserts[start+i] {
+				inserted = append(inserted, start+i)
+			} else if id, ok := upsertedIDs(result)[int64(i)]; ok {
+				users[start+i].ID, _ = id.(primitive.ObjectID)
+				inserted = append(inserted, start+i)
+			} else {
+				updated++
+			}
+		}
+		start += applied + 1
+	}
+
+	for _, i := range inserted {
+		if tokens[i] != "" {
+			sendVerificationEmail(ctx, users[i], tokens[i])
+		}
+	}
+	return len(inserted), updated, rowErrors, nil
+}
+
+func upsertedIDs(result *mongo.BulkWriteResult) map[int64]interface{} {
+	if result == nil {
+		return nil
+	}
+	return result.UpsertedIDs
+}
+
+// csvRowReader reads a CSV file whose header row names the User fields. Empty
+// cells are treated as absent and unknown columns are ignored.
+type csvRowReader struct {
+	reader  *csv.Reader
+	columns []string
+}
+
+func newCSVRowReader(r io.Reader) (rowReader, error) {
+	reader := csv.NewReader(r)
+	reader.ReuseRecord = true
+	header, err := reader.Read()
+	if errors.Is(err, io.EOF) {
+		return nil, errors.New("CSV file has no header row")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid CSV header: %w", err)
+	}
+	columns := make([]string, len(header))
+	known := false
+	for i, name := range header {
+		columns[i] = strings.TrimSpace(strings.TrimPrefix(name, "\ufeff"))
+		switch columns[i] {
+		case "name", "email", "password":
+			known = true
+		}
+	}
+	if !known {
+		return nil, errors.New("CSV header must contain at least one of the columns name, email and password")
+	}
+	return &csvRowReader{reader: reader, columns: columns}, nil
+}
+
+func (c *csvRowReader) next() (int, map[string]interface{}, error) {
+	record, err := c.reader.Read()
+	if err != nil {
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			return parseErr.StartLine, nil, &rowError{row: parseErr.StartLine, message: parseErr.Err.Error()}
+		}
+		return 0, nil, err
+	}
+	row, _ := c.reader.FieldPos(0)
+	value := make(map[string]interface{}, len(record))
+	for i, cell := range record {
+		if cell != "" {
+			value[c.columns[i]] = csvUnescape(cell)
+		}
+	}
+	return row, value, nil
+}
+
+// csvUnescape reverses csvSafe, so an export can be imported unchanged
+func csvUnescape(value string) string {
+	if len(value) > 1 && value[0] == '\'' && strings.ContainsAny(value[1:2], "=+-@\t\r") {
+		return value[1:]
+	}
+	return value
+}
+
+// ndjsonRowReader reads one JSON object per line, skipping blank lines
+type ndjsonRowReader struct {
+	scanner *bufio.Scanner
+	line    int
+}
+
+func newNDJSONRowReader(r io.Reader) (rowReader, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), importMaxLineBytes)
+	return &ndjsonRowReader{scanner: scanner}, nil
+}
+
+func (n *ndjsonRowReader) next() (int, map[string]interface{}, error) {
+	for n.scanner.Scan() {
+		n.line++
+		line := bytes.TrimSpace(n.scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		decoder := json.NewDecoder(bytes.NewReader(line))
+		decoder.UseNumber()
+		var value interface{}
+		if err := decoder.Decode(&value); err != nil || decoder.More() {
+			return n.line, nil, &rowError{row: n.line, message: "must be valid JSON"}
+		}
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return n.line, nil, &rowError{row: n.line, message: "must be a JSON object"}
+		}
+		return n.line, object, nil
+	}
+	if err := n.scanner.Err(); err != nil {
+		if errors.Is(err, bufio.ErrTooLong) {
+			return 0, nil, fmt.Errorf("line %d exceeds %d bytes", n.line+1, importMaxLineBytes)
+		}
+		return 0, nil, err
+	}
+	return 0, nil, io.EOF
+}
@@ -0,0 +1,298 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lep13/golang-restful-api/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// startImport uploads a file and waits for the import to finish
+func startImport(t *testing.T, url, contentType, body string) ImportJob {
+	req, _ := http.NewRequest("POST", url, strings.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	rr := httptest.NewRecorder()
+	req = signedIn()(req)
+	http.HandlerFunc(CreateImport).ServeHTTP(rr, req)
+	require.Equal(t, http.StatusAccepted, rr.Code, rr.Body.String())
+
+	var job ImportJob
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &job))
+	assert.Equal(t, "/v1/imports/"+job.ID, rr.Header().Get("Location"))
+	assert.Equal(t, "/v1/imports/"+job.ID+"/errors", job.ErrorReport)
+
+	require.Eventually(t, func() bool {
+		job = getImport(t, job.ID)
+		return job.Status == ImportCompleted || job.Status == ImportFailed
+	}, 5*time.Second, 5*time.Millisecond)
+	return job
+}
+
+func getImport(t *testing.T, id string) ImportJob {
+	req, _ := http.NewRequest("GET", "/v1/imports/"+id, nil)
+	req = mux.SetURLVars(req, map[string]string{"id": id})
+	rr := httptest.NewRecorder()
+	req = signedIn()(req)
+	http.HandlerFunc(GetImport).ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+	var job ImportJob
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &job))
+	return job
+}
+
+func importErrorReport(id string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("GET", "/v1/imports/"+id+"/errors", nil)
+	req = mux.SetURLVars(req, map[string]string{"id": id})
+	rr := httptest.NewRecorder()
+	req = signedIn()(req)
+	http.HandlerFunc(GetImportErrors).ServeHTTP(rr, req)
+	return rr
+}
+
+func TestCreateImport_CSV(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	mockCollection.On("BulkWrite", mock.Anything, mock.MatchedBy(func(writes []mongo.WriteModel) bool {
+		if len(writes) != 2 {
+			return false
+		}
+		first := writes[0].(*mongo.InsertOneModel).Document.(models.User)
+		second := writes[1].(*mongo.InsertOneModel).Document.(models.User)
+		// Exported values escaped against CSV injection are restored
+		return first.Name == "John Doe" && !first.ID.IsZero() && second.Name == "=Jane"
+	})).Return(&mongo.BulkWriteResult{InsertedCount: 2}, nil)
+
+	body := "_id,name,email,unknown\n" +
+		"66f0c2a1e4b0a1b2c3d4e5f6,John Doe,john@example.com,x\n" +
+		"nope,Bad Email,not-an-email,\n" +
+		",'=Jane,,\n"
+	job := startImport(t, "/v1/imports", "text/csv", body)
+
+	assert.Equal(t, ImportCompleted, job.Status)
+	assert.Equal(t, "csv", job.Format)
+	assert.Equal(t, 3, job.Processed)
+	assert.Equal(t, 2, job.Created)
+	assert.Equal(t, 1, job.Failed)
+	assert.NotNil(t, job.FinishedAt)
+
+	rr := importErrorReport(job.ID)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "text/csv; charset=utf-8", rr.Header().Get("Content-Type"))
+	assert.Equal(t, "row,field,message\n3,email,must be a valid email address\n", rr.Body.String())
+	mockCollection.AssertExpectations(t)
+}
+
+func TestCreateImport_NDJSONUpsert(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	mockCollection.On("BulkWrite", mock.Anything, mock.MatchedBy(func(writes []mongo.WriteModel) bool {
+		if len(writes) != 3 {
+			return false
+		}
+		upsert := writes[0].(*mongo.UpdateOneModel)
+		_, insert := writes[2].(*mongo.InsertOneModel)
+		return upsert.Filter.(bson.M)["email"] == "john@example.com" && *upsert.Upsert && insert
+	})).Return(&mongo.BulkWriteResult{UpsertedIDs: map[int64]interface{}{0: "new"}}, nil)
+
+	body := `{"name": "John Doe", "email": "john@example.com"}` + "\n" +
+		"\n" +
+		`{"name": 5}` + "\n" +
+		`{"name": "Johnny", "email": "john@example.com"}` + "\n" +
+		`not json` + "\n" +
+		`["array"]` + "\n" +
+		`{"name": "No Email"}`
+	job := startImport(t, "/v1/imports?upsert=true", "application/x-ndjson", body)
+
+	assert.Equal(t, ImportCompleted, job.Status)
+	assert.True(t, job.Upsert)
+	assert.Equal(t, 6, job.Processed)
+	assert.Equal(t, 2, job.Created)
+	assert.Equal(t, 1, job.Updated)
+	assert.Equal(t, 3, job.Failed)
+	assert.Equal(t, "row,field,message\n"+
+		"3,name,\"must be of type string, got integer\"\n"+
+		"5,,must be valid JSON\n"+
+		"6,,must be a JSON object\n", importErrorReport(job.ID).Body.String())
+}
+
+func TestCreateImport_MailsCreatedUsers(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	sender := new(recordingMailer)
+	defer setupMailer(sender)()
+	johnID := primitive.NewObjectID()
+	var writes []mongo.WriteModel
+	mockCollection.On("BulkWrite", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		writes = args.Get(1).([]mongo.WriteModel)
+	}).Return(&mongo.BulkWriteResult{UpsertedIDs: map[int64]interface{}{0: johnID}}, nil)
+
+	body := `{"name": "John", "email": "john@example.com"}` + "\n" +
+		`{"name": "Jane", "email": "jane@example.com"}` + "\n" +
+		`{"name": "No Email"}`
+	job := startImport(t, "/v1/imports?upsert=true", "application/x-ndjson", body)
+
+	assert.Equal(t, 2, job.Created)
+	assert.Equal(t, 1, job.Updated)
+	// Jane already existed: she keeps the verification of her email and is not mailed
+	messages := sender.sent()
+	require.Len(t, messages, 1)
+	assert.Equal(t, "john@example.com", messages[0].To)
+	assert.Contains(t, messages[0].Body, "/v1/users/"+johnID.Hex()+"/verify-email")
+	update := writes[0].(*mongo.UpdateOneModel).Update.(bson.M)
+	assert.Nil(t, update["$set"].(models.User).EmailVerification)
+	verification := update["$setOnInsert"].(bson.M)["email_verification"].(*models.EmailVerification)
+	assert.Equal(t, hashToken(tokenPattern.FindString(messages[0].Body)), verification.TokenHash)
+}
+
+func TestCreateImport_Passwords(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	var writes []mongo.WriteModel
+	mockCollection.On("BulkWrite", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		writes = args.Get(1).([]mongo.WriteModel)
+	}).Return(&mongo.BulkWriteResult{}, nil)
+
+	body := `{"name": "John", "email": "john@example.com", "password": "correct horse"}` + "\n" +
+		`{"name": "Jane", "email": "jane@example.com", "password": "short"}`
+	job := startImport(t, "/v1/imports?upsert=true", "application/x-ndjson", body)
+
+	assert.Equal(t, 1, job.Updated)
+	assert.Equal(t, 1, job.Failed)
+	require.Len(t, writes, 1)
+	// An existing user keeps their password; a created one gets the hash
+	update := writes[0].(*mongo.UpdateOneModel).Update.(bson.M)
+	assert.Empty(t, update["$set"].(models.User).Password)
+	assert.True(t, checkPassword(update["$setOnInsert"].(bson.M)["password"].(string), "correct horse"))
+	rr := importErrorReport(job.ID)
+	assert.Contains(t, rr.Body.String(), "2,password,Password must be at least 8 characters")
+}
+
+func TestCreateImport_DryRun(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	mockCollection.On("Find", mock.Anything, bson.M{"email": bson.M{"$in": []string{"john@example.com", "jane@example.com", "jane@example.com"}}}).
+		Return(usersCursor(models.User{Email: "john@example.com"}), nil)
+
+	body := "email,name\njohn@example.com,John\njane@example.com,Jane\njane@example.com,Janet\n,Anonymous\n"
+	job := startImport(t, "/v1/imports?dryRun=true&upsert=true", "text/csv; charset=utf-8", body)
+
+	assert.Equal(t, ImportCompleted, job.Status)
+	assert.True(t, job.DryRun)
+	assert.Equal(t, 4, job.Processed)
+	assert.Equal(t, 2, job.Created)
+	assert.Equal(t, 2, job.Updated)
+	mockCollection.AssertNotCalled(t, "BulkWrite", mock.Anything, mock.Anything)
+}
+
+func TestCreateImport_WriteErrorResumesAfterFailedRow(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	mockCollection.On("BulkWrite", mock.Anything, mock.MatchedBy(func(writes []mongo.WriteModel) bool {
+		return len(writes) == 3
+	})).Return(&mongo.BulkWriteResult{InsertedCount: 1}, duplicateKeyAt(1)).Once()
+	mockCollection.On("BulkWrite", mock.Anything, mock.MatchedBy(func(writes []mongo.WriteModel) bool {
+		return len(writes) == 1 && writes[0].(*mongo.InsertOneModel).Document.(models.User).Name == "Third"
+	})).Return(&mongo.BulkWriteResult{InsertedCount: 1}, nil).Once()
+
+	job := startImport(t, "/v1/imports", "text/csv", "name\nFirst\nSecond\nThird\n")
+
+	assert.Equal(t, ImportCompleted, job.Status)
+	assert.Equal(t, 2, job.Created)
+	assert.Equal(t, 1, job.Failed)
+	assert.Equal(t, "row,field,message\n3,,Email is already in use\n", importErrorReport(job.ID).Body.String())
+	mockCollection.AssertExpectations(t)
+}
+
+func TestCreateImport_JobFailure(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	mockCollection.On("BulkWrite", mock.Anything, mock.Anything).Return(nil, mongo.CommandError{Message: "connection refused", Labels: []string{"NetworkError"}})
+
+	job := startImport(t, "/v1/imports", "text/csv", "name\nJohn\n")
+	assert.Equal(t, ImportFailed, job.Status)
+	assert.Contains(t, job.Error, "connection refused")
+
+	job = startImport(t, "/v1/imports", "text/csv", "first,last\nJohn,Doe\n")
+	assert.Equal(t, ImportFailed, job.Status)
+	assert.Equal(t, "CSV header must contain at least one of the columns name, email and password", job.Error)
+}
+
+func TestCreateImport_InvalidRequest(t *testing.T) {
+	for _, tc := range []struct {
+		url, contentType, body string
+		status                 int
+		message                string
+	}{
+		{"/v1/imports", "application/json", `{"name": "John"}`, http.StatusUnsupportedMediaType, "Content-Type must be text/csv or application/x-ndjson"},
+		{"/v1/imports", "", "name\nJohn\n", http.StatusUnsupportedMediaType, "Content-Type must be text/csv or application/x-ndjson"},
+		{"/v1/imports?dryRun=maybe", "text/csv", "name\nJohn\n", http.StatusBadRequest, "Invalid dryRun parameter"},
+		{"/v1/imports?upsert=maybe", "text/csv", "name\nJohn\n", http.StatusBadRequest, "Invalid upsert parameter"},
+		{"/v1/imports", "text/csv", "", http.StatusBadRequest, "Import file is empty"},
+	} {
+		req, _ := http.NewRequest("POST", tc.url, strings.NewReader(tc.body))
+		if tc.contentType != "" {
+			req.Header.Set("Content-Type", tc.contentType)
+		}
+		rr := httptest.NewRecorder()
+		req = signedIn()(req)
+		http.HandlerFunc(CreateImport).ServeHTTP(rr, req)
+
+		assert.Equal(t, tc.status, rr.Code, tc.url)
+		assert.Contains(t, rr.Body.String(), tc.message)
+	}
+
+	// Bodies over the upload limit are rejected while spooling
+	req, _ := http.NewRequest("POST", "/v1/imports", strings.NewReader("name\nJohn\n"))
+	req.Header.Set("Content-Type", "text/csv")
+	rr := httptest.NewRecorder()
+	req.Body = http.MaxBytesReader(rr, req.Body, 4)
+	req = signedIn()(req)
+	http.HandlerFunc(CreateImport).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rr.Code)
+}
+
+func TestImports_Anonymous(t *testing.T) {
+	id := "66f0c2a1e4b0a1b2c3d4e5f6"
+	for _, tc := range []struct {
+		handler http.HandlerFunc
+		method  string
+		target  string
+	}{
+		{CreateImport, "POST", "/v1/imports"},
+		{GetImport, "GET", "/v1/imports/" + id},
+		{GetImportErrors, "GET", "/v1/imports/" + id + "/errors"},
+	} {
+		req, _ := http.NewRequest(tc.method, tc.target, strings.NewReader("name\nJohn\n"))
+		req.Header.Set("Content-Type", "text/csv")
+		req = mux.SetURLVars(req, map[string]string{"id": id})
+		rr := httptest.NewRecorder()
+		tc.handler.ServeHTTP(rr, req)
+
+		assert.Equal(t, http.StatusUnauthorized, rr.Code, tc.target)
+		assert.JSONEq(t, `{"error":"Authentication required"}`, rr.Body.String())
+	}
+}
+
+func TestGetImport_NotFound(t *testing.T) {
+	for _, handler := range []http.HandlerFunc{GetImport, GetImportErrors} {
+		req, _ := http.NewRequest("GET", "/v1/imports/66f0c2a1e4b0a1b2c3d4e5f6", nil)
+		req = mux.SetURLVars(req, map[string]string{"id": "66f0c2a1e4b0a1b2c3d4e5f6"})
+		req = signedIn()(req)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		assert.Equal(t, http.StatusNotFound, rr.Code)
+		assert.JSONEq(t, `{"error":"Import not found"}`, rr.Body.String())
+	}
+}
@@ -0,0 +1,318 @@
+package handlers
+
+import (
+	"context"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lep13/golang-restful-api/audit"
+	"github.com/lep13/golang-restful-api/config"
+	"github.com/lep13/golang-restful-api/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	// maxLoginDelay caps the delay after a failed login, which doubles with
+	// each failure
+	maxLoginDelay = time.Minute
+
+	// failureSweepInterval is how often failures that no longer count are
+	// dropped from a failureTracker
+	failureSweepInterval = time.Minute
+)
+
+var (
+	lockout = config.LockoutConfig{
+		MaxAttempts:   5,
+		Duration:      15 * time.Minute,
+		IPMaxAttempts: 50,
+		Window:        15 * time.Minute,
+		Delay:         time.Second,
+	}
+
+	// ipFailures counts the failed logins of each client IP. emailFailures
+	// counts those of emails without an account, which are delayed and locked
+	// like accounts so the responses do not tell which emails have one. Both
+	// are kept in memory, per instance.
+	ipFailures    = newFailureTracker()
+	emailFailures = newFailureTracker()
+
+	// lockouts counts the lockouts since the process started
+	lockouts = new(lockoutCounters)
+)
+
+type lockoutCounters struct {
+	accounts, ips, emails atomic.Int64
+}
+
+// LockoutCounts are the lockouts an instance has applied since it started,
+// for metrics: a climbing count points at credential stuffing or at a
+// threshold set too low.
+type LockoutCounts struct {
+	// Accounts locked after failed logins
+	Accounts int64 `json:"accounts"`
+	// IPs locked after failed logins from them
+	IPs int64 `json:"ips"`
+	// Emails without an account locked like accounts
+	Emails int64 `json:"emails"`
+}
+
+// Lockouts returns the lockout counts of this instance
+func Lockouts() LockoutCounts {
+	return LockoutCounts{
+		Accounts: lockouts.accounts.Load(),
+		IPs:      lockouts.ips.Load(),
+		Emails:   lockouts.emails.Load(),
+	}
+}
+
+// SetLockout sets the thresholds of the login delays and lockouts
+func SetLockout(cfg config.LockoutConfig) {
+	if cfg.Duration <= 0 {
+		cfg.Duration = lockout.Duration
+	}
+	if cfg.Window <= 0 {
+		cfg.Window = lockout.Window
+	}
+	lockout = cfg
+}
+
+// LockStatus reports whether failed logins have locked out a user
+type LockStatus struct {
+	Locked         bool       `json:"locked"`
+	LockedUntil    *time.Time `json:"locked_until,omitempty"`
+	FailedAttempts int        `json:"failed_attempts"`
+}
+
+// recentFailures returns the failures that still count at now: none once a
+// lockout has ended, or after a window without failures
+func recentFailures(f *models.LoginFailures, now time.Time) models.LoginFailures {
+	if f == nil {
+		return models.LoginFailures{}
+	}
+	if !f.LockedUntil.IsZero() {
+		if now.Before(f.LockedUntil) {
+			return *f
+		}
+		return models.LoginFailures{}
+	}
+	if now.Sub(f.LastFailedAt) >= lockout.Window {
+		return models.LoginFailures{}
+	}
+	return *f
+}
+
+// loginWait returns how long the next login with failures f has to wait:
+// until the lockout ends, or for the delay after the last failure
+func loginWait(f models.LoginFailures, now time.Time) time.Duration {
+	if now.Before(f.LockedUntil) {
+		return f.LockedUntil.Sub(now)
+	}
+	if f.Count == 0 || lockout.Delay <= 0 {
+		return 0
+	}
+	delay := maxLoginDelay
+	if f.Count <= 16 && lockout.Delay<<(f.Count-1) < maxLoginDelay {
+		delay = lockout.Delay << (f.Count - 1)
+	}
+	if wait := f.LastFailedAt.Add(delay).Sub(now); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// writeLoginThrottled answers a login attempt made before wait has passed
+func writeLoginThrottled(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	writeError(w, "Too many failed login attempts", http.StatusTooManyRequests)
+}
+
+// checkIPLockout writes 429 when the client IP of the request is locked out
+func checkIPLockout(w http.ResponseWriter, r *http.Request, now time.Time) bool {
+	if f := ipFailures.get(clientIP(r), now); now.Before(f.LockedUntil) {
+		writeLoginThrottled(w, f.LockedUntil.Sub(now))
+		return false
+	}
+	return true
+}
+
+// recordLoginFailure counts a failed login against the client IP and the
+// account, or the email when it has no account, locking them out once they
+// reach their threshold. failures are the recent failures of the account.
+func recordLoginFailure(ctx context.Context, r *http.Request, user models.User, email string, failures models.LoginFailures, now time.Time) {
+	ip := clientIP(r)
+	if f, locked := ipFailures.fail(ip, now, lockout.IPMaxAttempts); locked {
+		lockouts.ips.Add(1)
+		recordAudit(audit.LoginIPLocked, "", ip, lockDetails(f))
+	}
+	if user.ID.IsZero() {
+		// Not audited, as there is no user to record it against
+		if _, locked := emailFailures.fail(normalizeEmail(email), now, lockout.MaxAttempts); locked {
+			lockouts.emails.Add(1)
+		}
+		return
+	}
+
+	next := models.LoginFailures{Count: failures.Count + 1, LastFailedAt: now}
+	locked := lockout.MaxAttempts > 0 && next.Count >= lockout.MaxAttempts
+	if locked {
+		next.LockedUntil = now.Add(lockout.Duration)
+	}
+	var update bson.M
+	if failures.Count == 0 {
+		// Replacing the record drops failures that no longer count
+		update = bson.M{"$set": bson.M{"login_failures": next}}
+	} else {
+		// Incrementing counts concurrent failures once each
+		set := bson.M{"login_failures.last_failed_at": now}
+		if locked {
+			set["login_failures.locked_until"] = next.LockedUntil
+		}
+		update = bson.M{"$inc": bson.M{"login_failures.count": 1}, "$set": set}
+	}
+	if _, err := mongoCollection.UpdateOne(ctx, bson.M{"_id": user.ID}, update); err != nil {
+		log.Printf("Failed to record a failed login of user %s: %v", user.ID.Hex(), err)
+		return
+	}
+	if locked {
+		lockouts.accounts.Add(1)
+		recordAudit(audit.AccountLocked, user.ID.Hex(), ip, lockDetails(next))
+	}
+}
+
+func lockDetails(f models.LoginFailures) map[string]string {
+	return map[string]string{
+		"attempts":     strconv.Itoa(f.Count),
+		"locked_until": f.LockedUntil.UTC().Format(time.RFC3339),
+	}
+}
+
+// resetLoginFailures forgets the failed logins of a user who logged in.
+// Errors are logged; the failures then expire with their window.
+func resetLoginFailures(ctx context.Context, user models.User) {
+	if user.LoginFailures == nil {
+		return
+	}
+	_, err := mongoCollection.UpdateOne(ctx, bson.M{"_id": user.ID}, bson.M{"$unset": bson.M{"login_failures": ""}})
+	if err != nil {
+		log.Printf("Failed to reset the failed logins of user %s: %v", user.ID.Hex(), err)
+	}
+}
+
+// GetLock reports whether failed logins have locked out the user. Users may
+// see their own status, and admins that of any user.
+func GetLock(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, "Invalid ID format", http.StatusBadRequest)
+		return
+	}
+	if !requireSelfOrAdmin(w, r, id) {
+		return
+	}
+
+	ctx, cancel := dbContext(r)
+	defer cancel()
+	var user models.User
+	if err := mongoCollection.FindOne(ctx, bson.M{"_id": id}).Decode(&user); err != nil {
+		if err == mongo.ErrNoDocuments {
+			writeError(w, "User not found", http.StatusNotFound)
+		} else {
+			writeDBError(w, err)
+		}
+		return
+	}
+	now := time.Now()
+	failures := recentFailures(user.LoginFailures, now)
+	status := LockStatus{Locked: now.Before(failures.LockedUntil), FailedAttempts: failures.Count}
+	if status.Locked {
+		status.LockedUntil = &failures.LockedUntil
+	}
+	writeJSON(w, status)
+}
+
+// Unlock lifts the lockout of a user and forgets their failed logins. Only
+// admins may unlock users.
+func Unlock(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, "Invalid ID format", http.StatusBadRequest)
+		return
+	}
+	admin, ok := requireAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := dbContext(r)
+	defer cancel()
+	res, err := mongoCollection.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$unset": bson.M{"login_failures": ""}})
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if res.MatchedCount == 0 {
+		writeError(w, "User not found", http.StatusNotFound)
+		return
+	}
+	recordAudit(audit.AccountUnlocked, id.Hex(), clientIP(r), map[string]string{"admin_id": admin.ID.Hex()})
+	writeJSON(w, LockStatus{})
+}
+
+// failureTracker counts failed logins in memory, by client IP or email
+type failureTracker struct {
+	mu        sync.Mutex
+	failures  map[string]models.LoginFailures
+	lastSweep time.Time
+}
+
+func newFailureTracker() *failureTracker {
+	return &failureTracker{failures: make(map[string]models.LoginFailures)}
+}
+
+// get returns the failures of key that still count at now
+func (t *failureTracker) get(key string, now time.Time) models.LoginFailures {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	f, ok := t.failures[key]
+	if !ok {
+		return models.LoginFailures{}
+	}
+	return recentFailures(&f, now)
+}
+
+// fail counts a failure of key, locking it out when it reaches max failures,
+// and reports whether it did
+func (t *failureTracker) fail(key string, now time.Time, max int) (models.LoginFailures, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if now.Sub(t.lastSweep) >= failureSweepInterval {
+		for k, f := range t.failures {
+			if recentFailures(&f, now).Count == 0 {
+				delete(t.failures, k)
+			}
+		}
+		t.lastSweep = now
+	}
+
+	f := t.failures[key]
+	f = recentFailures(&f, now)
+	f.Count++
+	f.LastFailedAt = now
+	locked := max > 0 && f.Count >= max && !now.Before(f.LockedUntil)
+	if locked {
+		f.LockedUntil = now.Add(lockout.Duration)
+	}
+	t.failures[key] = f
+	return f, locked
+}
@@ -0,0 +1,405 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/lep13/golang-restful-api/audit"
+	"github.com/lep13/golang-restful-api/config"
+	"github.com/lep13/golang-restful-api/models"
+	"github.com/lep13/golang-restful-api/totp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// testLockout are the lockout thresholds of the tests
+var testLockout = config.LockoutConfig{MaxAttempts: 3, Duration: 15 * time.Minute, IPMaxAttempts: 10, Window: 15 * time.Minute, Delay: time.Second}
+
+// setupLockout sets the lockout thresholds and starts the failure counts of
+// client IPs and unknown emails, and the lockout counts, over, returning a
+// function restoring them
+func setupLockout(cfg config.LockoutConfig) func() {
+	saved, savedIPs, savedEmails, savedLockouts := lockout, ipFailures, emailFailures, lockouts
+	lockout, ipFailures, emailFailures, lockouts = cfg, newFailureTracker(), newFailureTracker(), new(lockoutCounters)
+	return func() {
+		lockout, ipFailures, emailFailures, lockouts = saved, savedIPs, savedEmails, savedLockouts
+	}
+}
+
+// assertRetryAfter checks that Retry-After asks to wait at most want seconds,
+// less the time the test took
+func assertRetryAfter(t *testing.T, rr *httptest.ResponseRecorder, want int) {
+	seconds, err := strconv.Atoi(rr.Header().Get("Retry-After"))
+	require.NoError(t, err)
+	assert.InDelta(t, want, seconds, 2)
+	assert.LessOrEqual(t, seconds, want)
+}
+
+func TestLoginWait(t *testing.T) {
+	defer setupLockout(testLockout)()
+	now := time.Now()
+
+	for _, tc := range []struct {
+		name     string
+		failures models.LoginFailures
+		want     time.Duration
+	}{
+		{"no failures", models.LoginFailures{}, 0},
+		{"first failure", models.LoginFailures{Count: 1, LastFailedAt: now}, time.Second},
+		{"doubled", models.LoginFailures{Count: 3, LastFailedAt: now.Add(-time.Second)}, 3 * time.Second},
+		{"capped", models.LoginFailures{Count: 40, LastFailedAt: now}, maxLoginDelay},
+		{"delay over", models.LoginFailures{Count: 2, LastFailedAt: now.Add(-time.Minute)}, 0},
+		{"locked", models.LoginFailures{Count: 3, LastFailedAt: now, LockedUntil: now.Add(10 * time.Minute)}, 10 * time.Minute},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, loginWait(tc.failures, now))
+		})
+	}
+
+	lockout.Delay = 0
+	assert.Zero(t, loginWait(models.LoginFailures{Count: 2, LastFailedAt: now}, now))
+}
+
+func TestRecentFailures(t *testing.T) {
+	defer setupLockout(testLockout)()
+	now := time.Now()
+
+	recent := &models.LoginFailures{Count: 2, LastFailedAt: now.Add(-time.Minute)}
+	assert.Equal(t, *recent, recentFailures(recent, now))
+	assert.Zero(t, recentFailures(&models.LoginFailures{Count: 2, LastFailedAt: now.Add(-time.Hour)}, now))
+	locked := &models.LoginFailures{Count: 3, LastFailedAt: now.Add(-time.Hour), LockedUntil: now.Add(time.Minute)}
+	assert.Equal(t, *locked, recentFailures(locked, now))
+	assert.Zero(t, recentFailures(&models.LoginFailures{Count: 3, LastFailedAt: now.Add(-time.Hour), LockedUntil: now.Add(-time.Minute)}, now))
+	assert.Zero(t, recentFailures(nil, now))
+}
+
+func TestFailureTracker(t *testing.T) {
+	defer setupLockout(testLockout)()
+	tracker := newFailureTracker()
+	now := time.Now()
+
+	f, locked := tracker.fail("203.0.113.7", now, 2)
+	assert.False(t, locked)
+	assert.Equal(t, 1, f.Count)
+	f, locked = tracker.fail("203.0.113.7", now, 2)
+	assert.True(t, locked)
+	assert.Equal(t, now.Add(15*time.Minute), f.LockedUntil)
+	assert.Equal(t, f, tracker.get("203.0.113.7", now))
+	assert.Zero(t, tracker.get("198.51.100.1", now))
+
+	// The count starts over once the lockout ends, and idle entries are dropped
+	later := now.Add(time.Hour)
+	assert.Zero(t, tracker.get("203.0.113.7", later))
+	f, locked = tracker.fail("198.51.100.1", later, 2)
+	assert.False(t, locked)
+	assert.Equal(t, 1, f.Count)
+	assert.Len(t, tracker.failures, 1)
+}
+
+func TestLogin_CountsFailures(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	defer setupLockout(testLockout)()
+	user := models.User{ID: primitive.NewObjectID(), Email: "john@example.com", Password: hashedPassword(t, "correct horse")}
+	findByEmail(mockCollection, "john@example.com", user, nil)
+	var update bson.M
+	mockCollection.On("UpdateOne", mock.Anything, bson.M{"_id": user.ID}, mock.Anything).Run(func(args mock.Arguments) {
+		update = args.Get(2).(bson.M)
+	}).Return(&mongo.UpdateResult{MatchedCount: 1}, nil)
+
+	rr := serve(Login, "POST", "/v1/auth/login", `{"email": "john@example.com", "password": "wrong horse"}`)
+
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	failures := update["$set"].(bson.M)["login_failures"].(models.LoginFailures)
+	assert.Equal(t, 1, failures.Count)
+	assert.WithinDuration(t, time.Now(), failures.LastFailedAt, time.Second)
+	assert.True(t, failures.LockedUntil.IsZero())
+}
+
+func TestLogin_LocksAccount(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	defer setupLockout(testLockout)()
+	auditLog := new(recordingAuditLogger)
+	defer setupAuditLogger(auditLog)()
+	user := models.User{
+		ID:            primitive.NewObjectID(),
+		Email:         "john@example.com",
+		Password:      hashedPassword(t, "correct horse"),
+		LoginFailures: &models.LoginFailures{Count: 2, LastFailedAt: time.Now().Add(-10 * time.Second)},
+	}
+	findByEmail(mockCollection, "john@example.com", user, nil)
+	var update bson.M
+	mockCollection.On("UpdateOne", mock.Anything, bson.M{"_id": user.ID}, mock.Anything).Run(func(args mock.Arguments) {
+		update = args.Get(2).(bson.M)
+	}).Return(&mongo.UpdateResult{MatchedCount: 1}, nil)
+
+	rr := serve(Login, "POST", "/v1/auth/login", `{"email": "john@example.com", "password": "wrong horse"}`)
+
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	assert.Equal(t, bson.M{"login_failures.count": 1}, update["$inc"])
+	lockedUntil := update["$set"].(bson.M)["login_failures.locked_until"].(time.Time)
+	assert.WithinDuration(t, time.Now().Add(15*time.Minute), lockedUntil, time.Second)
+	events := auditLog.recorded()
+	require.Len(t, events, 1)
+	assert.Equal(t, audit.AccountLocked, events[0].Action)
+	assert.Equal(t, user.ID.Hex(), events[0].UserID)
+	assert.Equal(t, "203.0.113.7", events[0].IP)
+	assert.Equal(t, "3", events[0].Details["attempts"])
+	assert.Equal(t, LockoutCounts{Accounts: 1}, Lockouts())
+}
+
+func TestLogin_Throttled(t *testing.T) {
+	now := time.Now()
+	for _, tc := range []struct {
+		name       string
+		failures   *models.LoginFailures
+		retryAfter int
+	}{
+		{"delayed", &models.LoginFailures{Count: 2, LastFailedAt: now}, 2},
+		{"locked", &models.LoginFailures{Count: 3, LastFailedAt: now, LockedUntil: now.Add(10 * time.Minute)}, 600},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mockCollection := new(MockCollection)
+			defer SetupMockCollection(mockCollection)()
+			defer setupLockout(testLockout)()
+			user := models.User{ID: primitive.NewObjectID(), Email: "john@example.com", Password: hashedPassword(t, "correct horse"), LoginFailures: tc.failures}
+			findByEmail(mockCollection, "john@example.com", user, nil)
+
+			// Even the right password is refused until the wait is over
+			rr := serve(Login, "POST", "/v1/auth/login", `{"email": "john@example.com", "password": "correct horse"}`)
+
+			assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+			assertRetryAfter(t, rr, tc.retryAfter)
+			assert.JSONEq(t, `{"error":"Too many failed login attempts"}`, rr.Body.String())
+			mockCollection.AssertNotCalled(t, "UpdateOne", mock.Anything, mock.Anything, mock.Anything)
+		})
+	}
+}
+
+func TestLogin_ThrottlesUnknownEmails(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	cfg := testLockout
+	cfg.Delay = 30 * time.Second
+	defer setupLockout(cfg)()
+	findByEmail(mockCollection, "nobody@example.com", models.User{}, mongo.ErrNoDocuments)
+
+	rr := serve(Login, "POST", "/v1/auth/login", `{"email": "nobody@example.com", "password": "wrong horse"}`)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	// Answered like an account with one failure
+	rr = serve(Login, "POST", "/v1/auth/login", `{"email": "nobody@example.com", "password": "wrong horse"}`)
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assertRetryAfter(t, rr, 30)
+	assert.JSONEq(t, `{"error":"Too many failed login attempts"}`, rr.Body.String())
+}
+
+func TestLogin_LocksIP(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	defer setupLockout(config.LockoutConfig{IPMaxAttempts: 2, Duration: time.Minute, Window: time.Minute})()
+	auditLog := new(recordingAuditLogger)
+	defer setupAuditLogger(auditLog)()
+	findByEmail(mockCollection, "nobody@example.com", models.User{}, mongo.ErrNoDocuments)
+
+	for i := 0; i < 2; i++ {
+		rr := serve(Login, "POST", "/v1/auth/login", `{"email": "nobody@example.com", "password": "wrong horse"}`)
+		assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	}
+	rr := serve(Login, "POST", "/v1/auth/login", `{"email": "john@example.com", "password": "correct horse"}`)
+
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assertRetryAfter(t, rr, 60)
+	events := auditLog.recorded()
+	require.Len(t, events, 1)
+	assert.Equal(t, audit.LoginIPLocked, events[0].Action)
+	assert.Equal(t, "203.0.113.7", events[0].IP)
+	assert.Empty(t, events[0].UserID)
+	assert.Equal(t, LockoutCounts{IPs: 1}, Lockouts())
+}
+
+func TestLogin_CountsEmailLockouts(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	defer setupLockout(config.LockoutConfig{MaxAttempts: 2, Duration: time.Minute, Window: time.Minute})()
+	auditLog := new(recordingAuditLogger)
+	defer setupAuditLogger(auditLog)()
+	findByEmail(mockCollection, "nobody@example.com", models.User{}, mongo.ErrNoDocuments)
+
+	for i := 0; i < 2; i++ {
+		rr := serve(Login, "POST", "/v1/auth/login", `{"email": "nobody@example.com", "password": "wrong horse"}`)
+		assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	}
+
+	assert.Equal(t, LockoutCounts{Emails: 1}, Lockouts())
+	assert.Empty(t, auditLog.recorded())
+}
+
+func TestLogin_ResetsFailures(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	defer setupLockout(testLockout)()
+	defer setupAuditLogger(new(recordingAuditLogger))()
+	user := models.User{
+		ID:            primitive.NewObjectID(),
+		Email:         "john@example.com",
+		Password:      hashedPassword(t, "correct horse"),
+		LoginFailures: &models.LoginFailures{Count: 2, LastFailedAt: time.Now().Add(-time.Minute)},
+	}
+	findByEmail(mockCollection, "john@example.com", user, nil)
+	mockCollection.On("UpdateOne", mock.Anything, bson.M{"_id": user.ID}, bson.M{"$unset": bson.M{"login_failures": ""}}).Return(&mongo.UpdateResult{MatchedCount: 1}, nil)
+	acceptSessions(mockCollection, user.ID)
+
+	rr := serve(Login, "POST", "/v1/auth/login", `{"email": "john@example.com", "password": "correct horse"}`)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	mockCollection.AssertExpectations(t)
+}
+
+func TestLoginMFA_CountsFailures(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	defer setupLockout(testLockout)()
+	id := primitive.NewObjectID()
+	user := models.User{ID: id, MFA: &models.MFA{Enabled: true, Secret: testSecret}}
+	findUser(mockCollection, id, user, nil)
+	var update bson.M
+	mockCollection.On("UpdateOne", mock.Anything, bson.M{"_id": id}, mock.Anything).Run(func(args mock.Arguments) {
+		update = args.Get(2).(bson.M)
+	}).Return(&mongo.UpdateResult{MatchedCount: 1}, nil)
+	wrong, _ := totp.Code(testSecret, totp.Step(time.Now())+10)
+
+	rr := serve(LoginMFA, "POST", "/v1/auth/login/mfa", `{"mfa_token": "`+mfaToken(t, id)+`", "code": "`+wrong+`"}`)
+
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	assert.Equal(t, 1, update["$set"].(bson.M)["login_failures"].(models.LoginFailures).Count)
+
+	// A locked account cannot complete its login either
+	user.LoginFailures = &models.LoginFailures{Count: 3, LastFailedAt: time.Now(), LockedUntil: time.Now().Add(time.Minute)}
+	mockCollection = new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	findUser(mockCollection, id, user, nil)
+	code, _ := totp.Code(testSecret, totp.Step(time.Now()))
+
+	rr = serve(LoginMFA, "POST", "/v1/auth/login/mfa", `{"mfa_token": "`+mfaToken(t, id)+`", "code": "`+code+`"}`)
+
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	mockCollection.AssertNotCalled(t, "UpdateOne", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestGetLock(t *testing.T) {
+	id := primitive.NewObjectID()
+	adminID := primitive.NewObjectID()
+	otherID := primitive.NewObjectID()
+	lockedUntil := time.Now().Add(10 * time.Minute).UTC().Truncate(time.Second)
+	locked := models.User{ID: id, LoginFailures: &models.LoginFailures{Count: 3, LastFailedAt: time.Now(), LockedUntil: lockedUntil}}
+
+	for _, tc := range []struct {
+		name     string
+		callerID string
+		status   int
+	}{
+		{"self", id.Hex(), http.StatusOK},
+		{"admin", adminID.Hex(), http.StatusOK},
+		{"other user", otherID.Hex(), http.StatusForbidden},
+		{"anonymous", "", http.StatusUnauthorized},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mockCollection := new(MockCollection)
+			defer SetupMockCollection(mockCollection)()
+			findUser(mockCollection, id, locked, nil)
+			findUser(mockCollection, adminID, models.User{ID: adminID, Admin: true}, nil)
+			findUser(mockCollection, otherID, models.User{ID: otherID}, nil)
+
+			rr := serve(GetLock, "GET", "/v1/users/"+id.Hex()+"/lock", "", withVars("id", id.Hex()), as(tc.callerID))
+
+			require.Equal(t, tc.status, rr.Code, rr.Body.String())
+			if tc.status != http.StatusOK {
+				return
+			}
+			var status LockStatus
+			require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &status))
+			assert.True(t, status.Locked)
+			assert.Equal(t, 3, status.FailedAttempts)
+			assert.Equal(t, lockedUntil, status.LockedUntil.UTC())
+		})
+	}
+}
+
+func TestGetLock_Expired(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	defer setupLockout(testLockout)()
+	id := primitive.NewObjectID()
+	findUser(mockCollection, id, models.User{ID: id, LoginFailures: &models.LoginFailures{Count: 3, LockedUntil: time.Now().Add(-time.Minute)}}, nil)
+
+	rr := serve(GetLock, "GET", "/v1/users/"+id.Hex()+"/lock", "", withVars("id", id.Hex()), as(id.Hex()))
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, `{"locked": false, "failed_attempts": 0}`, rr.Body.String())
+}
+
+func TestUnlock(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	auditLog := new(recordingAuditLogger)
+	defer setupAuditLogger(auditLog)()
+	id := primitive.NewObjectID()
+	adminID := primitive.NewObjectID()
+	findUser(mockCollection, adminID, models.User{ID: adminID, Admin: true}, nil)
+	mockCollection.On("UpdateOne", mock.Anything, bson.M{"_id": id}, bson.M{"$unset": bson.M{"login_failures": ""}}).Return(&mongo.UpdateResult{MatchedCount: 1}, nil)
+
+	rr := serve(Unlock, "DELETE", "/v1/users/"+id.Hex()+"/lock", "", withVars("id", id.Hex()), as(adminID.Hex()))
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, `{"locked": false, "failed_attempts": 0}`, rr.Body.String())
+	mockCollection.AssertExpectations(t)
+	events := auditLog.recorded()
+	require.Len(t, events, 1)
+	assert.Equal(t, audit.AccountUnlocked, events[0].Action)
+	assert.Equal(t, id.Hex(), events[0].UserID)
+	assert.Equal(t, map[string]string{"admin_id": adminID.Hex()}, events[0].Details)
+}
+
+func TestUnlock_Rejected(t *testing.T) {
+	id := primitive.NewObjectID()
+	callerID := primitive.NewObjectID()
+
+	for _, tc := range []struct {
+		name     string
+		callerID string
+		caller   models.User
+		matched  int64
+		status   int
+		error    string
+	}{
+		{"anonymous", "", models.User{}, 1, http.StatusUnauthorized, "Authentication required"},
+		{"not an admin", callerID.Hex(), models.User{ID: callerID}, 1, http.StatusForbidden, "Admin access required"},
+		{"the user themselves", id.Hex(), models.User{ID: id}, 1, http.StatusForbidden, "Admin access required"},
+		{"unknown user", callerID.Hex(), models.User{ID: callerID, Admin: true}, 0, http.StatusNotFound, "User not found"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mockCollection := new(MockCollection)
+			defer SetupMockCollection(mockCollection)()
+			findUser(mockCollection, tc.caller.ID, tc.caller, nil)
+			mockCollection.On("UpdateOne", mock.Anything, mock.Anything, mock.Anything).Return(&mongo.UpdateResult{MatchedCount: tc.matched}, nil)
+
+			rr := serve(Unlock, "DELETE", "/v1/users/"+id.Hex()+"/lock", "", withVars("id", id.Hex()), as(tc.callerID))
+
+			assert.Equal(t, tc.status, rr.Code)
+			assert.Contains(t, rr.Body.String(), tc.error)
+			if tc.status != http.StatusNotFound {
+				mockCollection.AssertNotCalled(t, "UpdateOne", mock.Anything, mock.Anything, mock.Anything)
+			}
+		})
+	}
+}
@@ -0,0 +1,380 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lep13/golang-restful-api/audit"
+	"github.com/lep13/golang-restful-api/jwt"
+	"github.com/lep13/golang-restful-api/middleware"
+	"github.com/lep13/golang-restful-api/models"
+	"github.com/lep13/golang-restful-api/totp"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Purposes of the tokens issued at login; a token is only accepted for its own
+const (
+	accessTokenPurpose = "access"
+	mfaTokenPurpose    = "mfa"
+	// oauthTokenPurpose marks the access tokens issued to OAuth clients
+	oauthTokenPurpose = "oauth"
+)
+
+// mfaTokenTTL is how long a user has to enter their code after the password
+const mfaTokenTTL = 5 * time.Minute
+
+// codeSkew is the number of 30 second steps a TOTP code may be early or late,
+// for clocks that drift
+const codeSkew = 1
+
+var (
+	tokenSigner    = jwt.NewHS256(randomKey())
+	accessTokenTTL = time.Hour
+)
+
+// tokenClaims are the claims of the tokens issued at login
+type tokenClaims struct {
+	jwt.Claims
+	Purpose string `json:"purpose"`
+	// AMR lists how the user authenticated (RFC 8176): pwd, fed at an
+	// upstream identity provider or email with a login link, plus otp after MFA
+	AMR []string `json:"amr,omitempty"`
+	// SessionID names the session of an access token
+	SessionID string `json:"sid,omitempty"`
+	// Scope and ClientID limit the access tokens issued to OAuth clients
+	Scope    string `json:"scope,omitempty"`
+	ClientID string `json:"client_id,omitempty"`
+}
+
+// TokenResponse is returned by a successful login
+type TokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+// MFAChallenge is returned by the first step of the login of a user with MFA
+type MFAChallenge struct {
+	MFARequired bool   `json:"mfa_required"`
+	MFAToken    string `json:"mfa_token"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+func randomKey() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return key
+}
+
+// SetTokenSigning sets the key signing the tokens issued at login and how long
+// access tokens are valid. Until a key is set, tokens are signed with a random
+// key, so they do not survive a restart nor work across instances.
+func SetTokenSigning(key []byte, ttl time.Duration) {
+	if len(key) > 0 {
+		tokenSigner = jwt.NewHS256(key)
+	}
+	if ttl > 0 {
+		accessTokenTTL = ttl
+	}
+}
+
+func issueToken(userID primitive.ObjectID, sessionID, purpose string, amr []string, ttl time.Duration) (string, error) {
+	id, _, err := newToken()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	return tokenSigner.Sign(tokenClaims{
+		Claims:    jwt.Claims{ID: id, Subject: userID.Hex(), IssuedAt: now.Unix(), ExpiresAt: now.Add(ttl).Unix()},
+		Purpose:   purpose,
+		AMR:       amr,
+		SessionID: sessionID,
+	})
+}
+
+// parseToken verifies a token issued for one of purposes and returns its user
+func parseToken(token string, purposes ...string) (tokenClaims, primitive.ObjectID, error) {
+	var claims tokenClaims
+	if err := tokenSigner.Verify(token, &claims); err != nil {
+		return claims, primitive.NilObjectID, err
+	}
+	if err := claims.Valid(time.Now()); err != nil {
+		return claims, primitive.NilObjectID, err
+	}
+	known := false
+	for _, purpose := range purposes {
+		known = known || claims.Purpose == purpose
+	}
+	if !known {
+		return claims, primitive.NilObjectID, jwt.ErrInvalid
+	}
+	id, err := primitive.ObjectIDFromHex(claims.Subject)
+	if err != nil {
+		return claims, primitive.NilObjectID, jwt.ErrInvalid
+	}
+	return claims, id, nil
+}
+
+// AuthenticateToken is the middleware.TokenVerifier of the access tokens
+// issued at login and to OAuth clients, the latter limited to their scopes. A
+// token is only accepted while its session exists, so tokens of revoked
+// sessions and deleted users are rejected, and so are tokens issued before
+// the sessions of their user were revoked, as by a password reset. Valid
+// sessions are cached for a while; see SetSessionCache. The SCIM tokens are
+// accepted too, for no user and with only the ScopeSCIM scope.
+func AuthenticateToken(ctx context.Context, token string) (string, []string, error) {
+	if isSCIMToken(token) {
+		return "", []string{ScopeSCIM}, nil
+	}
+	claims, id, err := parseToken(token, accessTokenPurpose, oauthTokenPurpose)
+	if err != nil {
+		return "", nil, middleware.ErrInvalidCredentials
+	}
+	sessionID, err := primitive.ObjectIDFromHex(claims.SessionID)
+	if err != nil {
+		return "", nil, middleware.ErrInvalidCredentials
+	}
+	var scopes []string
+	if claims.Purpose == oauthTokenPurpose {
+		scopes = append([]string{}, strings.Fields(claims.Scope)...)
+	}
+	now := time.Now()
+	if validSessions.valid(claims.SessionID, claims.Subject, now) {
+		return id.Hex(), scopes, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, operationTimeout)
+	defer cancel()
+	ok, err := checkSession(ctx, id, sessionID, claims.IssuedAt)
+	if err != nil {
+		return "", nil, err
+	}
+	if !ok {
+		return "", nil, middleware.ErrInvalidCredentials
+	}
+	validSessions.add(claims.SessionID, claims.Subject, now)
+	return id.Hex(), scopes, nil
+}
+
+// Login checks the email and password of a user. A user without MFA receives
+// an access token. A user with MFA receives a short-lived MFA token instead,
+// to exchange for an access token with a code at LoginMFA. Failed logins
+// delay the next attempt on the account, then lock it out, and too many from
+// one client IP lock out the IP; see LockoutConfig.
+func Login(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var body struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+	if !decodeBody(w, r, &body) {
+		return
+	}
+	if body.Email == "" || body.Password == "" {
+		writeError(w, "Email and password are required", http.StatusBadRequest)
+		return
+	}
+	body.Email = normalizeEmail(body.Email)
+	now := time.Now()
+	if !checkIPLockout(w, r, now) {
+		return
+	}
+
+	ctx, cancel := dbContext(r)
+	defer cancel()
+	var user models.User
+	err := mongoCollection.FindOne(ctx, bson.M{"email": body.Email}).Decode(&user)
+	if err != nil && err != mongo.ErrNoDocuments {
+		writeDBError(w, err)
+		return
+	}
+	// An unknown email is throttled and costs as much as a wrong password, so
+	// the two cannot be told apart
+	var failures models.LoginFailures
+	if user.ID.IsZero() {
+		failures = emailFailures.get(body.Email, now)
+	} else {
+		failures = recentFailures(user.LoginFailures, now)
+	}
+	if wait := loginWait(failures, now); wait > 0 {
+		writeLoginThrottled(w, wait)
+		return
+	}
+	if !checkPassword(user.Password, body.Password) {
+		recordLoginFailure(ctx, r, user, body.Email, failures, now)
+		writeError(w, "Invalid email or password", http.StatusUnauthorized)
+		return
+	}
+	if rejectDeactivated(w, user) {
+		return
+	}
+
+	// The failures of a user with MFA are kept until the second step, so
+	// guessing codes cannot be restarted with the password
+	if user.MFA != nil && user.MFA.Enabled {
+		writeMFAChallenge(w, user.ID, []string{"pwd"})
+		return
+	}
+	resetLoginFailures(ctx, user)
+	writeAccessToken(ctx, w, r, user.ID, []string{"pwd"})
+}
+
+// writeMFAChallenge writes the MFA token of a user with MFA who completed the
+// first login step in the ways listed in amr
+func writeMFAChallenge(w http.ResponseWriter, userID primitive.ObjectID, amr []string) {
+	token, err := issueToken(userID, "", mfaTokenPurpose, amr, mfaTokenTTL)
+	if err != nil {
+		writeError(w, "Failed to issue token", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, MFAChallenge{MFARequired: true, MFAToken: token, ExpiresIn: int(mfaTokenTTL.Seconds())})
+}
+
+// rejectDeactivated writes 403 when the user was deactivated over SCIM and
+// may not log in
+func rejectDeactivated(w http.ResponseWriter, user models.User) bool {
+	if user.Deactivated {
+		writeError(w, "Account is deactivated", http.StatusForbidden)
+	}
+	return user.Deactivated
+}
+
+// LoginMFA completes the login of a user with MFA, exchanging the MFA token
+// from Login and either a TOTP code or a recovery code for an access token.
+// Each code is accepted once: a TOTP code cannot be replayed, even within its
+// 30 seconds, and a recovery code is removed when used. Wrong codes count as
+// failed logins of the account.
+func LoginMFA(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var body struct {
+		MFAToken     string `json:"mfa_token"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+	if !decodeBody(w, r, &body) {
+		return
+	}
+	if (body.Code == "") == (body.RecoveryCode == "") {
+		writeError(w, "Either code or recovery_code is required", http.StatusBadRequest)
+		return
+	}
+	now := time.Now()
+	if !checkIPLockout(w, r, now) {
+		return
+	}
+	claims, id, err := parseToken(body.MFAToken, mfaTokenPurpose)
+	if err != nil {
+		writeError(w, "Invalid or expired MFA token", http.StatusUnauthorized)
+		return
+	}
+
+	ctx, cancel := dbContext(r)
+	defer cancel()
+	var user models.User
+	if err := mongoCollection.FindOne(ctx, bson.M{"_id": id}).Decode(&user); err != nil {
+		if err == mongo.ErrNoDocuments {
+			writeError(w, "Invalid or expired MFA token", http.StatusUnauthorized)
+		} else {
+			writeDBError(w, err)
+		}
+		return
+	}
+	// The password may have been reset since the first step
+	if user.MFA == nil || !user.MFA.Enabled || claims.IssuedAt < user.SessionsRevokedAt.Unix() {
+		writeError(w, "Invalid or expired MFA token", http.StatusUnauthorized)
+		return
+	}
+	if rejectDeactivated(w, user) {
+		return
+	}
+	failures := recentFailures(user.LoginFailures, now)
+	if wait := loginWait(failures, now); wait > 0 {
+		writeLoginThrottled(w, wait)
+		return
+	}
+
+	if body.RecoveryCode != "" {
+		hash := hashToken(normalizeRecoveryCode(body.RecoveryCode))
+		// Pulling the code only if present makes using it atomic
+		res, err := mongoCollection.UpdateOne(ctx,
+			bson.M{"_id": id, "mfa.enabled": true, "mfa.recovery_codes": hash},
+			bson.M{"$pull": bson.M{"mfa.recovery_codes": hash}})
+		if err != nil {
+			writeDBError(w, err)
+			return
+		}
+		if res.MatchedCount == 0 {
+			recordLoginFailure(ctx, r, user, user.Email, failures, now)
+			writeError(w, "Invalid recovery code", http.StatusUnauthorized)
+			return
+		}
+		recordAudit(audit.MFARecoveryCodeUsed, id.Hex(), clientIP(r), map[string]string{
+			"remaining": strconv.Itoa(len(user.MFA.RecoveryCodes) - 1),
+		})
+	} else {
+		step, ok := totp.Validate(user.MFA.Secret, body.Code, now, codeSkew)
+		if !ok {
+			recordLoginFailure(ctx, r, user, user.Email, failures, now)
+			writeError(w, "Invalid code", http.StatusUnauthorized)
+			return
+		}
+		if !useCodeStep(ctx, w, id, user.MFA.Secret, step) {
+			return
+		}
+	}
+	resetLoginFailures(ctx, user)
+	writeAccessToken(ctx, w, r, id, append(append([]string{}, claims.AMR...), "otp"))
+}
+
+// useCodeStep records the time step of an accepted code, writing 401 when a
+// code of that step or a later one was already used
+func useCodeStep(ctx context.Context, w http.ResponseWriter, id primitive.ObjectID, secret string, step int64) bool {
+	res, err := mongoCollection.UpdateOne(ctx,
+		bson.M{"_id": id, "mfa.secret": secret, "mfa.last_step": bson.M{"$lt": step}},
+		bson.M{"$set": bson.M{"mfa.last_step": step}})
+	if err != nil {
+		writeDBError(w, err)
+		return false
+	}
+	if res.MatchedCount == 0 {
+		writeError(w, "Code already used", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// writeAccessToken starts a session of the user and writes its access token
+func writeAccessToken(ctx context.Context, w http.ResponseWriter, r *http.Request, userID primitive.ObjectID, amr []string) {
+	session, err := startSession(ctx, r, userID, "")
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	token, err := issueToken(userID, session.ID.Hex(), accessTokenPurpose, amr, accessTokenTTL)
+	if err != nil {
+		writeError(w, "Failed to issue token", http.StatusInternalServerError)
+		return
+	}
+	recordAudit(audit.LoginSucceeded, userID.Hex(), clientIP(r), map[string]string{
+		"amr":        strings.Join(amr, " "),
+		"session_id": session.ID.Hex(),
+	})
+	writeJSON(w, TokenResponse{AccessToken: token, TokenType: "Bearer", ExpiresIn: int(accessTokenTTL.Seconds())})
+}
+
+// writeJSON writes value as a 200 response
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.Println("Error encoding JSON response:", err)
+	}
+}
@@ -0,0 +1,265 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/lep13/golang-restful-api/audit"
+	"github.com/lep13/golang-restful-api/jwt"
+	"github.com/lep13/golang-restful-api/middleware"
+	"github.com/lep13/golang-restful-api/models"
+	"github.com/lep13/golang-restful-api/totp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testSecret is a TOTP secret for the tests
+const testSecret = "JBSWY3DPEHPK3PXPJBSWY3DPEHPK3PXP"
+
+func hashedPassword(t *testing.T, password string) string {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	require.NoError(t, err)
+	return string(hash)
+}
+
+func decodeTokenResponse(t *testing.T, body []byte) TokenResponse {
+	var response TokenResponse
+	require.NoError(t, json.Unmarshal(body, &response))
+	return response
+}
+
+func TestLogin(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	auditLog := new(recordingAuditLogger)
+	defer setupAuditLogger(auditLog)()
+	user := models.User{ID: primitive.NewObjectID(), Email: "john@example.com", Password: hashedPassword(t, "correct horse")}
+	findByEmail(mockCollection, "john@example.com", user, nil)
+	sessions := acceptSessions(mockCollection, user.ID)
+
+	// Emails are stored in lower case and matched ignoring case
+	rr := serve(Login, "POST", "/v1/auth/login", `{"email": "John@Example.com", "password": "correct horse"}`)
+
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	response := decodeTokenResponse(t, rr.Body.Bytes())
+	assert.Equal(t, "Bearer", response.TokenType)
+	assert.Equal(t, 3600, response.ExpiresIn)
+	claims, id, err := parseToken(response.AccessToken, accessTokenPurpose)
+	assert.NoError(t, err)
+	assert.Equal(t, user.ID, id)
+	// The token names the session recorded for the login
+	require.Len(t, *sessions, 1)
+	session := (*sessions)[0]
+	assert.Equal(t, session.ID.Hex(), claims.SessionID)
+	assert.Equal(t, "203.0.113.7", session.IP)
+	assert.Equal(t, time.Hour, session.ExpiresAt.Sub(session.CreatedAt))
+	events := auditLog.recorded()
+	require.Len(t, events, 1)
+	assert.Equal(t, audit.LoginSucceeded, events[0].Action)
+	assert.Equal(t, map[string]string{"amr": "pwd", "session_id": session.ID.Hex()}, events[0].Details)
+	// Nothing else is written
+	mockCollection.AssertNumberOfCalls(t, "UpdateOne", 1)
+}
+
+func TestLogin_Rejected(t *testing.T) {
+	hash := hashedPassword(t, "correct horse")
+	for _, tc := range []struct {
+		name   string
+		body   string
+		user   models.User
+		err    error
+		status int
+		error  string
+	}{
+		{"wrong password", `{"email": "john@example.com", "password": "wrong horse"}`, models.User{Password: hash}, nil, http.StatusUnauthorized, "Invalid email or password"},
+		{"unhashed password", `{"email": "john@example.com", "password": "correct horse"}`, models.User{Password: "correct horse"}, nil, http.StatusUnauthorized, "Invalid email or password"},
+		{"unknown email", `{"email": "john@example.com", "password": "correct horse"}`, models.User{}, mongo.ErrNoDocuments, http.StatusUnauthorized, "Invalid email or password"},
+		{"no password", `{"email": "john@example.com", "password": "correct horse"}`, models.User{}, nil, http.StatusUnauthorized, "Invalid email or password"},
+		{"missing password", `{"email": "john@example.com"}`, models.User{}, nil, http.StatusBadRequest, "Email and password are required"},
+		{"deactivated", `{"email": "john@example.com", "password": "correct horse"}`, models.User{Password: hash, Deactivated: true}, nil, http.StatusForbidden, "Account is deactivated"},
+		{"database down", `{"email": "john@example.com", "password": "correct horse"}`, models.User{}, mongo.CommandError{Labels: []string{"NetworkError"}}, http.StatusServiceUnavailable, "Database unavailable"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mockCollection := new(MockCollection)
+			defer SetupMockCollection(mockCollection)()
+			defer setupLockout(lockout)()
+			findByEmail(mockCollection, "john@example.com", tc.user, tc.err)
+
+			rr := serve(Login, "POST", "/v1/auth/login", tc.body)
+
+			assert.Equal(t, tc.status, rr.Code)
+			assert.Contains(t, rr.Body.String(), tc.error)
+			assert.NotContains(t, rr.Body.String(), "access_token")
+		})
+	}
+}
+
+func TestLogin_MFARequired(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	user := models.User{ID: primitive.NewObjectID(), Email: "john@example.com", Password: hashedPassword(t, "correct horse"), MFA: &models.MFA{Enabled: true, Secret: testSecret}}
+	findByEmail(mockCollection, "john@example.com", user, nil)
+	findUser(mockCollection, user.ID, user, nil)
+
+	rr := serve(Login, "POST", "/v1/auth/login", `{"email": "john@example.com", "password": "correct horse"}`)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var challenge MFAChallenge
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &challenge))
+	assert.True(t, challenge.MFARequired)
+	assert.Equal(t, 300, challenge.ExpiresIn)
+	assert.NotContains(t, rr.Body.String(), "access_token")
+	// The MFA token is no access token
+	_, _, err := AuthenticateToken(context.Background(), challenge.MFAToken)
+	assert.ErrorIs(t, err, middleware.ErrInvalidCredentials)
+}
+
+func mfaToken(t *testing.T, id primitive.ObjectID) string {
+	token, err := issueToken(id, "", mfaTokenPurpose, []string{"pwd"}, mfaTokenTTL)
+	require.NoError(t, err)
+	return token
+}
+
+func TestLoginMFA(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	defer setupAuditLogger(new(recordingAuditLogger))()
+	user := models.User{ID: primitive.NewObjectID(), MFA: &models.MFA{Enabled: true, Secret: testSecret, LastStep: 1}}
+	findUser(mockCollection, user.ID, user, nil)
+	step := totp.Step(time.Now())
+	code, _ := totp.Code(testSecret, step)
+	acceptSessions(mockCollection, user.ID)
+	mockCollection.On("UpdateOne", mock.Anything, bson.M{"_id": user.ID, "mfa.secret": testSecret, "mfa.last_step": bson.M{"$lt": step}},
+		bson.M{"$set": bson.M{"mfa.last_step": step}}).Return(&mongo.UpdateResult{MatchedCount: 1}, nil)
+
+	rr := serve(LoginMFA, "POST", "/v1/auth/login/mfa", fmt.Sprintf(`{"mfa_token": %q, "code": %q}`, mfaToken(t, user.ID), code))
+
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	claims, _, err := parseToken(decodeTokenResponse(t, rr.Body.Bytes()).AccessToken, accessTokenPurpose)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"pwd", "otp"}, claims.AMR)
+}
+
+func TestLoginMFA_RecoveryCode(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	auditLog := new(recordingAuditLogger)
+	defer setupAuditLogger(auditLog)()
+	hash := hashToken("abcdefghijklmnop")
+	user := models.User{ID: primitive.NewObjectID(), MFA: &models.MFA{Enabled: true, Secret: testSecret, RecoveryCodes: []string{"other", hash}}}
+	findUser(mockCollection, user.ID, user, nil)
+	acceptSessions(mockCollection, user.ID)
+	mockCollection.On("UpdateOne", mock.Anything, bson.M{"_id": user.ID, "mfa.enabled": true, "mfa.recovery_codes": hash},
+		bson.M{"$pull": bson.M{"mfa.recovery_codes": hash}}).Return(&mongo.UpdateResult{MatchedCount: 1}, nil)
+
+	rr := serve(LoginMFA, "POST", "/v1/auth/login/mfa", fmt.Sprintf(`{"mfa_token": %q, "recovery_code": "ABCD-EFGH-IJKL-MNOP"}`, mfaToken(t, user.ID)))
+
+	assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	events := auditLog.recorded()
+	require.Len(t, events, 2)
+	assert.Equal(t, audit.MFARecoveryCodeUsed, events[0].Action)
+	assert.Equal(t, map[string]string{"remaining": "1"}, events[0].Details)
+	assert.Equal(t, audit.LoginSucceeded, events[1].Action)
+}
+
+func TestLoginMFA_Rejected(t *testing.T) {
+	id := primitive.NewObjectID()
+	enabled := models.User{ID: id, MFA: &models.MFA{Enabled: true, Secret: testSecret}}
+	code, _ := totp.Code(testSecret, totp.Step(time.Now()))
+	wrong, _ := totp.Code(testSecret, totp.Step(time.Now())+10)
+	access, _ := issueToken(id, primitive.NewObjectID().Hex(), accessTokenPurpose, []string{"pwd"}, time.Hour)
+	expired, _ := issueToken(id, "", mfaTokenPurpose, []string{"pwd"}, -time.Minute)
+
+	for _, tc := range []struct {
+		name    string
+		token   string
+		body    string
+		user    models.User
+		matched int64
+		status  int
+		error   string
+	}{
+		{"replayed code", mfaToken(t, id), `"code": "` + code + `"`, enabled, 0, http.StatusUnauthorized, "Code already used"},
+		{"wrong code", mfaToken(t, id), `"code": "` + wrong + `"`, enabled, 1, http.StatusUnauthorized, "Invalid code"},
+		{"used recovery code", mfaToken(t, id), `"recovery_code": "abcd-efgh-ijkl-mnop"`, enabled, 0, http.StatusUnauthorized, "Invalid recovery code"},
+		{"access token", access, `"code": "` + code + `"`, enabled, 1, http.StatusUnauthorized, "Invalid or expired MFA token"},
+		{"expired token", expired, `"code": "` + code + `"`, enabled, 1, http.StatusUnauthorized, "Invalid or expired MFA token"},
+		{"mfa disabled", mfaToken(t, id), `"code": "` + code + `"`, models.User{ID: id}, 1, http.StatusUnauthorized, "Invalid or expired MFA token"},
+		{"password reset since", mfaToken(t, id), `"code": "` + code + `"`, models.User{ID: id, MFA: enabled.MFA, SessionsRevokedAt: time.Now().Add(time.Minute)}, 1, http.StatusUnauthorized, "Invalid or expired MFA token"},
+		{"code and recovery code", mfaToken(t, id), `"code": "` + code + `", "recovery_code": "abcd"`, enabled, 1, http.StatusBadRequest, "Either code or recovery_code is required"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mockCollection := new(MockCollection)
+			defer SetupMockCollection(mockCollection)()
+			defer setupLockout(lockout)()
+			findUser(mockCollection, id, tc.user, nil)
+			mockCollection.On("UpdateOne", mock.Anything, mock.Anything, mock.Anything).Return(&mongo.UpdateResult{MatchedCount: tc.matched}, nil)
+
+			rr := serve(LoginMFA, "POST", "/v1/auth/login/mfa", `{"mfa_token": "`+tc.token+`", `+tc.body+`}`)
+
+			assert.Equal(t, tc.status, rr.Code)
+			assert.Contains(t, rr.Body.String(), tc.error)
+		})
+	}
+}
+
+func TestAuthenticateToken(t *testing.T) {
+	defer setupSessionCache(0)()
+	id := primitive.NewObjectID()
+	sessionID := primitive.NewObjectID()
+	token := sessionToken(t, id, sessionID)
+	noSession, _ := issueToken(id, "", accessTokenPurpose, []string{"pwd"}, time.Hour)
+	forged, _ := jwt.NewHS256([]byte("another key of at least 32 bytes")).Sign(tokenClaims{
+		Claims:    jwt.Claims{Subject: id.Hex(), IssuedAt: time.Now().Unix(), ExpiresAt: time.Now().Add(time.Hour).Unix()},
+		Purpose:   accessTokenPurpose,
+		SessionID: sessionID.Hex(),
+	})
+	session := models.Session{ID: sessionID, LastSeenAt: time.Now(), ExpiresAt: time.Now().Add(time.Hour)}
+	other := models.Session{ID: primitive.NewObjectID(), LastSeenAt: time.Now(), ExpiresAt: time.Now().Add(time.Hour)}
+	expired := models.Session{ID: sessionID, LastSeenAt: time.Now(), ExpiresAt: time.Now().Add(-time.Second)}
+
+	for _, tc := range []struct {
+		name  string
+		token string
+		user  models.User
+		err   error
+		want  error
+	}{
+		{"valid", token, models.User{ID: id, Sessions: []models.Session{other, session}}, nil, nil},
+		{"revoked before", token, models.User{ID: id, Sessions: []models.Session{session}, SessionsRevokedAt: time.Now().Add(-time.Hour)}, nil, nil},
+		{"revoked since", token, models.User{ID: id, Sessions: []models.Session{session}, SessionsRevokedAt: time.Now().Add(time.Minute)}, nil, middleware.ErrInvalidCredentials},
+		{"revoked session", token, models.User{ID: id, Sessions: []models.Session{other}}, nil, middleware.ErrInvalidCredentials},
+		{"expired session", token, models.User{ID: id, Sessions: []models.Session{expired}}, nil, middleware.ErrInvalidCredentials},
+		{"no session", noSession, models.User{ID: id, Sessions: []models.Session{session}}, nil, middleware.ErrInvalidCredentials},
+		{"deleted user", token, models.User{}, mongo.ErrNoDocuments, middleware.ErrInvalidCredentials},
+		{"other key", forged, models.User{ID: id, Sessions: []models.Session{session}}, nil, middleware.ErrInvalidCredentials},
+		{"garbage", "garbage", models.User{ID: id}, nil, middleware.ErrInvalidCredentials},
+		{"database down", token, models.User{}, errors.New("connection refused"), errors.New("connection refused")},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mockCollection := new(MockCollection)
+			defer SetupMockCollection(mockCollection)()
+			findUser(mockCollection, id, tc.user, tc.err)
+
+			userID, scopes, err := AuthenticateToken(context.Background(), tc.token)
+
+			if tc.want == nil {
+				assert.NoError(t, err)
+				assert.Equal(t, id.Hex(), userID)
+				assert.Nil(t, scopes, "login tokens have the full access of the user")
+			} else {
+				assert.EqualError(t, err, tc.want.Error())
+			}
+		})
+	}
+}
@@ -0,0 +1,261 @@
+package handlers
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/lep13/golang-restful-api/audit"
+	"github.com/lep13/golang-restful-api/config"
+	"github.com/lep13/golang-restful-api/jwt"
+	"github.com/lep13/golang-restful-api/mailer"
+	"github.com/lep13/golang-restful-api/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	// magicLinkPurpose marks the tokens of login links
+	magicLinkPurpose = "magic_link"
+	// magicLinkCookie binds a login link to the browser that requested it
+	magicLinkCookie = "magic_link_binding"
+	// magicLinkCookiePath limits the binding cookie to the login link routes
+	magicLinkCookiePath = "/v1/auth/magic-link/"
+	// maxBindingLength bounds the binding cookies reused from requests
+	maxBindingLength = 128
+)
+
+var (
+	magicLinkTTL            = 15 * time.Minute
+	magicLinkResendInterval = time.Minute
+	magicLinkURL            string
+)
+
+// SetMagicLink sets how long login links are valid, the least time between
+// two links mailed to an email, and the client page completing the login,
+// which may be empty
+func SetMagicLink(cfg config.MagicLinkConfig) {
+	if cfg.TokenTTL > 0 {
+		magicLinkTTL = cfg.TokenTTL
+	}
+	if cfg.ResendInterval > 0 {
+		magicLinkResendInterval = cfg.ResendInterval
+	}
+	magicLinkURL = cfg.URL
+}
+
+// magicLinkClaims are the claims of the token in a login link. The hash of
+// its ID is stored on the user until the link is used.
+type magicLinkClaims struct {
+	jwt.Claims
+	Purpose string `json:"purpose"`
+	// Binding is the hash of the value of the binding cookie
+	Binding string `json:"binding"`
+}
+
+// RequestMagicLink mails a login link to the user with the given email. Like
+// RequestPasswordReset, the response is 202 whether or not such a user
+// exists, and the lookup happens after responding. The response sets a
+// cookie binding the link to the browser; ConfirmMagicLink requires it, so a
+// link is of no use in another browser. A browser that already holds the
+// cookie keeps it, so a request ignored within the resend interval does not
+// orphan the link already sent.
+func RequestMagicLink(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var body struct {
+		Email string `json:"email"`
+	}
+	if !decodeBody(w, r, &body) {
+		return
+	}
+	if body.Email == "" {
+		writeError(w, "Email is required", http.StatusBadRequest)
+		return
+	}
+
+	var binding string
+	if cookie, err := r.Cookie(magicLinkCookie); err == nil && cookie.Value != "" && len(cookie.Value) <= maxBindingLength {
+		binding = cookie.Value
+	} else if binding, _, err = newToken(); err != nil {
+		writeError(w, "Failed to create login link", http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     magicLinkCookie,
+		Value:    binding,
+		Path:     magicLinkCookiePath,
+		MaxAge:   int(magicLinkTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil || strings.HasPrefix(issuerURL(), "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	ip := clientIP(r)
+	bindingHash := hashToken(binding)
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		startMagicLink(body.Email, bindingHash, ip)
+	}()
+
+	w.WriteHeader(http.StatusAccepted)
+	writeJSON(w, map[string]string{"message": "If an account uses this email, a login link is on its way"})
+}
+
+// startMagicLink stores a new login link for the user with the email and
+// mails it to them. Nothing is sent within the resend interval of the last
+// link, so the endpoint cannot be used to flood a mailbox, nor to deactivated
+// users.
+func startMagicLink(email, bindingHash, ip string) {
+	ctx, cancel := context.WithTimeout(context.Background(), operationTimeout)
+	defer cancel()
+	var user models.User
+	if err := mongoCollection.FindOne(ctx, bson.M{"email": normalizeEmail(email)}).Decode(&user); err != nil {
+		if err != mongo.ErrNoDocuments {
+			log.Printf("Failed to look up user for login link: %v", err)
+		}
+		return
+	}
+	if user.Deactivated {
+		return
+	}
+
+	now := time.Now()
+	filter := bson.M{"_id": user.ID, "magic_link": bson.M{"$exists": false}}
+	if user.MagicLink != nil {
+		if user.MagicLink.SentAt.Add(magicLinkResendInterval).After(now) {
+			return
+		}
+		// Replacing only the link that was read lets one of concurrent requests win
+		filter = bson.M{"_id": user.ID, "magic_link.token_hash": user.MagicLink.TokenHash}
+	}
+	id, hash, err := newToken()
+	if err != nil {
+		log.Printf("Failed to create login link: %v", err)
+		return
+	}
+	link := &models.MagicLink{TokenHash: hash, ExpiresAt: now.Add(magicLinkTTL), SentAt: now}
+	token, err := tokenSigner.Sign(magicLinkClaims{
+		Claims:  jwt.Claims{ID: id, Subject: user.ID.Hex(), IssuedAt: now.Unix(), ExpiresAt: link.ExpiresAt.Unix()},
+		Purpose: magicLinkPurpose,
+		Binding: bindingHash,
+	})
+	if err != nil {
+		log.Printf("Failed to sign login link: %v", err)
+		return
+	}
+	res, err := mongoCollection.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"magic_link": link}})
+	if err != nil {
+		log.Printf("Failed to store login link for user %s: %v", user.ID.Hex(), err)
+		return
+	}
+	if res.MatchedCount == 0 {
+		return
+	}
+	recordAudit(audit.MagicLinkRequested, user.ID.Hex(), ip, nil)
+
+	user.MagicLink = link
+	sendMagicLinkEmail(user, token)
+}
+
+// sendMagicLinkEmail mails the login link to the user
+func sendMagicLinkEmail(user models.User, token string) {
+	ctx, cancel := context.WithTimeout(context.Background(), mailTimeout)
+	defer cancel()
+
+	action := fmt.Sprintf("send this token to POST /v1/auth/magic-link/confirm from the browser that asked for it:\n\n%s", token)
+	if link, err := url.Parse(magicLinkURL); err == nil && magicLinkURL != "" {
+		query := link.Query()
+		query.Set("token", token)
+		link.RawQuery = query.Encode()
+		action = "open this link in the browser you asked for it from:\n\n" + link.String()
+	}
+	expires := user.MagicLink.ExpiresAt.UTC().Format(time.RFC1123)
+	err := mailSender.Send(ctx, mailer.Message{
+		To:      user.Email,
+		Subject: "Your login link",
+		Body: fmt.Sprintf("Hello %s,\n\nTo log in, %s\n\n"+
+			"This expires on %s and can be used once. If you did not ask to log in, you can ignore this email.\n",
+			user.Name, action, expires),
+	})
+	if err != nil {
+		log.Printf("Failed to send login link to user %s: %v", user.ID.Hex(), err)
+	}
+}
+
+// ConfirmMagicLink logs in the user of a login link, from the browser that
+// requested it. The link is consumed, and the response is that of Login: an
+// access token of a new session, or an MFA challenge for users with MFA.
+// Links requested again replace the earlier ones.
+func ConfirmMagicLink(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var body struct {
+		Token string `json:"token"`
+	}
+	if !decodeBody(w, r, &body) {
+		return
+	}
+	if body.Token == "" {
+		writeError(w, "Token is required", http.StatusBadRequest)
+		return
+	}
+	var claims magicLinkClaims
+	if err := tokenSigner.Verify(body.Token, &claims); err != nil ||
+		claims.Valid(time.Now()) != nil || claims.Purpose != magicLinkPurpose {
+		writeError(w, "Invalid or expired login link", http.StatusBadRequest)
+		return
+	}
+	id, err := primitive.ObjectIDFromHex(claims.Subject)
+	if err != nil {
+		writeError(w, "Invalid or expired login link", http.StatusBadRequest)
+		return
+	}
+	cookie, err := r.Cookie(magicLinkCookie)
+	if err != nil || subtle.ConstantTimeCompare([]byte(hashToken(cookie.Value)), []byte(claims.Binding)) != 1 {
+		writeError(w, "Login link was requested in another browser", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := dbContext(r)
+	defer cancel()
+	hash := hashToken(claims.ID)
+	var user models.User
+	err = mongoCollection.FindOne(ctx, bson.M{"_id": id, "magic_link.token_hash": hash}).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		writeError(w, "Invalid or expired login link", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if rejectDeactivated(w, user) {
+		return
+	}
+	// Matching on the link again makes consuming it atomic
+	res, err := mongoCollection.UpdateOne(ctx,
+		bson.M{"_id": id, "magic_link.token_hash": hash},
+		bson.M{"$unset": bson.M{"magic_link": ""}})
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if res.MatchedCount == 0 {
+		writeError(w, "Invalid or expired login link", http.StatusBadRequest)
+		return
+	}
+	// The binding cookie is good for one login
+	http.SetCookie(w, &http.Cookie{Name: magicLinkCookie, Path: magicLinkCookiePath, MaxAge: -1, HttpOnly: true})
+
+	if user.MFA != nil && user.MFA.Enabled {
+		writeMFAChallenge(w, user.ID, []string{"email"})
+		return
+	}
+	writeAccessToken(ctx, w, r, user.ID, []string{"email"})
+}
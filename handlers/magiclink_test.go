@@ -0,0 +1,291 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/lep13/golang-restful-api/audit"
+	"github.com/lep13/golang-restful-api/config"
+	"github.com/lep13/golang-restful-api/jwt"
+	"github.com/lep13/golang-restful-api/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// signedTokenPattern matches the signed tokens in login link emails
+var signedTokenPattern = regexp.MustCompile(`[\w-]+\.[\w-]+\.[\w-]+`)
+
+// bindingCookie returns the binding cookie set by a response
+func bindingCookie(t *testing.T, rr *httptest.ResponseRecorder) *http.Cookie {
+	t.Helper()
+	for _, cookie := range rr.Result().Cookies() {
+		if cookie.Name == magicLinkCookie {
+			return cookie
+		}
+	}
+	require.FailNow(t, "no binding cookie set")
+	return nil
+}
+
+// magicLinkToken signs the token of a login link of the user
+func magicLinkToken(t *testing.T, id primitive.ObjectID, linkID, binding string, ttl time.Duration) string {
+	now := time.Now()
+	token, err := tokenSigner.Sign(magicLinkClaims{
+		Claims:  jwt.Claims{ID: linkID, Subject: id.Hex(), IssuedAt: now.Unix(), ExpiresAt: now.Add(ttl).Unix()},
+		Purpose: magicLinkPurpose,
+		Binding: hashToken(binding),
+	})
+	require.NoError(t, err)
+	return token
+}
+
+// findByMagicLink makes FindOne by login link return user, or err when it is set
+func findByMagicLink(mockCollection *MockCollection, id primitive.ObjectID, linkID string, user models.User, err error) {
+	result := new(MockSingleResult)
+	result.On("Decode", mock.AnythingOfType("*models.User")).Run(func(args mock.Arguments) {
+		*args.Get(0).(*models.User) = user
+	}).Return(err)
+	mockCollection.On("FindOne", mock.Anything, bson.M{"_id": id, "magic_link.token_hash": hashToken(linkID)}).Return(result)
+}
+
+func TestRequestMagicLink(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	sender := new(recordingMailer)
+	defer setupMailer(sender)()
+	auditLog := new(recordingAuditLogger)
+	defer setupAuditLogger(auditLog)()
+	id := primitive.NewObjectID()
+	findByEmail(mockCollection, "john@example.com", models.User{ID: id, Name: "John", Email: "john@example.com"}, nil)
+	var stored *models.MagicLink
+	mockCollection.On("UpdateOne", mock.Anything, bson.M{"_id": id, "magic_link": bson.M{"$exists": false}}, mock.Anything).Run(func(args mock.Arguments) {
+		stored = args.Get(2).(bson.M)["$set"].(bson.M)["magic_link"].(*models.MagicLink)
+	}).Return(&mongo.UpdateResult{MatchedCount: 1}, nil)
+
+	rr := serve(RequestMagicLink, "POST", "/v1/auth/magic-link/request", `{"email": "john@example.com"}`)
+
+	assert.Equal(t, http.StatusAccepted, rr.Code)
+	assert.JSONEq(t, `{"message": "If an account uses this email, a login link is on its way"}`, rr.Body.String())
+	cookie := bindingCookie(t, rr)
+	assert.Equal(t, magicLinkCookiePath, cookie.Path)
+	assert.True(t, cookie.HttpOnly)
+	assert.Equal(t, int(magicLinkTTL.Seconds()), cookie.MaxAge)
+
+	messages := sender.sent()
+	require.Len(t, messages, 1)
+	assert.Equal(t, "john@example.com", messages[0].To)
+	assert.Contains(t, messages[0].Body, "POST /v1/auth/magic-link/confirm")
+	var claims magicLinkClaims
+	require.NoError(t, tokenSigner.Verify(signedTokenPattern.FindString(messages[0].Body), &claims))
+	assert.Equal(t, id.Hex(), claims.Subject)
+	assert.Equal(t, magicLinkPurpose, claims.Purpose)
+	// The link is bound to the browser, and only its ID is stored, hashed
+	assert.Equal(t, hashToken(cookie.Value), claims.Binding)
+	assert.Equal(t, hashToken(claims.ID), stored.TokenHash)
+	assert.WithinDuration(t, time.Now().Add(magicLinkTTL), stored.ExpiresAt, time.Minute)
+	events := auditLog.recorded()
+	require.Len(t, events, 1)
+	assert.Equal(t, audit.MagicLinkRequested, events[0].Action)
+	assert.Equal(t, id.Hex(), events[0].UserID)
+	assert.Equal(t, "203.0.113.7", events[0].IP)
+}
+
+func TestRequestMagicLink_Link(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	sender := new(recordingMailer)
+	defer setupMailer(sender)()
+	defer setupAuditLogger(new(recordingAuditLogger))()
+	defer SetMagicLink(config.MagicLinkConfig{TokenTTL: magicLinkTTL, ResendInterval: magicLinkResendInterval, URL: magicLinkURL})
+	SetMagicLink(config.MagicLinkConfig{URL: "https://app.example.com/magic?lang=en"})
+	findByEmail(mockCollection, "john@example.com", models.User{ID: primitive.NewObjectID(), Email: "john@example.com"}, nil)
+	mockCollection.On("UpdateOne", mock.Anything, mock.Anything, mock.Anything).Return(&mongo.UpdateResult{MatchedCount: 1}, nil)
+
+	serve(RequestMagicLink, "POST", "/v1/auth/magic-link/request", `{"email": "john@example.com"}`)
+
+	messages := sender.sent()
+	require.Len(t, messages, 1)
+	link := regexp.MustCompile(`https://app\.example\.com/magic\?lang=en&token=(\S+)`).FindStringSubmatch(messages[0].Body)
+	require.NotNil(t, link, messages[0].Body)
+	var claims magicLinkClaims
+	require.NoError(t, tokenSigner.Verify(link[1], &claims))
+}
+
+func TestRequestMagicLink_KeepsBindingCookie(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	sender := new(recordingMailer)
+	defer setupMailer(sender)()
+	defer setupAuditLogger(new(recordingAuditLogger))()
+	findByEmail(mockCollection, "john@example.com", models.User{ID: primitive.NewObjectID(), Email: "john@example.com"}, nil)
+	mockCollection.On("UpdateOne", mock.Anything, mock.Anything, mock.Anything).Return(&mongo.UpdateResult{MatchedCount: 1}, nil)
+	binding := &http.Cookie{Name: magicLinkCookie, Value: "earlier-binding"}
+
+	rr := serve(RequestMagicLink, "POST", "/v1/auth/magic-link/request", `{"email": "john@example.com"}`, withCookie(binding))
+
+	assert.Equal(t, "earlier-binding", bindingCookie(t, rr).Value)
+	messages := sender.sent()
+	require.Len(t, messages, 1)
+	var claims magicLinkClaims
+	require.NoError(t, tokenSigner.Verify(signedTokenPattern.FindString(messages[0].Body), &claims))
+	assert.Equal(t, hashToken("earlier-binding"), claims.Binding)
+}
+
+func TestRequestMagicLink_SameAnswerWithoutMail(t *testing.T) {
+	id := primitive.NewObjectID()
+	for _, tc := range []struct {
+		name string
+		user models.User
+		err  error
+	}{
+		{"unknown email", models.User{}, mongo.ErrNoDocuments},
+		{"sent recently", models.User{ID: id, Email: "john@example.com", MagicLink: &models.MagicLink{TokenHash: "old", SentAt: time.Now().Add(-10 * time.Second)}}, nil},
+		{"deactivated", models.User{ID: id, Email: "john@example.com", Deactivated: true}, nil},
+		{"database down", models.User{}, mongo.CommandError{Labels: []string{"NetworkError"}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mockCollection := new(MockCollection)
+			defer SetupMockCollection(mockCollection)()
+			sender := new(recordingMailer)
+			defer setupMailer(sender)()
+			findByEmail(mockCollection, "john@example.com", tc.user, tc.err)
+
+			rr := serve(RequestMagicLink, "POST", "/v1/auth/magic-link/request", `{"email": "john@example.com"}`)
+
+			assert.Equal(t, http.StatusAccepted, rr.Code)
+			assert.JSONEq(t, `{"message": "If an account uses this email, a login link is on its way"}`, rr.Body.String())
+			bindingCookie(t, rr)
+			assert.Empty(t, sender.sent())
+			mockCollection.AssertNotCalled(t, "UpdateOne", mock.Anything, mock.Anything, mock.Anything)
+		})
+	}
+}
+
+func TestRequestMagicLink_ReplacesOldLink(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	sender := new(recordingMailer)
+	defer setupMailer(sender)()
+	defer setupAuditLogger(new(recordingAuditLogger))()
+	id := primitive.NewObjectID()
+	old := &models.MagicLink{TokenHash: "old", SentAt: time.Now().Add(-2 * magicLinkResendInterval)}
+	findByEmail(mockCollection, "john@example.com", models.User{ID: id, Email: "john@example.com", MagicLink: old}, nil)
+	// A concurrent request replaced the link first
+	mockCollection.On("UpdateOne", mock.Anything, bson.M{"_id": id, "magic_link.token_hash": "old"}, mock.Anything).Return(&mongo.UpdateResult{MatchedCount: 0}, nil)
+
+	rr := serve(RequestMagicLink, "POST", "/v1/auth/magic-link/request", `{"email": "john@example.com"}`)
+
+	assert.Equal(t, http.StatusAccepted, rr.Code)
+	assert.Empty(t, sender.sent())
+}
+
+func TestRequestMagicLink_InvalidRequest(t *testing.T) {
+	for _, body := range []string{`{}`, `{"email": ""}`, `not json`} {
+		rr := serve(RequestMagicLink, "POST", "/v1/auth/magic-link/request", body)
+		assert.Equal(t, http.StatusBadRequest, rr.Code, body)
+	}
+}
+
+func TestConfirmMagicLink(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	auditLog := new(recordingAuditLogger)
+	defer setupAuditLogger(auditLog)()
+	user := models.User{ID: primitive.NewObjectID(), Email: "john@example.com"}
+	findByMagicLink(mockCollection, user.ID, "link", user, nil)
+	var consumed bson.M
+	mockCollection.On("UpdateOne", mock.Anything, bson.M{"_id": user.ID, "magic_link.token_hash": hashToken("link")}, mock.Anything).Run(func(args mock.Arguments) {
+		consumed = args.Get(2).(bson.M)
+	}).Return(&mongo.UpdateResult{MatchedCount: 1}, nil)
+	sessions := acceptSessions(mockCollection, user.ID)
+	token := magicLinkToken(t, user.ID, "link", "binding", time.Minute)
+
+	rr := serve(ConfirmMagicLink, "POST", "/v1/auth/magic-link/confirm", `{"token": `+jsonString(token)+`}`, withCookie(&http.Cookie{Name: magicLinkCookie, Value: "binding"}))
+
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	response := decodeTokenResponse(t, rr.Body.Bytes())
+	claims, id, err := parseToken(response.AccessToken, accessTokenPurpose)
+	require.NoError(t, err)
+	assert.Equal(t, user.ID, id)
+	assert.Equal(t, []string{"email"}, claims.AMR)
+	require.Len(t, *sessions, 1)
+	assert.Equal(t, (*sessions)[0].ID.Hex(), claims.SessionID)
+	assert.Equal(t, bson.M{"$unset": bson.M{"magic_link": ""}}, consumed)
+	// The binding cookie is cleared
+	assert.Equal(t, -1, bindingCookie(t, rr).MaxAge)
+	events := auditLog.recorded()
+	require.Len(t, events, 1)
+	assert.Equal(t, audit.LoginSucceeded, events[0].Action)
+}
+
+func TestConfirmMagicLink_MFA(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	user := models.User{ID: primitive.NewObjectID(), MFA: &models.MFA{Enabled: true, Secret: testSecret}}
+	findByMagicLink(mockCollection, user.ID, "link", user, nil)
+	mockCollection.On("UpdateOne", mock.Anything, mock.Anything, mock.Anything).Return(&mongo.UpdateResult{MatchedCount: 1}, nil)
+	token := magicLinkToken(t, user.ID, "link", "binding", time.Minute)
+
+	rr := serve(ConfirmMagicLink, "POST", "/v1/auth/magic-link/confirm", `{"token": `+jsonString(token)+`}`, withCookie(&http.Cookie{Name: magicLinkCookie, Value: "binding"}))
+
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var challenge MFAChallenge
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &challenge))
+	assert.True(t, challenge.MFARequired)
+	claims, _, err := parseToken(challenge.MFAToken, mfaTokenPurpose)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"email"}, claims.AMR)
+}
+
+func TestConfirmMagicLink_Rejected(t *testing.T) {
+	id := primitive.NewObjectID()
+	valid := magicLinkToken(t, id, "link", "binding", time.Minute)
+	accessToken, err := issueToken(id, "", accessTokenPurpose, []string{"pwd"}, time.Minute)
+	require.NoError(t, err)
+	for _, tc := range []struct {
+		name    string
+		token   string
+		binding string
+		user    models.User
+		err     error
+		matched int64
+		status  int
+		error   string
+	}{
+		{"missing token", "", "binding", models.User{}, nil, 1, http.StatusBadRequest, "Token is required"},
+		{"expired", magicLinkToken(t, id, "link", "binding", -time.Minute), "binding", models.User{ID: id}, nil, 1, http.StatusBadRequest, "Invalid or expired login link"},
+		{"forged", valid + "x", "binding", models.User{ID: id}, nil, 1, http.StatusBadRequest, "Invalid or expired login link"},
+		{"access token", accessToken, "binding", models.User{ID: id}, nil, 1, http.StatusBadRequest, "Invalid or expired login link"},
+		{"no cookie", valid, "", models.User{ID: id}, nil, 1, http.StatusBadRequest, "Login link was requested in another browser"},
+		{"other browser", valid, "other", models.User{ID: id}, nil, 1, http.StatusBadRequest, "Login link was requested in another browser"},
+		{"used or replaced", valid, "binding", models.User{}, mongo.ErrNoDocuments, 1, http.StatusBadRequest, "Invalid or expired login link"},
+		{"used concurrently", valid, "binding", models.User{ID: id}, nil, 0, http.StatusBadRequest, "Invalid or expired login link"},
+		{"deactivated", valid, "binding", models.User{ID: id, Deactivated: true}, nil, 1, http.StatusForbidden, "Account is deactivated"},
+		{"database down", valid, "binding", models.User{}, mongo.CommandError{Labels: []string{"NetworkError"}}, 1, http.StatusServiceUnavailable, "Database unavailable"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mockCollection := new(MockCollection)
+			defer SetupMockCollection(mockCollection)()
+			findByMagicLink(mockCollection, id, "link", tc.user, tc.err)
+			mockCollection.On("UpdateOne", mock.Anything, bson.M{"_id": id, "magic_link.token_hash": hashToken("link")}, mock.Anything).Return(&mongo.UpdateResult{MatchedCount: tc.matched}, nil)
+			var binding *http.Cookie
+			if tc.binding != "" {
+				binding = &http.Cookie{Name: magicLinkCookie, Value: tc.binding}
+			}
+
+			rr := serve(ConfirmMagicLink, "POST", "/v1/auth/magic-link/confirm", `{"token": `+jsonString(tc.token)+`}`, withCookie(binding))
+
+			assert.Equal(t, tc.status, rr.Code)
+			assert.Contains(t, rr.Body.String(), tc.error)
+			assert.NotContains(t, rr.Body.String(), "access_token")
+		})
+	}
+}
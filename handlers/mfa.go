@@ -0,0 +1,179 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lep13/golang-restful-api/audit"
+	"github.com/lep13/golang-restful-api/models"
+	"github.com/lep13/golang-restful-api/totp"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// recoveryCodeCount is the number of recovery codes issued with MFA
+const recoveryCodeCount = 10
+
+// recoveryCodeEncoding spells recovery codes in lowercase letters and digits
+var recoveryCodeEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+var mfaIssuer = "Golang RESTful API"
+
+// SetMFAIssuer sets the service name shown next to the account in
+// authenticator apps
+func SetMFAIssuer(issuer string) {
+	if issuer != "" {
+		mfaIssuer = issuer
+	}
+}
+
+// MFAStatus reports the MFA settings of a user
+type MFAStatus struct {
+	Enabled bool `json:"enabled"`
+	// Pending is set while an enrollment awaits its first code
+	Pending                bool `json:"pending"`
+	RecoveryCodesRemaining int  `json:"recovery_codes_remaining"`
+}
+
+// TOTPEnrollment is the secret of a new TOTP enrollment, to add to an
+// authenticator app
+type TOTPEnrollment struct {
+	Secret     string `json:"secret"`
+	OTPAuthURI string `json:"otpauth_uri"`
+}
+
+// GetMFA reports whether MFA is enabled for the user and how many recovery
+// codes they have left. Users may only see their own settings.
+func GetMFA(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	user, ok := selfUser(w, r)
+	if !ok {
+		return
+	}
+	var status MFAStatus
+	if user.MFA != nil {
+		status = MFAStatus{
+			Enabled:                user.MFA.Enabled,
+			Pending:                user.MFA.PendingSecret != "",
+			RecoveryCodesRemaining: len(user.MFA.RecoveryCodes),
+		}
+	}
+	writeJSON(w, status)
+}
+
+// EnrollTOTP starts the enrollment of a TOTP authenticator, returning a new
+// secret and its otpauth:// URI. MFA is enabled once ConfirmTOTP receives a
+// code generated from the secret. Starting again replaces the secret.
+func EnrollTOTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	user, ok := selfUser(w, r)
+	if !ok {
+		return
+	}
+	if user.MFA != nil && user.MFA.Enabled {
+		writeError(w, "MFA is already enabled", http.StatusConflict)
+		return
+	}
+	secret, err := totp.NewSecret()
+	if err != nil {
+		writeError(w, "Failed to create secret", http.StatusInternalServerError)
+		return
+	}
+
+	ctx, cancel := dbContext(r)
+	defer cancel()
+	res, err := mongoCollection.UpdateOne(ctx,
+		bson.M{"_id": user.ID, "mfa.enabled": bson.M{"$ne": true}},
+		bson.M{"$set": bson.M{"mfa.pending_secret": secret}})
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if res.MatchedCount == 0 {
+		writeError(w, "MFA is already enabled", http.StatusConflict)
+		return
+	}
+	account := user.Email
+	if account == "" {
+		account = user.ID.Hex()
+	}
+	writeJSON(w, TOTPEnrollment{Secret: secret, OTPAuthURI: totp.URI(mfaIssuer, account, secret)})
+}
+
+// ConfirmTOTP enables MFA with the pending TOTP secret once given a code
+// generated from it, and returns the recovery codes. They are shown this once
+// and stored hashed; each can replace a code at login a single time.
+func ConfirmTOTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var body struct {
+		Code string `json:"code"`
+	}
+	if !decodeBody(w, r, &body) {
+		return
+	}
+	user, ok := selfUser(w, r)
+	if !ok {
+		return
+	}
+	switch {
+	case user.MFA != nil && user.MFA.Enabled:
+		writeError(w, "MFA is already enabled", http.StatusConflict)
+		return
+	case user.MFA == nil || user.MFA.PendingSecret == "":
+		writeError(w, "No MFA enrollment in progress", http.StatusConflict)
+		return
+	}
+	secret := user.MFA.PendingSecret
+	step, ok := totp.Validate(secret, body.Code, time.Now(), codeSkew)
+	if !ok {
+		writeError(w, "Invalid code", http.StatusBadRequest)
+		return
+	}
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		writeError(w, "Failed to create recovery codes", http.StatusInternalServerError)
+		return
+	}
+
+	ctx, cancel := dbContext(r)
+	defer cancel()
+	// Matching on the secret that was checked keeps a concurrent enrollment
+	// from enabling a secret the code was not generated from
+	mfa := models.MFA{Enabled: true, Secret: secret, RecoveryCodes: hashes, LastStep: step, EnabledAt: time.Now()}
+	res, err := mongoCollection.UpdateOne(ctx,
+		bson.M{"_id": user.ID, "mfa.pending_secret": secret, "mfa.enabled": bson.M{"$ne": true}},
+		bson.M{"$set": bson.M{"mfa": mfa}})
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if res.MatchedCount == 0 {
+		writeError(w, "No MFA enrollment in progress", http.StatusConflict)
+		return
+	}
+	recordAudit(audit.MFAEnabled, user.ID.Hex(), clientIP(r), nil)
+	writeJSON(w, map[string][]string{"recovery_codes": codes})
+}
+
+// newRecoveryCodes returns recovery codes of 80 random bits, written as
+// xxxx-xxxx-xxxx-xxxx, and the hashes under which they are stored
+func newRecoveryCodes() (codes, hashes []string, err error) {
+	for i := 0; i < recoveryCodeCount; i++ {
+		raw := make([]byte, 10)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, nil, err
+		}
+		code := recoveryCodeEncoding.EncodeToString(raw)
+		codes = append(codes, code[0:4]+"-"+code[4:8]+"-"+code[8:12]+"-"+code[12:16])
+		hashes = append(hashes, hashToken(code))
+	}
+	return codes, hashes, nil
+}
+
+// normalizeRecoveryCode undoes the formatting of a recovery code, so it is
+// accepted with or without dashes and in any case
+func normalizeRecoveryCode(code string) string {
+	return strings.NewReplacer("-", "", " ", "").Replace(strings.ToLower(code))
+}
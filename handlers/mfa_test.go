@@ -0,0 +1,149 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/lep13/golang-restful-api/audit"
+	"github.com/lep13/golang-restful-api/models"
+	"github.com/lep13/golang-restful-api/totp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestGetMFA(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	id := primitive.NewObjectID()
+	findUser(mockCollection, id, models.User{ID: id, MFA: &models.MFA{Enabled: true, Secret: testSecret, RecoveryCodes: []string{"a", "b"}}}, nil)
+
+	rr := serve(GetMFA, "GET", "/v1/users/"+id.Hex()+"/mfa", "", withVars("id", id.Hex()), as(id.Hex()))
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, `{"enabled": true, "pending": false, "recovery_codes_remaining": 2}`, rr.Body.String())
+	assert.NotContains(t, rr.Body.String(), testSecret)
+}
+
+func TestMFA_RequiresTheUser(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	id := primitive.NewObjectID()
+
+	for _, handler := range []http.HandlerFunc{GetMFA, EnrollTOTP, ConfirmTOTP} {
+		rr := serve(handler, "POST", "/v1/users/"+id.Hex()+"/mfa", `{"code": "123456"}`, withVars("id", id.Hex()))
+		assert.Equal(t, http.StatusUnauthorized, rr.Code)
+		assert.Equal(t, "Bearer", rr.Header().Get("WWW-Authenticate"))
+
+		rr = serve(handler, "POST", "/v1/users/"+id.Hex()+"/mfa", `{"code": "123456"}`, withVars("id", id.Hex()), as(primitive.NewObjectID().Hex()))
+		assert.Equal(t, http.StatusForbidden, rr.Code)
+		assert.Contains(t, rr.Body.String(), "Not allowed to manage this user")
+	}
+	mockCollection.AssertNotCalled(t, "FindOne", mock.Anything, mock.Anything)
+}
+
+func TestEnrollTOTP(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	id := primitive.NewObjectID()
+	findUser(mockCollection, id, models.User{ID: id, Email: "john@example.com"}, nil)
+	var pending string
+	mockCollection.On("UpdateOne", mock.Anything, bson.M{"_id": id, "mfa.enabled": bson.M{"$ne": true}}, mock.Anything).Run(func(args mock.Arguments) {
+		pending = args.Get(2).(bson.M)["$set"].(bson.M)["mfa.pending_secret"].(string)
+	}).Return(&mongo.UpdateResult{MatchedCount: 1}, nil)
+
+	rr := serve(EnrollTOTP, "POST", "/v1/users/"+id.Hex()+"/mfa/totp", "", withVars("id", id.Hex()), as(id.Hex()))
+
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var enrollment TOTPEnrollment
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &enrollment))
+	assert.Equal(t, pending, enrollment.Secret)
+	assert.Equal(t, totp.URI("Golang RESTful API", "john@example.com", pending), enrollment.OTPAuthURI)
+}
+
+func TestEnrollTOTP_AlreadyEnabled(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	id := primitive.NewObjectID()
+	findUser(mockCollection, id, models.User{ID: id, MFA: &models.MFA{Enabled: true, Secret: testSecret}}, nil)
+
+	rr := serve(EnrollTOTP, "POST", "/v1/users/"+id.Hex()+"/mfa/totp", "", withVars("id", id.Hex()), as(id.Hex()))
+
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	assert.Contains(t, rr.Body.String(), "MFA is already enabled")
+	mockCollection.AssertNotCalled(t, "UpdateOne", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestConfirmTOTP(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	auditLog := new(recordingAuditLogger)
+	defer setupAuditLogger(auditLog)()
+	id := primitive.NewObjectID()
+	findUser(mockCollection, id, models.User{ID: id, MFA: &models.MFA{PendingSecret: testSecret}}, nil)
+	step := totp.Step(time.Now())
+	code, _ := totp.Code(testSecret, step)
+	var mfa models.MFA
+	mockCollection.On("UpdateOne", mock.Anything, bson.M{"_id": id, "mfa.pending_secret": testSecret, "mfa.enabled": bson.M{"$ne": true}}, mock.Anything).Run(func(args mock.Arguments) {
+		mfa = args.Get(2).(bson.M)["$set"].(bson.M)["mfa"].(models.MFA)
+	}).Return(&mongo.UpdateResult{MatchedCount: 1}, nil)
+
+	rr := serve(ConfirmTOTP, "POST", "/v1/users/"+id.Hex()+"/mfa/totp/confirm", `{"code": "`+code+`"}`, withVars("id", id.Hex()), as(id.Hex()))
+
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var response struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &response))
+	require.Len(t, response.RecoveryCodes, 10)
+	assert.Regexp(t, `^[a-z2-7]{4}-[a-z2-7]{4}-[a-z2-7]{4}-[a-z2-7]{4}$`, response.RecoveryCodes[0])
+	assert.True(t, mfa.Enabled)
+	assert.Equal(t, testSecret, mfa.Secret)
+	assert.Empty(t, mfa.PendingSecret)
+	// The code used to confirm cannot log in again
+	assert.Equal(t, step, mfa.LastStep)
+	for i, code := range response.RecoveryCodes {
+		assert.Equal(t, hashToken(normalizeRecoveryCode(code)), mfa.RecoveryCodes[i])
+	}
+	events := auditLog.recorded()
+	require.Len(t, events, 1)
+	assert.Equal(t, audit.MFAEnabled, events[0].Action)
+}
+
+func TestConfirmTOTP_Rejected(t *testing.T) {
+	id := primitive.NewObjectID()
+	code, _ := totp.Code(testSecret, totp.Step(time.Now()))
+	wrong, _ := totp.Code(testSecret, totp.Step(time.Now())+10)
+
+	for _, tc := range []struct {
+		name    string
+		user    models.User
+		code    string
+		matched int64
+		status  int
+		error   string
+	}{
+		{"wrong code", models.User{ID: id, MFA: &models.MFA{PendingSecret: testSecret}}, wrong, 1, http.StatusBadRequest, "Invalid code"},
+		{"not enrolling", models.User{ID: id}, code, 1, http.StatusConflict, "No MFA enrollment in progress"},
+		{"already enabled", models.User{ID: id, MFA: &models.MFA{Enabled: true, Secret: testSecret}}, code, 1, http.StatusConflict, "MFA is already enabled"},
+		{"secret replaced meanwhile", models.User{ID: id, MFA: &models.MFA{PendingSecret: testSecret}}, code, 0, http.StatusConflict, "No MFA enrollment in progress"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mockCollection := new(MockCollection)
+			defer SetupMockCollection(mockCollection)()
+			findUser(mockCollection, id, tc.user, nil)
+			mockCollection.On("UpdateOne", mock.Anything, mock.Anything, mock.Anything).Return(&mongo.UpdateResult{MatchedCount: tc.matched}, nil)
+
+			rr := serve(ConfirmTOTP, "POST", "/v1/users/"+id.Hex()+"/mfa/totp/confirm", `{"code": "`+tc.code+`"}`, withVars("id", id.Hex()), as(id.Hex()))
+
+			assert.Equal(t, tc.status, rr.Code)
+			assert.Contains(t, rr.Body.String(), tc.error)
+			assert.NotContains(t, rr.Body.String(), "recovery_codes")
+		})
+	}
+}
@@ -0,0 +1,955 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lep13/golang-restful-api/audit"
+	"github.com/lep13/golang-restful-api/config"
+	"github.com/lep13/golang-restful-api/jwt"
+	"github.com/lep13/golang-restful-api/middleware"
+	"github.com/lep13/golang-restful-api/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Scopes OAuth clients can request (OpenID Connect Core, section 5.4)
+const (
+	ScopeOpenID  = "openid"
+	ScopeProfile = "profile"
+	ScopeEmail   = "email"
+)
+
+var oauthScopes = []string{ScopeOpenID, ScopeProfile, ScopeEmail}
+
+// Ways OAuth clients authenticate at the token endpoint (RFC 7591)
+const (
+	clientSecretBasic = "client_secret_basic"
+	clientSecretPost  = "client_secret_post"
+	clientAuthNone    = "none"
+)
+
+const (
+	maxOAuthClients          = 20
+	maxOAuthClientNameLength = 100
+	maxRedirectURIs          = 10
+	// maxOAuthCodes is the number of unredeemed codes kept per user; older
+	// ones are dropped
+	maxOAuthCodes = 10
+	// maxOAuthParamLength bounds the state and nonce clients pass through
+	maxOAuthParamLength = 512
+	// oauthClientIDBytes is the length of the random part of a client ID
+	oauthClientIDBytes = 10
+)
+
+var (
+	oauthIssuer  string
+	oauthCodeTTL = time.Minute
+
+	// idTokenSigner signs the ID tokens; see idTokens
+	idTokenSigner     *jwt.RS256
+	idTokenSignerOnce sync.Once
+)
+
+// SetOAuth configures the OAuth provider: its issuer, the key signing ID
+// tokens and how long authorization codes are valid. The provider is only
+// served with an issuer, which is never taken from the Host of a request, as
+// the client chooses it. Issuers follow the rules of redirect URIs: HTTPS, or
+// HTTP on the loopback interface. Until a key is set, ID tokens are signed
+// with a random key generated on first use.
+func SetOAuth(cfg config.OAuthConfig) error {
+	if cfg.Issuer != "" {
+		// OpenID Connect Discovery 1.0, section 3
+		issuer, err := url.Parse(cfg.Issuer)
+		if err != nil || !validRedirectURI(cfg.Issuer) || issuer.User != nil || issuer.RawQuery != "" {
+			return fmt.Errorf("invalid issuer %q: must be an https URL, or http on the loopback interface, without credentials, query or fragment", cfg.Issuer)
+		}
+	}
+	oauthIssuer = strings.TrimSuffix(cfg.Issuer, "/")
+	if cfg.CodeTTL > 0 {
+		oauthCodeTTL = cfg.CodeTTL
+	}
+	if cfg.SigningKeyFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(cfg.SigningKeyFile)
+	if err != nil {
+		return err
+	}
+	key, err := parseRSAKey(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", cfg.SigningKeyFile, err)
+	}
+	idTokenSigner = jwt.NewRS256(key)
+	return nil
+}
+
+// parseRSAKey reads a PEM RSA private key in the PKCS #1 or PKCS #8 format
+func parseRSAKey(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	var key *rsa.PrivateKey
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		k, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		key = k
+	case "PRIVATE KEY":
+		k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		rsaKey, ok := k.(*rsa.PrivateKey)
+		if !ok {
+			return nil, errors.New("not an RSA key")
+		}
+		key = rsaKey
+	default:
+		return nil, fmt.Errorf("unexpected PEM block %q", block.Type)
+	}
+	if key.N.BitLen() < 2048 {
+		return nil, errors.New("RSA keys must have at least 2048 bits")
+	}
+	return key, nil
+}
+
+// idTokens returns the signer of the ID tokens, generating a key if none was set
+func idTokens() *jwt.RS256 {
+	idTokenSignerOnce.Do(func() {
+		if idTokenSigner != nil {
+			return
+		}
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			panic(err)
+		}
+		idTokenSigner = jwt.NewRS256(key)
+	})
+	return idTokenSigner
+}
+
+// issuerURL returns the issuer of the provider, which is the public base URL
+// of the API. It is empty when the provider is disabled, leaving the URLs
+// built on it relative.
+func issuerURL() string {
+	return oauthIssuer
+}
+
+// OAuthClientInfo describes a registered OAuth client without its secret, in
+// the terms of RFC 7591
+type OAuthClientInfo struct {
+	ClientID                string   `json:"client_id"`
+	ClientName              string   `json:"client_name"`
+	RedirectURIs            []string `json:"redirect_uris"`
+	TokenEndpointAuthMethod string   `json:"token_endpoint_auth_method"`
+	GrantTypes              []string `json:"grant_types"`
+	ResponseTypes           []string `json:"response_types"`
+	ClientIDIssuedAt        int64    `json:"client_id_issued_at"`
+}
+
+// NewOAuthClient is a registered OAuth client, the only response that
+// contains its secret. Public clients have none.
+type NewOAuthClient struct {
+	OAuthClientInfo
+	ClientSecret string `json:"client_secret,omitempty"`
+	// ClientSecretExpiresAt is 0: secrets do not expire
+	ClientSecretExpiresAt int64 `json:"client_secret_expires_at"`
+}
+
+func oauthClientInfo(client models.OAuthClient) OAuthClientInfo {
+	return OAuthClientInfo{
+		ClientID:                client.ClientID,
+		ClientName:              client.Name,
+		RedirectURIs:            client.RedirectURIs,
+		TokenEndpointAuthMethod: client.TokenEndpointAuthMethod,
+		GrantTypes:              []string{"authorization_code"},
+		ResponseTypes:           []string{"code"},
+		ClientIDIssuedAt:        client.CreatedAt.Unix(),
+	}
+}
+
+// validRedirectURI accepts absolute HTTPS URIs without a fragment, and HTTP
+// ones on the loopback interface for native apps (RFC 8252)
+func validRedirectURI(raw string) bool {
+	u, err := url.Parse(raw)
+	if err != nil || !u.IsAbs() || u.Host == "" || strings.Contains(raw, "#") {
+		return false
+	}
+	switch u.Scheme {
+	case "https":
+		return true
+	case "http":
+		host := u.Hostname()
+		return host == "localhost" || net.ParseIP(host).IsLoopback()
+	}
+	return false
+}
+
+// validateOAuthClient checks a client registration, returning its
+// authentication method with the default applied
+func validateOAuthClient(name string, redirectURIs []string, method string) (string, error) {
+	switch {
+	case strings.TrimSpace(name) == "":
+		return "", fmt.Errorf("Client name is required")
+	case len(name) > maxOAuthClientNameLength:
+		return "", fmt.Errorf("Client name must be at most %d characters", maxOAuthClientNameLength)
+	case len(redirectURIs) == 0:
+		return "", fmt.Errorf("At least one redirect URI is required")
+	case len(redirectURIs) > maxRedirectURIs:
+		return "", fmt.Errorf("A client may have at most %d redirect URIs", maxRedirectURIs)
+	}
+	for _, uri := range redirectURIs {
+		if !validRedirectURI(uri) {
+			return "", fmt.Errorf("Invalid redirect URI %q; use HTTPS, or HTTP on the loopback interface", uri)
+		}
+	}
+	switch method {
+	case "":
+		return clientSecretBasic, nil
+	case clientSecretBasic, clientSecretPost, clientAuthNone:
+		return method, nil
+	}
+	return "", fmt.Errorf("Unsupported token endpoint auth method %q", method)
+}
+
+// RegisterOAuthClient registers an OAuth client owned by the caller (RFC
+// 7591). Clients authenticating with a secret receive it only in this
+// response; it is stored hashed. Clients with the none method are public and
+// rely on PKCE alone.
+func RegisterOAuthClient(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var body struct {
+		ClientName              string   `json:"client_name"`
+		RedirectURIs            []string `json:"redirect_uris"`
+		TokenEndpointAuthMethod string   `json:"token_endpoint_auth_method"`
+	}
+	if !decodeBody(w, r, &body) {
+		return
+	}
+	userID, ok := authenticatedUser(w, r)
+	if !ok {
+		return
+	}
+	method, err := validateOAuthClient(body.ClientName, body.RedirectURIs, body.TokenEndpointAuthMethod)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	raw := make([]byte, oauthClientIDBytes)
+	if _, err := rand.Read(raw); err != nil {
+		writeError(w, "Failed to register client", http.StatusInternalServerError)
+		return
+	}
+	client := models.OAuthClient{
+		ClientID:                recoveryCodeEncoding.EncodeToString(raw),
+		Name:                    strings.TrimSpace(body.ClientName),
+		RedirectURIs:            body.RedirectURIs,
+		TokenEndpointAuthMethod: method,
+		CreatedAt:               time.Now().UTC().Truncate(time.Millisecond),
+	}
+	var secret string
+	if method != clientAuthNone {
+		if secret, client.SecretHash, err = newToken(); err != nil {
+			writeError(w, "Failed to register client", http.StatusInternalServerError)
+			return
+		}
+	}
+	id, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		writeError(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	ctx, cancel := dbContext(r)
+	defer cancel()
+	// Only pushing while below the limit keeps concurrent requests from exceeding it
+	res, err := mongoCollection.UpdateOne(ctx,
+		bson.M{"_id": id, "oauth_clients." + strconv.Itoa(maxOAuthClients-1): bson.M{"$exists": false}},
+		bson.M{"$push": bson.M{"oauth_clients": client}})
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if res.MatchedCount == 0 {
+		writeError(w, fmt.Sprintf("A user may have at most %d OAuth clients", maxOAuthClients), http.StatusConflict)
+		return
+	}
+	recordAudit(audit.OAuthClientRegistered, userID, clientIP(r), map[string]string{
+		"client_id": client.ClientID,
+		"name":      client.Name,
+	})
+	w.WriteHeader(http.StatusCreated)
+	writeJSON(w, NewOAuthClient{OAuthClientInfo: oauthClientInfo(client), ClientSecret: secret})
+}
+
+// ListOAuthClients lists the OAuth clients registered by the caller
+func ListOAuthClients(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	userID, ok := authenticatedUser(w, r)
+	if !ok {
+		return
+	}
+	id, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		writeError(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	ctx, cancel := dbContext(r)
+	defer cancel()
+	var user models.User
+	if err := mongoCollection.FindOne(ctx, bson.M{"_id": id}).Decode(&user); err != nil {
+		if err == mongo.ErrNoDocuments {
+			writeError(w, "User not found", http.StatusNotFound)
+		} else {
+			writeDBError(w, err)
+		}
+		return
+	}
+	clients := make([]OAuthClientInfo, 0, len(user.OAuthClients))
+	for _, client := range user.OAuthClients {
+		clients = append(clients, oauthClientInfo(client))
+	}
+	writeJSON(w, clients)
+}
+
+// DeleteOAuthClient deletes an OAuth client registered by the caller. Its
+// pending codes can no longer be redeemed; tokens already issued stay valid
+// until they expire or their sessions are revoked.
+func DeleteOAuthClient(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	userID, ok := authenticatedUser(w, r)
+	if !ok {
+		return
+	}
+	id, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		writeError(w, "OAuth client not found", http.StatusNotFound)
+		return
+	}
+	clientID := mux.Vars(r)["client_id"]
+
+	ctx, cancel := dbContext(r)
+	defer cancel()
+	res, err := mongoCollection.UpdateOne(ctx,
+		bson.M{"_id": id, "oauth_clients.client_id": clientID},
+		bson.M{"$pull": bson.M{"oauth_clients": bson.M{"client_id": clientID}}})
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if res.MatchedCount == 0 {
+		writeError(w, "OAuth client not found", http.StatusNotFound)
+		return
+	}
+	recordAudit(audit.OAuthClientDeleted, userID, clientIP(r), map[string]string{"client_id": clientID})
+	writeJSON(w, map[string]string{"message": "OAuth client deleted"})
+}
+
+// findOAuthClient looks up a registered client by ID, returning false when
+// there is none
+func findOAuthClient(ctx context.Context, clientID string) (models.OAuthClient, bool, error) {
+	if clientID == "" {
+		return models.OAuthClient{}, false, nil
+	}
+	var owner models.User
+	if err := mongoCollection.FindOne(ctx, bson.M{"oauth_clients.client_id": clientID}).Decode(&owner); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return models.OAuthClient{}, false, nil
+		}
+		return models.OAuthClient{}, false, err
+	}
+	for _, client := range owner.OAuthClients {
+		if client.ClientID == clientID {
+			return client, true, nil
+		}
+	}
+	return models.OAuthClient{}, false, nil
+}
+
+// parseScopes splits a scope parameter, rejecting unknown scopes and dropping
+// duplicates. An empty parameter requests openid.
+func parseScopes(scope string) ([]string, bool) {
+	requested := strings.Fields(scope)
+	if len(requested) == 0 {
+		return []string{ScopeOpenID}, true
+	}
+	var scopes []string
+	for _, known := range oauthScopes {
+		for _, s := range requested {
+			if s == known {
+				scopes = append(scopes, known)
+				break
+			}
+		}
+	}
+	for _, s := range requested {
+		if !containsString(oauthScopes, s) {
+			return nil, false
+		}
+	}
+	return scopes, true
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// OAuthAuthorization answers an authorization request: either the redirect
+// completing it, or the client and scopes the user must consent to first
+type OAuthAuthorization struct {
+	RedirectTo      string   `json:"redirect_to,omitempty"`
+	ConsentRequired bool     `json:"consent_required,omitempty"`
+	ClientID        string   `json:"client_id,omitempty"`
+	ClientName      string   `json:"client_name,omitempty"`
+	Scopes          []string `json:"scopes,omitempty"`
+}
+
+// authorizationRequest holds the parameters of an authorization request (RFC
+// 6749, section 4.1.1, with PKCE from RFC 7636)
+type authorizationRequest struct {
+	ResponseType        string `json:"response_type"`
+	ClientID            string `json:"client_id"`
+	RedirectURI         string `json:"redirect_uri"`
+	Scope               string `json:"scope"`
+	State               string `json:"state"`
+	CodeChallenge       string `json:"code_challenge"`
+	CodeChallengeMethod string `json:"code_challenge_method"`
+	Nonce               string `json:"nonce"`
+}
+
+// Authorize starts the authorization code flow for the logged in user. The
+// consent page of the client app calls it with the query parameters of the
+// authorization request. When the user already allowed the client the
+// requested scopes, it answers with the redirect carrying the code; otherwise
+// it answers with what to ask the user, whose decision is sent to
+// ApproveAuthorization. PKCE with S256 is required.
+func Authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	authorize(w, r, authorizationRequest{
+		ResponseType:        q.Get("response_type"),
+		ClientID:            q.Get("client_id"),
+		RedirectURI:         q.Get("redirect_uri"),
+		Scope:               q.Get("scope"),
+		State:               q.Get("state"),
+		CodeChallenge:       q.Get("code_challenge"),
+		CodeChallengeMethod: q.Get("code_challenge_method"),
+		Nonce:               q.Get("nonce"),
+	}, nil)
+}
+
+// ApproveAuthorization completes an authorization request with the decision
+// of the user, recording their consent when they approve. The body carries
+// the parameters of the request and approve.
+func ApproveAuthorization(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var body struct {
+		authorizationRequest
+		Approve bool `json:"approve"`
+	}
+	if !decodeBody(w, r, &body) {
+		return
+	}
+	authorize(w, r, body.authorizationRequest, &body.Approve)
+}
+
+// authorize handles an authorization request; approve is the decision of the
+// user, or nil when they were not asked yet
+func authorize(w http.ResponseWriter, r *http.Request, req authorizationRequest, approve *bool) {
+	w.Header().Set("Content-Type", "application/json")
+	userID, ok := authenticatedUser(w, r)
+	if !ok {
+		return
+	}
+	id, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		writeError(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	ctx, cancel := dbContext(r)
+	defer cancel()
+	// Errors before the redirect URI is known cannot be sent back to the client
+	client, found, err := findOAuthClient(ctx, req.ClientID)
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if !found {
+		writeError(w, "Unknown OAuth client", http.StatusBadRequest)
+		return
+	}
+	redirectURI := req.RedirectURI
+	if redirectURI == "" && len(client.RedirectURIs) == 1 {
+		redirectURI = client.RedirectURIs[0]
+	}
+	if !containsString(client.RedirectURIs, redirectURI) {
+		writeError(w, "Redirect URI is not registered for the client", http.StatusBadRequest)
+		return
+	}
+	redirect := func(params url.Values) {
+		params.Set("iss", issuerURL())
+		if req.State != "" {
+			params.Set("state", req.State)
+		}
+		writeJSON(w, OAuthAuthorization{RedirectTo: withQuery(redirectURI, params)})
+	}
+	fail := func(code, description string) {
+		redirect(url.Values{"error": {code}, "error_description": {description}})
+	}
+
+	scopes, ok := parseScopes(req.Scope)
+	switch {
+	case req.ResponseType != "code":
+		fail("unsupported_response_type", "Only the code response type is supported")
+		return
+	case !ok:
+		fail("invalid_scope", "Supported scopes are "+strings.Join(oauthScopes, ", "))
+		return
+	case req.CodeChallengeMethod != "S256" || !validCodeChallenge(req.CodeChallenge):
+		fail("invalid_request", "PKCE with the S256 method is required")
+		return
+	case len(req.State) > maxOAuthParamLength || len(req.Nonce) > maxOAuthParamLength:
+		fail("invalid_request", fmt.Sprintf("State and nonce must be at most %d characters", maxOAuthParamLength))
+		return
+	case approve != nil && !*approve:
+		fail("access_denied", "The user denied the request")
+		return
+	}
+
+	var user models.User
+	if err := mongoCollection.FindOne(ctx, bson.M{"_id": id}).Decode(&user); err != nil {
+		if err == mongo.ErrNoDocuments {
+			writeError(w, "User not found", http.StatusNotFound)
+		} else {
+			writeDBError(w, err)
+		}
+		return
+	}
+	consent := user.OAuthConsents[client.ClientID]
+	consented := true
+	for _, scope := range scopes {
+		consented = consented && containsString(consent.Scopes, scope)
+	}
+	if !consented {
+		if approve == nil {
+			writeJSON(w, OAuthAuthorization{ConsentRequired: true, ClientID: client.ClientID, ClientName: client.Name, Scopes: scopes})
+			return
+		}
+		granted := append([]string{}, consent.Scopes...)
+		for _, scope := range scopes {
+			if !containsString(granted, scope) {
+				granted = append(granted, scope)
+			}
+		}
+		_, err := mongoCollection.UpdateOne(ctx, bson.M{"_id": id}, bson.M{
+			"$set": bson.M{"oauth_consents." + client.ClientID: models.OAuthConsent{Scopes: granted, GrantedAt: time.Now().UTC()}},
+		})
+		if err != nil {
+			writeDBError(w, err)
+			return
+		}
+		recordAudit(audit.OAuthConsentGranted, userID, clientIP(r), map[string]string{
+			"client_id": client.ClientID,
+			"scopes":    strings.Join(granted, " "),
+		})
+	}
+
+	code, hash, err := newToken()
+	if err != nil {
+		writeError(w, "Failed to issue authorization code", http.StatusInternalServerError)
+		return
+	}
+	pending := models.OAuthCode{
+		Hash:                hash,
+		ClientID:            client.ClientID,
+		RedirectURI:         redirectURI,
+		RedirectURIExplicit: req.RedirectURI != "",
+		Scopes:              scopes,
+		CodeChallenge:       req.CodeChallenge,
+		Nonce:               req.Nonce,
+		ExpiresAt:           time.Now().Add(oauthCodeTTL).UTC(),
+	}
+	// Slicing drops the oldest codes beyond the limit
+	if _, err := mongoCollection.UpdateOne(ctx, bson.M{"_id": id}, bson.M{
+		"$push": bson.M{"oauth_codes": bson.M{"$each": []models.OAuthCode{pending}, "$slice": -maxOAuthCodes}},
+	}); err != nil {
+		writeDBError(w, err)
+		return
+	}
+	redirect(url.Values{"code": {code}})
+}
+
+// withQuery adds params to the query of a registered redirect URI
+func withQuery(uri string, params url.Values) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return uri
+	}
+	q := u.Query()
+	for key, values := range params {
+		q[key] = values
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// validCodeChallenge accepts S256 challenges: unpadded base64url SHA-256 hashes
+func validCodeChallenge(challenge string) bool {
+	raw, err := base64.RawURLEncoding.DecodeString(challenge)
+	return err == nil && len(raw) == sha256.Size
+}
+
+// verifyCodeVerifier checks a PKCE verifier against its S256 challenge
+func verifyCodeVerifier(verifier, challenge string) bool {
+	// RFC 7636, section 4.1
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	return subtle.ConstantTimeCompare([]byte(base64.RawURLEncoding.EncodeToString(sum[:])), []byte(challenge)) == 1
+}
+
+// OAuthTokenResponse is returned by the token endpoint (RFC 6749, section
+// 5.1). IDToken is set when the openid scope was granted.
+type OAuthTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+	Scope       string `json:"scope"`
+	IDToken     string `json:"id_token,omitempty"`
+}
+
+// idTokenClaims are the claims of an OpenID Connect ID token
+type idTokenClaims struct {
+	jwt.Claims
+	Nonce         string `json:"nonce,omitempty"`
+	Name          string `json:"name,omitempty"`
+	Email         string `json:"email,omitempty"`
+	EmailVerified *bool  `json:"email_verified,omitempty"`
+}
+
+// writeOAuthError writes an error of the token endpoint (RFC 6749, section 5.2)
+func writeOAuthError(w http.ResponseWriter, status int, code, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(map[string]string{"error": code, "error_description": description}); err != nil {
+		log.Println("Error encoding JSON error response:", err)
+	}
+}
+
+// errInvalidClient is returned when a client fails to authenticate
+var errInvalidClient = errors.New("invalid client")
+
+// authenticateClient identifies the client calling the token endpoint, with
+// the method it registered
+func authenticateClient(ctx context.Context, r *http.Request) (models.OAuthClient, error) {
+	clientID, secret, basic := r.BasicAuth()
+	method := clientSecretBasic
+	if basic {
+		// Credentials are form encoded before going into the header (RFC 6749, section 2.3.1)
+		var errID, errSecret error
+		clientID, errID = url.QueryUnescape(clientID)
+		secret, errSecret = url.QueryUnescape(secret)
+		if errID != nil || errSecret != nil {
+			return models.OAuthClient{}, errInvalidClient
+		}
+		if formID := r.PostForm.Get("client_id"); formID != "" && formID != clientID {
+			return models.OAuthClient{}, errInvalidClient
+		}
+	} else {
+		clientID, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+		method = clientSecretPost
+		if secret == "" {
+			method = clientAuthNone
+		}
+	}
+	client, found, err := findOAuthClient(ctx, clientID)
+	if err != nil {
+		return client, err
+	}
+	if !found || client.TokenEndpointAuthMethod != method {
+		return client, errInvalidClient
+	}
+	if method != clientAuthNone && subtle.ConstantTimeCompare([]byte(client.SecretHash), []byte(hashToken(secret))) != 1 {
+		return client, errInvalidClient
+	}
+	return client, nil
+}
+
+// Token redeems an authorization code for an access token, limited to the
+// granted scopes, and an ID token when openid was granted (RFC 6749, section
+// 4.1.3). The request is form encoded. Codes are single-use: a code is
+// consumed by the first attempt to redeem it, even a failed one. The access
+// token starts a session of the user, listed and revoked like those of
+// logins.
+func Token(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	if err := r.ParseForm(); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			writeError(w, "Request body too large", http.StatusRequestEntityTooLarge)
+		} else {
+			writeOAuthError(w, http.StatusBadRequest, "invalid_request", "Failed to decode request body")
+		}
+		return
+	}
+	if grantType := r.PostForm.Get("grant_type"); grantType != "authorization_code" {
+		writeOAuthError(w, http.StatusBadRequest, "unsupported_grant_type", "Only the authorization_code grant type is supported")
+		return
+	}
+
+	ctx, cancel := dbContext(r)
+	defer cancel()
+	client, err := authenticateClient(ctx, r)
+	if err != nil {
+		if err != errInvalidClient {
+			writeDBError(w, err)
+			return
+		}
+		if _, _, basic := r.BasicAuth(); basic {
+			w.Header().Set("WWW-Authenticate", `Basic realm="oauth"`)
+		}
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_client", "Client authentication failed")
+		return
+	}
+	code := r.PostForm.Get("code")
+	if code == "" {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "code is required")
+		return
+	}
+
+	hash := hashToken(code)
+	var user models.User
+	if err := mongoCollection.FindOne(ctx, bson.M{"oauth_codes.hash": hash}).Decode(&user); err != nil {
+		if err == mongo.ErrNoDocuments {
+			writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "Invalid or expired authorization code")
+		} else {
+			writeDBError(w, err)
+		}
+		return
+	}
+	var pending models.OAuthCode
+	for _, c := range user.OAuthCodes {
+		if c.Hash == hash {
+			pending = c
+		}
+	}
+	// Pulling the code is what redeems it, so concurrent attempts succeed once
+	res, err := mongoCollection.UpdateOne(ctx,
+		bson.M{"_id": user.ID, "oauth_codes.hash": hash},
+		bson.M{"$pull": bson.M{"oauth_codes": bson.M{"hash": hash}}})
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	redirectURI := r.PostForm.Get("redirect_uri")
+	switch {
+	case res.MatchedCount == 0 || pending.ClientID != client.ClientID || !time.Now().Before(pending.ExpiresAt):
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "Invalid or expired authorization code")
+		return
+	// A redirect URI sent with the authorization request must be sent again
+	// (RFC 6749, section 4.1.3)
+	case redirectURI == "" && pending.RedirectURIExplicit:
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "Redirect URI is required as it was sent with the authorization request")
+		return
+	case redirectURI != "" && redirectURI != pending.RedirectURI:
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "Redirect URI does not match the authorization request")
+		return
+	case !verifyCodeVerifier(r.PostForm.Get("code_verifier"), pending.CodeChallenge):
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "Invalid code verifier")
+		return
+	case user.Deactivated:
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "The user is deactivated")
+		return
+	}
+
+	session, err := startSession(ctx, r, user.ID, client.ClientID)
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	response, err := issueOAuthTokens(r, user, session, client.ClientID, pending)
+	if err != nil {
+		writeError(w, "Failed to issue token", http.StatusInternalServerError)
+		return
+	}
+	recordAudit(audit.OAuthTokenIssued, user.ID.Hex(), clientIP(r), map[string]string{
+		"client_id":  client.ClientID,
+		"scopes":     response.Scope,
+		"session_id": session.ID.Hex(),
+	})
+	writeJSON(w, response)
+}
+
+// issueOAuthTokens issues the tokens of a redeemed authorization code
+func issueOAuthTokens(r *http.Request, user models.User, session models.Session, clientID string, code models.OAuthCode) (OAuthTokenResponse, error) {
+	jti, _, err := newToken()
+	if err != nil {
+		return OAuthTokenResponse{}, err
+	}
+	now := time.Now()
+	scope := strings.Join(code.Scopes, " ")
+	accessToken, err := tokenSigner.Sign(tokenClaims{
+		Claims:    jwt.Claims{ID: jti, Subject: user.ID.Hex(), IssuedAt: now.Unix(), ExpiresAt: session.ExpiresAt.Unix()},
+		Purpose:   oauthTokenPurpose,
+		SessionID: session.ID.Hex(),
+		Scope:     scope,
+		ClientID:  clientID,
+	})
+	if err != nil {
+		return OAuthTokenResponse{}, err
+	}
+	response := OAuthTokenResponse{AccessToken: accessToken, TokenType: "Bearer", ExpiresIn: int(accessTokenTTL.Seconds()), Scope: scope}
+	if !containsString(code.Scopes, ScopeOpenID) {
+		return response, nil
+	}
+	info := userInfo(user, code.Scopes)
+	response.IDToken, err = idTokens().Sign(idTokenClaims{
+		Claims: jwt.Claims{
+			Issuer:    issuerURL(),
+			Subject:   info.Subject,
+			Audience:  jwt.Audience{clientID},
+			IssuedAt:  now.Unix(),
+			ExpiresAt: session.ExpiresAt.Unix(),
+		},
+		Nonce:         code.Nonce,
+		Name:          info.Name,
+		Email:         info.Email,
+		EmailVerified: info.EmailVerified,
+	})
+	return response, err
+}
+
+// UserInfo holds the claims about a user released for the granted scopes
+// (OpenID Connect Core, section 5.3)
+type UserInfo struct {
+	Subject       string `json:"sub"`
+	Name          string `json:"name,omitempty"`
+	Email         string `json:"email,omitempty"`
+	EmailVerified *bool  `json:"email_verified,omitempty"`
+}
+
+func userInfo(user models.User, scopes []string) UserInfo {
+	info := UserInfo{Subject: user.ID.Hex()}
+	if containsString(scopes, ScopeProfile) {
+		info.Name = user.Name
+	}
+	if containsString(scopes, ScopeEmail) {
+		verified := user.EmailVerified
+		info.Email, info.EmailVerified = user.Email, &verified
+	}
+	return info
+}
+
+// GetUserInfo returns the claims about the caller released by the scopes of
+// their token. Login tokens, which are not limited to scopes, see them all.
+func GetUserInfo(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	userID, ok := authenticatedUser(w, r)
+	if !ok {
+		return
+	}
+	scopes, scoped := middleware.ScopesFromContext(r.Context())
+	if !scoped {
+		scopes = oauthScopes
+	}
+	id, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		writeError(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	ctx, cancel := dbContext(r)
+	defer cancel()
+	var user models.User
+	if err := mongoCollection.FindOne(ctx, bson.M{"_id": id}).Decode(&user); err != nil {
+		if err == mongo.ErrNoDocuments {
+			writeError(w, "User not found", http.StatusNotFound)
+		} else {
+			writeDBError(w, err)
+		}
+		return
+	}
+	writeJSON(w, userInfo(user, scopes))
+}
+
+// GetJWKS publishes the key verifying ID tokens (RFC 7517)
+func GetJWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	writeJSON(w, jwt.JWKSet{Keys: []jwt.JWK{idTokens().JWK()}})
+}
+
+// OpenIDConfiguration is the discovery document of the provider (OpenID
+// Connect Discovery, section 3)
+type OpenIDConfiguration struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	UserinfoEndpoint                  string   `json:"userinfo_endpoint"`
+	JWKSURI                           string   `json:"jwks_uri"`
+	RegistrationEndpoint              string   `json:"registration_endpoint"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+	ClaimsSupported                   []string `json:"claims_supported"`
+	// AuthorizationResponseIssParameterSupported announces the iss parameter
+	// of authorization responses (RFC 9207)
+	AuthorizationResponseIssParameterSupported bool `json:"authorization_response_iss_parameter_supported"`
+}
+
+// GetOpenIDConfiguration serves the discovery document of the provider
+func GetOpenIDConfiguration(w http.ResponseWriter, r *http.Request) {
+	issuer := issuerURL()
+	writeJSON(w, OpenIDConfiguration{
+		Issuer:                                     issuer,
+		AuthorizationEndpoint:                      issuer + "/v1/oauth/authorize",
+		TokenEndpoint:                              issuer + "/v1/oauth/token",
+		UserinfoEndpoint:                           issuer + "/v1/oauth/userinfo",
+		JWKSURI:                                    issuer + "/v1/oauth/jwks",
+		RegistrationEndpoint:                       issuer + "/v1/oauth/clients",
+		ScopesSupported:                            oauthScopes,
+		ResponseTypesSupported:                     []string{"code"},
+		GrantTypesSupported:                        []string{"authorization_code"},
+		SubjectTypesSupported:                      []string{"public"},
+		IDTokenSigningAlgValuesSupported:           []string{"RS256"},
+		TokenEndpointAuthMethodsSupported:          []string{clientSecretBasic, clientSecretPost, clientAuthNone},
+		CodeChallengeMethodsSupported:              []string{"S256"},
+		ClaimsSupported:                            []string{"iss", "sub", "aud", "exp", "iat", "nonce", "name", "email", "email_verified"},
+		AuthorizationResponseIssParameterSupported: true,
+	})
+}
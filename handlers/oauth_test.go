@@ -0,0 +1,655 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lep13/golang-restful-api/audit"
+	"github.com/lep13/golang-restful-api/config"
+	"github.com/lep13/golang-restful-api/jwt"
+	"github.com/lep13/golang-restful-api/middleware"
+	"github.com/lep13/golang-restful-api/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const testVerifier = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+
+// testChallenge is the S256 challenge of testVerifier (RFC 7636, appendix B)
+const testChallenge = "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+
+var testClient = models.OAuthClient{
+	ClientID:                "testclient",
+	SecretHash:              hashToken("test secret"),
+	Name:                    "Example app",
+	RedirectURIs:            []string{"https://app.example.com/callback", "http://127.0.0.1:8080/callback"},
+	TokenEndpointAuthMethod: clientSecretBasic,
+}
+
+// findByClientID makes FindOne by client ID return owner, or err when it is set
+func findByClientID(mockCollection *MockCollection, clientID string, owner models.User, err error) {
+	result := new(MockSingleResult)
+	result.On("Decode", mock.AnythingOfType("*models.User")).Run(func(args mock.Arguments) {
+		*args.Get(0).(*models.User) = owner
+	}).Return(err)
+	mockCollection.On("FindOne", mock.Anything, bson.M{"oauth_clients.client_id": clientID}).Return(result)
+}
+
+// findByCode makes FindOne by authorization code return user, or err when it is set
+func findByCode(mockCollection *MockCollection, code string, user models.User, err error) {
+	result := new(MockSingleResult)
+	result.On("Decode", mock.AnythingOfType("*models.User")).Run(func(args mock.Arguments) {
+		*args.Get(0).(*models.User) = user
+	}).Return(err)
+	mockCollection.On("FindOne", mock.Anything, bson.M{"oauth_codes.hash": hashToken(code)}).Return(result)
+}
+
+func authorizeQuery(overrides map[string]string) string {
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {testClient.ClientID},
+		"redirect_uri":          {"https://app.example.com/callback"},
+		"scope":                 {"openid profile"},
+		"state":                 {"af0ifjsldkj"},
+		"code_challenge":        {testChallenge},
+		"code_challenge_method": {"S256"},
+	}
+	for key, value := range overrides {
+		if value == "" {
+			params.Del(key)
+		} else {
+			params.Set(key, value)
+		}
+	}
+	return "/v1/oauth/authorize?" + params.Encode()
+}
+
+func TestRegisterOAuthClient(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	logger := new(recordingAuditLogger)
+	defer setupAuditLogger(logger)()
+	id := primitive.NewObjectID()
+	var pushed models.OAuthClient
+	mockCollection.On("UpdateOne", mock.Anything, bson.M{"_id": id, "oauth_clients.19": bson.M{"$exists": false}}, mock.Anything).Run(func(args mock.Arguments) {
+		pushed = args.Get(2).(bson.M)["$push"].(bson.M)["oauth_clients"].(models.OAuthClient)
+	}).Return(&mongo.UpdateResult{MatchedCount: 1}, nil)
+
+	rr := serve(RegisterOAuthClient, "POST", "/v1/oauth/clients",
+		`{"client_name":" Example app ","redirect_uris":["https://app.example.com/callback"]}`, as(id.Hex()))
+
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	var client NewOAuthClient
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &client))
+	assert.Equal(t, pushed.ClientID, client.ClientID)
+	assert.Equal(t, "Example app", client.ClientName)
+	assert.Equal(t, clientSecretBasic, client.TokenEndpointAuthMethod)
+	assert.Equal(t, []string{"authorization_code"}, client.GrantTypes)
+	assert.Equal(t, hashToken(client.ClientSecret), pushed.SecretHash, "only the hash of the secret is stored")
+	assert.Contains(t, rr.Body.String(), `"client_secret_expires_at":0`)
+	assert.Equal(t, audit.OAuthClientRegistered, logger.recorded()[0].Action)
+}
+
+func TestRegisterOAuthClient_PublicClient(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	var pushed models.OAuthClient
+	mockCollection.On("UpdateOne", mock.Anything, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		pushed = args.Get(2).(bson.M)["$push"].(bson.M)["oauth_clients"].(models.OAuthClient)
+	}).Return(&mongo.UpdateResult{MatchedCount: 1}, nil)
+
+	rr := serve(RegisterOAuthClient, "POST", "/v1/oauth/clients",
+		`{"client_name":"CLI","redirect_uris":["http://localhost:8080/callback"],"token_endpoint_auth_method":"none"}`, as(primitive.NewObjectID().Hex()))
+
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	assert.NotContains(t, rr.Body.String(), `"client_secret":`)
+	assert.Empty(t, pushed.SecretHash)
+}
+
+func TestRegisterOAuthClient_Rejects(t *testing.T) {
+	id := primitive.NewObjectID().Hex()
+	for _, tc := range []struct {
+		name     string
+		callerID string
+		body     string
+		status   int
+		message  string
+	}{
+		{"anonymous", "", `{"client_name":"app","redirect_uris":["https://app.example.com/cb"]}`, http.StatusUnauthorized, "Authentication required"},
+		{"no name", id, `{"client_name":" ","redirect_uris":["https://app.example.com/cb"]}`, http.StatusBadRequest, "Client name is required"},
+		{"no redirect URI", id, `{"client_name":"app","redirect_uris":[]}`, http.StatusBadRequest, "At least one redirect URI is required"},
+		{"plain HTTP", id, `{"client_name":"app","redirect_uris":["http://app.example.com/cb"]}`, http.StatusBadRequest, `Invalid redirect URI "http://app.example.com/cb"; use HTTPS, or HTTP on the loopback interface`},
+		{"fragment", id, `{"client_name":"app","redirect_uris":["https://app.example.com/cb#x"]}`, http.StatusBadRequest, `Invalid redirect URI "https://app.example.com/cb#x"; use HTTPS, or HTTP on the loopback interface`},
+		{"relative", id, `{"client_name":"app","redirect_uris":["/cb"]}`, http.StatusBadRequest, `Invalid redirect URI "/cb"; use HTTPS, or HTTP on the loopback interface`},
+		{"unknown method", id, `{"client_name":"app","redirect_uris":["https://app.example.com/cb"],"token_endpoint_auth_method":"private_key_jwt"}`, http.StatusBadRequest, `Unsupported token endpoint auth method "private_key_jwt"`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			defer SetupMockCollection(new(MockCollection))()
+
+			rr := serve(RegisterOAuthClient, "POST", "/v1/oauth/clients", tc.body, as(tc.callerID))
+
+			assert.Equal(t, tc.status, rr.Code)
+			assert.JSONEq(t, `{"error":`+jsonString(tc.message)+`}`, rr.Body.String())
+		})
+	}
+}
+
+func jsonString(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
+
+func TestRegisterOAuthClient_Limit(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	mockCollection.On("UpdateOne", mock.Anything, mock.Anything, mock.Anything).Return(&mongo.UpdateResult{MatchedCount: 0}, nil)
+
+	rr := serve(RegisterOAuthClient, "POST", "/v1/oauth/clients",
+		`{"client_name":"app","redirect_uris":["https://app.example.com/cb"]}`, as(primitive.NewObjectID().Hex()))
+
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	assert.JSONEq(t, `{"error":"A user may have at most 20 OAuth clients"}`, rr.Body.String())
+}
+
+func TestDeleteOAuthClient(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	id := primitive.NewObjectID()
+	mockCollection.On("UpdateOne", mock.Anything, bson.M{"_id": id, "oauth_clients.client_id": "mine"}, mock.Anything).
+		Return(&mongo.UpdateResult{MatchedCount: 1}, nil)
+	mockCollection.On("UpdateOne", mock.Anything, bson.M{"_id": id, "oauth_clients.client_id": "theirs"}, mock.Anything).
+		Return(&mongo.UpdateResult{MatchedCount: 0}, nil)
+
+	for clientID, status := range map[string]int{"mine": http.StatusOK, "theirs": http.StatusNotFound} {
+		req := httptest.NewRequest("DELETE", "/v1/oauth/clients/"+clientID, nil)
+		req = mux.SetURLVars(req, map[string]string{"client_id": clientID})
+		req = req.WithContext(middleware.WithUserID(req.Context(), id.Hex()))
+		rr := httptest.NewRecorder()
+		DeleteOAuthClient(rr, req)
+		assert.Equal(t, status, rr.Code, clientID)
+	}
+}
+
+func TestAuthorize_Errors(t *testing.T) {
+	id := primitive.NewObjectID()
+	owner := models.User{ID: primitive.NewObjectID(), OAuthClients: []models.OAuthClient{testClient}}
+
+	for _, tc := range []struct {
+		name      string
+		overrides map[string]string
+		status    int
+		// body is the error response, or the error code sent to the client
+		body  string
+		error string
+	}{
+		{"unknown client", map[string]string{"client_id": "nobody"}, http.StatusBadRequest, `{"error":"Unknown OAuth client"}`, ""},
+		{"unregistered redirect", map[string]string{"redirect_uri": "https://evil.example.com/cb"}, http.StatusBadRequest, `{"error":"Redirect URI is not registered for the client"}`, ""},
+		{"ambiguous redirect", map[string]string{"redirect_uri": ""}, http.StatusBadRequest, `{"error":"Redirect URI is not registered for the client"}`, ""},
+		{"token response", map[string]string{"response_type": "token"}, http.StatusOK, "", "unsupported_response_type"},
+		{"unknown scope", map[string]string{"scope": "openid admin"}, http.StatusOK, "", "invalid_scope"},
+		{"no PKCE", map[string]string{"code_challenge": "", "code_challenge_method": ""}, http.StatusOK, "", "invalid_request"},
+		{"plain PKCE", map[string]string{"code_challenge_method": "plain"}, http.StatusOK, "", "invalid_request"},
+		{"malformed challenge", map[string]string{"code_challenge": "short"}, http.StatusOK, "", "invalid_request"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mockCollection := new(MockCollection)
+			defer SetupMockCollection(mockCollection)()
+			findByClientID(mockCollection, testClient.ClientID, owner, nil)
+			findByClientID(mockCollection, "nobody", models.User{}, mongo.ErrNoDocuments)
+
+			rr := serve(Authorize, "GET", authorizeQuery(tc.overrides), "", as(id.Hex()))
+
+			assert.Equal(t, tc.status, rr.Code)
+			if tc.body != "" {
+				assert.JSONEq(t, tc.body, rr.Body.String())
+				return
+			}
+			var authorization OAuthAuthorization
+			require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &authorization))
+			redirect, err := url.Parse(authorization.RedirectTo)
+			require.NoError(t, err)
+			assert.Equal(t, "app.example.com", redirect.Host)
+			assert.Equal(t, tc.error, redirect.Query().Get("error"))
+			assert.Equal(t, "af0ifjsldkj", redirect.Query().Get("state"))
+			assert.Empty(t, redirect.Query().Get("code"))
+		})
+	}
+}
+
+func TestAuthorize_RequiresLogin(t *testing.T) {
+	rr := serve(Authorize, "GET", authorizeQuery(nil), "")
+
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	assert.Equal(t, "Bearer", rr.Header().Get("WWW-Authenticate"))
+}
+
+func TestAuthorize_AsksForConsent(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	id := primitive.NewObjectID()
+	findByClientID(mockCollection, testClient.ClientID, models.User{OAuthClients: []models.OAuthClient{testClient}}, nil)
+	// A consent to fewer scopes does not cover the request
+	findUser(mockCollection, id, models.User{ID: id, OAuthConsents: map[string]models.OAuthConsent{
+		testClient.ClientID: {Scopes: []string{ScopeOpenID}},
+	}}, nil)
+
+	rr := serve(Authorize, "GET", authorizeQuery(nil), "", as(id.Hex()))
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, `{"consent_required":true,"client_id":"testclient","client_name":"Example app","scopes":["openid","profile"]}`, rr.Body.String())
+	mockCollection.AssertNotCalled(t, "UpdateOne", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestAuthorize_IssuesCode(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	defer setupIssuer("https://api.example.com")()
+	id := primitive.NewObjectID()
+	findByClientID(mockCollection, testClient.ClientID, models.User{OAuthClients: []models.OAuthClient{testClient}}, nil)
+	findUser(mockCollection, id, models.User{ID: id, OAuthConsents: map[string]models.OAuthConsent{
+		testClient.ClientID: {Scopes: []string{ScopeOpenID, ScopeProfile, ScopeEmail}},
+	}}, nil)
+	var pushed bson.M
+	mockCollection.On("UpdateOne", mock.Anything, bson.M{"_id": id}, mock.Anything).Run(func(args mock.Arguments) {
+		pushed = args.Get(2).(bson.M)["$push"].(bson.M)["oauth_codes"].(bson.M)
+	}).Return(&mongo.UpdateResult{MatchedCount: 1}, nil)
+
+	rr := serve(Authorize, "GET", authorizeQuery(map[string]string{"nonce": "n-0S6"}), "", as(id.Hex()))
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var authorization OAuthAuthorization
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &authorization))
+	redirect, err := url.Parse(authorization.RedirectTo)
+	require.NoError(t, err)
+	assert.Equal(t, "/callback", redirect.Path)
+	assert.Equal(t, "af0ifjsldkj", redirect.Query().Get("state"))
+	assert.Equal(t, "https://api.example.com", redirect.Query().Get("iss"))
+
+	codes := pushed["$each"].([]models.OAuthCode)
+	require.Len(t, codes, 1)
+	assert.Equal(t, -maxOAuthCodes, pushed["$slice"])
+	code := codes[0]
+	assert.Equal(t, hashToken(redirect.Query().Get("code")), code.Hash, "only the hash of the code is stored")
+	assert.Equal(t, testClient.ClientID, code.ClientID)
+	assert.Equal(t, "https://app.example.com/callback", code.RedirectURI)
+	assert.True(t, code.RedirectURIExplicit, "the token request must repeat the redirect URI")
+	assert.Equal(t, []string{ScopeOpenID, ScopeProfile}, code.Scopes)
+	assert.Equal(t, testChallenge, code.CodeChallenge)
+	assert.Equal(t, "n-0S6", code.Nonce)
+	assert.WithinDuration(t, time.Now().Add(oauthCodeTTL), code.ExpiresAt, time.Second)
+}
+
+func TestApproveAuthorization(t *testing.T) {
+	body := func(approve bool) string {
+		b, _ := json.Marshal(map[string]interface{}{
+			"response_type":         "code",
+			"client_id":             testClient.ClientID,
+			"redirect_uri":          "http://127.0.0.1:8080/callback",
+			"scope":                 "openid email",
+			"code_challenge":        testChallenge,
+			"code_challenge_method": "S256",
+			"approve":               approve,
+		})
+		return string(b)
+	}
+
+	t.Run("approved", func(t *testing.T) {
+		mockCollection := new(MockCollection)
+		defer SetupMockCollection(mockCollection)()
+		logger := new(recordingAuditLogger)
+		defer setupAuditLogger(logger)()
+		id := primitive.NewObjectID()
+		findByClientID(mockCollection, testClient.ClientID, models.User{OAuthClients: []models.OAuthClient{testClient}}, nil)
+		findUser(mockCollection, id, models.User{ID: id, OAuthConsents: map[string]models.OAuthConsent{
+			testClient.ClientID: {Scopes: []string{ScopeOpenID, ScopeProfile}},
+		}}, nil)
+		var consent models.OAuthConsent
+		isConsent := mock.MatchedBy(func(update bson.M) bool { _, ok := update["$set"]; return ok })
+		mockCollection.On("UpdateOne", mock.Anything, bson.M{"_id": id}, isConsent).Run(func(args mock.Arguments) {
+			consent = args.Get(2).(bson.M)["$set"].(bson.M)["oauth_consents."+testClient.ClientID].(models.OAuthConsent)
+		}).Return(&mongo.UpdateResult{MatchedCount: 1}, nil).Once()
+		mockCollection.On("UpdateOne", mock.Anything, bson.M{"_id": id}, mock.Anything).Return(&mongo.UpdateResult{MatchedCount: 1}, nil)
+
+		rr := serve(ApproveAuthorization, "POST", "/v1/oauth/authorize", body(true), as(id.Hex()))
+
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Contains(t, rr.Body.String(), `"redirect_to":"http://127.0.0.1:8080/callback?code=`)
+		// The consent adds the new scopes to those granted before
+		assert.Equal(t, []string{ScopeOpenID, ScopeProfile, ScopeEmail}, consent.Scopes)
+		assert.Equal(t, audit.OAuthConsentGranted, logger.recorded()[0].Action)
+	})
+
+	t.Run("denied", func(t *testing.T) {
+		mockCollection := new(MockCollection)
+		defer SetupMockCollection(mockCollection)()
+		findByClientID(mockCollection, testClient.ClientID, models.User{OAuthClients: []models.OAuthClient{testClient}}, nil)
+
+		rr := serve(ApproveAuthorization, "POST", "/v1/oauth/authorize", body(false), as(primitive.NewObjectID().Hex()))
+
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Contains(t, rr.Body.String(), "error=access_denied")
+		mockCollection.AssertNotCalled(t, "UpdateOne", mock.Anything, mock.Anything, mock.Anything)
+	})
+}
+
+// tokenRequest builds a request to the token endpoint, with Basic credentials
+// when clientID is set
+func tokenRequest(form url.Values, clientID, secret string) *http.Request {
+	req := httptest.NewRequest("POST", "/v1/oauth/token", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if clientID != "" {
+		req.SetBasicAuth(url.QueryEscape(clientID), url.QueryEscape(secret))
+	}
+	return req
+}
+
+func codeForm(code string) url.Values {
+	return url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {"https://app.example.com/callback"},
+		"code_verifier": {testVerifier},
+	}
+}
+
+func TestToken(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	defer setupIssuer("https://api.example.com")()
+	logger := new(recordingAuditLogger)
+	defer setupAuditLogger(logger)()
+	id := primitive.NewObjectID()
+	user := models.User{ID: id, Name: "John", Email: "john@example.com", OAuthCodes: []models.OAuthCode{{
+		Hash:          hashToken("the code"),
+		ClientID:      testClient.ClientID,
+		RedirectURI:   "https://app.example.com/callback",
+		Scopes:        []string{ScopeOpenID, ScopeProfile},
+		CodeChallenge: testChallenge,
+		Nonce:         "n-0S6",
+		ExpiresAt:     time.Now().Add(time.Minute),
+	}}}
+	findByClientID(mockCollection, testClient.ClientID, models.User{OAuthClients: []models.OAuthClient{testClient}}, nil)
+	findByCode(mockCollection, "the code", user, nil)
+	mockCollection.On("UpdateOne", mock.Anything, bson.M{"_id": id, "oauth_codes.hash": hashToken("the code")}, mock.Anything).
+		Return(&mongo.UpdateResult{MatchedCount: 1}, nil)
+	sessions := acceptSessions(mockCollection, id)
+
+	rr := httptest.NewRecorder()
+	Token(rr, tokenRequest(codeForm("the code"), testClient.ClientID, "test secret"))
+
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.Equal(t, "no-store", rr.Header().Get("Cache-Control"))
+	var response OAuthTokenResponse
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &response))
+	assert.Equal(t, "Bearer", response.TokenType)
+	assert.Equal(t, "openid profile", response.Scope)
+
+	// The session names the client, and the access token is limited to the scopes
+	require.Len(t, *sessions, 1)
+	assert.Equal(t, testClient.ClientID, (*sessions)[0].ClientID)
+	claims, _, err := parseToken(response.AccessToken, oauthTokenPurpose)
+	require.NoError(t, err)
+	assert.Equal(t, (*sessions)[0].ID.Hex(), claims.SessionID)
+	assert.Equal(t, "openid profile", claims.Scope)
+	_, _, err = parseToken(response.AccessToken, accessTokenPurpose)
+	assert.Error(t, err, "OAuth tokens are not login tokens")
+
+	var idToken idTokenClaims
+	require.NoError(t, idTokens().Verify(response.IDToken, &idToken))
+	assert.Equal(t, "https://api.example.com", idToken.Issuer)
+	assert.Equal(t, id.Hex(), idToken.Subject)
+	assert.Equal(t, jwt.Audience{testClient.ClientID}, idToken.Audience)
+	assert.Equal(t, "n-0S6", idToken.Nonce)
+	assert.Equal(t, "John", idToken.Name)
+	assert.Empty(t, idToken.Email, "the email scope was not granted")
+	assert.Equal(t, audit.OAuthTokenIssued, logger.recorded()[0].Action)
+}
+
+func TestToken_PublicClientWithoutOpenID(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	public := models.OAuthClient{ClientID: "publicclient", RedirectURIs: []string{"https://app.example.com/callback"}, TokenEndpointAuthMethod: clientAuthNone}
+	id := primitive.NewObjectID()
+	user := models.User{ID: id, OAuthCodes: []models.OAuthCode{{
+		Hash: hashToken("the code"), ClientID: public.ClientID, RedirectURI: "https://app.example.com/callback",
+		Scopes: []string{ScopeEmail}, CodeChallenge: testChallenge, ExpiresAt: time.Now().Add(time.Minute),
+	}}}
+	findByClientID(mockCollection, public.ClientID, models.User{OAuthClients: []models.OAuthClient{public}}, nil)
+	findByCode(mockCollection, "the code", user, nil)
+	mockCollection.On("UpdateOne", mock.Anything, bson.M{"_id": id, "oauth_codes.hash": hashToken("the code")}, mock.Anything).
+		Return(&mongo.UpdateResult{MatchedCount: 1}, nil)
+	acceptSessions(mockCollection, id)
+	form := codeForm("the code")
+	form.Set("client_id", public.ClientID)
+
+	rr := httptest.NewRecorder()
+	Token(rr, tokenRequest(form, "", ""))
+
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var response OAuthTokenResponse
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &response))
+	assert.Empty(t, response.IDToken, "ID tokens need the openid scope")
+
+	assert.Equal(t, "email", response.Scope)
+	claims, _, err := parseToken(response.AccessToken, oauthTokenPurpose)
+	require.NoError(t, err)
+	assert.Equal(t, public.ClientID, claims.ClientID)
+}
+
+func TestToken_Rejects(t *testing.T) {
+	id := primitive.NewObjectID()
+	valid := models.OAuthCode{
+		Hash: hashToken("the code"), ClientID: testClient.ClientID, RedirectURI: "https://app.example.com/callback",
+		Scopes: []string{ScopeOpenID}, CodeChallenge: testChallenge, ExpiresAt: time.Now().Add(time.Minute),
+	}
+	expired := valid
+	expired.ExpiresAt = time.Now().Add(-time.Second)
+	otherClient := valid
+	otherClient.ClientID = "otherclient"
+	explicitRedirect := valid
+	explicitRedirect.RedirectURIExplicit = true
+	with := func(change func(url.Values)) url.Values {
+		form := codeForm("the code")
+		change(form)
+		return form
+	}
+
+	for _, tc := range []struct {
+		name     string
+		form     url.Values
+		clientID string
+		secret   string
+		code     models.OAuthCode
+		consumed bool
+		status   int
+		error    string
+	}{
+		{"wrong secret", codeForm("the code"), testClient.ClientID, "guess", valid, false, http.StatusUnauthorized, "invalid_client"},
+		{"unknown client", codeForm("the code"), "nobody", "test secret", valid, false, http.StatusUnauthorized, "invalid_client"},
+		{"secret in form", with(func(f url.Values) { f.Set("client_id", testClient.ClientID); f.Set("client_secret", "test secret") }), "", "", valid, false, http.StatusUnauthorized, "invalid_client"},
+		{"no client", codeForm("the code"), "", "", valid, false, http.StatusUnauthorized, "invalid_client"},
+		{"other grant", with(func(f url.Values) { f.Set("grant_type", "client_credentials") }), testClient.ClientID, "test secret", valid, false, http.StatusBadRequest, "unsupported_grant_type"},
+		{"no code", with(func(f url.Values) { f.Del("code") }), testClient.ClientID, "test secret", valid, false, http.StatusBadRequest, "invalid_request"},
+		{"unknown code", codeForm("another code"), testClient.ClientID, "test secret", valid, false, http.StatusBadRequest, "invalid_grant"},
+		{"already redeemed", codeForm("the code"), testClient.ClientID, "test secret", valid, true, http.StatusBadRequest, "invalid_grant"},
+		{"code of another client", codeForm("the code"), testClient.ClientID, "test secret", otherClient, false, http.StatusBadRequest, "invalid_grant"},
+		{"expired code", codeForm("the code"), testClient.ClientID, "test secret", expired, false, http.StatusBadRequest, "invalid_grant"},
+		{"other redirect", with(func(f url.Values) { f.Set("redirect_uri", "http://127.0.0.1:8080/callback") }), testClient.ClientID, "test secret", valid, false, http.StatusBadRequest, "invalid_grant"},
+		{"redirect not repeated", with(func(f url.Values) { f.Del("redirect_uri") }), testClient.ClientID, "test secret", explicitRedirect, false, http.StatusBadRequest, "invalid_grant"},
+		{"wrong verifier", with(func(f url.Values) { f.Set("code_verifier", strings.Repeat("a", 43)) }), testClient.ClientID, "test secret", valid, false, http.StatusBadRequest, "invalid_grant"},
+		{"no verifier", with(func(f url.Values) { f.Del("code_verifier") }), testClient.ClientID, "test secret", valid, false, http.StatusBadRequest, "invalid_grant"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mockCollection := new(MockCollection)
+			defer SetupMockCollection(mockCollection)()
+			findByClientID(mockCollection, testClient.ClientID, models.User{OAuthClients: []models.OAuthClient{testClient}}, nil)
+			findByClientID(mockCollection, "nobody", models.User{}, mongo.ErrNoDocuments)
+			findByCode(mockCollection, "the code", models.User{ID: id, OAuthCodes: []models.OAuthCode{tc.code}}, nil)
+			findByCode(mockCollection, "another code", models.User{}, mongo.ErrNoDocuments)
+			matched := int64(1)
+			if tc.consumed {
+				matched = 0
+			}
+			mockCollection.On("UpdateOne", mock.Anything, bson.M{"_id": id, "oauth_codes.hash": hashToken("the code")}, mock.Anything).
+				Return(&mongo.UpdateResult{MatchedCount: matched}, nil)
+
+			rr := httptest.NewRecorder()
+			Token(rr, tokenRequest(tc.form, tc.clientID, tc.secret))
+
+			assert.Equal(t, tc.status, rr.Code)
+			var body map[string]string
+			require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &body))
+			assert.Equal(t, tc.error, body["error"])
+			if tc.status == http.StatusUnauthorized && tc.clientID != "" {
+				assert.Equal(t, `Basic realm="oauth"`, rr.Header().Get("WWW-Authenticate"))
+			}
+			mockCollection.AssertNotCalled(t, "UpdateOne", mock.Anything, bson.M{"_id": id}, mock.Anything)
+		})
+	}
+}
+
+func TestToken_DatabaseError(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	findByClientID(mockCollection, testClient.ClientID, models.User{}, errors.New("connection refused"))
+
+	rr := httptest.NewRecorder()
+	Token(rr, tokenRequest(codeForm("the code"), testClient.ClientID, "test secret"))
+
+	assert.Equal(t, http.StatusInternalServerError, rr.Code)
+	assert.JSONEq(t, `{"error":"connection refused"}`, rr.Body.String())
+}
+
+func TestGetUserInfo(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	id := primitive.NewObjectID()
+	findUser(mockCollection, id, models.User{ID: id, Name: "John", Email: "john@example.com", EmailVerified: true}, nil)
+
+	for _, tc := range []struct {
+		name   string
+		scopes []string
+		want   string
+	}{
+		{"openid", []string{ScopeOpenID}, `{"sub":"` + id.Hex() + `"}`},
+		{"profile", []string{ScopeOpenID, ScopeProfile}, `{"sub":"` + id.Hex() + `","name":"John"}`},
+		{"email", []string{ScopeOpenID, ScopeEmail}, `{"sub":"` + id.Hex() + `","email":"john@example.com","email_verified":true}`},
+		{"login token", nil, `{"sub":"` + id.Hex() + `","name":"John","email":"john@example.com","email_verified":true}`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/v1/oauth/userinfo", nil)
+			ctx := middleware.WithUserID(req.Context(), id.Hex())
+			if tc.scopes != nil {
+				ctx = middleware.WithScopes(ctx, tc.scopes)
+			}
+			rr := httptest.NewRecorder()
+			GetUserInfo(rr, req.WithContext(ctx))
+
+			assert.Equal(t, http.StatusOK, rr.Code)
+			assert.JSONEq(t, tc.want, rr.Body.String())
+		})
+	}
+}
+
+func setupIssuer(issuer string) func() {
+	original := oauthIssuer
+	oauthIssuer = issuer
+	return func() { oauthIssuer = original }
+}
+
+func TestGetOpenIDConfiguration(t *testing.T) {
+	defer setupIssuer("https://api.example.com")()
+
+	rr := httptest.NewRecorder()
+	GetOpenIDConfiguration(rr, httptest.NewRequest("GET", "/.well-known/openid-configuration", nil))
+
+	var discovery OpenIDConfiguration
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &discovery))
+	assert.Equal(t, "https://api.example.com", discovery.Issuer)
+	assert.Equal(t, "https://api.example.com/v1/oauth/token", discovery.TokenEndpoint)
+	assert.Equal(t, "https://api.example.com/v1/oauth/jwks", discovery.JWKSURI)
+	assert.Equal(t, []string{"S256"}, discovery.CodeChallengeMethodsSupported)
+
+	rr = httptest.NewRecorder()
+	GetJWKS(rr, httptest.NewRequest("GET", "/v1/oauth/jwks", nil))
+	assert.JSONEq(t, `{"keys":[`+mustJSON(t, idTokens().JWK())+`]}`, rr.Body.String())
+}
+
+func mustJSON(t *testing.T, v interface{}) string {
+	b, err := json.Marshal(v)
+	require.NoError(t, err)
+	return string(b)
+}
+
+func TestSetOAuth(t *testing.T) {
+	defer setupIssuer(oauthIssuer)()
+
+	require.NoError(t, SetOAuth(config.OAuthConfig{Issuer: "https://api.example.com/"}))
+	assert.Equal(t, "https://api.example.com", issuerURL())
+
+	for _, issuer := range []string{"http://api.example.com", "api.example.com", "https://api.example.com?tenant=1", "https://user@api.example.com"} {
+		assert.EqualError(t, SetOAuth(config.OAuthConfig{Issuer: issuer}),
+			fmt.Sprintf("invalid issuer %q: must be an https URL, or http on the loopback interface, without credentials, query or fragment", issuer))
+	}
+	// A rejected issuer keeps the previous one
+	assert.Equal(t, "https://api.example.com", issuerURL())
+
+	// Plain HTTP is fine for local development
+	require.NoError(t, SetOAuth(config.OAuthConfig{Issuer: "http://localhost:5000"}))
+	assert.Equal(t, "http://localhost:5000", issuerURL())
+
+	// Without an issuer the provider is disabled
+	require.NoError(t, SetOAuth(config.OAuthConfig{}))
+	assert.Empty(t, issuerURL())
+}
+
+func TestParseRSAKey(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+	small, err := rsa.GenerateKey(rand.Reader, 1024)
+	require.NoError(t, err)
+
+	for name, data := range map[string][]byte{
+		"PKCS #1": pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}),
+		"PKCS #8": pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}),
+	} {
+		parsed, err := parseRSAKey(data)
+		require.NoError(t, err, name)
+		assert.True(t, key.Equal(parsed), name)
+	}
+
+	_, err = parseRSAKey(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(small)}))
+	assert.EqualError(t, err, "RSA keys must have at least 2048 bits")
+	_, err = parseRSAKey([]byte("not a key"))
+	assert.EqualError(t, err, "no PEM block found")
+	_, err = parseRSAKey(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte{1}}))
+	assert.EqualError(t, err, `unexpected PEM block "CERTIFICATE"`)
+}
+
+func TestVerifyCodeVerifier(t *testing.T) {
+	assert.True(t, verifyCodeVerifier(testVerifier, testChallenge))
+	assert.False(t, verifyCodeVerifier(testVerifier, "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cN"))
+	short := strings.Repeat("a", 42)
+	sum := sha256.Sum256([]byte(short))
+	assert.False(t, verifyCodeVerifier(short, base64.RawURLEncoding.EncodeToString(sum[:])), "verifiers have at least 43 characters")
+}
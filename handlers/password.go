@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/lep13/golang-restful-api/models"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// maxPasswordBytes is the longest password bcrypt can hash
+const maxPasswordBytes = 72
+
+var (
+	passwordMinLength = 8
+
+	// dummyPasswordHash is checked against when a login names an unknown
+	// user, so the response takes as long as for a wrong password
+	dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+)
+
+// SetPasswordPolicy sets the shortest password users may choose
+func SetPasswordPolicy(minLength int) {
+	if minLength > 0 {
+		passwordMinLength = minLength
+	}
+}
+
+// validatePassword checks a new password of the user against the password
+// policy. The error is meant to be shown to the user.
+func validatePassword(password string, user models.User) error {
+	length := utf8.RuneCountInString(password)
+	switch {
+	case length < passwordMinLength:
+		return fmt.Errorf("Password must be at least %d characters", passwordMinLength)
+	case len(password) > maxPasswordBytes:
+		return fmt.Errorf("Password must be at most %d bytes", maxPasswordBytes)
+	case strings.TrimSpace(password) == "":
+		return errors.New("Password must not be blank")
+	case user.Email != "" && strings.EqualFold(password, user.Email),
+		user.Name != "" && strings.EqualFold(password, user.Name):
+		return errors.New("Password must not be your name or email")
+	}
+	return nil
+}
+
+// hashPassword returns the bcrypt hash under which a password is stored
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// hashNewPassword checks the password a request gives the user against the
+// password policy and replaces it with its hash. A user without a password is
+// left alone. When the password is rejected it returns the status and the
+// message to answer with, and 0 otherwise.
+func hashNewPassword(user *models.User) (int, string) {
+	if user.Password == "" {
+		return 0, ""
+	}
+	if err := validatePassword(user.Password, *user); err != nil {
+		return http.StatusBadRequest, err.Error()
+	}
+	hash, err := hashPassword(user.Password)
+	if err != nil {
+		return http.StatusInternalServerError, "Failed to hash password"
+	}
+	user.Password = hash
+	return 0, ""
+}
+
+// checkPassword reports whether password matches the stored bcrypt hash.
+// Anything else, such as the empty password of a user created without one,
+// never matches, but takes as long to check so the response time does not
+// tell these users apart.
+func checkPassword(stored, password string) bool {
+	if !strings.HasPrefix(stored, "$2") {
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) == nil
+}
@@ -0,0 +1,207 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/lep13/golang-restful-api/audit"
+	"github.com/lep13/golang-restful-api/mailer"
+	"github.com/lep13/golang-restful-api/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var (
+	passwordResetTTL            = 30 * time.Minute
+	passwordResetResendInterval = time.Minute
+	passwordResetURL            string
+
+	// background tracks the work handlers leave running after responding, so
+	// tests can wait for it
+	background sync.WaitGroup
+)
+
+// SetPasswordReset sets how long password reset tokens are valid, the least
+// time between two reset emails to a user, and the client page where users
+// pick a new password, which may be empty
+func SetPasswordReset(ttl, resendInterval time.Duration, pageURL string) {
+	if ttl > 0 {
+		passwordResetTTL = ttl
+	}
+	if resendInterval > 0 {
+		passwordResetResendInterval = resendInterval
+	}
+	passwordResetURL = pageURL
+}
+
+// RequestPasswordReset mails a password reset token to the user with the given
+// email. The response is 202 whether or not such a user exists, and the lookup
+// happens after responding, so neither the answer nor its timing reveals which
+// emails have an account.
+func RequestPasswordReset(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var body struct {
+		Email string `json:"email"`
+	}
+	if !decodeBody(w, r, &body) {
+		return
+	}
+	if body.Email == "" {
+		writeError(w, "Email is required", http.StatusBadRequest)
+		return
+	}
+
+	ip := clientIP(r)
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		startPasswordReset(body.Email, ip)
+	}()
+
+	w.WriteHeader(http.StatusAccepted)
+	response := map[string]string{"message": "If an account uses this email, a password reset email is on its way"}
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Println("Error encoding JSON response:", err)
+	}
+}
+
+// startPasswordReset stores a new reset token for the user with the email and
+// mails it to them. Nothing is sent within the resend interval of the last
+// email, so the endpoint cannot be used to flood a mailbox.
+func startPasswordReset(email, ip string) {
+	ctx, cancel := context.WithTimeout(context.Background(), operationTimeout)
+	defer cancel()
+	var user models.User
+	if err := mongoCollection.FindOne(ctx, bson.M{"email": normalizeEmail(email)}).Decode(&user); err != nil {
+		if err != mongo.ErrNoDocuments {
+			log.Printf("Failed to look up user for password reset: %v", err)
+		}
+		return
+	}
+
+	now := time.Now()
+	filter := bson.M{"_id": user.ID, "password_reset": bson.M{"$exists": false}}
+	if user.PasswordReset != nil {
+		if user.PasswordReset.SentAt.Add(passwordResetResendInterval).After(now) {
+			return
+		}
+		// Replacing only the token that was read lets one of concurrent requests win
+		filter = bson.M{"_id": user.ID, "password_reset.token_hash": user.PasswordReset.TokenHash}
+	}
+	token, hash, err := newToken()
+	if err != nil {
+		log.Printf("Failed to create password reset token: %v", err)
+		return
+	}
+	reset := &models.PasswordReset{TokenHash: hash, ExpiresAt: now.Add(passwordResetTTL), SentAt: now}
+	res, err := mongoCollection.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"password_reset": reset}})
+	if err != nil {
+		log.Printf("Failed to store password reset token for user %s: %v", user.ID.Hex(), err)
+		return
+	}
+	if res.MatchedCount == 0 {
+		return
+	}
+	recordAudit(audit.PasswordResetRequested, user.ID.Hex(), ip, nil)
+
+	user.PasswordReset = reset
+	sendPasswordResetEmail(user, token)
+}
+
+// sendPasswordResetEmail mails the reset token to the user
+func sendPasswordResetEmail(user models.User, token string) {
+	ctx, cancel := context.WithTimeout(context.Background(), mailTimeout)
+	defer cancel()
+
+	action := fmt.Sprintf("send this token with your new password to POST /v1/auth/password-reset/confirm:\n\n%s", token)
+	if link, err := url.Parse(passwordResetURL); err == nil && passwordResetURL != "" {
+		query := link.Query()
+		query.Set("token", token)
+		link.RawQuery = query.Encode()
+		action = "open this link:\n\n" + link.String()
+	}
+	expires := user.PasswordReset.ExpiresAt.UTC().Format(time.RFC1123)
+	err := mailSender.Send(ctx, mailer.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Hello %s,\n\nTo choose a new password, %s\n\n"+
+			"This expires on %s and can be used once. If you did not ask to reset your password, you can ignore this email.\n",
+			user.Name, action, expires),
+	})
+	if err != nil {
+		log.Printf("Failed to send password reset email to user %s: %v", user.ID.Hex(), err)
+	}
+}
+
+// ConfirmPasswordReset sets a new password for the user holding a reset token.
+// The token is consumed, and every session and token issued to the user before
+// the reset is revoked. A password rejected by the policy leaves the token
+// usable for another attempt.
+func ConfirmPasswordReset(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var body struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	if !decodeBody(w, r, &body) {
+		return
+	}
+	if body.Token == "" {
+		writeError(w, "Token is required", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := dbContext(r)
+	defer cancel()
+	hash := hashToken(body.Token)
+	var user models.User
+	err := mongoCollection.FindOne(ctx, bson.M{
+		"password_reset.token_hash": hash,
+		"password_reset.expires_at": bson.M{"$gt": time.Now()},
+	}).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		writeError(w, "Invalid or expired reset token", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if err := validatePassword(body.Password, user); err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	password, err := hashPassword(body.Password)
+	if err != nil {
+		writeError(w, "Failed to hash password", http.StatusInternalServerError)
+		return
+	}
+
+	// Matching on the token again makes consuming it atomic
+	res, err := mongoCollection.UpdateOne(ctx,
+		bson.M{"_id": user.ID, "password_reset.token_hash": hash},
+		bson.M{
+			"$set":   bson.M{"password": password, "sessions_revoked_at": time.Now()},
+			"$unset": bson.M{"password_reset": "", "sessions": ""},
+		})
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if res.MatchedCount == 0 {
+		writeError(w, "Invalid or expired reset token", http.StatusBadRequest)
+		return
+	}
+	validSessions.forgetUser(user.ID.Hex())
+	recordAudit(audit.PasswordResetCompleted, user.ID.Hex(), clientIP(r), nil)
+
+	if err := json.NewEncoder(w).Encode(map[string]string{"message": "Password reset"}); err != nil {
+		log.Println("Error encoding JSON response:", err)
+	}
+}
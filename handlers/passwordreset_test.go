@@ -0,0 +1,258 @@
+package handlers
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lep13/golang-restful-api/audit"
+	"github.com/lep13/golang-restful-api/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// recordingAuditLogger keeps the events it is asked to record
+type recordingAuditLogger struct {
+	mu     sync.Mutex
+	events []audit.Event
+}
+
+func (l *recordingAuditLogger) Record(event audit.Event) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events = append(l.events, event)
+	return nil
+}
+
+func (l *recordingAuditLogger) recorded() []audit.Event {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]audit.Event(nil), l.events...)
+}
+
+func setupAuditLogger(l audit.Logger) func() {
+	original := auditLogger
+	auditLogger = l
+	return func() { auditLogger = original }
+}
+
+// findByEmail makes FindOne by email return user, or err when it is set
+func findByEmail(mockCollection *MockCollection, email string, user models.User, err error) {
+	result := new(MockSingleResult)
+	result.On("Decode", mock.AnythingOfType("*models.User")).Run(func(args mock.Arguments) {
+		*args.Get(0).(*models.User) = user
+	}).Return(err)
+	mockCollection.On("FindOne", mock.Anything, bson.M{"email": email}).Return(result)
+}
+
+// findByResetToken makes FindOne by reset token return user, or err when it is set
+func findByResetToken(mockCollection *MockCollection, token string, user models.User, err error) {
+	result := new(MockSingleResult)
+	result.On("Decode", mock.AnythingOfType("*models.User")).Run(func(args mock.Arguments) {
+		*args.Get(0).(*models.User) = user
+	}).Return(err)
+	mockCollection.On("FindOne", mock.Anything, mock.MatchedBy(func(filter bson.M) bool {
+		return filter["password_reset.token_hash"] == hashToken(token)
+	})).Return(result)
+}
+
+func TestRequestPasswordReset(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	sender := new(recordingMailer)
+	defer setupMailer(sender)()
+	auditLog := new(recordingAuditLogger)
+	defer setupAuditLogger(auditLog)()
+	id := primitive.NewObjectID()
+	findByEmail(mockCollection, "john@example.com", models.User{ID: id, Name: "John", Email: "john@example.com"}, nil)
+	var stored *models.PasswordReset
+	mockCollection.On("UpdateOne", mock.Anything, bson.M{"_id": id, "password_reset": bson.M{"$exists": false}}, mock.Anything).Run(func(args mock.Arguments) {
+		stored = args.Get(2).(bson.M)["$set"].(bson.M)["password_reset"].(*models.PasswordReset)
+	}).Return(&mongo.UpdateResult{MatchedCount: 1}, nil)
+
+	rr := serve(RequestPasswordReset, "POST", "/v1/auth/password-reset/request", `{"email": "john@example.com"}`)
+
+	assert.Equal(t, http.StatusAccepted, rr.Code)
+	messages := sender.sent()
+	require.Len(t, messages, 1)
+	assert.Equal(t, "john@example.com", messages[0].To)
+	assert.Contains(t, messages[0].Body, "POST /v1/auth/password-reset/confirm")
+	token := tokenPattern.FindString(messages[0].Body)
+	assert.Equal(t, hashToken(token), stored.TokenHash)
+	assert.WithinDuration(t, time.Now().Add(passwordResetTTL), stored.ExpiresAt, time.Minute)
+	events := auditLog.recorded()
+	require.Len(t, events, 1)
+	assert.Equal(t, audit.PasswordResetRequested, events[0].Action)
+	assert.Equal(t, id.Hex(), events[0].UserID)
+	assert.Equal(t, "203.0.113.7", events[0].IP)
+}
+
+func TestRequestPasswordReset_Link(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	sender := new(recordingMailer)
+	defer setupMailer(sender)()
+	defer setupAuditLogger(new(recordingAuditLogger))()
+	defer SetPasswordReset(passwordResetTTL, passwordResetResendInterval, passwordResetURL)
+	SetPasswordReset(0, 0, "https://app.example.com/reset?lang=en")
+	findByEmail(mockCollection, "john@example.com", models.User{ID: primitive.NewObjectID(), Email: "john@example.com"}, nil)
+	mockCollection.On("UpdateOne", mock.Anything, mock.Anything, mock.Anything).Return(&mongo.UpdateResult{MatchedCount: 1}, nil)
+
+	serve(RequestPasswordReset, "POST", "/v1/auth/password-reset/request", `{"email": "john@example.com"}`)
+
+	messages := sender.sent()
+	require.Len(t, messages, 1)
+	token := tokenPattern.FindString(messages[0].Body)
+	assert.Contains(t, messages[0].Body, "https://app.example.com/reset?lang=en&token="+token)
+}
+
+func TestRequestPasswordReset_SameAnswerWithoutMail(t *testing.T) {
+	id := primitive.NewObjectID()
+	for _, tc := range []struct {
+		name string
+		user models.User
+		err  error
+	}{
+		{"unknown email", models.User{}, mongo.ErrNoDocuments},
+		{"sent recently", models.User{ID: id, Email: "john@example.com", PasswordReset: &models.PasswordReset{TokenHash: "old", SentAt: time.Now().Add(-10 * time.Second)}}, nil},
+		{"database down", models.User{}, mongo.CommandError{Labels: []string{"NetworkError"}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mockCollection := new(MockCollection)
+			defer SetupMockCollection(mockCollection)()
+			sender := new(recordingMailer)
+			defer setupMailer(sender)()
+			findByEmail(mockCollection, "john@example.com", tc.user, tc.err)
+
+			rr := serve(RequestPasswordReset, "POST", "/v1/auth/password-reset/request", `{"email": "john@example.com"}`)
+
+			assert.Equal(t, http.StatusAccepted, rr.Code)
+			assert.JSONEq(t, `{"message": "If an account uses this email, a password reset email is on its way"}`, rr.Body.String())
+			assert.Empty(t, sender.sent())
+			mockCollection.AssertNotCalled(t, "UpdateOne", mock.Anything, mock.Anything, mock.Anything)
+		})
+	}
+}
+
+func TestRequestPasswordReset_ReplacesExpiredToken(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	sender := new(recordingMailer)
+	defer setupMailer(sender)()
+	defer setupAuditLogger(new(recordingAuditLogger))()
+	id := primitive.NewObjectID()
+	old := &models.PasswordReset{TokenHash: "old", SentAt: time.Now().Add(-time.Hour)}
+	findByEmail(mockCollection, "john@example.com", models.User{ID: id, Email: "john@example.com", PasswordReset: old}, nil)
+	mockCollection.On("UpdateOne", mock.Anything, bson.M{"_id": id, "password_reset.token_hash": "old"}, mock.Anything).Return(&mongo.UpdateResult{}, nil)
+
+	rr := serve(RequestPasswordReset, "POST", "/v1/auth/password-reset/request", `{"email": "john@example.com"}`)
+
+	// A concurrent request replaced the token first, and sends its own email
+	assert.Equal(t, http.StatusAccepted, rr.Code)
+	assert.Empty(t, sender.sent())
+	mockCollection.AssertExpectations(t)
+}
+
+func TestRequestPasswordReset_InvalidRequest(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+
+	for _, body := range []string{`{}`, `{"email": `} {
+		rr := serve(RequestPasswordReset, "POST", "/v1/auth/password-reset/request", body)
+
+		assert.Equal(t, http.StatusBadRequest, rr.Code, body)
+	}
+	mockCollection.AssertNotCalled(t, "FindOne", mock.Anything, mock.Anything)
+}
+
+func TestConfirmPasswordReset(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	auditLog := new(recordingAuditLogger)
+	defer setupAuditLogger(auditLog)()
+	id := primitive.NewObjectID()
+	findByResetToken(mockCollection, "reset-token", models.User{ID: id, Email: "john@example.com"}, nil)
+	var update bson.M
+	mockCollection.On("UpdateOne", mock.Anything, bson.M{"_id": id, "password_reset.token_hash": hashToken("reset-token")}, mock.Anything).Run(func(args mock.Arguments) {
+		update = args.Get(2).(bson.M)
+	}).Return(&mongo.UpdateResult{MatchedCount: 1}, nil)
+
+	rr := serve(ConfirmPasswordReset, "POST", "/v1/auth/password-reset/confirm", `{"token": "reset-token", "password": "correct horse battery"}`)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	set := update["$set"].(bson.M)
+	assert.True(t, checkPassword(set["password"].(string), "correct horse battery"))
+	assert.WithinDuration(t, time.Now(), set["sessions_revoked_at"].(time.Time), time.Minute)
+	assert.Equal(t, bson.M{"password_reset": "", "sessions": ""}, update["$unset"])
+	events := auditLog.recorded()
+	require.Len(t, events, 1)
+	assert.Equal(t, audit.Event{Time: events[0].Time, Action: audit.PasswordResetCompleted, UserID: id.Hex(), IP: "203.0.113.7"}, events[0])
+}
+
+func TestConfirmPasswordReset_Rejected(t *testing.T) {
+	user := models.User{ID: primitive.NewObjectID(), Name: "John Doe", Email: "john@example.com"}
+	for _, tc := range []struct {
+		name     string
+		body     string
+		findErr  error
+		matched  int64
+		status   int
+		message  string
+		consumed bool
+	}{
+		{"unknown token", `{"token": "reset-token", "password": "correct horse battery"}`, mongo.ErrNoDocuments, 0, http.StatusBadRequest, "Invalid or expired reset token", false},
+		{"short password", `{"token": "reset-token", "password": "short"}`, nil, 0, http.StatusBadRequest, "Password must be at least 8 characters", false},
+		{"email as password", `{"token": "reset-token", "password": "JOHN@example.com"}`, nil, 0, http.StatusBadRequest, "Password must not be your name or email", false},
+		{"token used concurrently", `{"token": "reset-token", "password": "correct horse battery"}`, nil, 0, http.StatusBadRequest, "Invalid or expired reset token", true},
+		{"missing token", `{"password": "correct horse battery"}`, nil, 0, http.StatusBadRequest, "Token is required", false},
+		{"database down", `{"token": "reset-token", "password": "correct horse battery"}`, mongo.CommandError{Labels: []string{"NetworkError"}}, 0, http.StatusServiceUnavailable, "", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mockCollection := new(MockCollection)
+			defer SetupMockCollection(mockCollection)()
+			auditLog := new(recordingAuditLogger)
+			defer setupAuditLogger(auditLog)()
+			findByResetToken(mockCollection, "reset-token", user, tc.findErr)
+			mockCollection.On("UpdateOne", mock.Anything, mock.Anything, mock.Anything).Return(&mongo.UpdateResult{MatchedCount: tc.matched}, nil)
+
+			rr := serve(ConfirmPasswordReset, "POST", "/v1/auth/password-reset/confirm", tc.body)
+
+			assert.Equal(t, tc.status, rr.Code)
+			assert.Contains(t, rr.Body.String(), tc.message)
+			if !tc.consumed {
+				mockCollection.AssertNotCalled(t, "UpdateOne", mock.Anything, mock.Anything, mock.Anything)
+			}
+			assert.Empty(t, auditLog.recorded())
+		})
+	}
+}
+
+func TestValidatePassword(t *testing.T) {
+	defer SetPasswordPolicy(passwordMinLength)
+	SetPasswordPolicy(10)
+	user := models.User{Name: "John Doe", Email: "john@example.com"}
+
+	for password, expected := range map[string]string{
+		"correct horse":         "",
+		"mot de pässé":          "",
+		"too short":             "Password must be at least 10 characters",
+		strings.Repeat("a", 73): "Password must be at most 72 bytes",
+		strings.Repeat("ä", 37): "Password must be at most 72 bytes",
+		"            ":          "Password must not be blank",
+		"JOHN@EXAMPLE.COM":      "Password must not be your name or email",
+		"John Doe":              "Password must be at least 10 characters",
+	} {
+		err := validatePassword(password, user)
+		if expected == "" {
+			assert.NoError(t, err, password)
+		} else {
+			assert.EqualError(t, err, expected, password)
+		}
+	}
+}
@@ -0,0 +1,1017 @@
+package handlers
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lep13/golang-restful-api/audit"
+	"github.com/lep13/golang-restful-api/filter"
+	"github.com/lep13/golang-restful-api/middleware"
+	"github.com/lep13/golang-restful-api/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ScopeSCIM is the scope of the SCIM tokens. It is never granted to API keys
+// or OAuth clients, so only SCIM tokens reach the SCIM endpoints.
+const ScopeSCIM = "scim"
+
+// URNs of the SCIM schemas and messages (RFC 7643, RFC 7644)
+const (
+	scimUserSchema                  = "urn:ietf:params:scim:schemas:core:2.0:User"
+	scimServiceProviderConfigSchema = "urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"
+	scimResourceTypeSchema          = "urn:ietf:params:scim:schemas:core:2.0:ResourceType"
+	scimSchemaSchema                = "urn:ietf:params:scim:schemas:core:2.0:Schema"
+	scimListResponseSchema          = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	scimPatchOpSchema               = "urn:ietf:params:scim:api:messages:2.0:PatchOp"
+	scimErrorSchema                 = "urn:ietf:params:scim:api:messages:2.0:Error"
+)
+
+const (
+	scimMediaType = "application/scim+json"
+	// scimMaxResults caps the users returned by one list request
+	scimMaxResults = MaxPageSize
+	// scimMaxOperations caps the operations of one PATCH request
+	scimMaxOperations = 100
+	// minSCIMTokenLength is the shortest SCIM token accepted in the configuration
+	minSCIMTokenLength = 32
+)
+
+// Error types of SCIM error responses (RFC 7644, section 3.12)
+const (
+	scimInvalidFilter = "invalidFilter"
+	scimInvalidSyntax = "invalidSyntax"
+	scimInvalidPath   = "invalidPath"
+	scimInvalidValue  = "invalidValue"
+	scimNoTarget      = "noTarget"
+	scimMutability    = "mutability"
+	scimUniqueness    = "uniqueness"
+)
+
+// scimTokenHashes are the SHA-256 hashes of the SCIM tokens
+var scimTokenHashes []string
+
+// SetSCIMTokens sets the bearer tokens identity providers call the SCIM
+// endpoints with. Only their hashes are kept.
+func SetSCIMTokens(tokens []string) error {
+	hashes := make([]string, 0, len(tokens))
+	for i, token := range tokens {
+		if len(token) < minSCIMTokenLength {
+			return fmt.Errorf("SCIM token %d is shorter than %d characters", i+1, minSCIMTokenLength)
+		}
+		hashes = append(hashes, hashToken(token))
+	}
+	scimTokenHashes = hashes
+	return nil
+}
+
+// isSCIMToken reports whether token is one of the SCIM tokens, comparing it
+// with all of them so the time taken does not tell which one matched
+func isSCIMToken(token string) bool {
+	hash := []byte(hashToken(token))
+	match := 0
+	for _, h := range scimTokenHashes {
+		match |= subtle.ConstantTimeCompare(hash, []byte(h))
+	}
+	return match == 1
+}
+
+// SCIMUser is a user in the SCIM core schema. userName is the email the user
+// logs in with, and emails repeats it; displayName and name.formatted are
+// both the name of the user. password is write-only.
+type SCIMUser struct {
+	Schemas     []string    `json:"schemas"`
+	ID          string      `json:"id,omitempty"`
+	ExternalID  string      `json:"externalId,omitempty"`
+	UserName    string      `json:"userName"`
+	Name        *SCIMName   `json:"name,omitempty"`
+	DisplayName string      `json:"displayName,omitempty"`
+	Emails      []SCIMEmail `json:"emails,omitempty"`
+	Active      *bool       `json:"active,omitempty"`
+	Password    string      `json:"password,omitempty"`
+	Meta        *SCIMMeta   `json:"meta,omitempty"`
+}
+
+// SCIMName is the name of a SCIMUser
+type SCIMName struct {
+	Formatted  string `json:"formatted,omitempty"`
+	GivenName  string `json:"givenName,omitempty"`
+	FamilyName string `json:"familyName,omitempty"`
+}
+
+// SCIMEmail is an email of a SCIMUser
+type SCIMEmail struct {
+	Value   string `json:"value"`
+	Type    string `json:"type,omitempty"`
+	Primary bool   `json:"primary,omitempty"`
+}
+
+// SCIMMeta describes a SCIM resource
+type SCIMMeta struct {
+	ResourceType string     `json:"resourceType"`
+	Created      *time.Time `json:"created,omitempty"`
+	LastModified *time.Time `json:"lastModified,omitempty"`
+	Location     string     `json:"location"`
+}
+
+// SCIMListResponse is a page of resources (RFC 7644, section 3.4.2)
+type SCIMListResponse struct {
+	Schemas      []string    `json:"schemas"`
+	TotalResults int64       `json:"totalResults"`
+	StartIndex   int         `json:"startIndex"`
+	ItemsPerPage int         `json:"itemsPerPage"`
+	Resources    interface{} `json:"Resources"`
+}
+
+// SCIMPatchRequest modifies a user (RFC 7644, section 3.5.2)
+type SCIMPatchRequest struct {
+	Schemas    []string             `json:"schemas"`
+	Operations []SCIMPatchOperation `json:"Operations"`
+}
+
+// SCIMPatchOperation is one operation of a SCIMPatchRequest. Op is add,
+// replace or remove; Path is empty for an add or replace of the attributes
+// in Value.
+type SCIMPatchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// SCIMError is an error response (RFC 7644, section 3.12)
+type SCIMError struct {
+	Schemas  []string `json:"schemas"`
+	Status   string   `json:"status"`
+	ScimType string   `json:"scimType,omitempty"`
+	Detail   string   `json:"detail,omitempty"`
+}
+
+// scimProblem is a request a SCIM endpoint rejects
+type scimProblem struct {
+	status   int
+	scimType string
+	detail   string
+}
+
+func invalidSCIMValue(detail string) *scimProblem {
+	return &scimProblem{status: http.StatusBadRequest, scimType: scimInvalidValue, detail: detail}
+}
+
+func writeSCIMError(w http.ResponseWriter, status int, scimType, detail string) {
+	writeSCIM(w, status, SCIMError{
+		Schemas:  []string{scimErrorSchema},
+		Status:   strconv.Itoa(status),
+		ScimType: scimType,
+		Detail:   detail,
+	})
+}
+
+func writeSCIMProblem(w http.ResponseWriter, p *scimProblem) {
+	writeSCIMError(w, p.status, p.scimType, p.detail)
+}
+
+// writeSCIMDBError maps a database error like writeDBError, as a SCIM error.
+// A duplicate key is the email, and so the userName, of another user.
+func writeSCIMDBError(w http.ResponseWriter, err error) {
+	switch {
+	case mongo.IsDuplicateKeyError(err):
+		writeSCIMError(w, http.StatusConflict, scimUniqueness, "userName is already taken")
+	case errors.Is(err, context.DeadlineExceeded) || mongo.IsTimeout(err):
+		writeSCIMError(w, http.StatusGatewayTimeout, "", "Database operation timed out")
+	case errors.Is(err, context.Canceled) || mongo.IsNetworkError(err):
+		writeSCIMError(w, http.StatusServiceUnavailable, "", "Database unavailable")
+	default:
+		writeSCIMError(w, http.StatusInternalServerError, "", err.Error())
+	}
+}
+
+// writeSCIM writes value with the SCIM media type
+func writeSCIM(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", scimMediaType)
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.Println("Error encoding SCIM response:", err)
+	}
+}
+
+// decodeSCIMBody decodes the request body like decodeBody, writing SCIM errors
+func decodeSCIMBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			writeSCIMError(w, http.StatusRequestEntityTooLarge, "", "Request body too large")
+		} else {
+			writeSCIMError(w, http.StatusBadRequest, scimInvalidSyntax, "Failed to decode request body")
+		}
+		return false
+	}
+	return true
+}
+
+// requireSCIM writes 401 unless the request carries a SCIM token, or 403 for
+// the other credentials of a user
+func requireSCIM(w http.ResponseWriter, r *http.Request) bool {
+	scopes, _ := middleware.ScopesFromContext(r.Context())
+	if containsString(scopes, ScopeSCIM) {
+		return true
+	}
+	if _, ok := middleware.UserIDFromContext(r.Context()); ok {
+		writeSCIMError(w, http.StatusForbidden, "", "Only SCIM tokens may call the SCIM endpoints")
+		return false
+	}
+	w.Header().Set("WWW-Authenticate", `Bearer realm="SCIM"`)
+	writeSCIMError(w, http.StatusUnauthorized, "", "A SCIM bearer token is required")
+	return false
+}
+
+// scimBaseURL is the URL the SCIM endpoints are served under
+func scimBaseURL() string {
+	return issuerURL() + "/scim/v2"
+}
+
+// scimUser represents user in the SCIM core schema
+func scimUser(user models.User, base string) SCIMUser {
+	var attributes models.SCIMAttributes
+	if user.SCIM != nil {
+		attributes = *user.SCIM
+	}
+	created := user.ID.Timestamp().UTC()
+	lastModified := created
+	if !attributes.LastModified.IsZero() {
+		lastModified = attributes.LastModified.UTC()
+	}
+	active := !user.Deactivated
+	u := SCIMUser{
+		Schemas:     []string{scimUserSchema},
+		ID:          user.ID.Hex(),
+		ExternalID:  attributes.ExternalID,
+		UserName:    user.Email,
+		DisplayName: user.Name,
+		Active:      &active,
+		Meta: &SCIMMeta{
+			ResourceType: "User",
+			Created:      &created,
+			LastModified: &lastModified,
+			Location:     base + "/Users/" + user.ID.Hex(),
+		},
+	}
+	if user.Name != "" || attributes.GivenName != "" || attributes.FamilyName != "" {
+		u.Name = &SCIMName{Formatted: user.Name, GivenName: attributes.GivenName, FamilyName: attributes.FamilyName}
+	}
+	if user.Email != "" {
+		u.Emails = []SCIMEmail{{Value: user.Email, Type: "work", Primary: true}}
+	}
+	return u
+}
+
+// applyTo writes the attributes of u to user as a replacement does: the
+// attributes u lacks are cleared, except active and password, which are left
+// as they are. The identity provider owns the email, so it is verified.
+func (u SCIMUser) applyTo(user *models.User, now time.Time) *scimProblem {
+	if u.UserName == "" {
+		return invalidSCIMValue("userName is required")
+	}
+	if address, err := mail.ParseAddress(u.UserName); err != nil || address.Address != u.UserName {
+		return invalidSCIMValue("userName must be an email address")
+	}
+	attributes := models.SCIMAttributes{ExternalID: u.ExternalID, LastModified: now}
+	name := u.DisplayName
+	if u.Name != nil {
+		attributes.GivenName, attributes.FamilyName = u.Name.GivenName, u.Name.FamilyName
+		if name == "" {
+			name = u.Name.Formatted
+		}
+		if name == "" {
+			name = strings.TrimSpace(u.Name.GivenName + " " + u.Name.FamilyName)
+		}
+	}
+	user.Email = normalizeEmail(u.UserName)
+	user.EmailVerified = true
+	user.EmailVerification = nil
+	user.Name = name
+	user.SCIM = &attributes
+	if u.Active != nil {
+		user.Deactivated = !*u.Active
+	}
+	if u.Password != "" {
+		if err := validatePassword(u.Password, *user); err != nil {
+			return invalidSCIMValue(err.Error())
+		}
+		hash, err := hashPassword(u.Password)
+		if err != nil {
+			return &scimProblem{status: http.StatusInternalServerError, detail: "Failed to hash password"}
+		}
+		user.Password = hash
+	}
+	return nil
+}
+
+// hasUserSchema reports whether the schemas of a request name the User schema
+func hasUserSchema(schemas []string) bool {
+	for _, schema := range schemas {
+		if strings.EqualFold(schema, scimUserSchema) {
+			return true
+		}
+	}
+	return false
+}
+
+// scimUserNameTaken reports whether a user other than id has the userName.
+// userName is not case sensitive in SCIM, so neither is the check.
+func scimUserNameTaken(ctx context.Context, userName string, id primitive.ObjectID) (bool, error) {
+	var existing models.User
+	err := mongoCollection.FindOne(ctx, bson.M{
+		"email": primitive.Regex{Pattern: "^" + regexp.QuoteMeta(userName) + "$", Options: "i"},
+		"_id":   bson.M{"$ne": id},
+	}).Decode(&existing)
+	if err == mongo.ErrNoDocuments {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// scimUserID parses the id path parameter, writing 404 when it cannot name a user
+func scimUserID(w http.ResponseWriter, r *http.Request) (primitive.ObjectID, bool) {
+	raw := mux.Vars(r)["id"]
+	id, err := primitive.ObjectIDFromHex(raw)
+	if err != nil {
+		writeSCIMError(w, http.StatusNotFound, "", "User "+raw+" not found")
+		return id, false
+	}
+	return id, true
+}
+
+// findSCIMUser loads the user named in the path, writing 404 when it does not exist
+func findSCIMUser(ctx context.Context, w http.ResponseWriter, r *http.Request) (models.User, bool) {
+	var user models.User
+	id, ok := scimUserID(w, r)
+	if !ok {
+		return user, false
+	}
+	if err := mongoCollection.FindOne(ctx, bson.M{"_id": id}).Decode(&user); err != nil {
+		if err == mongo.ErrNoDocuments {
+			writeSCIMError(w, http.StatusNotFound, "", "User "+id.Hex()+" not found")
+		} else {
+			writeSCIMDBError(w, err)
+		}
+		return user, false
+	}
+	return user, true
+}
+
+// scimFilterFields are the User attributes a SCIM filter may use, by their
+// SCIM names and by their names qualified with the schema URN
+var scimFilterFields = func() filter.Fields {
+	fields := filter.Fields{
+		"id":              {Path: "_id", Type: filter.ObjectID},
+		"externalid":      {Path: "scim.external_id", Type: filter.String},
+		"username":        {Path: "email", Type: filter.String},
+		"displayname":     {Path: "name", Type: filter.String},
+		"name.formatted":  {Path: "name", Type: filter.String},
+		"name.givenname":  {Path: "scim.given_name", Type: filter.String},
+		"name.familyname": {Path: "scim.family_name", Type: filter.String},
+		"emails":          {Path: "email", Type: filter.String},
+		"emails.value":    {Path: "email", Type: filter.String},
+		"meta.created":    {Path: "_id", Type: filter.CreationTime},
+	}
+	prefix := strings.ToLower(scimUserSchema) + ":"
+	for name, field := range fields {
+		fields[prefix+name] = field
+	}
+	return fields
+}()
+
+// ListSCIMUsers lists users, in the order they were created, matching the
+// filter parameter. startIndex, from 1, and count page through the results.
+func ListSCIMUsers(w http.ResponseWriter, r *http.Request) {
+	if !requireSCIM(w, r) {
+		return
+	}
+	query := r.URL.Query()
+	conditions, ok := scimListFilter(w, query.Get("filter"))
+	if !ok {
+		return
+	}
+	startIndex, count := 1, scimMaxResults
+	if raw := query.Get("startIndex"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			writeSCIMError(w, http.StatusBadRequest, scimInvalidValue, "startIndex must be an integer")
+			return
+		}
+		// Indexes below 1 mean 1 (RFC 7644, section 3.4.2.4)
+		startIndex = max(n, 1)
+	}
+	if raw := query.Get("count"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			writeSCIMError(w, http.StatusBadRequest, scimInvalidValue, "count must be an integer")
+			return
+		}
+		count = min(max(n, 0), scimMaxResults)
+	}
+
+	ctx, cancel := dbContext(r)
+	defer cancel()
+	total, err := mongoCollection.CountDocuments(ctx, conditions)
+	if err != nil {
+		writeSCIMDBError(w, err)
+		return
+	}
+	base := scimBaseURL()
+	resources := []SCIMUser{}
+	if count > 0 && int64(startIndex) <= total {
+		findOptions := options.Find().
+			SetSort(bson.D{{Key: "_id", Value: 1}}).
+			SetSkip(int64(startIndex - 1)).
+			SetLimit(int64(count)).
+			SetProjection(bson.M{"password": 0})
+		cur, err := mongoCollection.Find(ctx, conditions, findOptions)
+		if err != nil {
+			writeSCIMDBError(w, err)
+			return
+		}
+		defer cur.Close(context.Background())
+		for cur.Next(ctx) {
+			var user models.User
+			if err := cur.Decode(&user); err != nil {
+				log.Println("Failed to decode user:", err)
+				continue
+			}
+			resources = append(resources, scimUser(user, base))
+		}
+		if err := cur.Err(); err != nil {
+			writeSCIMDBError(w, err)
+			return
+		}
+	}
+	writeSCIM(w, http.StatusOK, SCIMListResponse{
+		Schemas:      []string{scimListResponseSchema},
+		TotalResults: total,
+		StartIndex:   startIndex,
+		ItemsPerPage: len(resources),
+		Resources:    resources,
+	})
+}
+
+// scimListFilter compiles a SCIM filter, writing 400 when it is invalid
+func scimListFilter(w http.ResponseWriter, raw string) (bson.M, bool) {
+	if raw == "" {
+		return bson.M{}, true
+	}
+	expr, err := filter.Parse(raw)
+	var compiled bson.M
+	if err == nil {
+		compiled, err = filter.Compile(expr, scimFilterFields)
+	}
+	if err != nil {
+		writeSCIMError(w, http.StatusBadRequest, scimInvalidFilter, "Invalid filter: "+err.Error())
+		return nil, false
+	}
+	return compiled, true
+}
+
+// GetSCIMUser returns a user
+func GetSCIMUser(w http.ResponseWriter, r *http.Request) {
+	if !requireSCIM(w, r) {
+		return
+	}
+	ctx, cancel := dbContext(r)
+	defer cancel()
+	user, ok := findSCIMUser(ctx, w, r)
+	if !ok {
+		return
+	}
+	writeSCIM(w, http.StatusOK, scimUser(user, scimBaseURL()))
+}
+
+// CreateSCIMUser provisions a user. Its userName must not be taken by
+// another user.
+func CreateSCIMUser(w http.ResponseWriter, r *http.Request) {
+	if !requireSCIM(w, r) {
+		return
+	}
+	var body SCIMUser
+	if !decodeSCIMBody(w, r, &body) {
+		return
+	}
+	if !hasUserSchema(body.Schemas) {
+		writeSCIMError(w, http.StatusBadRequest, scimInvalidSyntax, "schemas must contain "+scimUserSchema)
+		return
+	}
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	user := models.User{ID: primitive.NewObjectID()}
+	if p := body.applyTo(&user, now); p != nil {
+		writeSCIMProblem(w, p)
+		return
+	}
+
+	ctx, cancel := dbContext(r)
+	defer cancel()
+	taken, err := scimUserNameTaken(ctx, user.Email, user.ID)
+	if err != nil {
+		writeSCIMDBError(w, err)
+		return
+	}
+	if taken {
+		writeSCIMError(w, http.StatusConflict, scimUniqueness, "userName is already taken")
+		return
+	}
+	if _, err := mongoCollection.InsertOne(ctx, user); err != nil {
+		writeSCIMDBError(w, err)
+		return
+	}
+	recordAudit(audit.SCIMUserCreated, user.ID.Hex(), clientIP(r), map[string]string{"user_name": user.Email})
+	if user.Deactivated {
+		recordAudit(audit.UserDeactivated, user.ID.Hex(), clientIP(r), nil)
+	}
+	created := scimUser(user, scimBaseURL())
+	w.Header().Set("Location", created.Meta.Location)
+	writeSCIM(w, http.StatusCreated, created)
+}
+
+// ReplaceSCIMUser replaces the attributes of a user; see SCIMUser.applyTo
+func ReplaceSCIMUser(w http.ResponseWriter, r *http.Request) {
+	if !requireSCIM(w, r) {
+		return
+	}
+	var body SCIMUser
+	if !decodeSCIMBody(w, r, &body) {
+		return
+	}
+	if !hasUserSchema(body.Schemas) {
+		writeSCIMError(w, http.StatusBadRequest, scimInvalidSyntax, "schemas must contain "+scimUserSchema)
+		return
+	}
+	ctx, cancel := dbContext(r)
+	defer cancel()
+	user, ok := findSCIMUser(ctx, w, r)
+	if !ok {
+		return
+	}
+	replaced := user
+	if p := body.applyTo(&replaced, time.Now().UTC().Truncate(time.Millisecond)); p != nil {
+		writeSCIMProblem(w, p)
+		return
+	}
+	if !saveSCIMUser(ctx, w, r, user, replaced) {
+		return
+	}
+	writeSCIM(w, http.StatusOK, scimUser(replaced, scimBaseURL()))
+}
+
+// PatchSCIMUser applies add, replace and remove operations to a user, all
+// or none of them. emails is read-only; it follows userName.
+func PatchSCIMUser(w http.ResponseWriter, r *http.Request) {
+	if !requireSCIM(w, r) {
+		return
+	}
+	var body SCIMPatchRequest
+	if !decodeSCIMBody(w, r, &body) {
+		return
+	}
+	if len(body.Schemas) != 1 || !strings.EqualFold(body.Schemas[0], scimPatchOpSchema) {
+		writeSCIMError(w, http.StatusBadRequest, scimInvalidSyntax, "schemas must be ["+scimPatchOpSchema+"]")
+		return
+	}
+	if len(body.Operations) == 0 || len(body.Operations) > scimMaxOperations {
+		writeSCIMError(w, http.StatusBadRequest, scimInvalidSyntax, fmt.Sprintf("Operations must have 1 to %d operations", scimMaxOperations))
+		return
+	}
+	ctx, cancel := dbContext(r)
+	defer cancel()
+	user, ok := findSCIMUser(ctx, w, r)
+	if !ok {
+		return
+	}
+	patched := scimUser(user, "")
+	for _, operation := range body.Operations {
+		if p := patched.patch(operation); p != nil {
+			writeSCIMProblem(w, p)
+			return
+		}
+	}
+	updated := user
+	if p := patched.applyTo(&updated, time.Now().UTC().Truncate(time.Millisecond)); p != nil {
+		writeSCIMProblem(w, p)
+		return
+	}
+	if !saveSCIMUser(ctx, w, r, user, updated) {
+		return
+	}
+	writeSCIM(w, http.StatusOK, scimUser(updated, scimBaseURL()))
+}
+
+// saveSCIMUser stores the attributes of a user replaced or patched from
+// before to after. Deactivating the user or setting their password revokes
+// their sessions, as a password reset does.
+func saveSCIMUser(ctx context.Context, w http.ResponseWriter, r *http.Request, before, after models.User) bool {
+	if !strings.EqualFold(after.Email, before.Email) {
+		taken, err := scimUserNameTaken(ctx, after.Email, after.ID)
+		if err != nil {
+			writeSCIMDBError(w, err)
+			return false
+		}
+		if taken {
+			writeSCIMError(w, http.StatusConflict, scimUniqueness, "userName is already taken")
+			return false
+		}
+	}
+	set := bson.M{"email": after.Email, "email_verified": true, "scim": after.SCIM}
+	unset := bson.M{"email_verification": ""}
+	if after.Name != "" {
+		set["name"] = after.Name
+	} else {
+		unset["name"] = ""
+	}
+	if after.Deactivated {
+		set["deactivated"] = true
+	} else {
+		unset["deactivated"] = ""
+	}
+	passwordChanged := after.Password != before.Password
+	if passwordChanged {
+		set["password"] = after.Password
+	}
+	revoke := passwordChanged || (after.Deactivated && !before.Deactivated)
+	if revoke {
+		set["sessions_revoked_at"] = after.SCIM.LastModified
+		unset["sessions"] = ""
+	}
+	res, err := mongoCollection.UpdateOne(ctx, bson.M{"_id": after.ID}, bson.M{"$set": set, "$unset": unset})
+	if err != nil {
+		writeSCIMDBError(w, err)
+		return false
+	}
+	if res.MatchedCount == 0 {
+		writeSCIMError(w, http.StatusNotFound, "", "User "+after.ID.Hex()+" not found")
+		return false
+	}
+	if revoke {
+		validSessions.forgetUser(after.ID.Hex())
+	}
+	ip := clientIP(r)
+	recordAudit(audit.SCIMUserUpdated, after.ID.Hex(), ip, nil)
+	switch {
+	case after.Deactivated && !before.Deactivated:
+		recordAudit(audit.UserDeactivated, after.ID.Hex(), ip, nil)
+	case !after.Deactivated && before.Deactivated:
+		recordAudit(audit.UserReactivated, after.ID.Hex(), ip, nil)
+	}
+	return true
+}
+
+// scimAttribute returns the lower case name of an attribute path, without
+// the URN of the User schema
+func scimAttribute(path string) string {
+	path = strings.ToLower(strings.TrimSpace(path))
+	return strings.TrimPrefix(path, strings.ToLower(scimUserSchema)+":")
+}
+
+// patch applies one PATCH operation to the user (RFC 7644, section 3.5.2)
+func (u *SCIMUser) patch(operation SCIMPatchOperation) *scimProblem {
+	op := strings.ToLower(operation.Op)
+	if op != "add" && op != "replace" && op != "remove" {
+		return &scimProblem{status: http.StatusBadRequest, scimType: scimInvalidSyntax, detail: fmt.Sprintf("Unknown op %q", operation.Op)}
+	}
+	path := scimAttribute(operation.Path)
+	if op == "remove" {
+		if path == "" {
+			return &scimProblem{status: http.StatusBadRequest, scimType: scimNoTarget, detail: "remove requires a path"}
+		}
+		return u.remove(path)
+	}
+	if path != "" {
+		return u.set(path, operation.Value)
+	}
+	// Without a path, the value holds the attributes to set
+	var attributes map[string]json.RawMessage
+	if err := json.Unmarshal(operation.Value, &attributes); err != nil {
+		return invalidSCIMValue("value must be an object of attributes when path is omitted")
+	}
+	for name, value := range attributes {
+		if p := u.set(scimAttribute(name), value); p != nil {
+			return p
+		}
+	}
+	return nil
+}
+
+// set sets the attribute at path to value. Complex values are merged: their
+// sub-attributes that value lacks are left as they are.
+func (u *SCIMUser) set(path string, value json.RawMessage) *scimProblem {
+	if string(value) == "null" {
+		return u.remove(path)
+	}
+	if p := checkSCIMPath(path); p != nil {
+		return p
+	}
+	if path == "active" {
+		active, ok := scimBool(value)
+		if !ok {
+			return invalidSCIMValue("active must be a boolean")
+		}
+		u.Active = &active
+		return nil
+	}
+	if path == "name" {
+		var name SCIMName
+		if err := json.Unmarshal(value, &name); err != nil {
+			return invalidSCIMValue("name must be an object")
+		}
+		if u.Name == nil {
+			u.Name = &SCIMName{}
+		}
+		for _, sub := range []struct{ path, value string }{
+			{"name.formatted", name.Formatted},
+			{"name.givenname", name.GivenName},
+			{"name.familyname", name.FamilyName},
+		} {
+			if sub.value != "" {
+				*u.stringAttribute(sub.path) = sub.value
+			}
+		}
+		u.DisplayName = u.Name.Formatted
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(value, &s); err != nil {
+		return invalidSCIMValue(path + " must be a string")
+	}
+	*u.stringAttribute(path) = s
+	u.syncDisplayName(path)
+	return nil
+}
+
+// remove clears the attribute at path
+func (u *SCIMUser) remove(path string) *scimProblem {
+	if p := checkSCIMPath(path); p != nil {
+		return p
+	}
+	switch path {
+	case "username":
+		return invalidSCIMValue("userName is required")
+	case "password":
+		return &scimProblem{status: http.StatusBadRequest, scimType: scimMutability, detail: "password cannot be removed"}
+	case "active":
+		// Without the attribute, users are active
+		active := true
+		u.Active = &active
+	case "name":
+		u.Name = nil
+		u.DisplayName = ""
+	default:
+		*u.stringAttribute(path) = ""
+		u.syncDisplayName(path)
+	}
+	return nil
+}
+
+// checkSCIMPath rejects the paths of read-only and unknown attributes
+func checkSCIMPath(path string) *scimProblem {
+	switch path {
+	case "username", "externalid", "displayname", "active", "password",
+		"name", "name.formatted", "name.givenname", "name.familyname":
+		return nil
+	case "id", "emails", "meta", "schemas":
+		return &scimProblem{status: http.StatusBadRequest, scimType: scimMutability, detail: path + " is read-only"}
+	}
+	if strings.HasPrefix(path, "emails[") || strings.HasPrefix(path, "emails.") || strings.HasPrefix(path, "meta.") {
+		return &scimProblem{status: http.StatusBadRequest, scimType: scimMutability, detail: path + " is read-only"}
+	}
+	return &scimProblem{status: http.StatusBadRequest, scimType: scimInvalidPath, detail: fmt.Sprintf("Unsupported attribute path %q", path)}
+}
+
+// stringAttribute returns the string attribute at path, one of those
+// checkSCIMPath accepts
+func (u *SCIMUser) stringAttribute(path string) *string {
+	switch path {
+	case "username":
+		return &u.UserName
+	case "externalid":
+		return &u.ExternalID
+	case "displayname":
+		return &u.DisplayName
+	case "password":
+		return &u.Password
+	}
+	if u.Name == nil {
+		u.Name = &SCIMName{}
+	}
+	switch path {
+	case "name.givenname":
+		return &u.Name.GivenName
+	case "name.familyname":
+		return &u.Name.FamilyName
+	}
+	return &u.Name.Formatted
+}
+
+// syncDisplayName keeps displayName and name.formatted equal after one of
+// them changed, since both are the name of the user
+func (u *SCIMUser) syncDisplayName(path string) {
+	switch path {
+	case "displayname":
+		if u.Name == nil {
+			u.Name = &SCIMName{}
+		}
+		u.Name.Formatted = u.DisplayName
+	case "name.formatted":
+		u.DisplayName = u.Name.Formatted
+	}
+}
+
+// scimBool decodes a boolean, also accepting the strings "true" and "false"
+// in any case, which some identity providers send
+func scimBool(value json.RawMessage) (bool, bool) {
+	var b bool
+	if err := json.Unmarshal(value, &b); err == nil {
+		return b, true
+	}
+	var s string
+	if err := json.Unmarshal(value, &s); err == nil {
+		switch strings.ToLower(s) {
+		case "true":
+			return true, true
+		case "false":
+			return false, true
+		}
+	}
+	return false, false
+}
+
+// DeleteSCIMUser deletes a user
+func DeleteSCIMUser(w http.ResponseWriter, r *http.Request) {
+	if !requireSCIM(w, r) {
+		return
+	}
+	id, ok := scimUserID(w, r)
+	if !ok {
+		return
+	}
+	ctx, cancel := dbContext(r)
+	defer cancel()
+	res, err := mongoCollection.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		writeSCIMDBError(w, err)
+		return
+	}
+	if res.DeletedCount == 0 {
+		writeSCIMError(w, http.StatusNotFound, "", "User "+id.Hex()+" not found")
+		return
+	}
+	validSessions.forgetUser(id.Hex())
+	recordAudit(audit.SCIMUserDeleted, id.Hex(), clientIP(r), nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetSCIMServiceProviderConfig describes the SCIM features supported
+// (RFC 7644, section 4). Like the schemas and resource types, it needs no
+// credentials.
+func GetSCIMServiceProviderConfig(w http.ResponseWriter, r *http.Request) {
+	base := scimBaseURL()
+	writeSCIM(w, http.StatusOK, map[string]interface{}{
+		"schemas":        []string{scimServiceProviderConfigSchema},
+		"patch":          map[string]bool{"supported": true},
+		"bulk":           map[string]interface{}{"supported": false, "maxOperations": 0, "maxPayloadSize": 0},
+		"filter":         map[string]interface{}{"supported": true, "maxResults": scimMaxResults},
+		"changePassword": map[string]bool{"supported": true},
+		"sort":           map[string]bool{"supported": false},
+		"etag":           map[string]bool{"supported": false},
+		"authenticationSchemes": []map[string]interface{}{{
+			"type":        "oauthbearertoken",
+			"name":        "Bearer token",
+			"description": "A SCIM token configured on the API, sent as Authorization: Bearer <token>",
+			"primary":     true,
+		}},
+		"meta": SCIMMeta{ResourceType: "ServiceProviderConfig", Location: base + "/ServiceProviderConfig"},
+	})
+}
+
+// scimAttributeSchema describes an attribute in a Schema resource (RFC 7643,
+// section 7)
+type scimAttributeSchema struct {
+	Name          string                `json:"name"`
+	Type          string                `json:"type"`
+	MultiValued   bool                  `json:"multiValued"`
+	Description   string                `json:"description"`
+	Required      bool                  `json:"required"`
+	CaseExact     bool                  `json:"caseExact"`
+	Mutability    string                `json:"mutability"`
+	Returned      string                `json:"returned"`
+	Uniqueness    string                `json:"uniqueness"`
+	SubAttributes []scimAttributeSchema `json:"subAttributes,omitempty"`
+}
+
+func scimStringAttribute(name, description, mutability string) scimAttributeSchema {
+	return scimAttributeSchema{Name: name, Type: "string", Description: description, Mutability: mutability, Returned: "default", Uniqueness: "none"}
+}
+
+// scimUserAttributes are the attributes of SCIMUser
+var scimUserAttributes = func() []scimAttributeSchema {
+	userName := scimStringAttribute("userName", "The email the user logs in with.", "readWrite")
+	userName.Required, userName.Uniqueness = true, "server"
+	externalID := scimStringAttribute("externalId", "The ID of the user at the identity provider.", "readWrite")
+	externalID.CaseExact = true
+	emailValue := scimStringAttribute("value", "The email address.", "readOnly")
+	emailType := scimStringAttribute("type", "Always work.", "readOnly")
+	password := scimStringAttribute("password", "The password of the user, for logins with an email and password.", "writeOnly")
+	password.Returned = "never"
+	return []scimAttributeSchema{
+		userName,
+		externalID,
+		{Name: "name", Type: "complex", Description: "The name of the user.", Mutability: "readWrite", Returned: "default", Uniqueness: "none",
+			SubAttributes: []scimAttributeSchema{
+				scimStringAttribute("formatted", "The full name, the same as displayName.", "readWrite"),
+				scimStringAttribute("givenName", "The given name.", "readWrite"),
+				scimStringAttribute("familyName", "The family name.", "readWrite"),
+			}},
+		scimStringAttribute("displayName", "The name of the user, the same as name.formatted.", "readWrite"),
+		{Name: "emails", Type: "complex", MultiValued: true, Description: "The email of the user, which is userName.", Mutability: "readOnly", Returned: "default", Uniqueness: "none",
+			SubAttributes: []scimAttributeSchema{
+				emailValue,
+				emailType,
+				{Name: "primary", Type: "boolean", Description: "Always true.", Mutability: "readOnly", Returned: "default", Uniqueness: "none"},
+			}},
+		{Name: "active", Type: "boolean", Description: "Whether the user may log in.", Mutability: "readWrite", Returned: "default", Uniqueness: "none"},
+		password,
+	}
+}()
+
+// scimSchema is the Schema resource of the User schema
+func scimSchema(base string) map[string]interface{} {
+	return map[string]interface{}{
+		"schemas":     []string{scimSchemaSchema},
+		"id":          scimUserSchema,
+		"name":        "User",
+		"description": "User Account",
+		"attributes":  scimUserAttributes,
+		"meta":        SCIMMeta{ResourceType: "Schema", Location: base + "/Schemas/" + scimUserSchema},
+	}
+}
+
+// scimResourceType is the ResourceType resource of users
+func scimResourceType(base string) map[string]interface{} {
+	return map[string]interface{}{
+		"schemas":     []string{scimResourceTypeSchema},
+		"id":          "User",
+		"name":        "User",
+		"endpoint":    "/Users",
+		"description": "User Account",
+		"schema":      scimUserSchema,
+		"meta":        SCIMMeta{ResourceType: "ResourceType", Location: base + "/ResourceTypes/User"},
+	}
+}
+
+func writeSCIMList(w http.ResponseWriter, resources []map[string]interface{}) {
+	writeSCIM(w, http.StatusOK, SCIMListResponse{
+		Schemas:      []string{scimListResponseSchema},
+		TotalResults: int64(len(resources)),
+		StartIndex:   1,
+		ItemsPerPage: len(resources),
+		Resources:    resources,
+	})
+}
+
+// ListSCIMSchemas lists the schemas of the SCIM resources: the User schema
+func ListSCIMSchemas(w http.ResponseWriter, r *http.Request) {
+	writeSCIMList(w, []map[string]interface{}{scimSchema(scimBaseURL())})
+}
+
+// GetSCIMSchema returns a schema by its URN
+func GetSCIMSchema(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if id != scimUserSchema {
+		writeSCIMError(w, http.StatusNotFound, "", "Schema "+id+" not found")
+		return
+	}
+	writeSCIM(w, http.StatusOK, scimSchema(scimBaseURL()))
+}
+
+// ListSCIMResourceTypes lists the types of SCIM resources: users
+func ListSCIMResourceTypes(w http.ResponseWriter, r *http.Request) {
+	writeSCIMList(w, []map[string]interface{}{scimResourceType(scimBaseURL())})
+}
+
+// GetSCIMResourceType returns a resource type by its ID
+func GetSCIMResourceType(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if id != "User" {
+		writeSCIMError(w, http.StatusNotFound, "", "Resource type "+id+" not found")
+		return
+	}
+	writeSCIM(w, http.StatusOK, scimResourceType(scimBaseURL()))
+}
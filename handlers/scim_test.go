@@ -0,0 +1,516 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lep13/golang-restful-api/audit"
+	"github.com/lep13/golang-restful-api/middleware"
+	"github.com/lep13/golang-restful-api/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// scimClient sends a SCIM body authenticated with a SCIM token
+func scimClient(req *http.Request) *http.Request {
+	req.Header.Set("Content-Type", scimMediaType)
+	return as("", ScopeSCIM)(req)
+}
+
+// decodeSCIMError decodes a SCIM error, checking its media type and status
+func decodeSCIMError(t *testing.T, rr *httptest.ResponseRecorder) SCIMError {
+	t.Helper()
+	assert.Equal(t, scimMediaType, rr.Header().Get("Content-Type"))
+	var scimErr SCIMError
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &scimErr))
+	assert.Equal(t, []string{scimErrorSchema}, scimErr.Schemas)
+	assert.Equal(t, strconv.Itoa(rr.Code), scimErr.Status)
+	return scimErr
+}
+
+// userNameFree makes the uniqueness check of userNames find no other user
+func userNameFree(mockCollection *MockCollection) {
+	result := new(MockSingleResult)
+	result.On("Decode", mock.AnythingOfType("*models.User")).Return(mongo.ErrNoDocuments)
+	mockCollection.On("FindOne", mock.Anything, mock.MatchedBy(isUserNameQuery)).Return(result)
+}
+
+func isUserNameQuery(filter bson.M) bool {
+	_, ok := filter["email"].(primitive.Regex)
+	return ok
+}
+
+func scimUserFixture() models.User {
+	return models.User{
+		ID:            primitive.NewObjectID(),
+		Name:          "Jane Doe",
+		Email:         "jane@example.com",
+		EmailVerified: true,
+		Password:      "$2a$10$hash",
+		SCIM:          &models.SCIMAttributes{ExternalID: "00u1", GivenName: "Jane", FamilyName: "Doe"},
+	}
+}
+
+func TestSetSCIMTokens(t *testing.T) {
+	defer func() { scimTokenHashes = nil }()
+	token := strings.Repeat("s", minSCIMTokenLength)
+
+	assert.Error(t, SetSCIMTokens([]string{token, "short"}))
+	require.NoError(t, SetSCIMTokens([]string{"other" + token, token}))
+
+	userID, scopes, err := AuthenticateToken(context.Background(), token)
+	require.NoError(t, err)
+	assert.Empty(t, userID)
+	assert.Equal(t, []string{ScopeSCIM}, scopes)
+	_, _, err = AuthenticateToken(context.Background(), token+"x")
+	assert.Equal(t, middleware.ErrInvalidCredentials, err)
+}
+
+func TestSCIM_RequiresSCIMToken(t *testing.T) {
+	req := httptest.NewRequest("GET", "/scim/v2/Users", nil)
+	rr := httptest.NewRecorder()
+	ListSCIMUsers(rr, req)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	assert.Equal(t, `Bearer realm="SCIM"`, rr.Header().Get("WWW-Authenticate"))
+	decodeSCIMError(t, rr)
+
+	// Users cannot provision others with their own tokens
+	req = req.WithContext(middleware.WithUserID(req.Context(), primitive.NewObjectID().Hex()))
+	rr = httptest.NewRecorder()
+	ListSCIMUsers(rr, req)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	decodeSCIMError(t, rr)
+}
+
+func TestCreateSCIMUser(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	defer setupIssuer("https://api.example.com")()
+	auditLog := new(recordingAuditLogger)
+	defer setupAuditLogger(auditLog)()
+	userNameFree(mockCollection)
+	var inserted models.User
+	mockCollection.On("InsertOne", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		inserted = args.Get(1).(models.User)
+	}).Return(&mongo.InsertOneResult{}, nil)
+
+	rr := serve(CreateSCIMUser, "POST", "/scim/v2/Users", `{
+		"schemas": ["urn:ietf:params:scim:schemas:core:2.0:User"],
+		"externalId": "00u1",
+		"userName": "jane@example.com",
+		"name": {"givenName": "Jane", "familyName": "Doe"},
+		"emails": [{"value": "ignored@example.com", "primary": true}],
+		"active": true,
+		"password": "correct horse"
+	}`, scimClient)
+
+	require.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+	assert.Equal(t, scimMediaType, rr.Header().Get("Content-Type"))
+	assert.Equal(t, "jane@example.com", inserted.Email)
+	assert.True(t, inserted.EmailVerified)
+	assert.Equal(t, "Jane Doe", inserted.Name)
+	assert.False(t, inserted.Deactivated)
+	assert.True(t, checkPassword(inserted.Password, "correct horse"))
+	require.NotNil(t, inserted.SCIM)
+	assert.Equal(t, "00u1", inserted.SCIM.ExternalID)
+	assert.Equal(t, "Jane", inserted.SCIM.GivenName)
+	assert.Equal(t, "Doe", inserted.SCIM.FamilyName)
+
+	var created SCIMUser
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &created))
+	assert.Equal(t, inserted.ID.Hex(), created.ID)
+	assert.Equal(t, "https://api.example.com/scim/v2/Users/"+created.ID, rr.Header().Get("Location"))
+	assert.Equal(t, rr.Header().Get("Location"), created.Meta.Location)
+	assert.Equal(t, []SCIMEmail{{Value: "jane@example.com", Type: "work", Primary: true}}, created.Emails)
+	assert.Empty(t, created.Password)
+	assert.NotContains(t, rr.Body.String(), "password")
+	events := auditLog.recorded()
+	require.Len(t, events, 1)
+	assert.Equal(t, audit.SCIMUserCreated, events[0].Action)
+	assert.Equal(t, inserted.ID.Hex(), events[0].UserID)
+}
+
+func TestCreateSCIMUser_Rejected(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		body     string
+		status   int
+		scimType string
+	}{
+		{"invalid JSON", `{`, http.StatusBadRequest, scimInvalidSyntax},
+		{"no schema", `{"userName": "jane@example.com"}`, http.StatusBadRequest, scimInvalidSyntax},
+		{"no userName", `{"schemas": ["urn:ietf:params:scim:schemas:core:2.0:User"]}`, http.StatusBadRequest, scimInvalidValue},
+		{"userName not an email", `{"schemas": ["urn:ietf:params:scim:schemas:core:2.0:User"], "userName": "jane"}`, http.StatusBadRequest, scimInvalidValue},
+		{"weak password", `{"schemas": ["urn:ietf:params:scim:schemas:core:2.0:User"], "userName": "jane@example.com", "password": "short"}`, http.StatusBadRequest, scimInvalidValue},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mockCollection := new(MockCollection)
+			defer SetupMockCollection(mockCollection)()
+
+			rr := serve(CreateSCIMUser, "POST", "/scim/v2/Users", tc.body, scimClient)
+
+			assert.Equal(t, tc.status, rr.Code)
+			assert.Equal(t, tc.scimType, decodeSCIMError(t, rr).ScimType)
+			mockCollection.AssertNotCalled(t, "InsertOne", mock.Anything, mock.Anything)
+		})
+	}
+}
+
+func TestCreateSCIMUser_UserNameTaken(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	var query bson.M
+	result := new(MockSingleResult)
+	result.On("Decode", mock.AnythingOfType("*models.User")).Return(nil)
+	mockCollection.On("FindOne", mock.Anything, mock.MatchedBy(isUserNameQuery)).Run(func(args mock.Arguments) {
+		query = args.Get(1).(bson.M)
+	}).Return(result)
+
+	rr := serve(CreateSCIMUser, "POST", "/scim/v2/Users",
+		`{"schemas": ["urn:ietf:params:scim:schemas:core:2.0:User"], "userName": "Jane.Doe+1@example.com"}`, scimClient)
+
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	assert.Equal(t, scimUniqueness, decodeSCIMError(t, rr).ScimType)
+	// userNames are compared ignoring case, and as literal strings
+	assert.Equal(t, primitive.Regex{Pattern: `^jane\.doe\+1@example\.com$`, Options: "i"}, query["email"])
+	mockCollection.AssertNotCalled(t, "InsertOne", mock.Anything, mock.Anything)
+}
+
+func TestGetSCIMUser(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	defer setupIssuer("https://api.example.com")()
+	user := scimUserFixture()
+	user.Deactivated = true
+	findUser(mockCollection, user.ID, user, nil)
+
+	rr := serve(GetSCIMUser, "GET", "/scim/v2/Users/"+user.ID.Hex(), "", withVars("id", user.ID.Hex()), scimClient)
+
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var got SCIMUser
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &got))
+	created := user.ID.Timestamp().UTC()
+	active := false
+	assert.Equal(t, SCIMUser{
+		Schemas:     []string{scimUserSchema},
+		ID:          user.ID.Hex(),
+		ExternalID:  "00u1",
+		UserName:    "jane@example.com",
+		Name:        &SCIMName{Formatted: "Jane Doe", GivenName: "Jane", FamilyName: "Doe"},
+		DisplayName: "Jane Doe",
+		Emails:      []SCIMEmail{{Value: "jane@example.com", Type: "work", Primary: true}},
+		Active:      &active,
+		Meta: &SCIMMeta{
+			ResourceType: "User",
+			Created:      &created,
+			LastModified: &created,
+			Location:     "https://api.example.com/scim/v2/Users/" + user.ID.Hex(),
+		},
+	}, got)
+	assert.NotContains(t, rr.Body.String(), "hash")
+}
+
+func TestGetSCIMUser_NotFound(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	id := primitive.NewObjectID()
+	findUser(mockCollection, id, models.User{}, mongo.ErrNoDocuments)
+
+	for _, raw := range []string{id.Hex(), "not-an-id"} {
+		rr := serve(GetSCIMUser, "GET", "/scim/v2/Users/"+raw, "", withVars("id", raw), scimClient)
+
+		assert.Equal(t, http.StatusNotFound, rr.Code)
+		decodeSCIMError(t, rr)
+	}
+}
+
+func TestListSCIMUsers(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	user := scimUserFixture()
+	want := bson.M{"email": primitive.Regex{Pattern: `^jane@example\.com$`, Options: "i"}}
+	mockCollection.On("CountDocuments", mock.Anything, want).Return(int64(3), nil)
+	mockCollection.On("Find", mock.Anything, want).Return(usersCursor(user), nil)
+
+	rr := serve(ListSCIMUsers, "GET", `/scim/v2/Users?filter=userName+eq+"jane@example.com"&startIndex=2&count=1`, "", scimClient)
+
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var page struct {
+		SCIMListResponse
+		Resources []SCIMUser `json:"Resources"`
+	}
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &page))
+	assert.Equal(t, []string{scimListResponseSchema}, page.Schemas)
+	assert.Equal(t, int64(3), page.TotalResults)
+	assert.Equal(t, 2, page.StartIndex)
+	assert.Equal(t, 1, page.ItemsPerPage)
+	require.Len(t, page.Resources, 1)
+	assert.Equal(t, user.ID.Hex(), page.Resources[0].ID)
+}
+
+func TestListSCIMUsers_Paging(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		query      string
+		startIndex int
+	}{
+		{"defaults", "", 1},
+		{"index below 1", "?startIndex=-4&count=5", 1},
+		{"count above the maximum", "?startIndex=3&count=1000", 3},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mockCollection := new(MockCollection)
+			defer SetupMockCollection(mockCollection)()
+			mockCollection.On("CountDocuments", mock.Anything, bson.M{}).Return(int64(10), nil)
+			mockCollection.On("Find", mock.Anything, bson.M{}).Return(usersCursor(), nil)
+
+			rr := serve(ListSCIMUsers, "GET", "/scim/v2/Users"+tc.query, "", scimClient)
+
+			require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+			assert.Contains(t, rr.Body.String(), `"startIndex":`+strconv.Itoa(tc.startIndex))
+			assert.Contains(t, rr.Body.String(), `"Resources":[]`)
+		})
+	}
+}
+
+func TestListSCIMUsers_CountOnly(t *testing.T) {
+	// Past the last user, or with a count of 0, only the total is looked up
+	for _, query := range []string{"?count=0", "?startIndex=11"} {
+		mockCollection := new(MockCollection)
+		defer SetupMockCollection(mockCollection)()
+		mockCollection.On("CountDocuments", mock.Anything, bson.M{}).Return(int64(10), nil)
+
+		rr := serve(ListSCIMUsers, "GET", "/scim/v2/Users"+query, "", scimClient)
+
+		require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+		assert.Contains(t, rr.Body.String(), `"totalResults":10`)
+		mockCollection.AssertNotCalled(t, "Find", mock.Anything, mock.Anything)
+	}
+}
+
+func TestListSCIMUsers_InvalidFilter(t *testing.T) {
+	for _, filter := range []string{`password eq "x"`, `userName eq`} {
+		mockCollection := new(MockCollection)
+		defer SetupMockCollection(mockCollection)()
+		req := httptest.NewRequest("GET", "/scim/v2/Users", nil)
+		req.URL.RawQuery = "filter=" + strings.ReplaceAll(filter, " ", "+")
+
+		rr := serve(ListSCIMUsers, "GET", req.URL.String(), "", scimClient)
+
+		assert.Equal(t, http.StatusBadRequest, rr.Code)
+		assert.Equal(t, scimInvalidFilter, decodeSCIMError(t, rr).ScimType)
+		mockCollection.AssertNotCalled(t, "CountDocuments", mock.Anything, mock.Anything)
+	}
+}
+
+func TestSCIMFilterFields(t *testing.T) {
+	// Attributes may be qualified with the URN of the User schema
+	assert.Equal(t, scimFilterFields["username"], scimFilterFields["urn:ietf:params:scim:schemas:core:2.0:user:username"])
+	assert.Equal(t, scimFilterFields["name.givenname"], scimFilterFields["urn:ietf:params:scim:schemas:core:2.0:user:name.givenname"])
+}
+
+// captureUpdate records the update of the user
+func captureUpdate(mockCollection *MockCollection, id primitive.ObjectID) *bson.M {
+	var update bson.M
+	mockCollection.On("UpdateOne", mock.Anything, bson.M{"_id": id}, mock.Anything).Run(func(args mock.Arguments) {
+		update = args.Get(2).(bson.M)
+	}).Return(&mongo.UpdateResult{MatchedCount: 1}, nil)
+	return &update
+}
+
+func TestReplaceSCIMUser(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	auditLog := new(recordingAuditLogger)
+	defer setupAuditLogger(auditLog)()
+	user := scimUserFixture()
+	findUser(mockCollection, user.ID, user, nil)
+	userNameFree(mockCollection)
+	update := captureUpdate(mockCollection, user.ID)
+
+	rr := serve(ReplaceSCIMUser, "PUT", "/scim/v2/Users/"+user.ID.Hex(),
+		`{"schemas": ["urn:ietf:params:scim:schemas:core:2.0:User"], "id": "`+user.ID.Hex()+`", "userName": "jane.doe@example.com", "displayName": "Jane D."}`, withVars("id", user.ID.Hex()), scimClient)
+
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	set := (*update)["$set"].(bson.M)
+	unset := (*update)["$unset"].(bson.M)
+	assert.Equal(t, "jane.doe@example.com", set["email"])
+	assert.Equal(t, "Jane D.", set["name"])
+	// Attributes missing from the request are cleared, but the password and
+	// the sessions are kept
+	attributes := set["scim"].(*models.SCIMAttributes)
+	assert.Empty(t, attributes.ExternalID)
+	assert.Empty(t, attributes.GivenName)
+	assert.NotContains(t, set, "password")
+	assert.NotContains(t, unset, "sessions")
+	assert.Contains(t, unset, "deactivated")
+
+	var replaced SCIMUser
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &replaced))
+	assert.Equal(t, "jane.doe@example.com", replaced.UserName)
+	assert.True(t, *replaced.Active)
+	assert.True(t, replaced.Meta.LastModified.After(*replaced.Meta.Created) || replaced.Meta.LastModified.Equal(*replaced.Meta.Created))
+	events := auditLog.recorded()
+	require.Len(t, events, 1)
+	assert.Equal(t, audit.SCIMUserUpdated, events[0].Action)
+}
+
+func TestPatchSCIMUser_Deactivate(t *testing.T) {
+	defer setupSessionCache(time.Minute)()
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	auditLog := new(recordingAuditLogger)
+	defer setupAuditLogger(auditLog)()
+	user := scimUserFixture()
+	findUser(mockCollection, user.ID, user, nil)
+	update := captureUpdate(mockCollection, user.ID)
+	sessionID := primitive.NewObjectID()
+	validSessions.add(sessionID.Hex(), user.ID.Hex(), time.Now())
+
+	// As Azure AD sends it
+	rr := serve(PatchSCIMUser, "PATCH", "/scim/v2/Users/"+user.ID.Hex(),
+		`{"schemas": ["urn:ietf:params:scim:api:messages:2.0:PatchOp"], "Operations": [{"op": "Replace", "path": "active", "value": "False"}]}`, withVars("id", user.ID.Hex()), scimClient)
+
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	set := (*update)["$set"].(bson.M)
+	assert.Equal(t, true, set["deactivated"])
+	assert.Contains(t, set, "sessions_revoked_at")
+	assert.Contains(t, (*update)["$unset"].(bson.M), "sessions")
+	// The other attributes are kept
+	assert.Equal(t, "Jane Doe", set["name"])
+	assert.Equal(t, "00u1", set["scim"].(*models.SCIMAttributes).ExternalID)
+	assert.False(t, validSessions.valid(sessionID.Hex(), user.ID.Hex(), time.Now()))
+	var actions []string
+	for _, event := range auditLog.recorded() {
+		actions = append(actions, event.Action)
+	}
+	assert.Equal(t, []string{audit.SCIMUserUpdated, audit.UserDeactivated}, actions)
+}
+
+func TestPatchSCIMUser_Attributes(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	defer setupAuditLogger(new(recordingAuditLogger))()
+	user := scimUserFixture()
+	user.Deactivated = true
+	findUser(mockCollection, user.ID, user, nil)
+	update := captureUpdate(mockCollection, user.ID)
+
+	rr := serve(PatchSCIMUser, "PATCH", "/scim/v2/Users/"+user.ID.Hex(), `{
+		"schemas": ["urn:ietf:params:scim:api:messages:2.0:PatchOp"],
+		"Operations": [
+			{"op": "replace", "value": {"name.givenName": "Janet", "active": true}},
+			{"op": "add", "path": "urn:ietf:params:scim:schemas:core:2.0:User:displayName", "value": "Janet Doe"},
+			{"op": "remove", "path": "externalId"}
+		]
+	}`, withVars("id", user.ID.Hex()), scimClient)
+
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var patched SCIMUser
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &patched))
+	assert.Equal(t, "Janet Doe", patched.DisplayName)
+	assert.Equal(t, &SCIMName{Formatted: "Janet Doe", GivenName: "Janet", FamilyName: "Doe"}, patched.Name)
+	assert.Empty(t, patched.ExternalID)
+	assert.True(t, *patched.Active)
+	set := (*update)["$set"].(bson.M)
+	assert.Equal(t, "Janet Doe", set["name"])
+	assert.Contains(t, (*update)["$unset"].(bson.M), "deactivated")
+	// Reactivating a user does not revoke anything
+	assert.NotContains(t, set, "sessions_revoked_at")
+}
+
+func TestPatchSCIMUser_Rejected(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		operations string
+		scimType   string
+	}{
+		{"unknown op", `[{"op": "move", "path": "displayName"}]`, scimInvalidSyntax},
+		{"read-only attribute", `[{"op": "replace", "path": "emails[type eq \"work\"].value", "value": "x@example.com"}]`, scimMutability},
+		{"read-only id", `[{"op": "replace", "value": {"id": "1"}}]`, scimMutability},
+		{"unknown attribute", `[{"op": "add", "path": "nickName", "value": "JD"}]`, scimInvalidPath},
+		{"remove userName", `[{"op": "remove", "path": "userName"}]`, scimInvalidValue},
+		{"remove without path", `[{"op": "remove"}]`, scimNoTarget},
+		{"active not a boolean", `[{"op": "replace", "path": "active", "value": "maybe"}]`, scimInvalidValue},
+		{"userName not an email", `[{"op": "replace", "path": "userName", "value": "jane"}]`, scimInvalidValue},
+		{"no operations", `[]`, scimInvalidSyntax},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mockCollection := new(MockCollection)
+			defer SetupMockCollection(mockCollection)()
+			user := scimUserFixture()
+			findUser(mockCollection, user.ID, user, nil)
+
+			rr := serve(PatchSCIMUser, "PATCH", "/scim/v2/Users/"+user.ID.Hex(),
+				`{"schemas": ["urn:ietf:params:scim:api:messages:2.0:PatchOp"], "Operations": `+tc.operations+`}`, withVars("id", user.ID.Hex()), scimClient)
+
+			assert.Equal(t, http.StatusBadRequest, rr.Code)
+			assert.Equal(t, tc.scimType, decodeSCIMError(t, rr).ScimType)
+			mockCollection.AssertNotCalled(t, "UpdateOne", mock.Anything, mock.Anything, mock.Anything)
+		})
+	}
+}
+
+func TestDeleteSCIMUser(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	auditLog := new(recordingAuditLogger)
+	defer setupAuditLogger(auditLog)()
+	id := primitive.NewObjectID()
+	mockCollection.On("DeleteOne", mock.Anything, bson.M{"_id": id}).Return(&mongo.DeleteResult{DeletedCount: 1}, nil).Once()
+	mockCollection.On("DeleteOne", mock.Anything, bson.M{"_id": id}).Return(&mongo.DeleteResult{DeletedCount: 0}, nil)
+	vars := withVars("id", id.Hex())
+
+	rr := serve(DeleteSCIMUser, "DELETE", "/scim/v2/Users/"+id.Hex(), "", vars, scimClient)
+	assert.Equal(t, http.StatusNoContent, rr.Code)
+	assert.Empty(t, rr.Body.String())
+	events := auditLog.recorded()
+	require.Len(t, events, 1)
+	assert.Equal(t, audit.SCIMUserDeleted, events[0].Action)
+
+	rr = serve(DeleteSCIMUser, "DELETE", "/scim/v2/Users/"+id.Hex(), "", vars, scimClient)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	decodeSCIMError(t, rr)
+}
+
+func TestSCIMDiscovery(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		handler http.HandlerFunc
+		id      string
+		status  int
+		body    string
+	}{
+		{"service provider config", GetSCIMServiceProviderConfig, "", http.StatusOK, `"patch":{"supported":true}`},
+		{"schemas", ListSCIMSchemas, "", http.StatusOK, `"totalResults":1`},
+		{"user schema", GetSCIMSchema, scimUserSchema, http.StatusOK, `"name":"userName"`},
+		{"unknown schema", GetSCIMSchema, "urn:example:Group", http.StatusNotFound, scimErrorSchema},
+		{"resource types", ListSCIMResourceTypes, "", http.StatusOK, `"endpoint":"/Users"`},
+		{"user resource type", GetSCIMResourceType, "User", http.StatusOK, `"schema":"` + scimUserSchema + `"`},
+		{"unknown resource type", GetSCIMResourceType, "Group", http.StatusNotFound, scimErrorSchema},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// Discovery needs no credentials
+			req := httptest.NewRequest("GET", "/scim/v2/", nil)
+			req = mux.SetURLVars(req, map[string]string{"id": tc.id})
+			rr := httptest.NewRecorder()
+
+			tc.handler(rr, req)
+
+			assert.Equal(t, tc.status, rr.Code)
+			assert.Equal(t, scimMediaType, rr.Header().Get("Content-Type"))
+			assert.Contains(t, rr.Body.String(), tc.body)
+		})
+	}
+}
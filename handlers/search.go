@@ -0,0 +1,372 @@
+package handlers
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"html"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/lep13/golang-restful-api/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// searchDefaultLimit is the page size of SearchUsers when no limit is given
+	searchDefaultLimit = 20
+	// searchMaxCandidates caps the users fetched from the database for one search
+	searchMaxCandidates = 1000
+	// searchMaxQueryLength caps the length of q, in characters
+	searchMaxQueryLength = 100
+	// errCodeIndexNotFound is returned by MongoDB for $text without a text index
+	errCodeIndexNotFound = 27
+)
+
+// searchFields are the fields searched, weighted like the text index created
+// by db.EnsureTextIndex
+var searchFields = []struct {
+	name   string
+	weight float64
+	value  func(user models.User) string
+}{
+	{"name", 2, func(user models.User) string { return user.Name }},
+	{"email", 1, func(user models.User) string { return user.Email }},
+}
+
+// SearchResult is a user matching a search. Highlights holds the matched
+// fields, HTML escaped, with the matched parts wrapped in <em>.
+type SearchResult struct {
+	User       models.User       `json:"user"`
+	Score      float64           `json:"score"`
+	Highlights map[string]string `json:"highlights"`
+
+	textScore float64
+}
+
+// searchQuery is a parsed search. Terms are lower case words; a user matches
+// when every term equals a word of the name or email. With prefix set, the
+// last term only has to start a word, so results appear while typing.
+type searchQuery struct {
+	terms  []string
+	prefix bool
+}
+
+// parseSearchQuery splits q into words like the text index does. The last word
+// is a prefix unless q ends with a separator, i.e. the user finished typing it.
+func parseSearchQuery(q string) searchQuery {
+	terms := strings.FieldsFunc(strings.ToLower(q), isWordSeparator)
+	last, _ := utf8.DecodeLastRuneInString(q)
+	return searchQuery{terms: terms, prefix: len(terms) > 0 && !isWordSeparator(last)}
+}
+
+func isWordSeparator(r rune) bool {
+	return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+}
+
+// wholeWords returns the terms that must match entire words
+func (q searchQuery) wholeWords() []string {
+	if q.prefix {
+		return q.terms[:len(q.terms)-1]
+	}
+	return q.terms
+}
+
+// prefixTerm returns the term that may match the beginning of a word, if any
+func (q searchQuery) prefixTerm() string {
+	if q.prefix {
+		return q.terms[len(q.terms)-1]
+	}
+	return ""
+}
+
+// word is a lower case word of a field and its byte range in the field
+type word struct {
+	text       string
+	start, end int
+}
+
+func splitWords(value string) []word {
+	var words []word
+	start := -1
+	for i, r := range value {
+		if !isWordSeparator(r) {
+			if start < 0 {
+				start = i
+			}
+			continue
+		}
+		if start >= 0 {
+			words = append(words, word{strings.ToLower(value[start:i]), start, i})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		words = append(words, word{strings.ToLower(value[start:]), start, len(value)})
+	}
+	return words
+}
+
+// match scores a user against the query, returning false when a term matches
+// no word. Each term scores its best match: a whole word counts 1 and a prefix
+// between 0.5 and 1 depending on how much of the word it covers, times the
+// field weight, with a bonus for the first word of a field.
+func (q searchQuery) match(user models.User) (float64, map[string]string, bool) {
+	type span struct{ start, end int }
+	values := make([]string, len(searchFields))
+	fieldWords := make([][]word, len(searchFields))
+	for i, field := range searchFields {
+		values[i] = field.value(user)
+		fieldWords[i] = splitWords(values[i])
+	}
+
+	spans := make([][]span, len(searchFields))
+	score := 0.0
+	for i, term := range q.terms {
+		isPrefix := q.prefix && i == len(q.terms)-1
+		best := 0.0
+		for f, field := range searchFields {
+			for position, w := range fieldWords[f] {
+				var s float64
+				end := w.end
+				switch {
+				case w.text == term:
+					s = 1
+				case isPrefix && strings.HasPrefix(w.text, term):
+					termLength := utf8.RuneCountInString(term)
+					s = 0.5 + 0.5*float64(termLength)/float64(utf8.RuneCountInString(w.text))
+					end = w.start + runePrefixBytes(values[f][w.start:w.end], termLength)
+				default:
+					continue
+				}
+				s *= field.weight
+				if position == 0 {
+					s += 0.25 * field.weight
+				}
+				best = math.Max(best, s)
+				spans[f] = append(spans[f], span{w.start, end})
+			}
+		}
+		if best == 0 {
+			return 0, nil, false
+		}
+		score += best
+	}
+
+	highlights := make(map[string]string)
+	for f, field := range searchFields {
+		if len(spans[f]) == 0 {
+			continue
+		}
+		sort.Slice(spans[f], func(i, j int) bool { return spans[f][i].start < spans[f][j].start })
+		var b strings.Builder
+		pos := 0
+		for _, s := range spans[f] {
+			if s.end <= pos {
+				continue
+			}
+			start := max(s.start, pos)
+			b.WriteString(html.EscapeString(values[f][pos:start]))
+			b.WriteString("<em>" + html.EscapeString(values[f][start:s.end]) + "</em>")
+			pos = s.end
+		}
+		b.WriteString(html.EscapeString(values[f][pos:]))
+		highlights[field.name] = strings.ReplaceAll(b.String(), "</em><em>", "")
+	}
+	return math.Round(score*1000) / 1000, highlights, true
+}
+
+// runePrefixBytes returns the byte length of the first n runes of s
+func runePrefixBytes(s string, n int) int {
+	length := 0
+	for i := 0; i < n && length < len(s); i++ {
+		_, size := utf8.DecodeRuneInString(s[length:])
+		length += size
+	}
+	return length
+}
+
+// SearchUsers finds users by the words of their name or email, ranked by
+// relevance, with the same limit and cursor pagination as GetUsers. Whole
+// words are looked up through the text index and the word being typed by
+// prefix; the matches are then scored and highlighted by searchQuery.match.
+// When the text index is missing the collection is scanned and matched in
+// the application instead. Only admins may search users.
+func SearchUsers(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if _, ok := requireAdmin(w, r); !ok {
+		return
+	}
+	query := r.URL.Query()
+	raw := query.Get("q")
+	if utf8.RuneCountInString(raw) > searchMaxQueryLength {
+		writeError(w, "Query is too long", http.StatusBadRequest)
+		return
+	}
+	q := parseSearchQuery(raw)
+	if len(q.terms) == 0 {
+		writeError(w, "Query must contain a letter or digit", http.StatusBadRequest)
+		return
+	}
+	limit, offset, ok := searchPage(w, query)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := dbContext(r)
+	defer cancel()
+	results, err := searchIndexed(ctx, q)
+	if isTextIndexMissing(err) {
+		log.Println("Text index unavailable, searching without it:", err)
+		results, err = searchScan(ctx, q)
+	}
+	if r.Context().Err() != nil {
+		log.Println("Client went away while searching users:", r.Context().Err())
+		return
+	}
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		if a.Score != b.Score {
+			return a.Score > b.Score
+		}
+		if a.textScore != b.textScore {
+			return a.textScore > b.textScore
+		}
+		return a.User.ID.Hex() < b.User.ID.Hex()
+	})
+	page := []SearchResult{}
+	if offset < len(results) {
+		page = results[offset:min(offset+limit, len(results))]
+	}
+	if offset+limit < len(results) {
+		setNextPage(w, r, encodeSearchCursor(offset+limit))
+	}
+	if err := json.NewEncoder(w).Encode(page); err != nil {
+		writeError(w, "Failed to encode response", http.StatusInternalServerError)
+	}
+}
+
+// searchPage reads the limit and cursor parameters. Search results are ranked
+// rather than ordered by ID, so the cursor is an opaque offset.
+func searchPage(w http.ResponseWriter, query url.Values) (limit, offset int, ok bool) {
+	limit = searchDefaultLimit
+	if raw := query.Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > MaxPageSize {
+			writeError(w, "Invalid limit", http.StatusBadRequest)
+			return 0, 0, false
+		}
+		limit = n
+	}
+	if raw := query.Get("cursor"); raw != "" {
+		n, err := decodeSearchCursor(raw)
+		if err != nil {
+			writeError(w, "Invalid cursor", http.StatusBadRequest)
+			return 0, 0, false
+		}
+		offset = n
+	}
+	return limit, offset, true
+}
+
+func encodeSearchCursor(offset int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(offset)))
+}
+
+func decodeSearchCursor(cursor string) (int, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, err
+	}
+	offset, err := strconv.Atoi(string(raw))
+	if err == nil && offset < 0 {
+		err = errors.New("negative offset")
+	}
+	return offset, err
+}
+
+// searchIndexed fetches candidates with the text index for whole words and a
+// regular expression anchored at a word start for the prefix term, up to
+// searchMaxCandidates ordered by text score. A query of a prefix alone has no
+// score, so its candidates are the oldest matching users, and those past the
+// cap are missed. The candidates are then checked with match, which also
+// drops the near misses of phrase matching.
+func searchIndexed(ctx context.Context, q searchQuery) ([]SearchResult, error) {
+	filter := bson.M{}
+	findOptions := options.Find().SetLimit(searchMaxCandidates)
+	if words := q.wholeWords(); len(words) > 0 {
+		// Quoted words are all required, unlike bare words which match any
+		filter["$text"] = bson.M{"$search": `"` + strings.Join(words, `" "`) + `"`}
+		findOptions.
+			SetProjection(bson.M{"password": 0, "textScore": bson.M{"$meta": "textScore"}}).
+			SetSort(bson.D{{Key: "textScore", Value: bson.M{"$meta": "textScore"}}})
+	} else {
+		findOptions.
+			SetProjection(bson.M{"password": 0}).
+			SetSort(bson.D{{Key: "_id", Value: 1}})
+	}
+	if term := q.prefixTerm(); term != "" {
+		pattern := primitive.Regex{Pattern: `(^|[^\p{L}\p{N}])` + regexp.QuoteMeta(term), Options: "i"}
+		filter["$or"] = []bson.M{{"name": pattern}, {"email": pattern}}
+	}
+	return findMatches(ctx, q, filter, findOptions)
+}
+
+// searchScan matches users in the application. It needs no index and is
+// used when text search is unavailable. Like searchIndexed, it fetches at
+// most searchMaxCandidates users, the oldest first, so in a larger
+// collection the newer users are not searched.
+func searchScan(ctx context.Context, q searchQuery) ([]SearchResult, error) {
+	findOptions := options.Find().
+		SetProjection(bson.M{"password": 0}).
+		SetSort(bson.D{{Key: "_id", Value: 1}}).
+		SetLimit(searchMaxCandidates)
+	return findMatches(ctx, q, bson.M{}, findOptions)
+}
+
+func findMatches(ctx context.Context, q searchQuery, filter bson.M, findOptions *options.FindOptions) ([]SearchResult, error) {
+	cur, err := mongoCollection.Find(ctx, filter, findOptions)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(context.Background())
+	var results []SearchResult
+	for cur.Next(ctx) {
+		var doc struct {
+			models.User `bson:",inline"`
+			TextScore   float64 `bson:"textScore"`
+		}
+		if err := cur.Decode(&doc); err != nil {
+			log.Println("Failed to decode user:", err)
+			continue
+		}
+		doc.User.Password = ""
+		if score, highlights, ok := q.match(doc.User); ok {
+			results = append(results, SearchResult{User: doc.User, Score: score, Highlights: highlights, textScore: doc.TextScore})
+		}
+	}
+	return results, cur.Err()
+}
+
+// isTextIndexMissing reports whether a $text query failed for lack of a text index
+func isTextIndexMissing(err error) bool {
+	var serverErr mongo.ServerError
+	return errors.As(err, &serverErr) && serverErr.HasErrorCode(errCodeIndexNotFound)
+}
@@ -0,0 +1,193 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/lep13/golang-restful-api/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// serveSearch searches as an admin stored in mockCollection
+func serveSearch(t *testing.T, mockCollection *MockCollection, url string) (*httptest.ResponseRecorder, []SearchResult) {
+	rr := serve(SearchUsers, "GET", url, "", asAdmin(mockCollection))
+	var results []SearchResult
+	if rr.Code == http.StatusOK {
+		require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &results))
+	}
+	return rr, results
+}
+
+func TestParseSearchQuery(t *testing.T) {
+	assert.Equal(t, searchQuery{terms: []string{"john", "do"}, prefix: true}, parseSearchQuery("John  do"))
+	assert.Equal(t, searchQuery{terms: []string{"john", "doe"}, prefix: false}, parseSearchQuery("john doe "))
+	assert.Equal(t, searchQuery{terms: []string{"john", "example", "com"}, prefix: true}, parseSearchQuery("john@example.com"))
+	assert.Empty(t, parseSearchQuery(" @. ").terms)
+}
+
+func TestSearchQuery_Match(t *testing.T) {
+	user := models.User{Name: "John <Doe>", Email: "jdoe@example.com"}
+
+	score, highlights, ok := parseSearchQuery("john").match(user)
+	assert.True(t, ok)
+	assert.Equal(t, 2.5, score)
+	assert.Equal(t, map[string]string{"name": "<em>John</em> &lt;Doe&gt;"}, highlights)
+
+	// The last term matches word prefixes in every field
+	score, highlights, ok = parseSearchQuery("doe j").match(user)
+	assert.True(t, ok)
+	assert.Equal(t, 3.75, score)
+	assert.Equal(t, map[string]string{"name": "<em>J</em>ohn &lt;<em>Doe</em>&gt;", "email": "<em>j</em>doe@example.com"}, highlights)
+
+	// Terms before the last must match whole words
+	_, _, ok = parseSearchQuery("jo doe").match(user)
+	assert.False(t, ok)
+	_, _, ok = parseSearchQuery("john smith").match(user)
+	assert.False(t, ok)
+
+	// Prefix matches are case insensitive and highlight the original text
+	_, highlights, ok = parseSearchQuery("émi").match(models.User{Name: "Émilie"})
+	assert.True(t, ok)
+	assert.Equal(t, "<em>Émi</em>lie", highlights["name"])
+}
+
+func TestSearchQuery_MatchRanking(t *testing.T) {
+	q := parseSearchQuery("jo")
+	exact, _, _ := q.match(models.User{Name: "Jo Smith"})
+	longer, _, _ := q.match(models.User{Name: "Jonathan Smith"})
+	later, _, _ := q.match(models.User{Name: "Smith Jonathan"})
+	email, _, _ := q.match(models.User{Name: "Smith", Email: "jonathan@example.com"})
+
+	assert.Greater(t, exact, longer)
+	assert.Greater(t, longer, later)
+	assert.Greater(t, later, email)
+}
+
+func TestSearchUsers_TextIndex(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	john := models.User{ID: primitive.NewObjectID(), Name: "John Doe", Email: "john@example.com"}
+	jonathan := models.User{ID: primitive.NewObjectID(), Name: "Jonathan Doe", Email: "jd@example.com"}
+	// Phrase matching can return near misses, which are dropped
+	johnson := models.User{ID: primitive.NewObjectID(), Name: "Doeling Johnson"}
+	mockCollection.On("Find", mock.Anything, mock.MatchedBy(func(filter bson.M) bool {
+		or := filter["$or"].([]bson.M)
+		return filter["$text"].(bson.M)["$search"] == `"doe"` && or[0]["name"].(primitive.Regex).Pattern == `(^|[^\p{L}\p{N}])jo`
+	})).Return(usersCursor(jonathan, johnson, john), nil)
+
+	rr, results := serveSearch(t, mockCollection, "/v1/users/search?q=doe+jo")
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	require.Len(t, results, 2)
+	assert.Equal(t, john.ID, results[0].User.ID)
+	assert.Equal(t, map[string]string{"name": "<em>Jo</em>hn <em>Doe</em>", "email": "<em>jo</em>hn@example.com"}, results[0].Highlights)
+	assert.Equal(t, jonathan.ID, results[1].User.ID)
+	assert.Greater(t, results[0].Score, results[1].Score)
+	mockCollection.AssertExpectations(t)
+}
+
+func TestSearchUsers_FallsBackWithoutTextIndex(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	john := models.User{ID: primitive.NewObjectID(), Name: "John Doe", Password: "secret"}
+	jane := models.User{ID: primitive.NewObjectID(), Name: "Jane Roe"}
+	mockCollection.On("Find", mock.Anything, mock.MatchedBy(func(filter bson.M) bool {
+		_, text := filter["$text"]
+		return text
+	})).Return(nil, mongo.CommandError{Code: errCodeIndexNotFound, Message: "text index required for $text query"})
+	mockCollection.On("Find", mock.Anything, bson.M{}).Return(usersCursor(jane, john), nil)
+
+	rr, results := serveSearch(t, mockCollection, "/v1/users/search?q=doe%20")
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	require.Len(t, results, 1)
+	assert.Equal(t, john.ID, results[0].User.ID)
+	assert.Empty(t, results[0].User.Password)
+	assert.Equal(t, "John <em>Doe</em>", results[0].Highlights["name"])
+}
+
+func TestSearchCandidatesAreCapped(t *testing.T) {
+	for name, search := range map[string]func(context.Context, searchQuery) ([]SearchResult, error){
+		"indexed": searchIndexed,
+		"scan":    searchScan,
+	} {
+		recorder := &findOptionsRecorder{MockCollection: new(MockCollection)}
+		restore := SetupMockCollection(recorder)
+		recorder.On("Find", mock.Anything, mock.Anything).Return(usersCursor(), nil)
+
+		_, err := search(context.Background(), parseSearchQuery("jo"))
+
+		require.NoError(t, err, name)
+		require.Len(t, recorder.opts, 1, name)
+		assert.Equal(t, int64(searchMaxCandidates), *recorder.opts[0].Limit, name)
+		assert.Equal(t, bson.D{{Key: "_id", Value: 1}}, recorder.opts[0].Sort, name)
+		restore()
+	}
+}
+
+func TestSearchUsers_Pagination(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	users := []models.User{
+		{ID: primitive.NewObjectID(), Name: "Ann"},
+		{ID: primitive.NewObjectID(), Name: "Anna"},
+		{ID: primitive.NewObjectID(), Name: "Annabel"},
+	}
+	mockCollection.On("Find", mock.Anything, mock.Anything).Return(usersCursor(users...), nil).Once()
+
+	rr, results := serveSearch(t, mockCollection, "/v1/users/search?q=ann&limit=2")
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	require.Len(t, results, 2)
+	assert.Equal(t, "Ann", results[0].User.Name)
+	assert.Equal(t, "Anna", results[1].User.Name)
+	cursor := rr.Header().Get("X-Next-Cursor")
+	assert.Equal(t, encodeSearchCursor(2), cursor)
+	assert.Equal(t, `</v1/users/search?cursor=`+cursor+`&limit=2&q=ann>; rel="next"`, rr.Header().Get("Link"))
+
+	mockCollection.On("Find", mock.Anything, mock.Anything).Return(usersCursor(users...), nil).Once()
+	rr, results = serveSearch(t, mockCollection, "/v1/users/search?q=ann&limit=2&cursor="+cursor)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	require.Len(t, results, 1)
+	assert.Equal(t, "Annabel", results[0].User.Name)
+	assert.Empty(t, rr.Header().Get("X-Next-Cursor"))
+}
+
+func TestSearchUsers_InvalidRequest(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+
+	for url, message := range map[string]string{
+		"/v1/users/search":                               "Query must contain a letter or digit",
+		"/v1/users/search?q=%40%40":                      "Query must contain a letter or digit",
+		"/v1/users/search?q=john&limit=0":                "Invalid limit",
+		"/v1/users/search?q=john&cursor=not-base64":      "Invalid cursor",
+		"/v1/users/search?q=" + strings.Repeat("a", 101): "Query is too long",
+	} {
+		rr, _ := serveSearch(t, mockCollection, url)
+
+		assert.Equal(t, http.StatusBadRequest, rr.Code, url)
+		assert.Contains(t, rr.Body.String(), message, url)
+	}
+	mockCollection.AssertNotCalled(t, "Find", mock.Anything, mock.Anything)
+}
+
+func TestSearchUsers_DatabaseError(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	mockCollection.On("Find", mock.Anything, mock.Anything).Return(nil, mongo.CommandError{Labels: []string{"NetworkError"}})
+
+	rr, _ := serveSearch(t, mockCollection, "/v1/users/search?q=john")
+
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+}
@@ -0,0 +1,295 @@
+package handlers
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lep13/golang-restful-api/audit"
+	"github.com/lep13/golang-restful-api/middleware"
+	"github.com/lep13/golang-restful-api/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	// maxSessions is the number of sessions kept per user; older ones are
+	// dropped, which revokes them
+	maxSessions = 50
+	// maxUserAgentLength truncates the user agents recorded with sessions
+	maxUserAgentLength = 512
+
+	// sessionActivityInterval is how precisely the last request of a session
+	// is recorded; a session seen again within it is not written to
+	sessionActivityInterval = time.Minute
+
+	// sessionCacheSize bounds the number of validated sessions cached
+	sessionCacheSize = 10000
+)
+
+// validSessions caches the sessions AuthenticateToken found in the database,
+// so active sessions are not looked up on every request
+var validSessions = newSessionCache(30 * time.Second)
+
+// SetSessionCache sets how long a validated session is trusted without
+// looking it up again. Sessions revoked on another instance are accepted here
+// until then. 0 looks sessions up on every request.
+func SetSessionCache(ttl time.Duration) {
+	validSessions = newSessionCache(ttl)
+}
+
+// Session describes a login of a user
+type Session struct {
+	ID         primitive.ObjectID `json:"id"`
+	CreatedAt  time.Time          `json:"created_at"`
+	LastSeenAt time.Time          `json:"last_seen_at"`
+	ExpiresAt  time.Time          `json:"expires_at"`
+	IP         string             `json:"ip,omitempty"`
+	UserAgent  string             `json:"user_agent,omitempty"`
+	// ClientID names the OAuth client of a session started for one
+	ClientID string `json:"client_id,omitempty"`
+}
+
+func sessionInfo(s models.Session) Session {
+	return Session{ID: s.ID, CreatedAt: s.CreatedAt, LastSeenAt: s.LastSeenAt, ExpiresAt: s.ExpiresAt, IP: s.IP, UserAgent: s.UserAgent, ClientID: s.ClientID}
+}
+
+// startSession records a login of the user from the client of the request,
+// lasting as long as its access token. clientID names the OAuth client the
+// login is for, if any.
+func startSession(ctx context.Context, r *http.Request, userID primitive.ObjectID, clientID string) (models.Session, error) {
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	userAgent := r.UserAgent()
+	if len(userAgent) > maxUserAgentLength {
+		userAgent = userAgent[:maxUserAgentLength]
+	}
+	session := models.Session{
+		ID:         primitive.NewObjectID(),
+		CreatedAt:  now,
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(accessTokenTTL),
+		IP:         clientIP(r),
+		UserAgent:  userAgent,
+		ClientID:   clientID,
+	}
+	// Slicing drops the oldest sessions beyond the limit
+	_, err := mongoCollection.UpdateOne(ctx, bson.M{"_id": userID}, bson.M{
+		"$push": bson.M{"sessions": bson.M{"$each": []models.Session{session}, "$slice": -maxSessions}},
+	})
+	return session, err
+}
+
+// checkSession reports whether the session named by a token of the user with
+// id still exists, recording that it was seen
+func checkSession(ctx context.Context, id primitive.ObjectID, sessionID primitive.ObjectID, issuedAt int64) (bool, error) {
+	var user models.User
+	if err := mongoCollection.FindOne(ctx, bson.M{"_id": id}).Decode(&user); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return false, nil
+		}
+		return false, err
+	}
+	// Times in tokens have a one second resolution, so a token issued in the
+	// second of the revocation stays valid
+	if issuedAt < user.SessionsRevokedAt.Unix() || user.Deactivated {
+		return false, nil
+	}
+	now := time.Now()
+	for _, s := range user.Sessions {
+		if s.ID != sessionID {
+			continue
+		}
+		if !now.Before(s.ExpiresAt) {
+			return false, nil
+		}
+		if now.Sub(s.LastSeenAt) >= sessionActivityInterval {
+			touchSession(ctx, id, sessionID, now)
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// touchSession records the last request of a session. Failures are logged;
+// the session works regardless.
+func touchSession(ctx context.Context, userID, sessionID primitive.ObjectID, now time.Time) {
+	_, err := mongoCollection.UpdateOne(ctx,
+		bson.M{"_id": userID, "sessions._id": sessionID},
+		bson.M{"$set": bson.M{"sessions.$.last_seen_at": now.UTC()}})
+	if err != nil {
+		log.Printf("Failed to record the use of session %s: %v", sessionID.Hex(), err)
+	}
+}
+
+// ListSessions lists the unexpired sessions of the user. Users may list their
+// own sessions, and admins those of any user.
+func ListSessions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, "Invalid ID format", http.StatusBadRequest)
+		return
+	}
+	if !requireSelfOrAdmin(w, r, id) {
+		return
+	}
+
+	ctx, cancel := dbContext(r)
+	defer cancel()
+	var user models.User
+	if err := mongoCollection.FindOne(ctx, bson.M{"_id": id}).Decode(&user); err != nil {
+		if err == mongo.ErrNoDocuments {
+			writeError(w, "User not found", http.StatusNotFound)
+		} else {
+			writeDBError(w, err)
+		}
+		return
+	}
+	now := time.Now()
+	sessions := make([]Session, 0, len(user.Sessions))
+	for _, s := range user.Sessions {
+		if now.Before(s.ExpiresAt) {
+			sessions = append(sessions, sessionInfo(s))
+		}
+	}
+	writeJSON(w, sessions)
+}
+
+// RevokeSession revokes a session of the user, rejecting its access token
+// from then on. Users may revoke their own sessions, and admins those of any
+// user.
+func RevokeSession(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, "Invalid ID format", http.StatusBadRequest)
+		return
+	}
+	sessionID, err := primitive.ObjectIDFromHex(mux.Vars(r)["session_id"])
+	if err != nil {
+		writeError(w, "Invalid session ID format", http.StatusBadRequest)
+		return
+	}
+	if !requireSelfOrAdmin(w, r, id) {
+		return
+	}
+
+	ctx, cancel := dbContext(r)
+	defer cancel()
+	res, err := mongoCollection.UpdateOne(ctx,
+		bson.M{"_id": id, "sessions._id": sessionID},
+		bson.M{"$pull": bson.M{"sessions": bson.M{"_id": sessionID}}})
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if res.MatchedCount == 0 {
+		writeError(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	validSessions.forget(sessionID.Hex())
+	callerID, _ := middleware.UserIDFromContext(r.Context())
+	recordAudit(audit.SessionRevoked, id.Hex(), clientIP(r), map[string]string{"session_id": sessionID.Hex(), "by": callerID})
+	writeJSON(w, map[string]string{"message": "Session revoked"})
+}
+
+// RevokeSessions revokes all sessions of the user, including the caller's,
+// and the MFA tokens of logins in progress. Users may revoke their own
+// sessions, and admins those of any user.
+func RevokeSessions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, "Invalid ID format", http.StatusBadRequest)
+		return
+	}
+	if !requireSelfOrAdmin(w, r, id) {
+		return
+	}
+
+	ctx, cancel := dbContext(r)
+	defer cancel()
+	res, err := mongoCollection.UpdateOne(ctx, bson.M{"_id": id}, bson.M{
+		"$set":   bson.M{"sessions_revoked_at": time.Now()},
+		"$unset": bson.M{"sessions": ""},
+	})
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if res.MatchedCount == 0 {
+		writeError(w, "User not found", http.StatusNotFound)
+		return
+	}
+	validSessions.forgetUser(id.Hex())
+	callerID, _ := middleware.UserIDFromContext(r.Context())
+	recordAudit(audit.SessionsRevoked, id.Hex(), clientIP(r), map[string]string{"by": callerID})
+	writeJSON(w, map[string]string{"message": "Sessions revoked"})
+}
+
+// sessionCache remembers sessions found valid for a while, keyed by session ID
+type sessionCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]cachedSession
+}
+
+type cachedSession struct {
+	userID string
+	until  time.Time
+}
+
+func newSessionCache(ttl time.Duration) *sessionCache {
+	return &sessionCache{ttl: ttl, entries: make(map[string]cachedSession)}
+}
+
+// valid reports whether the session of the user was found valid recently
+func (c *sessionCache) valid(sessionID, userID string, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[sessionID]
+	return ok && entry.userID == userID && now.Before(entry.until)
+}
+
+// add caches a session found valid at now. When the cache is full of
+// unexpired sessions, the session is not cached.
+func (c *sessionCache) add(sessionID, userID string, now time.Time) {
+	if c.ttl <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= sessionCacheSize {
+		for id, entry := range c.entries {
+			if !now.Before(entry.until) {
+				delete(c.entries, id)
+			}
+		}
+		if len(c.entries) >= sessionCacheSize {
+			return
+		}
+	}
+	c.entries[sessionID] = cachedSession{userID: userID, until: now.Add(c.ttl)}
+}
+
+// forget drops a revoked session
+func (c *sessionCache) forget(sessionID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, sessionID)
+}
+
+// forgetUser drops the sessions of a user
+func (c *sessionCache) forgetUser(userID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id, entry := range c.entries {
+		if entry.userID == userID {
+			delete(c.entries, id)
+		}
+	}
+}
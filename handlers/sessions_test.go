@@ -0,0 +1,285 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lep13/golang-restful-api/audit"
+	"github.com/lep13/golang-restful-api/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// acceptSessions makes the sessions started for the user succeed, and returns
+// the sessions recorded
+func acceptSessions(mockCollection *MockCollection, id primitive.ObjectID) *[]models.Session {
+	var sessions []models.Session
+	isPush := mock.MatchedBy(func(update bson.M) bool {
+		_, ok := update["$push"]
+		return ok
+	})
+	mockCollection.On("UpdateOne", mock.Anything, bson.M{"_id": id}, isPush).Run(func(args mock.Arguments) {
+		push := args.Get(2).(bson.M)["$push"].(bson.M)["sessions"].(bson.M)
+		sessions = append(sessions, push["$each"].([]models.Session)...)
+	}).Return(&mongo.UpdateResult{MatchedCount: 1}, nil)
+	return &sessions
+}
+
+// sessionToken returns an access token of the session of the user
+func sessionToken(t *testing.T, id, sessionID primitive.ObjectID) string {
+	token, err := issueToken(id, sessionID.Hex(), accessTokenPurpose, []string{"pwd"}, time.Hour)
+	require.NoError(t, err)
+	return token
+}
+
+func setupSessionCache(ttl time.Duration) func() {
+	original := validSessions
+	validSessions = newSessionCache(ttl)
+	return func() { validSessions = original }
+}
+
+func TestStartSession(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	id := primitive.NewObjectID()
+	var update bson.M
+	mockCollection.On("UpdateOne", mock.Anything, bson.M{"_id": id}, mock.Anything).Run(func(args mock.Arguments) {
+		update = args.Get(2).(bson.M)
+	}).Return(&mongo.UpdateResult{MatchedCount: 1}, nil)
+	req := httptest.NewRequest("POST", "/v1/auth/login", nil)
+	req.Header.Set("User-Agent", strings.Repeat("a", 1000))
+
+	session, err := startSession(context.Background(), req, id, "")
+
+	require.NoError(t, err)
+	assert.Len(t, session.UserAgent, 512)
+	assert.Equal(t, "192.0.2.1:1234", session.IP)
+	// Only the latest sessions are kept
+	assert.Equal(t, bson.M{"$push": bson.M{"sessions": bson.M{"$each": []models.Session{session}, "$slice": -50}}}, update)
+}
+
+func TestAuthenticateToken_CachesSessions(t *testing.T) {
+	defer setupSessionCache(time.Minute)()
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	id := primitive.NewObjectID()
+	sessionID := primitive.NewObjectID()
+	findUser(mockCollection, id, models.User{ID: id, Sessions: []models.Session{{ID: sessionID, LastSeenAt: time.Now(), ExpiresAt: time.Now().Add(time.Hour)}}}, nil)
+	token := sessionToken(t, id, sessionID)
+
+	for i := 0; i < 3; i++ {
+		userID, _, err := AuthenticateToken(context.Background(), token)
+		require.NoError(t, err)
+		assert.Equal(t, id.Hex(), userID)
+	}
+	mockCollection.AssertNumberOfCalls(t, "FindOne", 1)
+
+	// A revoked session is looked up again
+	validSessions.forget(sessionID.Hex())
+	_, _, err := AuthenticateToken(context.Background(), token)
+	require.NoError(t, err)
+	mockCollection.AssertNumberOfCalls(t, "FindOne", 2)
+
+	validSessions.forgetUser(id.Hex())
+	_, _, err = AuthenticateToken(context.Background(), token)
+	require.NoError(t, err)
+	mockCollection.AssertNumberOfCalls(t, "FindOne", 3)
+}
+
+func TestAuthenticateToken_RecordsLastSeen(t *testing.T) {
+	defer setupSessionCache(0)()
+	id := primitive.NewObjectID()
+	sessionID := primitive.NewObjectID()
+
+	for _, tc := range []struct {
+		name     string
+		lastSeen time.Time
+		touched  bool
+	}{
+		{"seen long ago", time.Now().Add(-2 * time.Minute), true},
+		{"seen recently", time.Now().Add(-time.Second), false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mockCollection := new(MockCollection)
+			defer SetupMockCollection(mockCollection)()
+			findUser(mockCollection, id, models.User{ID: id, Sessions: []models.Session{{ID: sessionID, LastSeenAt: tc.lastSeen, ExpiresAt: time.Now().Add(time.Hour)}}}, nil)
+			mockCollection.On("UpdateOne", mock.Anything, bson.M{"_id": id, "sessions._id": sessionID}, mock.Anything).Return(&mongo.UpdateResult{MatchedCount: 1}, nil)
+
+			_, _, err := AuthenticateToken(context.Background(), sessionToken(t, id, sessionID))
+
+			require.NoError(t, err)
+			if tc.touched {
+				mockCollection.AssertCalled(t, "UpdateOne", mock.Anything, bson.M{"_id": id, "sessions._id": sessionID}, mock.Anything)
+			} else {
+				mockCollection.AssertNotCalled(t, "UpdateOne", mock.Anything, mock.Anything, mock.Anything)
+			}
+		})
+	}
+}
+
+func TestListSessions(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	id := primitive.NewObjectID()
+	adminID := primitive.NewObjectID()
+	createdAt := time.Now().UTC().Truncate(time.Second)
+	active := models.Session{ID: primitive.NewObjectID(), CreatedAt: createdAt, LastSeenAt: createdAt.Add(time.Minute), ExpiresAt: createdAt.Add(time.Hour), IP: "203.0.113.7", UserAgent: "curl/8.0"}
+	expired := models.Session{ID: primitive.NewObjectID(), CreatedAt: createdAt.Add(-2 * time.Hour), ExpiresAt: createdAt.Add(-time.Hour)}
+	findUser(mockCollection, id, models.User{ID: id, Sessions: []models.Session{expired, active}}, nil)
+	findUser(mockCollection, adminID, models.User{ID: adminID, Admin: true}, nil)
+
+	for _, callerID := range []string{id.Hex(), adminID.Hex()} {
+		rr := serve(ListSessions, "GET", "/v1/users/"+id.Hex()+"/sessions", "", withVars("id", id.Hex()), as(callerID))
+
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.JSONEq(t, `[{
+			"id": "`+active.ID.Hex()+`",
+			"created_at": "`+createdAt.Format(time.RFC3339)+`",
+			"last_seen_at": "`+createdAt.Add(time.Minute).Format(time.RFC3339)+`",
+			"expires_at": "`+createdAt.Add(time.Hour).Format(time.RFC3339)+`",
+			"ip": "203.0.113.7",
+			"user_agent": "curl/8.0"
+		}]`, rr.Body.String())
+	}
+}
+
+func TestListSessions_None(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	id := primitive.NewObjectID()
+	findUser(mockCollection, id, models.User{ID: id}, nil)
+
+	rr := serve(ListSessions, "GET", "/v1/users/"+id.Hex()+"/sessions", "", withVars("id", id.Hex()), as(id.Hex()))
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, `[]`, rr.Body.String())
+}
+
+func TestListSessions_OtherUser(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	id := primitive.NewObjectID()
+	callerID := primitive.NewObjectID()
+	findUser(mockCollection, callerID, models.User{ID: callerID}, nil)
+
+	rr := serve(ListSessions, "GET", "/v1/users/"+id.Hex()+"/sessions", "", withVars("id", id.Hex()), as(callerID.Hex()))
+
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.JSONEq(t, `{"error":"Admin access required"}`, rr.Body.String())
+}
+
+func TestRevokeSession(t *testing.T) {
+	id := primitive.NewObjectID()
+	sessionID := primitive.NewObjectID()
+
+	for _, tc := range []struct {
+		name    string
+		matched int64
+		status  int
+		body    string
+	}{
+		{"revoked", 1, http.StatusOK, `{"message":"Session revoked"}`},
+		{"unknown session", 0, http.StatusNotFound, `{"error":"Session not found"}`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			defer setupSessionCache(time.Minute)()
+			validSessions.add(sessionID.Hex(), id.Hex(), time.Now())
+			mockCollection := new(MockCollection)
+			defer SetupMockCollection(mockCollection)()
+			auditLog := new(recordingAuditLogger)
+			defer setupAuditLogger(auditLog)()
+			mockCollection.On("UpdateOne", mock.Anything,
+				bson.M{"_id": id, "sessions._id": sessionID},
+				bson.M{"$pull": bson.M{"sessions": bson.M{"_id": sessionID}}}).Return(&mongo.UpdateResult{MatchedCount: tc.matched}, nil)
+
+			rr := serve(RevokeSession, "DELETE", "/v1/users/"+id.Hex()+"/sessions/"+sessionID.Hex(), "", withVars("id", id.Hex(), "session_id", sessionID.Hex()), as(id.Hex()))
+
+			assert.Equal(t, tc.status, rr.Code)
+			assert.JSONEq(t, tc.body, rr.Body.String())
+			if tc.matched == 1 {
+				assert.False(t, validSessions.valid(sessionID.Hex(), id.Hex(), time.Now()))
+				events := auditLog.recorded()
+				require.Len(t, events, 1)
+				assert.Equal(t, audit.SessionRevoked, events[0].Action)
+				assert.Equal(t, map[string]string{"session_id": sessionID.Hex(), "by": id.Hex()}, events[0].Details)
+			}
+		})
+	}
+}
+
+func TestRevokeSession_InvalidID(t *testing.T) {
+	id := primitive.NewObjectID()
+	rr := serve(RevokeSession, "DELETE", "/v1/users/"+id.Hex()+"/sessions/current", "", withVars("id", id.Hex(), "session_id", "current"))
+
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.JSONEq(t, `{"error":"Invalid session ID format"}`, rr.Body.String())
+}
+
+func TestRevokeSessions(t *testing.T) {
+	defer setupSessionCache(time.Minute)()
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	auditLog := new(recordingAuditLogger)
+	defer setupAuditLogger(auditLog)()
+	id := primitive.NewObjectID()
+	adminID := primitive.NewObjectID()
+	findUser(mockCollection, adminID, models.User{ID: adminID, Admin: true}, nil)
+	other := primitive.NewObjectID().Hex()
+	validSessions.add("first", id.Hex(), time.Now())
+	validSessions.add("second", id.Hex(), time.Now())
+	validSessions.add("other", other, time.Now())
+	var update bson.M
+	mockCollection.On("UpdateOne", mock.Anything, bson.M{"_id": id}, mock.Anything).Run(func(args mock.Arguments) {
+		update = args.Get(2).(bson.M)
+	}).Return(&mongo.UpdateResult{MatchedCount: 1}, nil)
+
+	rr := serve(RevokeSessions, "DELETE", "/v1/users/"+id.Hex()+"/sessions", "", withVars("id", id.Hex()), as(adminID.Hex()))
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, `{"message":"Sessions revoked"}`, rr.Body.String())
+	assert.WithinDuration(t, time.Now(), update["$set"].(bson.M)["sessions_revoked_at"].(time.Time), time.Minute)
+	assert.Equal(t, bson.M{"sessions": ""}, update["$unset"])
+	assert.False(t, validSessions.valid("first", id.Hex(), time.Now()))
+	assert.False(t, validSessions.valid("second", id.Hex(), time.Now()))
+	assert.True(t, validSessions.valid("other", other, time.Now()))
+	events := auditLog.recorded()
+	require.Len(t, events, 1)
+	assert.Equal(t, audit.SessionsRevoked, events[0].Action)
+	assert.Equal(t, map[string]string{"by": adminID.Hex()}, events[0].Details)
+}
+
+func TestRevokeSessions_UnknownUser(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	id := primitive.NewObjectID()
+	mockCollection.On("UpdateOne", mock.Anything, bson.M{"_id": id}, mock.Anything).Return(&mongo.UpdateResult{}, nil)
+
+	rr := serve(RevokeSessions, "DELETE", "/v1/users/"+id.Hex()+"/sessions", "", withVars("id", id.Hex()), as(id.Hex()))
+
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	assert.JSONEq(t, `{"error":"User not found"}`, rr.Body.String())
+}
+
+func TestSessionCache(t *testing.T) {
+	now := time.Now()
+	cache := newSessionCache(time.Minute)
+	cache.add("session", "user", now)
+
+	assert.True(t, cache.valid("session", "user", now.Add(59*time.Second)))
+	assert.False(t, cache.valid("session", "user", now.Add(time.Minute)))
+	assert.False(t, cache.valid("session", "another user", now))
+	assert.False(t, cache.valid("another session", "user", now))
+
+	// A cache without a TTL keeps nothing
+	disabled := newSessionCache(0)
+	disabled.add("session", "user", now)
+	assert.False(t, disabled.valid("session", "user", now))
+}
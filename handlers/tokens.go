@@ -0,0 +1,32 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+)
+
+// tokenBytes is the entropy of the tokens handed to users, such as email
+// verification tokens
+const tokenBytes = 32
+
+// newToken returns a random URL-safe token and the hash under which it is
+// stored. Only the hash is persisted, so a leaked database does not reveal
+// usable tokens.
+func newToken() (token, hash string, err error) {
+	raw := make([]byte, tokenBytes)
+	if _, err := rand.Read(raw); err != nil {
+		return "", "", err
+	}
+	token = base64.RawURLEncoding.EncodeToString(raw)
+	return token, hashToken(token), nil
+}
+
+// hashToken returns the hex SHA-256 of a token. The tokens are random and long,
+// so a fast unsalted hash is enough to make them unguessable from the hash,
+// and it lets a token be looked up by its hash.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -3,15 +3,21 @@ package handlers
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
+	"net/url"
+	"strconv"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/lep13/golang-restful-api/models"
     "github.com/lep13/golang-restful-api/db"
+	"github.com/lep13/golang-restful-api/filter"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 // CollectionInterface defines the methods that the collection should implement
@@ -25,141 +31,392 @@ type CollectionInterface interface {
 
 var mongoCollection db.MongoCollectionInterface
 
+// MaxPageSize is the largest page GetUsers returns
+const MaxPageSize = 100
+
+// operationTimeout bounds each database call made on behalf of a request
+var operationTimeout = 5 * time.Second
+
 // Initialize initializes the collection and stores it in a package-level variable
 func Initialize(collection db.MongoCollectionInterface) {
     mongoCollection = collection
 }
 
+// SetOperationTimeout sets the per-operation deadline applied to database calls
+func SetOperationTimeout(timeout time.Duration) {
+	if timeout > 0 {
+		operationTimeout = timeout
+	}
+}
+
+// dbContext derives a context for a database call from the request context, so the
+// call is cancelled when the client goes away or the operation timeout elapses
+func dbContext(r *http.Request) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(r.Context(), operationTimeout)
+}
+
+// writeError writes an error response of the form {"error": "<message>"}
+func writeError(w http.ResponseWriter, message string, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(map[string]string{"error": message}); err != nil {
+		log.Println("Error encoding JSON error response:", err)
+	}
+}
+
+// writeDBError maps a database error to an HTTP response. Deadline errors become
+// 504 Gateway Timeout, cancellations and network failures 503 Service Unavailable.
+func writeDBError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded) || mongo.IsTimeout(err):
+		writeError(w, "Database operation timed out", http.StatusGatewayTimeout)
+	case errors.Is(err, context.Canceled) || mongo.IsNetworkError(err):
+		writeError(w, "Database unavailable", http.StatusServiceUnavailable)
+	default:
+		writeError(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// errEmailInUse reports a user written with the email of another
+const errEmailInUse = "Email is already in use"
+
+// writeUserWriteError writes the error of storing a user, answering 409 when
+// another user has the email
+func writeUserWriteError(w http.ResponseWriter, err error) {
+	if mongo.IsDuplicateKeyError(err) {
+		writeError(w, errEmailInUse, http.StatusConflict)
+		return
+	}
+	writeDBError(w, err)
+}
+
+// decodeBody decodes the JSON request body into v, writing 413 when the body
+// exceeds the size limit and 400 when it is malformed
+func decodeBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			writeError(w, "Request body too large", http.StatusRequestEntityTooLarge)
+		} else {
+			writeError(w, "Failed to decode request body", http.StatusBadRequest)
+		}
+		return false
+	}
+	return true
+}
+
 // HealthCheck handles the health check request
 func HealthCheck(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	response := map[string]string{"status": "healthy"}
 	if err := json.NewEncoder(w).Encode(response); err != nil {
 		log.Println("Error encoding JSON response:", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		writeError(w, "Internal Server Error", http.StatusInternalServerError)
 	}
 }
 
-// CreateUser creates a new user in the database
+// CreateUser creates a new user in the database. It is open to anonymous
+// callers, so people can sign up; a user with an email is sent a token to
+// verify it. The password, which is optional, must meet the password policy
+// and is stored hashed.
 func CreateUser(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	var user models.User
-	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
-		http.Error(w, "Failed to decode request body", http.StatusBadRequest)
+	if !decodeBody(w, r, &user) {
+		return
+	}
+	if status, message := hashNewPassword(&user); status != 0 {
+		writeError(w, message, status)
 		return
 	}
 	user.ID = primitive.NewObjectID()
-	_, err := mongoCollection.InsertOne(context.TODO(), user)
+	user.Email = normalizeEmail(user.Email)
+	user.EmailVerified = false
+	var token string
+	if user.Email != "" {
+		var err error
+		user.EmailVerification, token, err = newEmailVerification(time.Now())
+		if err != nil {
+			writeError(w, "Failed to create verification token", http.StatusInternalServerError)
+			return
+		}
+	}
+	ctx, cancel := dbContext(r)
+	defer cancel()
+	_, err := mongoCollection.InsertOne(ctx, user)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeUserWriteError(w, err)
 		return
 	}
+	// The user exists either way; a failed email can be resent
+	if token != "" {
+		sendVerificationEmail(r.Context(), user, token)
+	}
+	// Passwords are write-only and never returned
+	user.Password = ""
 	if err := json.NewEncoder(w).Encode(user); err != nil {
-		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		writeError(w, "Failed to encode response", http.StatusInternalServerError)
 	}
 }
 
-// GetUsers retrieves all users from the database
+// GetUsers retrieves users from the database ordered by ID. When a limit is
+// given the results are paginated: the Link and X-Next-Cursor headers carry
+// the cursor of the next page, and are omitted on the last page. The fields
+// and exclude parameters select the fields returned. Only admins may list
+// users.
 func GetUsers(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	var users []models.User
-	cur, err := mongoCollection.Find(context.TODO(), bson.M{})
+	if _, ok := requireAdmin(w, r); !ok {
+		return
+	}
+	query := r.URL.Query()
+	findOptions := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}})
+	limit := 0
+	if raw := query.Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > MaxPageSize {
+			writeError(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+		// Fetch one extra document to learn whether another page exists
+		findOptions.SetLimit(int64(limit + 1))
+	}
+	filter, ok := listFilter(w, query)
+	if !ok {
+		return
+	}
+	projection, ok := userProjection(w, query)
+	if !ok {
+		return
+	}
+	findOptions.SetProjection(projection)
+	users := []models.User{}
+	ctx, cancel := dbContext(r)
+	defer cancel()
+	cur, err := mongoCollection.Find(ctx, filter, findOptions)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeDBError(w, err)
 		return
 	}
-	defer cur.Close(context.TODO())
-	for cur.Next(context.TODO()) {
+	// Close with a fresh context so the cursor is released even after cancellation
+	defer cur.Close(context.Background())
+	for cur.Next(ctx) {
 		var user models.User
 		if err := cur.Decode(&user); err != nil {
 			log.Println("Failed to decode user:", err)
 			continue
 		}
+		user.Password = ""
 		users = append(users, user)
 	}
+	if r.Context().Err() != nil {
+		log.Println("Client went away while listing users:", r.Context().Err())
+		return
+	}
 	if err := cur.Err(); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeDBError(w, err)
 		return
 	}
+	if limit > 0 && len(users) > limit {
+		users = users[:limit]
+		setNextPage(w, r, users[limit-1].ID.Hex())
+	}
 	if err := json.NewEncoder(w).Encode(users); err != nil {
-		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		writeError(w, "Failed to encode response", http.StatusInternalServerError)
+	}
+}
+
+// userFilterFields are the attributes of models.User a filter expression may
+// use, named after their JSON fields. The password is deliberately missing.
+// created_at is the creation time recorded in the ID.
+var userFilterFields = filter.Fields{
+	"_id":        {Path: "_id", Type: filter.ObjectID},
+	"name":       {Path: "name", Type: filter.String},
+	"email":      {Path: "email", Type: filter.String},
+	"created_at": {Path: "_id", Type: filter.CreationTime},
+}
+
+// listFilter builds the query shared by GetUsers and ExportUsers from the
+// request parameters, writing 400 when one is invalid
+func listFilter(w http.ResponseWriter, query url.Values) (bson.M, bool) {
+	var conditions bson.A
+	if raw := query.Get("cursor"); raw != "" {
+		after, err := primitive.ObjectIDFromHex(raw)
+		if err != nil {
+			writeError(w, "Invalid cursor", http.StatusBadRequest)
+			return nil, false
+		}
+		conditions = append(conditions, bson.M{"_id": bson.M{"$gt": after}})
 	}
+	if raw := query.Get("filter"); raw != "" {
+		expr, err := filter.Parse(raw)
+		var compiled bson.M
+		if err == nil {
+			compiled, err = filter.Compile(expr, userFilterFields)
+		}
+		if err != nil {
+			writeError(w, "Invalid filter: "+err.Error(), http.StatusBadRequest)
+			return nil, false
+		}
+		conditions = append(conditions, compiled)
+	}
+	switch len(conditions) {
+	case 0:
+		return bson.M{}, true
+	case 1:
+		return conditions[0].(bson.M), true
+	}
+	return bson.M{"$and": conditions}, true
 }
 
-// GetUser retrieves a single user by ID from the database
+// setNextPage advertises the next page through the Link and X-Next-Cursor headers
+func setNextPage(w http.ResponseWriter, r *http.Request, cursor string) {
+	query := r.URL.Query()
+	query.Set("cursor", cursor)
+	next := url.URL{Path: r.URL.Path, RawQuery: query.Encode()}
+	w.Header().Add("Link", "<"+next.String()+`>; rel="next"`)
+	w.Header().Set("X-Next-Cursor", cursor)
+}
+
+// GetUser retrieves a single user by ID from the database, for the user
+// themselves or an admin
 func GetUser(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	params := mux.Vars(r)
 	id, err := primitive.ObjectIDFromHex(params["id"])
 	if err != nil {
-		http.Error(w, "Invalid ID format", http.StatusBadRequest)
+		writeError(w, "Invalid ID format", http.StatusBadRequest)
+		return
+	}
+	if !requireSelfOrAdmin(w, r, id) {
 		return
 	}
 	var user models.User
-	err = mongoCollection.FindOne(context.TODO(), bson.M{"_id": id}).Decode(&user)
+	ctx, cancel := dbContext(r)
+	defer cancel()
+	err = mongoCollection.FindOne(ctx, bson.M{"_id": id}).Decode(&user)
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
-			http.Error(w, "User not found", http.StatusNotFound)
+			writeError(w, "User not found", http.StatusNotFound)
 		} else {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeDBError(w, err)
 		}
 		return
 	}
+	user.Password = ""
 	if err := json.NewEncoder(w).Encode(user); err != nil {
-		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		writeError(w, "Failed to encode response", http.StatusInternalServerError)
 	}
 }
 
-// DeleteUser deletes a user by ID from the database
+// DeleteUser deletes a user by ID from the database. Users may delete
+// themselves, and admins anyone.
 func DeleteUser(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	params := mux.Vars(r)
 	id, err := primitive.ObjectIDFromHex(params["id"])
 	if err != nil {
-		http.Error(w, "Invalid ID format", http.StatusBadRequest)
+		writeError(w, "Invalid ID format", http.StatusBadRequest)
+		return
+	}
+	if !requireSelfOrAdmin(w, r, id) {
 		return
 	}
-	res, err := mongoCollection.DeleteOne(context.TODO(), bson.M{"_id": id})
+	ctx, cancel := dbContext(r)
+	defer cancel()
+	res, err := mongoCollection.DeleteOne(ctx, bson.M{"_id": id})
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeDBError(w, err)
 		return
 	}
 	if res.DeletedCount == 0 {
-		http.Error(w, "User not found", http.StatusNotFound)
+		writeError(w, "User not found", http.StatusNotFound)
 		return
 	}
+	validSessions.forgetUser(id.Hex())
 	response := map[string]string{"message": "User deleted successfully"}
 	if err := json.NewEncoder(w).Encode(response); err != nil {
-		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		writeError(w, "Failed to encode response", http.StatusInternalServerError)
 	}
 }
 
-// UpdateUser updates a user by ID in the database
+// UpdateUser updates a user by ID in the database. Users may update
+// themselves, and admins anyone. Changing the email marks it unverified and
+// sends a token to the new address; changing the password revokes the
+// sessions of the user.
 func UpdateUser(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	params := mux.Vars(r)
 	id, err := primitive.ObjectIDFromHex(params["id"])
 	if err != nil {
-		http.Error(w, "Invalid ID format", http.StatusBadRequest)
+		writeError(w, "Invalid ID format", http.StatusBadRequest)
+		return
+	}
+	if !requireSelfOrAdmin(w, r, id) {
 		return
 	}
 	var user models.User
-	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
-		http.Error(w, "Failed to decode request body", http.StatusBadRequest)
+	if !decodeBody(w, r, &user) {
 		return
 	}
-	update := bson.M{"$set": user}
-	res, err := mongoCollection.UpdateOne(context.TODO(), bson.M{"_id": id}, update)
+	if status, message := hashNewPassword(&user); status != 0 {
+		writeError(w, message, status)
+		return
+	}
+	user.Email = normalizeEmail(user.Email)
+	user.EmailVerified = false
+	ctx, cancel := dbContext(r)
+	defer cancel()
+	if user.Email != "" {
+		changed, err := changeEmail(ctx, id, user)
+		if err != nil {
+			writeUserWriteError(w, err)
+			return
+		}
+		if changed {
+			writeUserUpdated(w, id, user)
+			return
+		}
+	}
+	res, err := mongoCollection.UpdateOne(ctx, bson.M{"_id": id}, userUpdate(user, nil))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeUserWriteError(w, err)
 		return
 	}
 	if res.MatchedCount == 0 {
-		http.Error(w, "User not found", http.StatusNotFound)
+		writeError(w, "User not found", http.StatusNotFound)
 		return
 	}
+	writeUserUpdated(w, id, user)
+}
+
+// userUpdate builds the update setting the fields of user and unsetting those
+// in unset, which may be nil. Changing the password revokes the sessions of
+// the user, as a password reset does.
+func userUpdate(user models.User, unset bson.M) bson.M {
+	if user.Password != "" {
+		user.SessionsRevokedAt = time.Now()
+		if unset == nil {
+			unset = bson.M{}
+		}
+		unset["sessions"] = ""
+	}
+	update := bson.M{"$set": user}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+	return update
+}
+
+// writeUserUpdated answers an applied update, first dropping the cached
+// sessions of a user whose password it changed
+func writeUserUpdated(w http.ResponseWriter, id primitive.ObjectID, user models.User) {
+	if user.Password != "" {
+		validSessions.forgetUser(id.Hex())
+	}
 	response := map[string]string{"message": "User updated successfully"}
 	if err := json.NewEncoder(w).Encode(response); err != nil {
-		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		writeError(w, "Failed to encode response", http.StatusInternalServerError)
 	}
 }
@@ -8,16 +8,21 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/lep13/golang-restful-api/db"
+	"github.com/lep13/golang-restful-api/middleware"
 	"github.com/lep13/golang-restful-api/models"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 // MockSingleResult implements db.MongoSingleResultInterface for unit testing
@@ -43,7 +48,7 @@ func (m *MockCollection) InsertOne(ctx context.Context, document interface{}) (*
 	return args.Get(0).(*mongo.InsertOneResult), args.Error(1)
 }
 
-func (m *MockCollection) Find(ctx context.Context, filter interface{}) (*mongo.Cursor, error) {
+func (m *MockCollection) Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error) {
 	args := m.Called(ctx, filter)
 	// Handle nil case gracefully to prevent panic
 	if args.Get(0) == nil {
@@ -76,6 +81,34 @@ func (m *MockCollection) UpdateOne(ctx context.Context, filter interface{}, upda
 	return args.Get(0).(*mongo.UpdateResult), args.Error(1)
 }
 
+func (m *MockCollection) InsertMany(ctx context.Context, documents []interface{}, opts ...*options.InsertManyOptions) (*mongo.InsertManyResult, error) {
+	args := m.Called(ctx, documents)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*mongo.InsertManyResult), args.Error(1)
+}
+
+func (m *MockCollection) BulkWrite(ctx context.Context, models []mongo.WriteModel, opts ...*options.BulkWriteOptions) (*mongo.BulkWriteResult, error) {
+	args := m.Called(ctx, models)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*mongo.BulkWriteResult), args.Error(1)
+}
+
+func (m *MockCollection) CountDocuments(ctx context.Context, filter interface{}) (int64, error) {
+	args := m.Called(ctx, filter)
+	return args.Get(0).(int64), args.Error(1)
+}
+
+// WithTransaction runs fn directly; tests observe the transaction through the
+// "WithTransaction" call and the error it returns.
+func (m *MockCollection) WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	m.Called(ctx)
+	return fn(ctx)
+}
+
 type MockCursor struct {
 	mock.Mock
 }
@@ -130,6 +163,68 @@ func SetupMockCollection(mock db.MongoCollectionInterface) func() {
 	}
 }
 
+// requestOption adjusts a request built by serve
+type requestOption func(*http.Request) *http.Request
+
+// serve runs handler on a request from a fixed client address, as the router
+// would after resolving the client IP, and waits for the work it leaves
+// running in the background
+func serve(handler http.HandlerFunc, method, target, body string, opts ...requestOption) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.RemoteAddr = "203.0.113.7:5555"
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for _, opt := range opts {
+		req = opt(req)
+	}
+	rr := httptest.NewRecorder()
+	middleware.TrustedProxies(nil).Middleware(handler).ServeHTTP(rr, req)
+	background.Wait()
+	return rr
+}
+
+// signedIn authenticates a request as a user other than those it acts on
+func signedIn() requestOption {
+	return as(primitive.NewObjectID().Hex())
+}
+
+// as authenticates the request as callerID, with credentials limited to scopes
+// when any are given. An empty callerID without scopes leaves it anonymous.
+func as(callerID string, scopes ...string) requestOption {
+	return func(req *http.Request) *http.Request {
+		if callerID == "" && len(scopes) == 0 {
+			return req
+		}
+		ctx := middleware.WithUserID(req.Context(), callerID)
+		if len(scopes) > 0 {
+			ctx = middleware.WithScopes(ctx, scopes)
+		}
+		return req.WithContext(ctx)
+	}
+}
+
+// withVars sets the route variables, given as name and value pairs
+func withVars(pairs ...string) requestOption {
+	return func(req *http.Request) *http.Request {
+		vars := make(map[string]string, len(pairs)/2)
+		for i := 0; i+1 < len(pairs); i += 2 {
+			vars[pairs[i]] = pairs[i+1]
+		}
+		return mux.SetURLVars(req, vars)
+	}
+}
+
+// withCookie sends cookie, unless it is nil
+func withCookie(cookie *http.Cookie) requestOption {
+	return func(req *http.Request) *http.Request {
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		return req
+	}
+}
+
 func TestHealthCheck(t *testing.T) {
 	req, _ := http.NewRequest("GET", "/health", nil)
 	rr := httptest.NewRecorder()
@@ -188,6 +283,7 @@ func TestGetUser(t *testing.T) {
 	rr := httptest.NewRecorder()
 	req = mux.SetURLVars(req, map[string]string{"id": expectedUser.ID.Hex()})
 
+	req = as(expectedUser.ID.Hex())(req)
 	handler := http.HandlerFunc(GetUser)
 	handler.ServeHTTP(rr, req)
 
@@ -206,6 +302,7 @@ func TestDeleteUser(t *testing.T) {
 	req, _ := http.NewRequest("DELETE", "/users/"+userID.Hex(), nil)
 	rr := httptest.NewRecorder()
 	req = mux.SetURLVars(req, map[string]string{"id": userID.Hex()})
+	req = req.WithContext(middleware.WithUserID(req.Context(), userID.Hex()))
 
 	handler := http.HandlerFunc(DeleteUser)
 	handler.ServeHTTP(rr, req)
@@ -221,19 +318,28 @@ func TestUpdateUser(t *testing.T) {
 	user := models.User{Name: "Jane Doe", Password: "lepakshi57983"}
 	user.ID = primitive.NewObjectID()
 
-	mockCollection.On("UpdateOne", mock.Anything, bson.M{"_id": user.ID}, bson.M{"$set": user}).Return(&mongo.UpdateResult{MatchedCount: 1}, nil)
+	var update bson.M
+	mockCollection.On("UpdateOne", mock.Anything, bson.M{"_id": user.ID}, mock.Anything).Run(func(args mock.Arguments) {
+		update = args.Get(2).(bson.M)
+	}).Return(&mongo.UpdateResult{MatchedCount: 1}, nil)
 
 	body, _ := json.Marshal(user)
 	req, _ := http.NewRequest("PUT", "/users/"+user.ID.Hex(), bytes.NewBuffer(body))
 	req.Header.Set("Content-Type", "application/json")
 	rr := httptest.NewRecorder()
 	req = mux.SetURLVars(req, map[string]string{"id": user.ID.Hex()})
+	req = req.WithContext(middleware.WithUserID(req.Context(), user.ID.Hex()))
 
 	handler := http.HandlerFunc(UpdateUser)
 	handler.ServeHTTP(rr, req)
 
 	assert.Equal(t, http.StatusOK, rr.Code)
-	mockCollection.AssertCalled(t, "UpdateOne", mock.Anything, bson.M{"_id": user.ID}, bson.M{"$set": user})
+	set := update["$set"].(models.User)
+	assert.Equal(t, "Jane Doe", set.Name)
+	// The new password is stored hashed and revokes the sessions of the user
+	assert.True(t, checkPassword(set.Password, "lepakshi57983"))
+	assert.WithinDuration(t, time.Now(), set.SessionsRevokedAt, time.Minute)
+	assert.Equal(t, bson.M{"sessions": ""}, update["$unset"])
 }
 
 func TestCreateUser_InvalidBody(t *testing.T) {
@@ -265,6 +371,7 @@ func TestUpdateUser_InvalidBody(t *testing.T) {
 	req.Header.Set("Content-Type", "application/json")
 	rr := httptest.NewRecorder()
 	req = mux.SetURLVars(req, map[string]string{"id": userID.Hex()})
+	req = req.WithContext(middleware.WithUserID(req.Context(), userID.Hex()))
 
 	handler := http.HandlerFunc(UpdateUser)
 	handler.ServeHTTP(rr, req)
@@ -285,6 +392,7 @@ func TestDeleteUser_UserNotFound(t *testing.T) {
 	req, _ := http.NewRequest("DELETE", "/users/"+userID.Hex(), nil)
 	rr := httptest.NewRecorder()
 	req = mux.SetURLVars(req, map[string]string{"id": userID.Hex()})
+	req = req.WithContext(middleware.WithUserID(req.Context(), userID.Hex()))
 
 	handler := http.HandlerFunc(DeleteUser)
 	handler.ServeHTTP(rr, req)
@@ -322,13 +430,14 @@ func TestUpdateUser_UpdateOneFailure(t *testing.T) {
 	userID := primitive.NewObjectID()
 
 	// Return an actual UpdateResult and a simulated error
-	mockCollection.On("UpdateOne", mock.Anything, bson.M{"_id": userID}, bson.M{"$set": user}).Return(&mongo.UpdateResult{}, errors.New("update error"))
+	mockCollection.On("UpdateOne", mock.Anything, bson.M{"_id": userID}, mock.Anything).Return(&mongo.UpdateResult{}, errors.New("update error"))
 
 	body, _ := json.Marshal(user)
 	req, _ := http.NewRequest("PUT", "/users/"+userID.Hex(), bytes.NewBuffer(body))
 	req.Header.Set("Content-Type", "application/json")
 	rr := httptest.NewRecorder()
 	req = mux.SetURLVars(req, map[string]string{"id": userID.Hex()})
+	req = req.WithContext(middleware.WithUserID(req.Context(), userID.Hex()))
 
 	handler := http.HandlerFunc(UpdateUser)
 	handler.ServeHTTP(rr, req)
@@ -349,6 +458,7 @@ func TestDeleteUser_DeleteOneFailure(t *testing.T) {
 	req, _ := http.NewRequest("DELETE", "/users/"+userID.Hex(), nil)
 	rr := httptest.NewRecorder()
 	req = mux.SetURLVars(req, map[string]string{"id": userID.Hex()})
+	req = req.WithContext(middleware.WithUserID(req.Context(), userID.Hex()))
 
 	handler := http.HandlerFunc(DeleteUser)
 	handler.ServeHTTP(rr, req)
@@ -367,6 +477,7 @@ func TestGetUsers_FindFailure(t *testing.T) {
 	req, _ := http.NewRequest("GET", "/users", nil)
 	rr := httptest.NewRecorder()
 
+	req = asAdmin(mockCollection)(req)
 	handler := http.HandlerFunc(GetUsers)
 	handler.ServeHTTP(rr, req)
 
@@ -426,6 +537,7 @@ func TestUpdateUser_UserNotFound(t *testing.T) {
 	rr := httptest.NewRecorder()
 
 	req = mux.SetURLVars(req, map[string]string{"id": userID.Hex()})
+	req = req.WithContext(middleware.WithUserID(req.Context(), userID.Hex()))
 	handler := http.HandlerFunc(UpdateUser)
 	handler.ServeHTTP(rr, req)
 
@@ -446,6 +558,7 @@ func TestGetUser_UserNotFound(t *testing.T) {
 	rr := httptest.NewRecorder()
 
 	req = mux.SetURLVars(req, map[string]string{"id": userID.Hex()})
+	req = as(userID.Hex())(req)
 	handler := http.HandlerFunc(GetUser)
 	handler.ServeHTTP(rr, req)
 
@@ -528,3 +641,433 @@ func TestGetUser_UserNotFound(t *testing.T) {
 //     assert.Equal(t, http.StatusInternalServerError, rr.Code)
 //     assert.Contains(t, rr.Body.String(), "some internal error")
 // }
+
+type ctxKey struct{}
+
+func TestCreateUser_UsesRequestContextWithDeadline(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+
+	mockCollection.On("InsertOne", mock.MatchedBy(func(ctx context.Context) bool {
+		_, hasDeadline := ctx.Deadline()
+		return hasDeadline && ctx.Value(ctxKey{}) == "request"
+	}), mock.Anything).Return(&mongo.InsertOneResult{}, nil)
+
+	body, _ := json.Marshal(models.User{Name: "John Doe"})
+	req, _ := http.NewRequest("POST", "/users", bytes.NewBuffer(body))
+	req = req.WithContext(context.WithValue(req.Context(), ctxKey{}, "request"))
+	rr := httptest.NewRecorder()
+
+	http.HandlerFunc(CreateUser).ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	mockCollection.AssertExpectations(t)
+}
+
+func TestGetUser_DeadlineExceeded(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+
+	userID := primitive.NewObjectID()
+	mockResult := new(MockSingleResult)
+	mockResult.On("Decode", mock.Anything).Return(context.DeadlineExceeded)
+	mockCollection.On("FindOne", mock.Anything, mock.Anything).Return(mockResult)
+
+	req, _ := http.NewRequest("GET", "/users/"+userID.Hex(), nil)
+	req = mux.SetURLVars(req, map[string]string{"id": userID.Hex()})
+	rr := httptest.NewRecorder()
+
+	req = as(userID.Hex())(req)
+	http.HandlerFunc(GetUser).ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusGatewayTimeout, rr.Code)
+	assert.Contains(t, rr.Body.String(), "timed out")
+}
+
+func TestDeleteUser_Canceled(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+
+	userID := primitive.NewObjectID()
+	mockCollection.On("DeleteOne", mock.Anything, mock.Anything).Return(nil, fmt.Errorf("delete: %w", context.Canceled))
+
+	req, _ := http.NewRequest("DELETE", "/users/"+userID.Hex(), nil)
+	req = mux.SetURLVars(req, map[string]string{"id": userID.Hex()})
+	req = req.WithContext(middleware.WithUserID(req.Context(), userID.Hex()))
+	rr := httptest.NewRecorder()
+
+	http.HandlerFunc(DeleteUser).ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+}
+
+func TestGetUsers_Success(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+
+	docs := []interface{}{
+		models.User{ID: primitive.NewObjectID(), Name: "John Doe"},
+		models.User{ID: primitive.NewObjectID(), Name: "Jane Doe"},
+	}
+	cursor, _ := mongo.NewCursorFromDocuments(docs, nil, nil)
+	mockCollection.On("Find", mock.Anything, mock.Anything).Return(cursor, nil)
+
+	req, _ := http.NewRequest("GET", "/users", nil)
+	rr := httptest.NewRecorder()
+
+	req = asAdmin(mockCollection)(req)
+	http.HandlerFunc(GetUsers).ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), "John Doe")
+	assert.Contains(t, rr.Body.String(), "Jane Doe")
+}
+
+func TestGetUsers_ClientGone(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+
+	docs := []interface{}{models.User{ID: primitive.NewObjectID(), Name: "John Doe"}}
+	cursor, _ := mongo.NewCursorFromDocuments(docs, nil, nil)
+	mockCollection.On("Find", mock.Anything, mock.Anything).Return(cursor, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", "/users", nil)
+	rr := httptest.NewRecorder()
+
+	req = asAdmin(mockCollection)(req)
+	http.HandlerFunc(GetUsers).ServeHTTP(rr, req)
+
+	assert.Empty(t, rr.Body.String())
+}
+
+func TestSetOperationTimeout(t *testing.T) {
+	original := operationTimeout
+	defer func() { operationTimeout = original }()
+
+	SetOperationTimeout(2 * time.Second)
+	assert.Equal(t, 2*time.Second, operationTimeout)
+
+	SetOperationTimeout(0)
+	assert.Equal(t, 2*time.Second, operationTimeout)
+}
+
+func TestCreateUser_BodyTooLarge(t *testing.T) {
+	req, _ := http.NewRequest("POST", "/users", bytes.NewBufferString(`{"name":"John Doe"}`))
+	rr := httptest.NewRecorder()
+	req.Body = http.MaxBytesReader(rr, req.Body, 4)
+
+	http.HandlerFunc(CreateUser).ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rr.Code)
+}
+
+func TestGetUsers_Paginated(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+
+	after := primitive.NewObjectID()
+	first, second, third := primitive.NewObjectID(), primitive.NewObjectID(), primitive.NewObjectID()
+	docs := []interface{}{
+		models.User{ID: first, Name: "John Doe"},
+		models.User{ID: second, Name: "Jane Doe"},
+		models.User{ID: third, Name: "Jim Doe"},
+	}
+	cursor, _ := mongo.NewCursorFromDocuments(docs, nil, nil)
+	mockCollection.On("Find", mock.Anything, bson.M{"_id": bson.M{"$gt": after}}).Return(cursor, nil)
+
+	req, _ := http.NewRequest("GET", "/users?limit=2&cursor="+after.Hex(), nil)
+	rr := httptest.NewRecorder()
+
+	req = asAdmin(mockCollection)(req)
+	http.HandlerFunc(GetUsers).ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var users []models.User
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &users))
+	assert.Len(t, users, 2)
+	assert.NotContains(t, rr.Body.String(), "Jim Doe")
+	assert.Equal(t, second.Hex(), rr.Header().Get("X-Next-Cursor"))
+	assert.Equal(t, "</users?cursor="+second.Hex()+`&limit=2>; rel="next"`, rr.Header().Get("Link"))
+	mockCollection.AssertExpectations(t)
+}
+
+func TestGetUsers_LastPage(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+
+	docs := []interface{}{models.User{ID: primitive.NewObjectID(), Name: "John Doe"}}
+	cursor, _ := mongo.NewCursorFromDocuments(docs, nil, nil)
+	mockCollection.On("Find", mock.Anything, mock.Anything).Return(cursor, nil)
+
+	req, _ := http.NewRequest("GET", "/users?limit=2", nil)
+	rr := httptest.NewRecorder()
+
+	req = asAdmin(mockCollection)(req)
+	http.HandlerFunc(GetUsers).ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Empty(t, rr.Header().Get("Link"))
+	assert.Empty(t, rr.Header().Get("X-Next-Cursor"))
+}
+
+func TestGetUsers_InvalidPagination(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+
+	for _, query := range []string{"limit=0", "limit=101", "limit=abc", "cursor=nope"} {
+		req, _ := http.NewRequest("GET", "/users?"+query, nil)
+		rr := httptest.NewRecorder()
+
+		req = asAdmin(mockCollection)(req)
+		http.HandlerFunc(GetUsers).ServeHTTP(rr, req)
+
+		assert.Equal(t, http.StatusBadRequest, rr.Code, query)
+	}
+	mockCollection.AssertNotCalled(t, "Find", mock.Anything, mock.Anything)
+}
+
+func TestGetUsers_Filter(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+
+	after := primitive.NewObjectID()
+	mockCollection.On("Find", mock.Anything, mock.MatchedBy(func(filter bson.M) bool {
+		conditions, ok := filter["$and"].(bson.A)
+		if !ok || len(conditions) != 2 {
+			return false
+		}
+		// The cursor and the filter are combined so neither can override the other
+		expr := conditions[1].(bson.M)["$and"].(bson.A)
+		email := expr[0].(bson.M)["email"].(primitive.Regex)
+		_, created := expr[1].(bson.M)["_id"].(bson.M)["$gte"]
+		return conditions[0].(bson.M)["_id"].(bson.M)["$gt"] == after && email.Pattern == `@acme\.com$` && created
+	})).Return(usersCursor(models.User{ID: primitive.NewObjectID(), Name: "John Doe"}), nil)
+
+	query := url.Values{"cursor": {after.Hex()}, "filter": {`email ew "@acme.com" and created_at gt "2026-01-01"`}}
+	req, _ := http.NewRequest("GET", "/users?"+query.Encode(), nil)
+	rr := httptest.NewRecorder()
+
+	req = asAdmin(mockCollection)(req)
+	http.HandlerFunc(GetUsers).ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), "John Doe")
+	mockCollection.AssertExpectations(t)
+}
+
+func TestGetUsers_InvalidFilter(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+
+	for filter, message := range map[string]string{
+		`name eq`:             "Invalid filter: expected value, got end of filter at position 7",
+		`password sw "a"`:     `Invalid filter: unknown attribute \"password\"`,
+		`email eq {"$ne": 1}`: `Invalid filter: unexpected character '{' at position 9`,
+	} {
+		req, _ := http.NewRequest("GET", "/users?filter="+url.QueryEscape(filter), nil)
+		rr := httptest.NewRecorder()
+
+		req = asAdmin(mockCollection)(req)
+		http.HandlerFunc(GetUsers).ServeHTTP(rr, req)
+
+		assert.Equal(t, http.StatusBadRequest, rr.Code, filter)
+		assert.Contains(t, rr.Body.String(), message, filter)
+	}
+	mockCollection.AssertNotCalled(t, "Find", mock.Anything, mock.Anything)
+}
+
+func TestCreateUser_HashesPassword(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	var inserted models.User
+	mockCollection.On("InsertOne", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		inserted = args.Get(1).(models.User)
+	}).Return(&mongo.InsertOneResult{}, nil)
+
+	rr := serve(CreateUser, "POST", "/v1/users", `{"name": "John Doe", "password": "correct horse"}`)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.True(t, checkPassword(inserted.Password, "correct horse"))
+	assert.NotContains(t, rr.Body.String(), "password")
+}
+
+func TestCreateUser_NormalizesEmail(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	var inserted models.User
+	mockCollection.On("InsertOne", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		inserted = args.Get(1).(models.User)
+	}).Return(&mongo.InsertOneResult{}, nil)
+
+	rr := serve(CreateUser, "POST", "/v1/users", `{"name": "John Doe", "email": "John.Doe@Example.com"}`)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "john.doe@example.com", inserted.Email)
+}
+
+func TestCreateUser_EmailInUse(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	duplicate := mongo.WriteException{WriteErrors: mongo.WriteErrors{{Code: 11000, Message: "E11000 duplicate key error"}}}
+	mockCollection.On("InsertOne", mock.Anything, mock.Anything).Return(nil, duplicate)
+
+	rr := serve(CreateUser, "POST", "/v1/users", `{"name": "John Doe", "email": "john@example.com"}`)
+
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	assert.JSONEq(t, `{"error": "Email is already in use"}`, rr.Body.String())
+}
+
+func TestUpdateUser_EmailInUse(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	id := primitive.NewObjectID()
+	duplicate := mongo.WriteException{WriteErrors: mongo.WriteErrors{{Code: 11000, Message: "E11000 duplicate key error"}}}
+	mockCollection.On("UpdateOne", mock.Anything, bson.M{"_id": id, "email": bson.M{"$ne": "jane@example.com"}}, mock.Anything).Return(nil, duplicate)
+
+	rr := serve(UpdateUser, "PUT", "/v1/users/"+id.Hex(), `{"email": "Jane@Example.com"}`, withVars("id", id.Hex()), as(id.Hex()))
+
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	assert.JSONEq(t, `{"error": "Email is already in use"}`, rr.Body.String())
+}
+
+func TestCreateUser_WeakPassword(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+
+	rr := serve(CreateUser, "POST", "/v1/users", `{"name": "John Doe", "password": "short"}`)
+
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.JSONEq(t, `{"error": "Password must be at least 8 characters"}`, rr.Body.String())
+	mockCollection.AssertNotCalled(t, "InsertOne", mock.Anything, mock.Anything)
+}
+
+func TestUpdateUser_WeakPassword(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	id := primitive.NewObjectID()
+
+	rr := serve(UpdateUser, "PUT", "/v1/users/"+id.Hex(), `{"name": "John Doe", "password": "john doe"}`, withVars("id", id.Hex()), as(id.Hex()))
+
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.JSONEq(t, `{"error": "Password must not be your name or email"}`, rr.Body.String())
+	mockCollection.AssertNotCalled(t, "UpdateOne", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestUpdateUser_PasswordForgetsSessions(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	defer setupSessionCache(time.Minute)()
+	id := primitive.NewObjectID()
+	validSessions.add("session-1", id.Hex(), time.Now())
+	mockCollection.On("UpdateOne", mock.Anything, bson.M{"_id": id}, mock.Anything).Return(&mongo.UpdateResult{MatchedCount: 1}, nil)
+
+	rr := serve(UpdateUser, "PUT", "/v1/users/"+id.Hex(), `{"password": "correct horse"}`, withVars("id", id.Hex()), as(id.Hex()))
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.False(t, validSessions.valid("session-1", id.Hex(), time.Now()))
+}
+
+func TestUpdateUser_ByAdmin(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	id, adminID := primitive.NewObjectID(), primitive.NewObjectID()
+	findUser(mockCollection, adminID, models.User{ID: adminID, Admin: true}, nil)
+	mockCollection.On("UpdateOne", mock.Anything, bson.M{"_id": id}, mock.Anything).Return(&mongo.UpdateResult{MatchedCount: 1}, nil)
+
+	rr := serve(UpdateUser, "PUT", "/v1/users/"+id.Hex(), `{"name": "John Doe"}`, withVars("id", id.Hex()), as(adminID.Hex()))
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+}
+
+func TestUserRoutes_Anonymous(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+
+	id := primitive.NewObjectID().Hex()
+	for _, tc := range []struct {
+		handler http.HandlerFunc
+		target  string
+	}{
+		{GetUsers, "/v1/users"},
+		{GetUser, "/v1/users/" + id},
+		{ExportUsers, "/v1/users/export"},
+		{SearchUsers, "/v1/users/search?q=john"},
+	} {
+		rr := serve(tc.handler, "GET", tc.target, "", withVars("id", id))
+
+		assert.Equal(t, http.StatusUnauthorized, rr.Code, tc.target)
+		assert.JSONEq(t, `{"error": "Authentication required"}`, rr.Body.String())
+		assert.Equal(t, "Bearer", rr.Header().Get("WWW-Authenticate"))
+	}
+	assert.Empty(t, mockCollection.Calls)
+}
+
+func TestUserRoutes_NotAdmin(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	callerID := primitive.NewObjectID()
+	findUser(mockCollection, callerID, models.User{ID: callerID, Name: "John Doe"}, nil)
+
+	// Listing, exporting and searching the directory are for admins, and
+	// other users can only be read by them
+	id := primitive.NewObjectID().Hex()
+	for _, tc := range []struct {
+		handler http.HandlerFunc
+		target  string
+	}{
+		{GetUsers, "/v1/users"},
+		{GetUser, "/v1/users/" + id},
+		{ExportUsers, "/v1/users/export"},
+		{SearchUsers, "/v1/users/search?q=john"},
+	} {
+		rr := serve(tc.handler, "GET", tc.target, "", withVars("id", id), as(callerID.Hex()))
+
+		assert.Equal(t, http.StatusForbidden, rr.Code, tc.target)
+		assert.JSONEq(t, `{"error": "Admin access required"}`, rr.Body.String())
+	}
+	mockCollection.AssertNotCalled(t, "Find", mock.Anything, mock.Anything)
+}
+
+func TestGetUser_ByAdmin(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	id := primitive.NewObjectID()
+	findUser(mockCollection, id, models.User{ID: id, Name: "Jane Doe"}, nil)
+
+	rr := serve(GetUser, "GET", "/v1/users/"+id.Hex(), "", withVars("id", id.Hex()), asAdmin(mockCollection))
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"name":"Jane Doe"`)
+}
+
+func TestUpdateAndDeleteUser_Forbidden(t *testing.T) {
+	id, callerID := primitive.NewObjectID(), primitive.NewObjectID()
+	for _, tc := range []struct {
+		name     string
+		handler  http.HandlerFunc
+		method   string
+		callerID string
+		status   int
+		error    string
+	}{
+		{"update anonymously", UpdateUser, "PUT", "", http.StatusUnauthorized, "Authentication required"},
+		{"update another user", UpdateUser, "PUT", callerID.Hex(), http.StatusForbidden, "Admin access required"},
+		{"delete anonymously", DeleteUser, "DELETE", "", http.StatusUnauthorized, "Authentication required"},
+		{"delete another user", DeleteUser, "DELETE", callerID.Hex(), http.StatusForbidden, "Admin access required"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mockCollection := new(MockCollection)
+			defer SetupMockCollection(mockCollection)()
+			findUser(mockCollection, callerID, models.User{ID: callerID}, nil)
+
+			rr := serve(tc.handler, tc.method, "/v1/users/"+id.Hex(), `{"password": "correct horse"}`, withVars("id", id.Hex()), as(tc.callerID))
+
+			assert.Equal(t, tc.status, rr.Code)
+			assert.JSONEq(t, `{"error": "`+tc.error+`"}`, rr.Body.String())
+			mockCollection.AssertNotCalled(t, "UpdateOne", mock.Anything, mock.Anything, mock.Anything)
+			mockCollection.AssertNotCalled(t, "DeleteOne", mock.Anything, mock.Anything)
+		})
+	}
+}
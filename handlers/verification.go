@@ -0,0 +1,246 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lep13/golang-restful-api/mailer"
+	"github.com/lep13/golang-restful-api/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// mailTimeout bounds the delivery of one email
+const mailTimeout = 10 * time.Second
+
+var (
+	mailSender mailer.Mailer = &mailer.Log{From: "no-reply@localhost"}
+
+	verificationTTL            = 24 * time.Hour
+	verificationResendInterval = time.Minute
+	verificationURL            string
+)
+
+// normalizeEmail returns an email as it is stored and looked up. The unique
+// index over emails is case sensitive, so they are kept in lower case.
+func normalizeEmail(email string) string {
+	return strings.ToLower(email)
+}
+
+// SetMailer sets the mailer used to send email to users
+func SetMailer(m mailer.Mailer) {
+	if m != nil {
+		mailSender = m
+	}
+}
+
+// SetEmailVerification sets how long verification tokens are valid, the least
+// time between two verification emails to a user, and the client page that
+// completes verification, which may be empty
+func SetEmailVerification(ttl, resendInterval time.Duration, pageURL string) {
+	if ttl > 0 {
+		verificationTTL = ttl
+	}
+	if resendInterval > 0 {
+		verificationResendInterval = resendInterval
+	}
+	verificationURL = pageURL
+}
+
+// newEmailVerification starts the verification of an email address, returning
+// the state to store with the user and the token to send them
+func newEmailVerification(now time.Time) (*models.EmailVerification, string, error) {
+	token, hash, err := newToken()
+	if err != nil {
+		return nil, "", err
+	}
+	return &models.EmailVerification{TokenHash: hash, ExpiresAt: now.Add(verificationTTL), SentAt: now}, token, nil
+}
+
+// sendVerificationEmail mails the verification token to the user. It outlives
+// the request, so a client hanging up does not interrupt delivery.
+func sendVerificationEmail(ctx context.Context, user models.User, token string) error {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), mailTimeout)
+	defer cancel()
+
+	action := fmt.Sprintf("send this token to POST /v1/users/%s/verify-email:\n\n%s", user.ID.Hex(), token)
+	if link, err := url.Parse(verificationURL); err == nil && verificationURL != "" {
+		query := link.Query()
+		query.Set("user", user.ID.Hex())
+		query.Set("token", token)
+		link.RawQuery = query.Encode()
+		action = "open this link:\n\n" + link.String()
+	}
+	expires := user.EmailVerification.ExpiresAt.UTC().Format(time.RFC1123)
+	err := mailSender.Send(ctx, mailer.Message{
+		To:      user.Email,
+		Subject: "Verify your email address",
+		Body: fmt.Sprintf("Hello %s,\n\nTo confirm that %s is your email address, %s\n\n"+
+			"This expires on %s. If you did not sign up, you can ignore this email.\n", user.Name, user.Email, action, expires),
+	})
+	if err != nil {
+		log.Printf("Failed to send verification email to user %s: %v", user.ID.Hex(), err)
+	}
+	return err
+}
+
+// changeEmail sets the fields of a user when the update changes their email
+// address, resetting its verification and mailing a token to the new address.
+// It reports false, writing nothing, when the user does not exist or already
+// has that address.
+func changeEmail(ctx context.Context, id primitive.ObjectID, user models.User) (bool, error) {
+	verification, token, err := newEmailVerification(time.Now())
+	if err != nil {
+		return false, err
+	}
+	user.EmailVerification = verification
+	// Matching on the old address makes the check and the write one atomic step
+	res, err := mongoCollection.UpdateOne(ctx,
+		bson.M{"_id": id, "email": bson.M{"$ne": user.Email}},
+		userUpdate(user, bson.M{"email_verified": ""}))
+	if err != nil || res.MatchedCount == 0 {
+		return false, err
+	}
+	user.ID = id
+	sendVerificationEmail(ctx, user, token)
+	return true, nil
+}
+
+// VerifyEmail marks the email of a user as verified when given the token sent
+// to it. Tokens are single use: consuming one removes it.
+func VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, "Invalid ID format", http.StatusBadRequest)
+		return
+	}
+	var body struct {
+		Token string `json:"token"`
+	}
+	if !decodeBody(w, r, &body) {
+		return
+	}
+	if body.Token == "" {
+		writeError(w, "Token is required", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := dbContext(r)
+	defer cancel()
+	res, err := mongoCollection.UpdateOne(ctx,
+		bson.M{
+			"_id":                           id,
+			"email_verification.token_hash": hashToken(body.Token),
+			"email_verification.expires_at": bson.M{"$gt": time.Now()},
+		},
+		bson.M{"$set": bson.M{"email_verified": true}, "$unset": bson.M{"email_verification": ""}})
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if res.MatchedCount == 0 {
+		// Tell a missing user and a verified email apart from a bad token
+		var user models.User
+		err := mongoCollection.FindOne(ctx, bson.M{"_id": id}).Decode(&user)
+		switch {
+		case err == mongo.ErrNoDocuments:
+			writeError(w, "User not found", http.StatusNotFound)
+		case err != nil:
+			writeDBError(w, err)
+		case user.EmailVerified:
+			writeError(w, "Email is already verified", http.StatusConflict)
+		default:
+			writeError(w, "Invalid or expired verification token", http.StatusBadRequest)
+		}
+		return
+	}
+	if err := json.NewEncoder(w).Encode(map[string]string{"message": "Email verified"}); err != nil {
+		writeError(w, "Failed to encode response", http.StatusInternalServerError)
+	}
+}
+
+// ResendVerificationEmail sends a new verification token to a user whose email
+// is not verified yet, replacing the previous token. Requests within the
+// resend interval of the last email are rejected with 429.
+func ResendVerificationEmail(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, "Invalid ID format", http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := dbContext(r)
+	defer cancel()
+	var user models.User
+	if err := mongoCollection.FindOne(ctx, bson.M{"_id": id}).Decode(&user); err != nil {
+		if err == mongo.ErrNoDocuments {
+			writeError(w, "User not found", http.StatusNotFound)
+		} else {
+			writeDBError(w, err)
+		}
+		return
+	}
+	switch {
+	case user.EmailVerified:
+		writeError(w, "Email is already verified", http.StatusConflict)
+		return
+	case user.Email == "":
+		writeError(w, "User has no email", http.StatusConflict)
+		return
+	}
+
+	now := time.Now()
+	previous := bson.M{"email_verification": bson.M{"$exists": false}}
+	if user.EmailVerification != nil {
+		if wait := user.EmailVerification.SentAt.Add(verificationResendInterval).Sub(now); wait > 0 {
+			writeResendThrottled(w, wait)
+			return
+		}
+		previous = bson.M{"email_verification.token_hash": user.EmailVerification.TokenHash}
+	}
+	verification, token, err := newEmailVerification(now)
+	if err != nil {
+		writeError(w, "Failed to create verification token", http.StatusInternalServerError)
+		return
+	}
+	// Replacing only the token that was read lets one of concurrent resends win
+	filter := bson.M{"_id": id, "email": user.Email, "email_verified": bson.M{"$ne": true}}
+	for key, value := range previous {
+		filter[key] = value
+	}
+	res, err := mongoCollection.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"email_verification": verification}})
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if res.MatchedCount == 0 {
+		writeResendThrottled(w, verificationResendInterval)
+		return
+	}
+
+	user.EmailVerification = verification
+	if err := sendVerificationEmail(r.Context(), user, token); err != nil {
+		writeError(w, "Failed to send verification email", http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(w).Encode(map[string]string{"message": "Verification email sent"}); err != nil {
+		log.Println("Error encoding JSON response:", err)
+	}
+}
+
+func writeResendThrottled(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	writeError(w, "Verification email sent too recently", http.StatusTooManyRequests)
+}
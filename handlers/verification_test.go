@@ -0,0 +1,305 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lep13/golang-restful-api/mailer"
+	"github.com/lep13/golang-restful-api/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// recordingMailer keeps the messages it is asked to send
+type recordingMailer struct {
+	mu       sync.Mutex
+	messages []mailer.Message
+	err      error
+}
+
+func (m *recordingMailer) Send(ctx context.Context, msg mailer.Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.messages = append(m.messages, msg)
+	return m.err
+}
+
+func (m *recordingMailer) sent() []mailer.Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]mailer.Message(nil), m.messages...)
+}
+
+func setupMailer(m mailer.Mailer) func() {
+	original := mailSender
+	mailSender = m
+	return func() { mailSender = original }
+}
+
+var tokenPattern = regexp.MustCompile(`[A-Za-z0-9_-]{43}`)
+
+// findUser makes FindOne return user, or err when it is set
+func findUser(mockCollection *MockCollection, id primitive.ObjectID, user models.User, err error) {
+	result := new(MockSingleResult)
+	result.On("Decode", mock.AnythingOfType("*models.User")).Run(func(args mock.Arguments) {
+		*args.Get(0).(*models.User) = user
+	}).Return(err)
+	mockCollection.On("FindOne", mock.Anything, bson.M{"_id": id}).Return(result)
+}
+
+func TestCreateUser_SendsVerificationEmail(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	sender := new(recordingMailer)
+	defer setupMailer(sender)()
+	var inserted models.User
+	mockCollection.On("InsertOne", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		inserted = args.Get(1).(models.User)
+	}).Return(&mongo.InsertOneResult{}, nil)
+
+	// Clients cannot verify their own email
+	rr := serve(CreateUser, "POST", "/v1/users", `{"name": "John", "email": "john@example.com", "email_verified": true}`)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.NotContains(t, rr.Body.String(), "email_verified")
+	assert.NotContains(t, rr.Body.String(), "verification")
+	assert.False(t, inserted.EmailVerified)
+	require.NotNil(t, inserted.EmailVerification)
+	assert.WithinDuration(t, time.Now().Add(24*time.Hour), inserted.EmailVerification.ExpiresAt, time.Minute)
+
+	messages := sender.sent()
+	require.Len(t, messages, 1)
+	assert.Equal(t, "john@example.com", messages[0].To)
+	assert.Contains(t, messages[0].Body, "POST /v1/users/"+inserted.ID.Hex()+"/verify-email")
+	token := tokenPattern.FindString(messages[0].Body)
+	assert.Equal(t, hashToken(token), inserted.EmailVerification.TokenHash)
+}
+
+func TestCreateUser_VerificationLink(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	sender := new(recordingMailer)
+	defer setupMailer(sender)()
+	defer func(original string) { verificationURL = original }(verificationURL)
+	verificationURL = "https://app.example.com/verify?lang=en"
+	mockCollection.On("InsertOne", mock.Anything, mock.Anything).Return(&mongo.InsertOneResult{}, nil)
+
+	serve(CreateUser, "POST", "/v1/users", `{"email": "john@example.com"}`)
+
+	messages := sender.sent()
+	require.Len(t, messages, 1)
+	link, err := url.Parse(regexp.MustCompile(`https://\S+`).FindString(messages[0].Body))
+	require.NoError(t, err)
+	assert.Equal(t, "app.example.com", link.Host)
+	assert.Equal(t, "en", link.Query().Get("lang"))
+	assert.Len(t, link.Query().Get("user"), 24)
+	assert.Len(t, link.Query().Get("token"), 43)
+}
+
+func TestCreateUser_MailFailureStillCreates(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	defer setupMailer(&recordingMailer{err: errors.New("connection refused")})()
+	mockCollection.On("InsertOne", mock.Anything, mock.Anything).Return(&mongo.InsertOneResult{}, nil)
+
+	rr := serve(CreateUser, "POST", "/v1/users", `{"email": "john@example.com"}`)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+}
+
+func TestUpdateUser_EmailChange(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	sender := new(recordingMailer)
+	defer setupMailer(sender)()
+	id := primitive.NewObjectID()
+	mockCollection.On("UpdateOne", mock.Anything, bson.M{"_id": id, "email": bson.M{"$ne": "new@example.com"}}, mock.MatchedBy(func(update bson.M) bool {
+		set := update["$set"].(models.User)
+		return set.EmailVerification != nil && !set.EmailVerified && update["$unset"].(bson.M)["email_verified"] == ""
+	})).Return(&mongo.UpdateResult{MatchedCount: 1}, nil)
+
+	rr := serve(UpdateUser, "PUT", "/v1/users/"+id.Hex(), `{"email": "new@example.com", "email_verified": true}`, withVars("id", id.Hex()), as(id.Hex()))
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	require.Len(t, sender.sent(), 1)
+	assert.Equal(t, "new@example.com", sender.sent()[0].To)
+	mockCollection.AssertNumberOfCalls(t, "UpdateOne", 1)
+}
+
+func TestUpdateUser_SameEmail(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	sender := new(recordingMailer)
+	defer setupMailer(sender)()
+	id := primitive.NewObjectID()
+	user := models.User{Name: "John", Email: "john@example.com"}
+	mockCollection.On("UpdateOne", mock.Anything, bson.M{"_id": id, "email": bson.M{"$ne": "john@example.com"}}, mock.Anything).Return(&mongo.UpdateResult{}, nil)
+	mockCollection.On("UpdateOne", mock.Anything, bson.M{"_id": id}, bson.M{"$set": user}).Return(&mongo.UpdateResult{MatchedCount: 1}, nil)
+
+	rr := serve(UpdateUser, "PUT", "/v1/users/"+id.Hex(), `{"name": "John", "email": "john@example.com"}`, withVars("id", id.Hex()), as(id.Hex()))
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Empty(t, sender.sent())
+	mockCollection.AssertExpectations(t)
+}
+
+func TestVerifyEmail(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	id := primitive.NewObjectID()
+	mockCollection.On("UpdateOne", mock.Anything, mock.MatchedBy(func(filter bson.M) bool {
+		return filter["_id"] == id && filter["email_verification.token_hash"] == hashToken("the-token")
+	}), bson.M{"$set": bson.M{"email_verified": true}, "$unset": bson.M{"email_verification": ""}}).Return(&mongo.UpdateResult{MatchedCount: 1}, nil)
+
+	rr := serve(VerifyEmail, "POST", "/v1/users/"+id.Hex()+"/verify-email", `{"token": "the-token"}`, withVars("id", id.Hex()))
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, `{"message": "Email verified"}`, rr.Body.String())
+	mockCollection.AssertExpectations(t)
+}
+
+func TestVerifyEmail_Rejected(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		user    models.User
+		err     error
+		status  int
+		message string
+	}{
+		{"wrong or expired token", models.User{Email: "john@example.com"}, nil, http.StatusBadRequest, "Invalid or expired verification token"},
+		{"already verified", models.User{Email: "john@example.com", EmailVerified: true}, nil, http.StatusConflict, "Email is already verified"},
+		{"missing user", models.User{}, mongo.ErrNoDocuments, http.StatusNotFound, "User not found"},
+	} {
+		mockCollection := new(MockCollection)
+		restore := SetupMockCollection(mockCollection)
+		id := primitive.NewObjectID()
+		mockCollection.On("UpdateOne", mock.Anything, mock.Anything, mock.Anything).Return(&mongo.UpdateResult{}, nil)
+		findUser(mockCollection, id, tc.user, tc.err)
+
+		rr := serve(VerifyEmail, "POST", "/v1/users/"+id.Hex()+"/verify-email", `{"token": "the-token"}`, withVars("id", id.Hex()))
+
+		assert.Equal(t, tc.status, rr.Code, tc.name)
+		assert.Contains(t, rr.Body.String(), tc.message, tc.name)
+		restore()
+	}
+}
+
+func TestVerifyEmail_InvalidRequest(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	id := primitive.NewObjectID()
+
+	rr := serve(VerifyEmail, "POST", "/v1/users/"+id.Hex()+"/verify-email", `{}`, withVars("id", id.Hex()))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Contains(t, rr.Body.String(), "Token is required")
+
+	req, _ := http.NewRequest("POST", "/v1/users/nope/verify-email", bytes.NewBufferString(`{"token": "x"}`))
+	req = mux.SetURLVars(req, map[string]string{"id": "nope"})
+	rr = httptest.NewRecorder()
+	VerifyEmail(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	mockCollection.AssertNotCalled(t, "UpdateOne", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestResendVerificationEmail(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	sender := new(recordingMailer)
+	defer setupMailer(sender)()
+	id := primitive.NewObjectID()
+	previous := &models.EmailVerification{TokenHash: "old", SentAt: time.Now().Add(-2 * time.Minute)}
+	findUser(mockCollection, id, models.User{ID: id, Email: "john@example.com", EmailVerification: previous}, nil)
+	var stored *models.EmailVerification
+	mockCollection.On("UpdateOne", mock.Anything, bson.M{
+		"_id":                           id,
+		"email":                         "john@example.com",
+		"email_verified":                bson.M{"$ne": true},
+		"email_verification.token_hash": "old",
+	}, mock.Anything).Run(func(args mock.Arguments) {
+		stored = args.Get(2).(bson.M)["$set"].(bson.M)["email_verification"].(*models.EmailVerification)
+	}).Return(&mongo.UpdateResult{MatchedCount: 1}, nil)
+
+	rr := serve(ResendVerificationEmail, "POST", "/v1/users/"+id.Hex()+"/verify-email/resend", "", withVars("id", id.Hex()))
+
+	assert.Equal(t, http.StatusAccepted, rr.Code)
+	messages := sender.sent()
+	require.Len(t, messages, 1)
+	assert.Equal(t, hashToken(tokenPattern.FindString(messages[0].Body)), stored.TokenHash)
+}
+
+func TestResendVerificationEmail_Throttled(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	sender := new(recordingMailer)
+	defer setupMailer(sender)()
+	id := primitive.NewObjectID()
+	recent := &models.EmailVerification{TokenHash: "old", SentAt: time.Now().Add(-20 * time.Second)}
+	findUser(mockCollection, id, models.User{ID: id, Email: "john@example.com", EmailVerification: recent}, nil)
+
+	rr := serve(ResendVerificationEmail, "POST", "/v1/users/"+id.Hex()+"/verify-email/resend", "", withVars("id", id.Hex()))
+
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assert.Equal(t, "40", rr.Header().Get("Retry-After"))
+	assert.Empty(t, sender.sent())
+	mockCollection.AssertNotCalled(t, "UpdateOne", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestResendVerificationEmail_LostRace(t *testing.T) {
+	mockCollection := new(MockCollection)
+	defer SetupMockCollection(mockCollection)()
+	sender := new(recordingMailer)
+	defer setupMailer(sender)()
+	id := primitive.NewObjectID()
+	findUser(mockCollection, id, models.User{ID: id, Email: "john@example.com"}, nil)
+	mockCollection.On("UpdateOne", mock.Anything, mock.MatchedBy(func(filter bson.M) bool {
+		return filter["email_verification"] != nil
+	}), mock.Anything).Return(&mongo.UpdateResult{}, nil)
+
+	rr := serve(ResendVerificationEmail, "POST", "/v1/users/"+id.Hex()+"/verify-email/resend", "", withVars("id", id.Hex()))
+
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assert.Empty(t, sender.sent())
+}
+
+func TestResendVerificationEmail_Rejected(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		user    models.User
+		err     error
+		mailErr error
+		status  int
+		message string
+	}{
+		{"verified", models.User{Email: "john@example.com", EmailVerified: true}, nil, nil, http.StatusConflict, "Email is already verified"},
+		{"no email", models.User{Name: "John"}, nil, nil, http.StatusConflict, "User has no email"},
+		{"missing user", models.User{}, mongo.ErrNoDocuments, nil, http.StatusNotFound, "User not found"},
+		{"mail failure", models.User{Email: "john@example.com"}, nil, errors.New("connection refused"), http.StatusServiceUnavailable, "Failed to send verification email"},
+	} {
+		mockCollection := new(MockCollection)
+		restore := SetupMockCollection(mockCollection)
+		restoreMailer := setupMailer(&recordingMailer{err: tc.mailErr})
+		id := primitive.NewObjectID()
+		findUser(mockCollection, id, tc.user, tc.err)
+		mockCollection.On("UpdateOne", mock.Anything, mock.Anything, mock.Anything).Return(&mongo.UpdateResult{MatchedCount: 1}, nil)
+
+		rr := serve(ResendVerificationEmail, "POST", "/v1/users/"+id.Hex()+"/verify-email/resend", "", withVars("id", id.Hex()))
+
+		assert.Equal(t, tc.status, rr.Code, tc.name)
+		assert.Contains(t, rr.Body.String(), tc.message, tc.name)
+		restoreMailer()
+		restore()
+	}
+}
@@ -0,0 +1,128 @@
+// Package jwt signs and verifies JSON Web Tokens (RFC 7519) in the compact
+// serialization. Only HS256 and RS256 are supported; tokens with any other
+// algorithm, including "none", are rejected.
+package jwt
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrInvalid is returned for tokens that are malformed or whose signature
+	// does not verify
+	ErrInvalid = errors.New("invalid token")
+	// ErrExpired is returned for tokens past their expiry
+	ErrExpired = errors.New("token expired")
+)
+
+// header is the only header issued and accepted
+var header = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// Claims are the registered claims used by the API. Embed it in a struct to
+// add claims of your own.
+type Claims struct {
+	ID        string   `json:"jti,omitempty"`
+	Issuer    string   `json:"iss,omitempty"`
+	Subject   string   `json:"sub,omitempty"`
+	Audience  Audience `json:"aud,omitempty"`
+	IssuedAt  int64    `json:"iat,omitempty"`
+	ExpiresAt int64    `json:"exp,omitempty"`
+}
+
+// Audience lists the recipients of a token. It is written as a string when
+// there is one, and read from either form.
+type Audience []string
+
+// MarshalJSON writes a single audience as a string
+func (a Audience) MarshalJSON() ([]byte, error) {
+	if len(a) == 1 {
+		return json.Marshal(a[0])
+	}
+	return json.Marshal([]string(a))
+}
+
+// UnmarshalJSON reads a string or an array of strings
+func (a *Audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = Audience{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*a = list
+	return nil
+}
+
+// Contains reports whether audience is one of the recipients
+func (a Audience) Contains(audience string) bool {
+	for _, candidate := range a {
+		if candidate == audience {
+			return true
+		}
+	}
+	return false
+}
+
+// Valid reports ErrExpired when the claims are past their expiry at now
+func (c Claims) Valid(now time.Time) error {
+	if c.ExpiresAt != 0 && now.Unix() >= c.ExpiresAt {
+		return ErrExpired
+	}
+	return nil
+}
+
+// HS256 signs tokens with HMAC-SHA256
+type HS256 struct {
+	key []byte
+}
+
+// NewHS256 returns a signer using key, which should be at least 32 random bytes
+func NewHS256(key []byte) *HS256 {
+	return &HS256{key: key}
+}
+
+// Sign returns a token carrying claims, which must marshal to a JSON object
+func (s *HS256) Sign(claims interface{}) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := header + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(s.sign(signed)), nil
+}
+
+// Verify checks the signature of a token and decodes its claims into claims.
+// It does not check the expiry; call Claims.Valid for that.
+func (s *HS256) Verify(token string, claims interface{}) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != header {
+		return ErrInvalid
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(signature, s.sign(parts[0]+"."+parts[1])) {
+		return ErrInvalid
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return ErrInvalid
+	}
+	if err := json.Unmarshal(payload, claims); err != nil {
+		return ErrInvalid
+	}
+	return nil
+}
+
+func (s *HS256) sign(signed string) []byte {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(signed))
+	return mac.Sum(nil)
+}
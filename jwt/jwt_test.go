@@ -0,0 +1,56 @@
+package jwt
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testClaims struct {
+	Claims
+	Purpose string `json:"purpose"`
+}
+
+var signer = NewHS256([]byte("0123456789abcdef0123456789abcdef"))
+
+func TestHS256_RoundTrip(t *testing.T) {
+	token, err := signer.Sign(testClaims{Claims: Claims{Subject: "john", ExpiresAt: 2000000000}, Purpose: "access"})
+	require.NoError(t, err)
+	assert.Len(t, strings.Split(token, "."), 3)
+
+	var claims testClaims
+	require.NoError(t, signer.Verify(token, &claims))
+	assert.Equal(t, testClaims{Claims: Claims{Subject: "john", ExpiresAt: 2000000000}, Purpose: "access"}, claims)
+}
+
+func TestHS256_Rejects(t *testing.T) {
+	token, _ := signer.Sign(Claims{Subject: "john"})
+	parts := strings.Split(token, ".")
+	forged := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"admin"}`))
+	none := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","typ":"JWT"}`))
+
+	for name, candidate := range map[string]string{
+		"other key":        func() string { t, _ := NewHS256([]byte("another key")).Sign(Claims{Subject: "john"}); return t }(),
+		"changed payload":  parts[0] + "." + forged + "." + parts[2],
+		"alg none":         none + "." + parts[1] + ".",
+		"missing part":     parts[0] + "." + parts[1],
+		"bad signature":    parts[0] + "." + parts[1] + ".!!",
+		"empty":            "",
+		"payload not JSON": func() string { t, _ := signer.Sign("text"); return t }(),
+	} {
+		var claims Claims
+		assert.ErrorIs(t, signer.Verify(candidate, &claims), ErrInvalid, name)
+	}
+}
+
+func TestClaims_Valid(t *testing.T) {
+	now := time.Unix(1000, 0)
+
+	assert.NoError(t, Claims{ExpiresAt: 1001}.Valid(now))
+	assert.NoError(t, Claims{}.Valid(now))
+	assert.ErrorIs(t, Claims{ExpiresAt: 1000}.Valid(now), ErrExpired)
+}
@@ -0,0 +1,155 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strings"
+)
+
+// RS256 signs tokens with RSASSA-PKCS1-v1_5 and SHA-256, for tokens verified
+// by others with the public key, such as OpenID Connect ID tokens
+type RS256 struct {
+	key    *rsa.PrivateKey
+	jwk    JWK
+	header string
+}
+
+// NewRS256 returns a signer using key, which should have at least 2048 bits.
+// Its tokens name the key by its JWK thumbprint.
+func NewRS256(key *rsa.PrivateKey) *RS256 {
+	jwk := PublicJWK(&key.PublicKey)
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": jwk.KeyID, "typ": "JWT"})
+	return &RS256{key: key, jwk: jwk, header: base64.RawURLEncoding.EncodeToString(header)}
+}
+
+// JWK returns the public key verifying the tokens of the signer
+func (s *RS256) JWK() JWK {
+	return s.jwk
+}
+
+// Sign returns a token carrying claims, which must marshal to a JSON object
+func (s *RS256) Sign(claims interface{}) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := s.header + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// Verify checks a token signed by the signer; see VerifyRS256
+func (s *RS256) Verify(token string, claims interface{}) error {
+	return VerifyRS256(token, &s.key.PublicKey, claims)
+}
+
+// VerifyRS256 checks the RS256 signature of a token with key and decodes its
+// claims into claims. It does not check the expiry; call Claims.Valid for
+// that.
+func VerifyRS256(token string, key *rsa.PublicKey, claims interface{}) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ErrInvalid
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodePart(parts[0], &header); err != nil || header.Alg != "RS256" {
+		return ErrInvalid
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return ErrInvalid
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+		return ErrInvalid
+	}
+	if err := decodePart(parts[1], claims); err != nil {
+		return ErrInvalid
+	}
+	return nil
+}
+
+func decodePart(part string, v interface{}) error {
+	raw, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, v)
+}
+
+// JWK is an RSA public key as a JSON Web Key (RFC 7517)
+type JWK struct {
+	KeyType   string `json:"kty"`
+	Use       string `json:"use,omitempty"`
+	Algorithm string `json:"alg,omitempty"`
+	KeyID     string `json:"kid,omitempty"`
+	N         string `json:"n"`
+	E         string `json:"e"`
+}
+
+// PublicJWK returns key as a JWK for RS256 signatures, identified by its
+// thumbprint (RFC 7638)
+func PublicJWK(key *rsa.PublicKey) JWK {
+	jwk := JWK{
+		KeyType:   "RSA",
+		Use:       "sig",
+		Algorithm: "RS256",
+		N:         base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		E:         base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+	// The thumbprint hashes the required members in lexicographic order
+	thumbprint := sha256.Sum256([]byte(`{"e":"` + jwk.E + `","kty":"RSA","n":"` + jwk.N + `"}`))
+	jwk.KeyID = base64.RawURLEncoding.EncodeToString(thumbprint[:])
+	return jwk
+}
+
+// PublicKey returns the RSA public key of the JWK
+func (k JWK) PublicKey() (*rsa.PublicKey, error) {
+	if k.KeyType != "RSA" {
+		return nil, errors.New("jwt: not an RSA key")
+	}
+	n, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil {
+		return nil, errors.New("jwt: invalid modulus")
+	}
+	e, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil || len(e) == 0 || len(e) > 4 {
+		return nil, errors.New("jwt: invalid exponent")
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+}
+
+// Header is the JOSE header of a token
+type Header struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid,omitempty"`
+	Type      string `json:"typ,omitempty"`
+}
+
+// ParseHeader decodes the header of a token without verifying it, to pick
+// the key verifying the token
+func ParseHeader(token string) (Header, error) {
+	var header Header
+	part, _, ok := strings.Cut(token, ".")
+	if !ok || decodePart(part, &header) != nil {
+		return header, ErrInvalid
+	}
+	return header, nil
+}
+
+// JWKSet is a set of keys (RFC 7517, section 5), as served at JWKS endpoints
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
@@ -0,0 +1,104 @@
+package jwt
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newRSAKey(t *testing.T) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	return key
+}
+
+func TestRS256_RoundTrip(t *testing.T) {
+	rs := NewRS256(newRSAKey(t))
+	token, err := rs.Sign(Claims{Issuer: "https://api.example.com", Subject: "john", Audience: Audience{"client"}, ExpiresAt: 2000000000})
+	require.NoError(t, err)
+
+	var header map[string]string
+	require.NoError(t, decodePart(strings.Split(token, ".")[0], &header))
+	assert.Equal(t, map[string]string{"alg": "RS256", "kid": rs.JWK().KeyID, "typ": "JWT"}, header)
+
+	// Verifiers only need the published JWK
+	key, err := rs.JWK().PublicKey()
+	require.NoError(t, err)
+	var claims Claims
+	require.NoError(t, VerifyRS256(token, key, &claims))
+	assert.Equal(t, Claims{Issuer: "https://api.example.com", Subject: "john", Audience: Audience{"client"}, ExpiresAt: 2000000000}, claims)
+}
+
+func TestRS256_Rejects(t *testing.T) {
+	rs := NewRS256(newRSAKey(t))
+	token, _ := rs.Sign(Claims{Subject: "john"})
+	parts := strings.Split(token, ".")
+	forged := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"admin"}`))
+	none := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","typ":"JWT"}`))
+	hs256, _ := NewHS256([]byte("0123456789abcdef0123456789abcdef")).Sign(Claims{Subject: "john"})
+	other, _ := NewRS256(newRSAKey(t)).Sign(Claims{Subject: "john"})
+
+	for name, candidate := range map[string]string{
+		"other key":       other,
+		"changed payload": parts[0] + "." + forged + "." + parts[2],
+		"alg none":        none + "." + parts[1] + ".",
+		"hs256":           hs256,
+		"missing part":    parts[0] + "." + parts[1],
+		"bad signature":   parts[0] + "." + parts[1] + ".!!",
+		"empty":           "",
+	} {
+		var claims Claims
+		assert.ErrorIs(t, rs.Verify(candidate, &claims), ErrInvalid, name)
+	}
+}
+
+func TestPublicJWK(t *testing.T) {
+	// The RSA key of RFC 7638, section 3.1
+	var jwk JWK
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"kty": "RSA",
+		"n": "0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw",
+		"e": "AQAB"
+	}`), &jwk))
+	key, err := jwk.PublicKey()
+	require.NoError(t, err)
+
+	assert.Equal(t, "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs", PublicJWK(key).KeyID)
+	assert.Equal(t, jwk.N, PublicJWK(key).N)
+	assert.Equal(t, "AQAB", PublicJWK(key).E)
+}
+
+func TestAudience(t *testing.T) {
+	single, _ := json.Marshal(Audience{"client"})
+	assert.JSONEq(t, `"client"`, string(single))
+	many, _ := json.Marshal(Audience{"a", "b"})
+	assert.JSONEq(t, `["a", "b"]`, string(many))
+
+	var audience Audience
+	require.NoError(t, json.Unmarshal([]byte(`"client"`), &audience))
+	assert.True(t, audience.Contains("client"))
+	require.NoError(t, json.Unmarshal([]byte(`["a", "b"]`), &audience))
+	assert.True(t, audience.Contains("b"))
+	assert.False(t, audience.Contains("client"))
+	assert.Error(t, json.Unmarshal([]byte(`1`), &audience))
+}
+
+func TestParseHeader(t *testing.T) {
+	rs := NewRS256(newRSAKey(t))
+	token, _ := rs.Sign(Claims{Subject: "john"})
+
+	header, err := ParseHeader(token)
+	require.NoError(t, err)
+	assert.Equal(t, Header{Algorithm: "RS256", KeyID: rs.JWK().KeyID, Type: "JWT"}, header)
+
+	for _, candidate := range []string{"", "no-dots", "!!.e30.", "e30"} {
+		_, err := ParseHeader(candidate)
+		assert.ErrorIs(t, err, ErrInvalid, candidate)
+	}
+}
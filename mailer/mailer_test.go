@@ -0,0 +1,146 @@
+package mailer
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lep13/golang-restful-api/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testMessage = Message{To: "john@example.com", Subject: "Vérifiez", Body: "Hello\nJohn"}
+
+func TestFormat(t *testing.T) {
+	data, err := format("no-reply@example.com", testMessage, time.Date(2026, time.October, 18, 12, 0, 0, 0, time.UTC))
+	require.NoError(t, err)
+	assert.Equal(t, "From: no-reply@example.com\r\n"+
+		"To: john@example.com\r\n"+
+		"Subject: =?utf-8?q?V=C3=A9rifiez?=\r\n"+
+		"Date: Sun, 18 Oct 2026 12:00:00 +0000\r\n"+
+		"MIME-Version: 1.0\r\n"+
+		"Content-Type: text/plain; charset=utf-8\r\n"+
+		"Content-Transfer-Encoding: 8bit\r\n"+
+		"\r\n"+
+		"Hello\r\nJohn", string(data))
+
+	_, err = format("no-reply@example.com", Message{To: "john@example.com\r\nBcc: eve@example.com"}, time.Now())
+	assert.Error(t, err)
+}
+
+func TestNew(t *testing.T) {
+	m, err := New(config.MailConfig{Driver: "file", Dir: "out", From: "a@example.com"})
+	require.NoError(t, err)
+	assert.Equal(t, &File{Dir: "out", From: "a@example.com"}, m)
+
+	m, err = New(config.MailConfig{Driver: "log"})
+	require.NoError(t, err)
+	assert.IsType(t, &Log{}, m)
+
+	_, err = New(config.MailConfig{Driver: "smtp"})
+	assert.EqualError(t, err, "SMTP_HOST is required by the smtp mail driver")
+
+	_, err = New(config.MailConfig{})
+	assert.EqualError(t, err, "MAIL_DRIVER is required: smtp, or file or log for local development")
+
+	_, err = New(config.MailConfig{Driver: "pigeon"})
+	assert.EqualError(t, err, `unknown mail driver "pigeon"`)
+}
+
+func TestFile_Send(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "mail")
+	m := &File{Dir: dir, From: "no-reply@example.com"}
+
+	require.NoError(t, m.Send(context.Background(), testMessage))
+	require.NoError(t, m.Send(context.Background(), testMessage))
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+	require.NoError(t, err)
+	require.Len(t, files, 2)
+	data, err := os.ReadFile(files[0])
+	require.NoError(t, err)
+	assert.Contains(t, string(data), "To: john@example.com\r\n")
+	assert.True(t, strings.HasSuffix(string(data), "\r\n\r\nHello\r\nJohn"))
+}
+
+// serveSMTP accepts one SMTP session without STARTTLS or authentication and
+// returns the transcript of the client's commands and data
+func serveSMTP(t *testing.T) (port int, transcript <-chan string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	done := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			done <- ""
+			return
+		}
+		defer conn.Close()
+		var b strings.Builder
+		reader := bufio.NewReader(conn)
+		reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+		reply("220 localhost ESMTP")
+		inData := false
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				break
+			}
+			b.WriteString(line)
+			switch {
+			case inData:
+				if line == ".\r\n" {
+					inData = false
+					reply("250 queued")
+				}
+			case strings.HasPrefix(line, "EHLO"):
+				reply("250 localhost")
+			case strings.HasPrefix(line, "DATA"):
+				inData = true
+				reply("354 go ahead")
+			case strings.HasPrefix(line, "QUIT"):
+				reply("221 bye")
+				done <- b.String()
+				return
+			default:
+				reply("250 ok")
+			}
+		}
+		done <- b.String()
+	}()
+	return listener.Addr().(*net.TCPAddr).Port, done
+}
+
+func TestSMTP_Send(t *testing.T) {
+	port, transcript := serveSMTP(t)
+	m := &SMTP{Host: "127.0.0.1", Port: port, From: "no-reply@example.com"}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, m.Send(ctx, testMessage))
+
+	session := <-transcript
+	assert.Contains(t, session, "MAIL FROM:<no-reply@example.com>")
+	assert.Contains(t, session, "RCPT TO:<john@example.com>")
+	assert.Contains(t, session, "Subject: =?utf-8?q?V=C3=A9rifiez?=\r\n")
+	assert.Contains(t, session, "\r\nHello\r\nJohn\r\n.\r\n")
+}
+
+func TestSMTP_SendUnreachable(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	m := &SMTP{Host: "127.0.0.1", Port: port, From: "no-reply@example.com"}
+	err = m.Send(context.Background(), testMessage)
+	assert.ErrorContains(t, err, strconv.Itoa(port))
+}
@@ -1,14 +1,20 @@
 package main
 
 import (
+    "context"
     "log"
     "net/http"
     "os"
     "time"
-    "github.com/gorilla/mux"
     "github.com/joho/godotenv"  // Keep this for local development
+    "github.com/lep13/golang-restful-api/audit"
+    "github.com/lep13/golang-restful-api/config"
     "github.com/lep13/golang-restful-api/db"
     "github.com/lep13/golang-restful-api/handlers"
+    "github.com/lep13/golang-restful-api/mailer"
+    "github.com/lep13/golang-restful-api/middleware"
+    "github.com/lep13/golang-restful-api/router"
+    "github.com/lep13/golang-restful-api/tlsutil"
 )
 
 // RunServer sets up and starts the server
@@ -20,14 +26,14 @@ func RunServer() {
         }
     }
 
-    // Get MongoDB URI from environment
-    mongoURI := os.Getenv("MONGO_URI")
-    if mongoURI == "" {
+    // Read configuration from environment
+    cfg := config.Load()
+    if cfg.MongoURI == "" {
         log.Fatal("MongoDB URI is not set in environment variables")
     }
 
     // Initialize MongoDB connection
-    mongoClient := db.ConnectDB(mongoURI)
+    mongoClient := db.ConnectDB(cfg.MongoURI)
 
     // Get the collection from the MongoDB client
     collection := db.GetCollection(mongoClient)
@@ -35,35 +41,60 @@ func RunServer() {
     // Wrap the collection and pass it to the handlers
     wrappedCollection := db.NewMongoCollectionWrapper(collection)
     handlers.Initialize(wrappedCollection)
+    handlers.SetOperationTimeout(cfg.MongoOperationTimeout)
+    handlers.SetMaxBatchItems(cfg.MaxBatchItems)
 
-    // Set up router
-    r := mux.NewRouter()
-
-    // Root handler to display confirmation message
-    r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-        w.WriteHeader(http.StatusOK)
-        _, err := w.Write([]byte("Your API is up and running on port 5000!"))
-        if err != nil {
-            log.Printf("Error writing response: %v", err)
-        }
-    }).Methods("GET")
+    // Set up the mailer used for email verification and password resets
+    if cfg.Mail.Driver == "" {
+        log.Println("MAIL_DRIVER is not set; using the log driver, which writes mailed links and their tokens to the log instead of sending them")
+        cfg.Mail.Driver = "log"
+    }
+    mail, err := mailer.New(cfg.Mail)
+    if err != nil {
+        log.Fatalf("Invalid mail configuration: %v", err)
+    }
+    handlers.SetMailer(mail)
+    handlers.SetEmailVerification(cfg.EmailVerification.TokenTTL, cfg.EmailVerification.ResendInterval, cfg.EmailVerification.URL)
+    handlers.SetPasswordReset(cfg.PasswordReset.TokenTTL, cfg.PasswordReset.ResendInterval, cfg.PasswordReset.URL)
+    handlers.SetMagicLink(cfg.MagicLink)
+    handlers.SetPasswordPolicy(cfg.PasswordMinLength)
 
-    // CRUD endpoints
-    r.HandleFunc("/users", handlers.CreateUser).Methods("POST")
-    r.HandleFunc("/users", handlers.GetUsers).Methods("GET")
-    r.HandleFunc("/users/{id}", handlers.GetUser).Methods("GET")
-    r.HandleFunc("/users/{id}", handlers.UpdateUser).Methods("PUT")
-    r.HandleFunc("/users/{id}", handlers.DeleteUser).Methods("DELETE")
+    // Set up the signing of login tokens
+    if cfg.Auth.TokenSecret == "" {
+        log.Println("AUTH_TOKEN_SECRET is not set; login tokens are signed with a random key and expire on restart")
+    }
+    handlers.SetTokenSigning([]byte(cfg.Auth.TokenSecret), cfg.Auth.TokenTTL)
+    handlers.SetMFAIssuer(cfg.Auth.MFAIssuer)
+    handlers.SetSessionCache(cfg.Auth.SessionCacheTTL)
+    handlers.SetLockout(cfg.Lockout)
+    if cfg.OAuth.Issuer == "" {
+        log.Println("OAUTH_ISSUER is not set; the OAuth provider and OpenID Connect discovery are disabled")
+    }
+    if err := handlers.SetOAuth(cfg.OAuth); err != nil {
+        log.Fatalf("Invalid OAuth configuration: %v", err)
+    }
+    if err := handlers.SetOIDCProviders(cfg.OIDCProviders); err != nil {
+        log.Fatalf("Invalid OIDC provider configuration: %v", err)
+    }
+    if err := handlers.SetSCIMTokens(cfg.SCIMTokens); err != nil {
+        log.Fatalf("Invalid SCIM configuration: %v", err)
+    }
 
-    // Health check endpoint
-    r.HandleFunc("/health", handlers.HealthCheck).Methods("GET")
+    // Set up the audit log of security relevant actions
+    auditLogger, err := audit.New(cfg.AuditLogFile)
+    if err != nil {
+        log.Fatalf("Failed to open audit log: %v", err)
+    }
+    handlers.SetAuditLogger(auditLogger)
 
-    // Get the port from environment variables or default to 5000
-    port := os.Getenv("PORT")
-    if port == "" {
-        port = "5000"
+    // Set up router
+    r, err := router.New(cfg, middleware.NewMemoryStore())
+    if err != nil {
+        log.Fatalf("Failed to set up router: %v", err)
     }
 
+    port := cfg.Port
+
     // Server configuration
     srv := &http.Server{
         Handler:      r,
@@ -72,9 +103,38 @@ func RunServer() {
         ReadTimeout:  15 * time.Second,
     }
 
-    // Start the server
-    log.Printf("Server is running on port %s...", port)
-    log.Fatal(srv.ListenAndServe())
+    if !cfg.TLS.Enabled() {
+        // Start the server
+        log.Printf("Server is running on port %s...", port)
+        log.Fatal(srv.ListenAndServe())
+    }
+
+    // Serve HTTPS, reloading the certificate when its files change
+    reloader, err := tlsutil.NewCertReloader(cfg.TLS.CertFile, cfg.TLS.KeyFile)
+    if err != nil {
+        log.Fatalf("Failed to load TLS certificate: %v", err)
+    }
+    srv.TLSConfig, err = tlsutil.NewServerConfig(cfg.TLS, reloader)
+    if err != nil {
+        log.Fatalf("Invalid TLS configuration: %v", err)
+    }
+    go reloader.Watch(context.Background(), cfg.TLS.ReloadInterval)
+
+    if cfg.TLS.RedirectPort != "" {
+        redirect := &http.Server{
+            Handler:      tlsutil.RedirectHandler(port),
+            Addr:         ":" + cfg.TLS.RedirectPort,
+            WriteTimeout: 5 * time.Second,
+            ReadTimeout:  5 * time.Second,
+        }
+        go func() {
+            log.Printf("Redirecting HTTP on port %s to HTTPS...", cfg.TLS.RedirectPort)
+            log.Fatal(redirect.ListenAndServe())
+        }()
+    }
+
+    log.Printf("Server is running with TLS on port %s...", port)
+    log.Fatal(srv.ListenAndServeTLS("", ""))
 }
 
 func main() {
@@ -9,6 +9,7 @@ import (
 	"net/http/httptest"
 	"github.com/gorilla/mux"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 	"github.com/lep13/golang-restful-api/handlers"
 	"github.com/lep13/golang-restful-api/db"
 )
@@ -23,7 +24,7 @@ func (m *MockCollection) InsertOne(ctx context.Context, document interface{}) (*
 	return args.Get(0).(*mongo.InsertOneResult), args.Error(1)
 }
 
-func (m *MockCollection) Find(ctx context.Context, filter interface{}) (*mongo.Cursor, error) {
+func (m *MockCollection) Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error) {
 	args := m.Called(ctx, filter)
 	return args.Get(0).(*mongo.Cursor), args.Error(1)
 }
@@ -43,6 +44,25 @@ func (m *MockCollection) UpdateOne(ctx context.Context, filter interface{}, upda
 	return args.Get(0).(*mongo.UpdateResult), args.Error(1)
 }
 
+func (m *MockCollection) InsertMany(ctx context.Context, documents []interface{}, opts ...*options.InsertManyOptions) (*mongo.InsertManyResult, error) {
+	args := m.Called(ctx, documents)
+	return args.Get(0).(*mongo.InsertManyResult), args.Error(1)
+}
+
+func (m *MockCollection) BulkWrite(ctx context.Context, models []mongo.WriteModel, opts ...*options.BulkWriteOptions) (*mongo.BulkWriteResult, error) {
+	args := m.Called(ctx, models)
+	return args.Get(0).(*mongo.BulkWriteResult), args.Error(1)
+}
+
+func (m *MockCollection) CountDocuments(ctx context.Context, filter interface{}) (int64, error) {
+	args := m.Called(ctx, filter)
+	return args.Get(0).(int64), args.Error(1)
+}
+
+func (m *MockCollection) WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	return fn(ctx)
+}
+
 // MockSingleResult simulates a MongoDB single result
 type MockSingleResult struct {
 	mock.Mock
@@ -0,0 +1,126 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// ErrInvalidCredentials is returned by a TokenVerifier or an APIKeyVerifier
+// for credentials that are malformed, expired or revoked.
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// TokenVerifier returns the ID of the user a bearer token was issued to, and
+// the scopes it is limited to, or nil for a token with the full access of the
+// user. It returns ErrInvalidCredentials when the token is not valid, and
+// other errors when it could not be checked.
+type TokenVerifier func(ctx context.Context, token string) (string, []string, error)
+
+// APIKeyVerifier returns the ID of the user an API key belongs to and the
+// scopes it was granted. It returns ErrInvalidCredentials when the key is not
+// valid, and other errors when it could not be checked.
+type APIKeyVerifier func(ctx context.Context, key string) (string, []string, error)
+
+// Authenticate identifies the caller from an "Authorization: Bearer <token>"
+// or "Authorization: ApiKey <key>" header and stores their user ID in the
+// request context with WithUserID, plus the scopes of an API key or scoped
+// token with WithScopes. Requests without the header pass through
+// anonymously; handlers that need a user check UserIDFromContext. So do
+// requests with Basic credentials, which OAuth clients send to the token
+// endpoint. Invalid credentials are rejected with 401.
+func Authenticate(tokens TokenVerifier, apiKeys APIKeyVerifier) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			authorization := r.Header.Get("Authorization")
+			if authorization == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			scheme, credentials, _ := strings.Cut(authorization, " ")
+			var (
+				userID string
+				scopes []string
+				err    error
+			)
+			switch {
+			case credentials == "":
+				writeInvalidAuthorization(w)
+				return
+			case strings.EqualFold(scheme, "Bearer"):
+				userID, scopes, err = tokens(r.Context(), credentials)
+			case strings.EqualFold(scheme, "ApiKey") && apiKeys != nil:
+				userID, scopes, err = apiKeys(r.Context(), credentials)
+				// A key granted nothing is still told apart from a login
+				if err == nil && scopes == nil {
+					scopes = []string{}
+				}
+			case strings.EqualFold(scheme, "Basic"):
+				next.ServeHTTP(w, r)
+				return
+			default:
+				writeInvalidAuthorization(w)
+				return
+			}
+			if errors.Is(err, ErrInvalidCredentials) {
+				if strings.EqualFold(scheme, "Bearer") {
+					w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+					writeJSONError(w, http.StatusUnauthorized, "Invalid or expired token")
+				} else {
+					w.Header().Set("WWW-Authenticate", "ApiKey")
+					writeJSONError(w, http.StatusUnauthorized, "Invalid or expired API key")
+				}
+				return
+			}
+			if err != nil {
+				log.Println("Failed to verify credentials:", err)
+				writeJSONError(w, http.StatusServiceUnavailable, "Failed to verify token")
+				return
+			}
+			ctx := WithUserID(r.Context(), userID)
+			if scopes != nil {
+				ctx = WithScopes(ctx, scopes)
+			}
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+func writeInvalidAuthorization(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Bearer error="invalid_request"`)
+	writeJSONError(w, http.StatusUnauthorized, "Authorization header must be Bearer <token> or ApiKey <key>")
+}
+
+// RequireScopes limits callers with scoped credentials, such as API keys and
+// OAuth access tokens, to the routes listed in scopes, keyed by "METHOD
+// /path/template", and among them to those whose scope they were granted.
+// Other requests are not restricted.
+func RequireScopes(scopes map[string]string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			granted, ok := ScopesFromContext(r.Context())
+			if !ok || r.Method == http.MethodOptions {
+				next.ServeHTTP(w, r)
+				return
+			}
+			scheme, credential := "ApiKey", "API key"
+			if s, _, _ := strings.Cut(r.Header.Get("Authorization"), " "); strings.EqualFold(s, "Bearer") {
+				scheme, credential = "Bearer", "Token"
+			}
+			required, ok := scopes[routeKey(r)]
+			if !ok {
+				writeJSONError(w, http.StatusForbidden, credential+"s may not call this route")
+				return
+			}
+			for _, scope := range granted {
+				if scope == required {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+			w.Header().Set("WWW-Authenticate", scheme+` error="insufficient_scope", scope="`+required+`"`)
+			writeJSONError(w, http.StatusForbidden, credential+" lacks the "+required+" scope")
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthenticate(t *testing.T) {
+	verify := func(ctx context.Context, token string) (string, []string, error) {
+		switch token {
+		case "good":
+			return "user-1", nil, nil
+		case "scoped":
+			return "user-1", []string{"openid"}, nil
+		case "unreachable":
+			return "", nil, errors.New("database down")
+		}
+		return "", nil, ErrInvalidCredentials
+	}
+	verifyKey := func(ctx context.Context, key string) (string, []string, error) {
+		switch key {
+		case "ak_good":
+			return "user-2", []string{"users:read"}, nil
+		case "ak_unscoped":
+			return "user-2", nil, nil
+		}
+		return "", nil, ErrInvalidCredentials
+	}
+	var userID string
+	var authenticated bool
+	var scopes []string
+	var scoped bool
+	handler := Authenticate(verify, verifyKey)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID, authenticated = UserIDFromContext(r.Context())
+		scopes, scoped = ScopesFromContext(r.Context())
+	}))
+
+	tests := []struct {
+		name          string
+		authorization string
+		status        int
+		userID        string
+		challenge     string
+		scopes        []string
+	}{
+		{"anonymous", "", http.StatusOK, "", "", nil},
+		{"valid token", "Bearer good", http.StatusOK, "user-1", "", nil},
+		{"scheme is case insensitive", "bearer good", http.StatusOK, "user-1", "", nil},
+		{"scoped token", "Bearer scoped", http.StatusOK, "user-1", "", []string{"openid"}},
+		{"invalid token", "Bearer forged", http.StatusUnauthorized, "", `Bearer error="invalid_token"`, nil},
+		{"valid API key", "ApiKey ak_good", http.StatusOK, "user-2", "", []string{"users:read"}},
+		{"API key without scopes", "ApiKey ak_unscoped", http.StatusOK, "user-2", "", []string{}},
+		{"invalid API key", "ApiKey ak_forged", http.StatusUnauthorized, "", "ApiKey", nil},
+		{"client credentials", "Basic am9objpzZWNyZXQ=", http.StatusOK, "", "", nil},
+		{"other scheme", "Digest username=\"john\"", http.StatusUnauthorized, "", `Bearer error="invalid_request"`, nil},
+		{"missing token", "Bearer", http.StatusUnauthorized, "", `Bearer error="invalid_request"`, nil},
+		{"verification failure", "Bearer unreachable", http.StatusServiceUnavailable, "", "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			userID, authenticated, scopes, scoped = "", false, nil, false
+			req := httptest.NewRequest("GET", "/v1/users", nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			assert.Equal(t, tt.status, rr.Code)
+			assert.Equal(t, tt.userID, userID)
+			assert.Equal(t, tt.userID != "", authenticated)
+			assert.Equal(t, tt.challenge, rr.Header().Get("WWW-Authenticate"))
+			assert.Equal(t, tt.scopes, scopes)
+			assert.Equal(t, tt.scopes != nil, scoped)
+		})
+	}
+}
+
+func TestRequireScopes(t *testing.T) {
+	r := mux.NewRouter()
+	r.Use(RequireScopes(map[string]string{
+		"GET /v1/users/{id}":    "users:read",
+		"DELETE /v1/users/{id}": "users:write",
+	}))
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+	r.HandleFunc("/v1/users/{id}", ok).Methods("GET", "DELETE")
+	r.HandleFunc("/v1/users/{id}/api-keys", ok).Methods("GET")
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		scopes []string
+		status int
+	}{
+		{"login token", "DELETE", "/v1/users/1", nil, http.StatusOK},
+		{"granted scope", "GET", "/v1/users/1", []string{"users:read"}, http.StatusOK},
+		{"missing scope", "DELETE", "/v1/users/1", []string{"users:read"}, http.StatusForbidden},
+		{"no scopes", "GET", "/v1/users/1", []string{}, http.StatusForbidden},
+		{"unlisted route", "GET", "/v1/users/1/api-keys", []string{"users:read", "users:write"}, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.scopes != nil {
+				req = req.WithContext(WithScopes(req.Context(), tt.scopes))
+			}
+			rr := httptest.NewRecorder()
+			r.ServeHTTP(rr, req)
+
+			assert.Equal(t, tt.status, rr.Code, rr.Body.String())
+		})
+	}
+
+	req := httptest.NewRequest("DELETE", "/v1/users/1", nil)
+	req.Header.Set("Authorization", "ApiKey ak_good")
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req.WithContext(WithScopes(req.Context(), []string{"users:read"})))
+	assert.Equal(t, `ApiKey error="insufficient_scope", scope="users:write"`, rr.Header().Get("WWW-Authenticate"))
+	assert.JSONEq(t, `{"error":"API key lacks the users:write scope"}`, rr.Body.String())
+
+	// Scoped bearer tokens are told apart from API keys
+	req = httptest.NewRequest("DELETE", "/v1/users/1", nil)
+	req.Header.Set("Authorization", "Bearer scoped")
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, req.WithContext(WithScopes(req.Context(), []string{"openid"})))
+	assert.Equal(t, `Bearer error="insufficient_scope", scope="users:write"`, rr.Header().Get("WWW-Authenticate"))
+	assert.JSONEq(t, `{"error":"Token lacks the users:write scope"}`, rr.Body.String())
+
+	req = httptest.NewRequest("GET", "/v1/users/1/api-keys", nil)
+	req.Header.Set("Authorization", "Bearer scoped")
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, req.WithContext(WithScopes(req.Context(), []string{"openid"})))
+	assert.JSONEq(t, `{"error":"Tokens may not call this route"}`, rr.Body.String())
+}
@@ -0,0 +1,172 @@
+package middleware
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/lep13/golang-restful-api/config"
+)
+
+// CORS answers preflight requests and adds the Access-Control-* headers for
+// the origins allowed by the configuration.
+type CORS struct {
+	cfg       config.CORSConfig
+	anyOrigin bool
+	origins   map[string]bool
+	wildcards []wildcardOrigin
+	methods   map[string]bool
+	headers   map[string]bool
+	anyHeader bool
+}
+
+// wildcardOrigin matches "https://*.example.com" style patterns.
+type wildcardOrigin struct {
+	prefix string // "https://"
+	suffix string // ".example.com", including any port
+}
+
+// NewCORS builds the CORS middleware from configuration. Any origin cannot be
+// allowed with credentials: every site the user visits could then call the API
+// as them.
+func NewCORS(cfg config.CORSConfig) (*CORS, error) {
+	c := &CORS{
+		cfg:     cfg,
+		origins: make(map[string]bool),
+		methods: make(map[string]bool),
+		headers: make(map[string]bool),
+	}
+	for _, origin := range cfg.AllowedOrigins {
+		origin = strings.ToLower(strings.TrimSuffix(origin, "/"))
+		switch {
+		case origin == "*":
+			c.anyOrigin = true
+		case strings.Contains(origin, "://*."):
+			scheme, host, _ := strings.Cut(origin, "*")
+			c.wildcards = append(c.wildcards, wildcardOrigin{prefix: scheme, suffix: host})
+		default:
+			c.origins[origin] = true
+		}
+	}
+	for _, method := range cfg.AllowedMethods {
+		c.methods[strings.ToUpper(method)] = true
+	}
+	for _, header := range cfg.AllowedHeaders {
+		if header == "*" {
+			c.anyHeader = true
+		}
+		c.headers[http.CanonicalHeaderKey(header)] = true
+	}
+	if c.anyOrigin && cfg.AllowCredentials {
+		return nil, errors.New(`the origin "*" cannot be allowed with credentials; list the origins instead`)
+	}
+	return c, nil
+}
+
+// allowed reports whether the browser origin may call the API.
+func (c *CORS) allowed(origin string) bool {
+	origin = strings.ToLower(origin)
+	if c.anyOrigin || c.origins[origin] {
+		return true
+	}
+	for _, w := range c.wildcards {
+		if strings.HasPrefix(origin, w.prefix) && strings.HasSuffix(origin, w.suffix) {
+			sub := origin[len(w.prefix) : len(origin)-len(w.suffix)]
+			if sub != "" && !strings.ContainsAny(sub, "/:@") && !strings.HasPrefix(sub, ".") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Middleware must be installed ahead of the rate limiter so that errors it
+// returns still carry CORS headers and preflights do not consume the budget.
+func (c *CORS) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if len(c.cfg.AllowedOrigins) == 0 || origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		h := w.Header()
+		h.Add("Vary", "Origin")
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		if preflight {
+			h.Add("Vary", "Access-Control-Request-Method")
+			h.Add("Vary", "Access-Control-Request-Headers")
+		}
+
+		if !c.allowed(origin) {
+			if preflight {
+				writeJSONError(w, http.StatusForbidden, "Origin not allowed")
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if c.anyOrigin {
+			h.Set("Access-Control-Allow-Origin", "*")
+		} else {
+			h.Set("Access-Control-Allow-Origin", origin)
+		}
+		if c.cfg.AllowCredentials {
+			h.Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		if !preflight {
+			if len(c.cfg.ExposedHeaders) > 0 {
+				h.Set("Access-Control-Expose-Headers", strings.Join(c.cfg.ExposedHeaders, ", "))
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		method := strings.ToUpper(r.Header.Get("Access-Control-Request-Method"))
+		if !c.methods[method] {
+			writeJSONError(w, http.StatusForbidden, "Method not allowed by CORS policy")
+			return
+		}
+		requested := requestedHeaders(r)
+		if !c.anyHeader {
+			for _, header := range requested {
+				if !c.headers[header] {
+					writeJSONError(w, http.StatusForbidden, "Header "+header+" not allowed by CORS policy")
+					return
+				}
+			}
+		}
+
+		h.Set("Access-Control-Allow-Methods", strings.Join(c.cfg.AllowedMethods, ", "))
+		if c.anyHeader {
+			h.Set("Access-Control-Allow-Headers", strings.Join(requested, ", "))
+		} else {
+			h.Set("Access-Control-Allow-Headers", strings.Join(c.cfg.AllowedHeaders, ", "))
+		}
+		if c.cfg.MaxAge > 0 {
+			h.Set("Access-Control-Max-Age", strconv.Itoa(int(c.cfg.MaxAge.Seconds())))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// Preflight is registered for OPTIONS on the CORS-enabled paths so the router
+// matches preflight requests; the response itself is written by Middleware.
+func Preflight(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func requestedHeaders(r *http.Request) []string {
+	var headers []string
+	for _, value := range r.Header.Values("Access-Control-Request-Headers") {
+		for _, header := range strings.Split(value, ",") {
+			if header = strings.TrimSpace(header); header != "" {
+				headers = append(headers, http.CanonicalHeaderKey(header))
+			}
+		}
+	}
+	return headers
+}
@@ -0,0 +1,157 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/lep13/golang-restful-api/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testCORSConfig() config.CORSConfig {
+	return config.CORSConfig{
+		AllowedOrigins:   []string{"https://app.example.com", "https://*.example.org"},
+		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE"},
+		AllowedHeaders:   []string{"Content-Type", "Authorization"},
+		ExposedHeaders:   []string{"Link", "X-Next-Cursor"},
+		AllowCredentials: true,
+		MaxAge:           10 * time.Minute,
+	}
+}
+
+func serveCORS(t *testing.T, cfg config.CORSConfig, req *http.Request) (*httptest.ResponseRecorder, bool) {
+	called := false
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		w.WriteHeader(http.StatusOK)
+	})
+	rr := httptest.NewRecorder()
+	c, err := NewCORS(cfg)
+	require.NoError(t, err)
+	c.Middleware(next).ServeHTTP(rr, req)
+	return rr, called
+}
+
+func TestCORS_OriginMatching(t *testing.T) {
+	c, err := NewCORS(testCORSConfig())
+	assert.NoError(t, err)
+
+	assert.True(t, c.allowed("https://app.example.com"))
+	assert.True(t, c.allowed("https://APP.example.com"))
+	assert.True(t, c.allowed("https://admin.example.org"))
+	assert.True(t, c.allowed("https://a.b.example.org"))
+	assert.False(t, c.allowed("https://example.org"))
+	assert.False(t, c.allowed("http://admin.example.org"))
+	assert.False(t, c.allowed("https://evil.com/.example.org"))
+	assert.False(t, c.allowed("https://admin.example.org.evil.com"))
+	assert.False(t, c.allowed("https://other.example.com"))
+}
+
+func TestCORS_SimpleRequest(t *testing.T) {
+	req := httptest.NewRequest("GET", "/users", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+
+	rr, called := serveCORS(t, testCORSConfig(), req)
+
+	assert.True(t, called)
+	assert.Equal(t, "https://app.example.com", rr.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "true", rr.Header().Get("Access-Control-Allow-Credentials"))
+	assert.Equal(t, "Link, X-Next-Cursor", rr.Header().Get("Access-Control-Expose-Headers"))
+	assert.Equal(t, "Origin", rr.Header().Get("Vary"))
+}
+
+func TestCORS_DisallowedOrigin(t *testing.T) {
+	req := httptest.NewRequest("GET", "/users", nil)
+	req.Header.Set("Origin", "https://evil.com")
+
+	rr, called := serveCORS(t, testCORSConfig(), req)
+
+	assert.True(t, called)
+	assert.Empty(t, rr.Header().Get("Access-Control-Allow-Origin"))
+}
+
+func TestCORS_Preflight(t *testing.T) {
+	req := httptest.NewRequest("OPTIONS", "/users/123", nil)
+	req.Header.Set("Origin", "https://admin.example.org")
+	req.Header.Set("Access-Control-Request-Method", "PUT")
+	req.Header.Set("Access-Control-Request-Headers", "content-type, authorization")
+
+	rr, called := serveCORS(t, testCORSConfig(), req)
+
+	assert.False(t, called)
+	assert.Equal(t, http.StatusNoContent, rr.Code)
+	assert.Equal(t, "https://admin.example.org", rr.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "GET, POST, PUT, DELETE", rr.Header().Get("Access-Control-Allow-Methods"))
+	assert.Equal(t, "Content-Type, Authorization", rr.Header().Get("Access-Control-Allow-Headers"))
+	assert.Equal(t, "600", rr.Header().Get("Access-Control-Max-Age"))
+}
+
+func TestCORS_PreflightRejections(t *testing.T) {
+	tests := []struct {
+		name    string
+		origin  string
+		method  string
+		headers string
+	}{
+		{"origin", "https://evil.com", "GET", ""},
+		{"method", "https://app.example.com", "PATCH", ""},
+		{"header", "https://app.example.com", "GET", "X-Secret"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("OPTIONS", "/users", nil)
+			req.Header.Set("Origin", tt.origin)
+			req.Header.Set("Access-Control-Request-Method", tt.method)
+			if tt.headers != "" {
+				req.Header.Set("Access-Control-Request-Headers", tt.headers)
+			}
+
+			rr, called := serveCORS(t, testCORSConfig(), req)
+
+			assert.False(t, called)
+			assert.Equal(t, http.StatusForbidden, rr.Code)
+			assert.Empty(t, rr.Header().Get("Access-Control-Allow-Methods"))
+		})
+	}
+}
+
+func TestCORS_AnyOriginWithoutCredentials(t *testing.T) {
+	cfg := testCORSConfig()
+	cfg.AllowedOrigins = []string{"*"}
+	cfg.AllowCredentials = false
+	cfg.AllowedHeaders = []string{"*"}
+	req := httptest.NewRequest("OPTIONS", "/users", nil)
+	req.Header.Set("Origin", "https://anything.test")
+	req.Header.Set("Access-Control-Request-Method", "POST")
+	req.Header.Set("Access-Control-Request-Headers", "X-Custom")
+
+	rr, _ := serveCORS(t, cfg, req)
+
+	assert.Equal(t, http.StatusNoContent, rr.Code)
+	assert.Equal(t, "*", rr.Header().Get("Access-Control-Allow-Origin"))
+	assert.Empty(t, rr.Header().Get("Access-Control-Allow-Credentials"))
+	assert.Equal(t, "X-Custom", rr.Header().Get("Access-Control-Allow-Headers"))
+}
+
+func TestCORS_AnyOriginWithCredentials(t *testing.T) {
+	cfg := testCORSConfig()
+	cfg.AllowedOrigins = []string{"https://app.example.com", "*"}
+
+	_, err := NewCORS(cfg)
+
+	assert.EqualError(t, err, `the origin "*" cannot be allowed with credentials; list the origins instead`)
+}
+
+func TestCORS_Disabled(t *testing.T) {
+	req := httptest.NewRequest("GET", "/users", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+
+	rr, called := serveCORS(t, config.CORSConfig{}, req)
+
+	assert.True(t, called)
+	assert.Empty(t, rr.Header().Get("Access-Control-Allow-Origin"))
+	assert.Empty(t, rr.Header().Get("Vary"))
+}
@@ -0,0 +1,26 @@
+package middleware
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/lep13/golang-restful-api/config"
+)
+
+// Deprecated marks every response of the wrapped routes as deprecated:
+// Deprecation (RFC 9745) carries the deprecation date, Sunset (RFC 8594) the
+// planned removal date, and Link points to the successor of the requested
+// resource as returned by successor.
+func Deprecated(cfg config.DeprecationConfig, successor func(r *http.Request) string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			h := w.Header()
+			h.Set("Deprecation", "@"+strconv.FormatInt(cfg.Deprecated.Unix(), 10))
+			if !cfg.Sunset.IsZero() {
+				h.Set("Sunset", cfg.Sunset.UTC().Format(http.TimeFormat))
+			}
+			h.Add("Link", "<"+successor(r)+`>; rel="successor-version"`)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,40 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/lep13/golang-restful-api/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeprecated(t *testing.T) {
+	cfg := config.DeprecationConfig{
+		Deprecated: time.Date(2026, time.October, 18, 0, 0, 0, 0, time.UTC),
+		Sunset:     time.Date(2027, time.April, 30, 0, 0, 0, 0, time.UTC),
+	}
+	handler := Deprecated(cfg, func(r *http.Request) string { return "/v1" + r.URL.Path })(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Link", `</users?cursor=abc>; rel="next"`)
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/users", nil)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	assert.Equal(t, "@1792281600", rr.Header().Get("Deprecation"))
+	assert.Equal(t, "Fri, 30 Apr 2027 00:00:00 GMT", rr.Header().Get("Sunset"))
+	assert.Equal(t, []string{`</v1/users>; rel="successor-version"`, `</users?cursor=abc>; rel="next"`}, rr.Header().Values("Link"))
+}
+
+func TestDeprecated_WithoutSunset(t *testing.T) {
+	cfg := config.DeprecationConfig{Deprecated: time.Unix(1700000000, 0)}
+	handler := Deprecated(cfg, func(r *http.Request) string { return "/v1/users" })(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/users", nil))
+
+	assert.Equal(t, "@1700000000", rr.Header().Get("Deprecation"))
+	assert.Empty(t, rr.Header().Get("Sunset"))
+}
@@ -0,0 +1,16 @@
+package middleware
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// writeJSONError writes an error response of the form {"error": "<message>"}.
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(map[string]string{"error": message}); err != nil {
+		log.Println("Error encoding JSON error response:", err)
+	}
+}
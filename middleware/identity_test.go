@@ -0,0 +1,71 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUserIDFromContext(t *testing.T) {
+	_, ok := UserIDFromContext(context.Background())
+	assert.False(t, ok)
+
+	userID, ok := UserIDFromContext(WithUserID(context.Background(), "abc"))
+	assert.True(t, ok)
+	assert.Equal(t, "abc", userID)
+}
+
+func TestParseTrustedProxies_Invalid(t *testing.T) {
+	_, err := ParseTrustedProxies([]string{"not-an-ip"})
+	assert.Error(t, err)
+}
+
+func TestClientIP(t *testing.T) {
+	proxies, err := ParseTrustedProxies([]string{"10.0.0.0/8", "::1"})
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  string
+		expected   string
+	}{
+		{"direct client", "203.0.113.7:5555", "", "203.0.113.7"},
+		{"untrusted peer ignores header", "203.0.113.7:5555", "198.51.100.1", "203.0.113.7"},
+		{"trusted peer uses header", "10.1.2.3:5555", "198.51.100.1", "198.51.100.1"},
+		{"spoofed prefix is skipped", "10.1.2.3:5555", "1.1.1.1, 198.51.100.1, 10.9.9.9", "198.51.100.1"},
+		{"ipv6 trusted proxy", "[::1]:5555", "198.51.100.1", "198.51.100.1"},
+		{"garbage stops the walk", "10.1.2.3:5555", "junk", "10.1.2.3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/users", nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.forwarded != "" {
+				req.Header.Set("X-Forwarded-For", tt.forwarded)
+			}
+			assert.Equal(t, tt.expected, proxies.ClientIP(req))
+		})
+	}
+}
+
+func TestTrustedProxies_Middleware(t *testing.T) {
+	proxies, err := ParseTrustedProxies([]string{"10.0.0.0/8"})
+	assert.NoError(t, err)
+	var ip string
+	handler := proxies.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip, _ = ClientIPFromContext(r.Context())
+	}))
+
+	req := httptest.NewRequest("GET", "/users", nil)
+	req.RemoteAddr = "10.1.2.3:5555"
+	req.Header.Set("X-Forwarded-For", "198.51.100.1")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	assert.Equal(t, "198.51.100.1", ip)
+	_, ok := ClientIPFromContext(context.Background())
+	assert.False(t, ok)
+}
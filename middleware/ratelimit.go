@@ -0,0 +1,202 @@
+package middleware
+
+import (
+	"context"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lep13/golang-restful-api/config"
+)
+
+// RateLimitStore keeps the token buckets of the rate limiter. MemoryStore serves
+// a single instance; a shared implementation (e.g. backed by Redis) lets several
+// instances enforce one budget per client.
+type RateLimitStore interface {
+	// Take removes one token from the bucket identified by key, creating it full if needed.
+	Take(ctx context.Context, key string, limit config.RateLimit) (RateLimitResult, error)
+}
+
+// RateLimitResult describes the state of a bucket after a Take.
+type RateLimitResult struct {
+	Allowed   bool
+	Remaining int
+	// Reset is the time until the bucket is full again.
+	Reset time.Duration
+	// RetryAfter is the time until the next token is available when the request was denied.
+	RetryAfter time.Duration
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	full    time.Time
+}
+
+// MemoryStore is an in-process RateLimitStore.
+type MemoryStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// NewMemoryStore creates an empty in-process store.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{buckets: make(map[string]*bucket), now: time.Now}
+}
+
+// sweepInterval is how often idle buckets are dropped from a MemoryStore.
+const sweepInterval = time.Minute
+
+// Take implements RateLimitStore.
+func (s *MemoryStore) Take(_ context.Context, key string, limit config.RateLimit) (RateLimitResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	if now.Sub(s.lastSweep) >= sweepInterval {
+		// A bucket that has refilled completely is indistinguishable from a new one
+		for k, b := range s.buckets {
+			if !now.Before(b.full) {
+				delete(s.buckets, k)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	capacity := float64(limit.Requests)
+	rate := capacity / limit.Period.Seconds()
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: capacity, updated: now}
+		s.buckets[key] = b
+	}
+	b.tokens = math.Min(capacity, b.tokens+now.Sub(b.updated).Seconds()*rate)
+	b.updated = now
+
+	result := RateLimitResult{}
+	if b.tokens >= 1 {
+		b.tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = seconds((1 - b.tokens) / rate)
+	}
+	result.Remaining = int(b.tokens)
+	result.Reset = seconds((capacity - b.tokens) / rate)
+	b.full = now.Add(result.Reset)
+	return result, nil
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// RateLimiter limits requests per route. Authenticated callers are keyed by user
+// ID, so clients sharing an address do not exhaust each other's budget;
+// anonymous callers are keyed by client IP. ClientMiddleware adds a limit per
+// client IP across all routes, checked before the credentials are.
+type RateLimiter struct {
+	store   RateLimitStore
+	limits  config.RateLimitConfig
+	proxies TrustedProxies
+}
+
+// NewRateLimiter creates a rate limiter backed by store.
+func NewRateLimiter(store RateLimitStore, limits config.RateLimitConfig, proxies TrustedProxies) *RateLimiter {
+	return &RateLimiter{store: store, limits: limits, proxies: proxies}
+}
+
+// ClientMiddleware enforces the limit per client IP. It goes before the
+// authentication middleware, so guessed credentials are throttled before
+// they are looked up.
+func (l *RateLimiter) ClientMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit := l.limits.Client
+		if limit.Requests <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		result, ok := l.take(r, "client|ip:"+l.proxies.ClientIP(r), limit)
+		if ok && !result.Allowed {
+			setRateLimitHeaders(w, limit, result)
+			w.Header().Set("Retry-After", ceilSeconds(result.RetryAfter))
+			writeJSONError(w, http.StatusTooManyRequests, "Rate limit exceeded")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Middleware enforces the limits. It must be installed with Router.Use so the
+// matched route is known, and after any authentication middleware.
+func (l *RateLimiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := routeKey(r)
+		limit, ok := l.limits.Routes[route]
+		if !ok {
+			limit = l.limits.Default
+		}
+		if limit.Requests <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key := route + "|ip:" + l.proxies.ClientIP(r)
+		if userID, ok := UserIDFromContext(r.Context()); ok {
+			key = route + "|user:" + userID
+		}
+
+		result, ok := l.take(r, key, limit)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		setRateLimitHeaders(w, limit, result)
+		if !result.Allowed {
+			w.Header().Set("Retry-After", ceilSeconds(result.RetryAfter))
+			writeJSONError(w, http.StatusTooManyRequests, "Rate limit exceeded")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// take removes a token from the bucket identified by key. It reports false
+// when the store failed, and the request should be let through.
+func (l *RateLimiter) take(r *http.Request, key string, limit config.RateLimit) (RateLimitResult, bool) {
+	result, err := l.store.Take(r.Context(), key, limit)
+	if err != nil {
+		// Fail open: an unavailable store must not take the API down
+		log.Printf("Rate limit store error for %s: %v", key, err)
+		return result, false
+	}
+	return result, true
+}
+
+func setRateLimitHeaders(w http.ResponseWriter, limit config.RateLimit, result RateLimitResult) {
+	h := w.Header()
+	h.Set("RateLimit-Policy", strconv.Itoa(limit.Requests)+";w="+strconv.Itoa(int(math.Ceil(limit.Period.Seconds()))))
+	h.Set("RateLimit-Limit", strconv.Itoa(limit.Requests))
+	h.Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	h.Set("RateLimit-Reset", ceilSeconds(result.Reset))
+}
+
+// routeKey identifies the matched route as "METHOD /path/template".
+func routeKey(r *http.Request) string {
+	if route := mux.CurrentRoute(r); route != nil {
+		if template, err := route.GetPathTemplate(); err == nil {
+			return r.Method + " " + template
+		}
+	}
+	return r.Method + " " + r.URL.Path
+}
+
+func ceilSeconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
@@ -0,0 +1,169 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lep13/golang-restful-api/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// MockRateLimitStore simulates a shared rate limit store
+type MockRateLimitStore struct {
+	mock.Mock
+}
+
+func (m *MockRateLimitStore) Take(ctx context.Context, key string, limit config.RateLimit) (RateLimitResult, error) {
+	args := m.Called(ctx, key, limit)
+	return args.Get(0).(RateLimitResult), args.Error(1)
+}
+
+func newLimitedRouter(store RateLimitStore, limits config.RateLimitConfig) *mux.Router {
+	limiter := NewRateLimiter(store, limits, nil)
+	r := mux.NewRouter()
+	r.Use(limiter.ClientMiddleware)
+	r.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if user := r.Header.Get("X-Test-User"); user != "" {
+				r = r.WithContext(WithUserID(r.Context(), user))
+			}
+			next.ServeHTTP(w, r)
+		})
+	})
+	r.Use(limiter.Middleware)
+	ok := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) }
+	r.HandleFunc("/users", ok).Methods("POST", "GET")
+	r.HandleFunc("/users/{id}", ok).Methods("GET")
+	return r
+}
+
+func doRequest(r http.Handler, method, path, remoteAddr, user string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	req.RemoteAddr = remoteAddr
+	if user != "" {
+		req.Header.Set("X-Test-User", user)
+	}
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestMemoryStore_TokenBucket(t *testing.T) {
+	store := NewMemoryStore()
+	now := time.Unix(1000, 0)
+	store.now = func() time.Time { return now }
+	limit := config.RateLimit{Requests: 2, Period: 10 * time.Second}
+
+	first, _ := store.Take(context.Background(), "k", limit)
+	second, _ := store.Take(context.Background(), "k", limit)
+	third, _ := store.Take(context.Background(), "k", limit)
+
+	assert.True(t, first.Allowed)
+	assert.Equal(t, 1, first.Remaining)
+	assert.True(t, second.Allowed)
+	assert.Equal(t, 0, second.Remaining)
+	assert.False(t, third.Allowed)
+	assert.Equal(t, 5*time.Second, third.RetryAfter)
+	assert.Equal(t, 10*time.Second, third.Reset)
+
+	// One token refills every 5 seconds
+	now = now.Add(5 * time.Second)
+	fourth, _ := store.Take(context.Background(), "k", limit)
+	assert.True(t, fourth.Allowed)
+}
+
+func TestMemoryStore_SweepsFullBuckets(t *testing.T) {
+	store := NewMemoryStore()
+	now := time.Unix(1000, 0)
+	store.now = func() time.Time { return now }
+	limit := config.RateLimit{Requests: 1, Period: time.Second}
+
+	_, _ = store.Take(context.Background(), "idle", limit)
+	now = now.Add(2 * sweepInterval)
+	_, _ = store.Take(context.Background(), "active", limit)
+
+	assert.NotContains(t, store.buckets, "idle")
+	assert.Contains(t, store.buckets, "active")
+}
+
+func TestRateLimiter_PerRouteLimitAndHeaders(t *testing.T) {
+	limits := config.RateLimitConfig{
+		Default: config.RateLimit{Requests: 100, Period: time.Minute},
+		Routes:  map[string]config.RateLimit{"POST /users": {Requests: 1, Period: time.Minute}},
+	}
+	r := newLimitedRouter(NewMemoryStore(), limits)
+
+	rr := doRequest(r, "POST", "/users", "203.0.113.7:1", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "1", rr.Header().Get("RateLimit-Limit"))
+	assert.Equal(t, "0", rr.Header().Get("RateLimit-Remaining"))
+	assert.Equal(t, "1;w=60", rr.Header().Get("RateLimit-Policy"))
+
+	rr = doRequest(r, "POST", "/users", "203.0.113.7:2", "")
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assert.Equal(t, "60", rr.Header().Get("Retry-After"))
+	assert.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+	assert.JSONEq(t, `{"error":"Rate limit exceeded"}`, rr.Body.String())
+
+	// Other routes and other clients have their own budgets
+	assert.Equal(t, http.StatusOK, doRequest(r, "GET", "/users", "203.0.113.7:3", "").Code)
+	assert.Equal(t, "100", doRequest(r, "GET", "/users/1", "203.0.113.7:3", "").Header().Get("RateLimit-Limit"))
+	assert.Equal(t, http.StatusOK, doRequest(r, "POST", "/users", "198.51.100.1:1", "").Code)
+}
+
+func TestRateLimiter_KeyedByAuthenticatedUser(t *testing.T) {
+	limits := config.RateLimitConfig{Default: config.RateLimit{Requests: 1, Period: time.Minute}}
+	r := newLimitedRouter(NewMemoryStore(), limits)
+
+	assert.Equal(t, http.StatusOK, doRequest(r, "GET", "/users", "203.0.113.7:1", "alice").Code)
+	assert.Equal(t, http.StatusOK, doRequest(r, "GET", "/users", "203.0.113.7:1", "bob").Code)
+	assert.Equal(t, http.StatusTooManyRequests, doRequest(r, "GET", "/users", "198.51.100.1:1", "alice").Code)
+}
+
+func TestRateLimiter_ClientLimit(t *testing.T) {
+	limits := config.RateLimitConfig{
+		Default: config.RateLimit{Requests: 100, Period: time.Minute},
+		Client:  config.RateLimit{Requests: 2, Period: time.Minute},
+	}
+	r := newLimitedRouter(NewMemoryStore(), limits)
+
+	// The client budget is shared by the routes and users of an address
+	assert.Equal(t, http.StatusOK, doRequest(r, "GET", "/users", "203.0.113.7:1", "alice").Code)
+	assert.Equal(t, http.StatusOK, doRequest(r, "GET", "/users/1", "203.0.113.7:1", "bob").Code)
+	rr := doRequest(r, "POST", "/users", "203.0.113.7:1", "")
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assert.Equal(t, "30", rr.Header().Get("Retry-After"))
+	assert.Equal(t, "2;w=60", rr.Header().Get("RateLimit-Policy"))
+	assert.JSONEq(t, `{"error":"Rate limit exceeded"}`, rr.Body.String())
+
+	assert.Equal(t, http.StatusOK, doRequest(r, "GET", "/users", "198.51.100.1:1", "alice").Code)
+}
+
+func TestRateLimiter_Disabled(t *testing.T) {
+	store := new(MockRateLimitStore)
+	r := newLimitedRouter(store, config.RateLimitConfig{})
+
+	rr := doRequest(r, "GET", "/users", "203.0.113.7:1", "")
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Empty(t, rr.Header().Get("RateLimit-Limit"))
+	store.AssertNotCalled(t, "Take", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestRateLimiter_StoreErrorFailsOpen(t *testing.T) {
+	store := new(MockRateLimitStore)
+	store.On("Take", mock.Anything, "GET /users|ip:203.0.113.7", mock.Anything).Return(RateLimitResult{}, errors.New("store down"))
+	limits := config.RateLimitConfig{Default: config.RateLimit{Requests: 1, Period: time.Minute}}
+	r := newLimitedRouter(store, limits)
+
+	rr := doRequest(r, "GET", "/users", "203.0.113.7:1", "")
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	store.AssertExpectations(t)
+}
@@ -0,0 +1,98 @@
+package middleware
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lep13/golang-restful-api/config"
+	"github.com/stretchr/testify/assert"
+)
+
+var okHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	if _, err := io.ReadAll(r.Body); err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+})
+
+func TestSecurityHeaders(t *testing.T) {
+	cfg := config.SecurityConfig{HSTSMaxAge: 24 * time.Hour, ContentSecurityPolicy: "default-src 'none'"}
+	rr := httptest.NewRecorder()
+
+	SecurityHeaders(cfg)(okHandler).ServeHTTP(rr, httptest.NewRequest("GET", "/users", nil))
+
+	assert.Equal(t, "nosniff", rr.Header().Get("X-Content-Type-Options"))
+	assert.Equal(t, "DENY", rr.Header().Get("X-Frame-Options"))
+	assert.Equal(t, "no-store", rr.Header().Get("Cache-Control"))
+	assert.Equal(t, "default-src 'none'", rr.Header().Get("Content-Security-Policy"))
+	assert.Equal(t, "max-age=86400; includeSubDomains", rr.Header().Get("Strict-Transport-Security"))
+}
+
+func TestSecurityHeaders_HSTSDisabled(t *testing.T) {
+	rr := httptest.NewRecorder()
+
+	SecurityHeaders(config.SecurityConfig{})(okHandler).ServeHTTP(rr, httptest.NewRequest("GET", "/users", nil))
+
+	assert.Empty(t, rr.Header().Get("Strict-Transport-Security"))
+	assert.Empty(t, rr.Header().Get("Content-Security-Policy"))
+}
+
+func TestLimitBody(t *testing.T) {
+	handler := LimitBody(8, Uploads{"PUT /imports": 64})(okHandler)
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("POST", "/users", strings.NewReader("small")))
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("POST", "/users", strings.NewReader("far too large")))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rr.Code)
+	assert.JSONEq(t, `{"error":"Request body too large"}`, rr.Body.String())
+
+	// Chunked bodies have no declared length and are cut off while reading
+	req := httptest.NewRequest("POST", "/users", strings.NewReader("far too large"))
+	req.ContentLength = -1
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rr.Code)
+
+	// Upload routes have their own limit
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("PUT", "/imports", strings.NewReader("far too large")))
+	assert.Equal(t, http.StatusOK, rr.Code)
+}
+
+func TestRequireJSON(t *testing.T) {
+	tests := []struct {
+		method      string
+		path        string
+		contentType string
+		body        string
+		expected    int
+	}{
+		{"POST", "/users", "application/json", "{}", http.StatusOK},
+		{"PUT", "/users", "application/json; charset=utf-8", "{}", http.StatusOK},
+		{"PATCH", "/users", "application/merge-patch+json", "{}", http.StatusOK},
+		{"POST", "/users", "text/plain", "{}", http.StatusUnsupportedMediaType},
+		{"PUT", "/users", "", "{}", http.StatusUnsupportedMediaType},
+		{"POST", "/users", "", "", http.StatusOK},
+		{"GET", "/users", "text/plain", "", http.StatusOK},
+		{"POST", "/imports", "text/csv", "name\n", http.StatusOK},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+		if tt.contentType != "" {
+			req.Header.Set("Content-Type", tt.contentType)
+		}
+		rr := httptest.NewRecorder()
+
+		RequireJSON(Uploads{"POST /imports": 0})(okHandler).ServeHTTP(rr, req)
+
+		assert.Equal(t, tt.expected, rr.Code, "%s %s %q", tt.method, tt.path, tt.contentType)
+	}
+}
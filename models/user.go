@@ -1,10 +1,185 @@
 package models
 
-import "go.mongodb.org/mongo-driver/bson/primitive"
+import (
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson/primitive"
+)
 
 type User struct {
     ID       primitive.ObjectID `json:"_id,omitempty" bson:"_id,omitempty"`
     Name     string             `json:"name,omitempty" bson:"name,omitempty"`
     Email    string             `json:"email,omitempty" bson:"email,omitempty"`
     Password string             `json:"password,omitempty" bson:"password,omitempty"`
+    // EmailVerified is set once the user proves they own Email; it is read-only for clients
+    EmailVerified bool `json:"email_verified,omitempty" bson:"email_verified,omitempty"`
+    // EmailVerification is the pending verification of Email, never serialized to clients
+    EmailVerification *EmailVerification `json:"-" bson:"email_verification,omitempty"`
+    // PasswordReset is the pending reset of Password, never serialized to clients
+    PasswordReset *PasswordReset `json:"-" bson:"password_reset,omitempty"`
+    // MagicLink is the pending passwordless login of the user, never serialized to clients
+    MagicLink *MagicLink `json:"-" bson:"magic_link,omitempty"`
+    // SessionsRevokedAt invalidates the sessions and tokens issued to the user before it
+    SessionsRevokedAt time.Time `json:"-" bson:"sessions_revoked_at,omitempty"`
+    // MFA is the second login factor of the user, never serialized to clients
+    MFA *MFA `json:"-" bson:"mfa,omitempty"`
+    // Admin lets the user manage other accounts, such as unlocking them. It is
+    // granted in the database and never serialized to clients.
+    Admin bool `json:"-" bson:"admin,omitempty"`
+    // LoginFailures counts the recent failed logins of the user, never serialized to clients
+    LoginFailures *LoginFailures `json:"-" bson:"login_failures,omitempty"`
+    // APIKeys let machine clients act as the user, never serialized to clients
+    APIKeys []APIKey `json:"-" bson:"api_keys,omitempty"`
+    // Sessions are the logins of the user, never serialized to clients
+    Sessions []Session `json:"-" bson:"sessions,omitempty"`
+    // OAuthClients are the OAuth clients the user registered, never serialized to clients
+    OAuthClients []OAuthClient `json:"-" bson:"oauth_clients,omitempty"`
+    // OAuthConsents are the scopes the user granted to OAuth clients, keyed by
+    // client ID and never serialized to clients
+    OAuthConsents map[string]OAuthConsent `json:"-" bson:"oauth_consents,omitempty"`
+    // OAuthCodes are the unredeemed authorization codes issued for the user,
+    // never serialized to clients
+    OAuthCodes []OAuthCode `json:"-" bson:"oauth_codes,omitempty"`
+    // Identities are the accounts at upstream OpenID Connect providers the
+    // user signs in with, never serialized to clients
+    Identities []Identity `json:"-" bson:"identities,omitempty"`
+    // Deactivated users cannot log in and their tokens and API keys are
+    // rejected. It is set over SCIM and never serialized to clients.
+    Deactivated bool `json:"-" bson:"deactivated,omitempty"`
+    // SCIM holds the attributes provisioned over SCIM that have no field of
+    // their own, never serialized to clients
+    SCIM *SCIMAttributes `json:"-" bson:"scim,omitempty"`
+}
+
+// EmailVerification is a single-use token proving ownership of an email
+// address. Only the SHA-256 hash of the token is stored.
+type EmailVerification struct {
+    TokenHash string    `bson:"token_hash"`
+    ExpiresAt time.Time `bson:"expires_at"`
+    SentAt    time.Time `bson:"sent_at"`
+}
+
+// PasswordReset is a single-use token allowing a user who forgot their
+// password to set a new one. Only the SHA-256 hash of the token is stored.
+type PasswordReset struct {
+    TokenHash string    `bson:"token_hash"`
+    ExpiresAt time.Time `bson:"expires_at"`
+    SentAt    time.Time `bson:"sent_at"`
+}
+
+// MagicLink is a single-use link logging a user in without their password.
+// The link carries a signed token; only the SHA-256 hash of its ID is stored,
+// and consumed by the login.
+type MagicLink struct {
+    TokenHash string    `bson:"token_hash"`
+    ExpiresAt time.Time `bson:"expires_at"`
+    SentAt    time.Time `bson:"sent_at"`
+}
+
+// MFA is a TOTP (RFC 6238) second factor. PendingSecret is set between the
+// start of an enrollment and its confirmation with a first code; Secret once
+// MFA is enabled.
+type MFA struct {
+    Enabled       bool   `bson:"enabled"`
+    Secret        string `bson:"secret,omitempty"`
+    PendingSecret string `bson:"pending_secret,omitempty"`
+    // RecoveryCodes are the SHA-256 hashes of the unused recovery codes
+    RecoveryCodes []string `bson:"recovery_codes,omitempty"`
+    // LastStep is the time step of the last accepted code. Codes of it and
+    // earlier steps are rejected, so a code cannot be replayed.
+    LastStep  int64     `bson:"last_step"`
+    EnabledAt time.Time `bson:"enabled_at,omitempty"`
+}
+
+// LoginFailures counts the failed logins of an account since its last
+// successful login, to slow down and lock out password guessing.
+type LoginFailures struct {
+    Count        int       `bson:"count"`
+    LastFailedAt time.Time `bson:"last_failed_at"`
+    // LockedUntil is set when Count reaches the lockout threshold
+    LockedUntil time.Time `bson:"locked_until,omitempty"`
+}
+
+// APIKey lets a machine client call the API as its user, limited to Scopes.
+// Only the SHA-256 hash of the key is stored; Prefix, which is part of the
+// key, finds it.
+type APIKey struct {
+    ID        primitive.ObjectID `bson:"_id"`
+    Name      string             `bson:"name"`
+    Prefix    string             `bson:"prefix"`
+    Hash      string             `bson:"hash"`
+    Scopes    []string           `bson:"scopes"`
+    CreatedAt time.Time          `bson:"created_at"`
+    // ExpiresAt is zero for keys that do not expire
+    ExpiresAt  time.Time `bson:"expires_at,omitempty"`
+    LastUsedAt time.Time `bson:"last_used_at,omitempty"`
+}
+
+// Session is a login of the user. The access token issued at the login names
+// it, and is only accepted while the session exists.
+type Session struct {
+    ID         primitive.ObjectID `bson:"_id"`
+    CreatedAt  time.Time          `bson:"created_at"`
+    LastSeenAt time.Time          `bson:"last_seen_at"`
+    ExpiresAt  time.Time          `bson:"expires_at"`
+    IP         string             `bson:"ip,omitempty"`
+    UserAgent  string             `bson:"user_agent,omitempty"`
+    // ClientID names the OAuth client the session was started for, if any
+    ClientID string `bson:"client_id,omitempty"`
+}
+
+// OAuthClient is an application registered to sign users in with the API
+// (RFC 6749). Only the SHA-256 hash of its secret is stored; public clients,
+// such as single page apps, have none and rely on PKCE alone.
+type OAuthClient struct {
+    ClientID     string   `bson:"client_id"`
+    SecretHash   string   `bson:"secret_hash,omitempty"`
+    Name         string   `bson:"name"`
+    RedirectURIs []string `bson:"redirect_uris"`
+    // TokenEndpointAuthMethod is client_secret_basic, client_secret_post or none
+    TokenEndpointAuthMethod string    `bson:"token_endpoint_auth_method"`
+    CreatedAt               time.Time `bson:"created_at"`
+}
+
+// OAuthConsent records the scopes a user allowed an OAuth client
+type OAuthConsent struct {
+    Scopes    []string  `bson:"scopes"`
+    GrantedAt time.Time `bson:"granted_at"`
+}
+
+// OAuthCode is an authorization code, redeemed once by its client for tokens.
+// Only the SHA-256 hash of the code is stored. RedirectURIExplicit records
+// that the client sent RedirectURI rather than relying on its only one.
+type OAuthCode struct {
+    Hash                string    `bson:"hash"`
+    ClientID            string    `bson:"client_id"`
+    RedirectURI         string    `bson:"redirect_uri"`
+    RedirectURIExplicit bool      `bson:"redirect_uri_explicit,omitempty"`
+    Scopes              []string  `bson:"scopes"`
+    CodeChallenge       string    `bson:"code_challenge"`
+    Nonce               string    `bson:"nonce,omitempty"`
+    ExpiresAt           time.Time `bson:"expires_at"`
+}
+
+// Identity is an account at an upstream OpenID Connect provider linked to the
+// user. Issuer and Subject identify it; Email is the verified email it had
+// when linked.
+type Identity struct {
+    ID          primitive.ObjectID `bson:"_id"`
+    Provider    string             `bson:"provider"`
+    Issuer      string             `bson:"issuer"`
+    Subject     string             `bson:"subject"`
+    Email       string             `bson:"email,omitempty"`
+    LinkedAt    time.Time          `bson:"linked_at"`
+    LastLoginAt time.Time          `bson:"last_login_at,omitempty"`
+}
+
+// SCIMAttributes are the SCIM (RFC 7643) attributes of a user that the other
+// fields do not hold. LastModified is the time of the last change made over
+// SCIM.
+type SCIMAttributes struct {
+    ExternalID   string    `bson:"external_id,omitempty"`
+    GivenName    string    `bson:"given_name,omitempty"`
+    FamilyName   string    `bson:"family_name,omitempty"`
+    LastModified time.Time `bson:"last_modified,omitempty"`
 }
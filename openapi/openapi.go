@@ -0,0 +1,43 @@
+package openapi
+
+import (
+	_ "embed"
+	"log"
+	"net/http"
+)
+
+// Spec is the OpenAPI 3.1 document describing the API.
+//
+//go:embed openapi.json
+var Spec []byte
+
+//go:embed docs.html
+var docsPage []byte
+
+// redocScript is the Redoc bundle docs.html loads, pinned to a release
+const redocScript = "https://cdn.redoc.ly/redoc/v2.1.5/bundles/redoc.standalone.js"
+
+// docsPolicy relaxes the default Content-Security-Policy just enough for the
+// Redoc bundle to render the specification. Scripts are limited to the pinned
+// bundle itself, not the whole CDN.
+const docsPolicy = "default-src 'none'; script-src " + redocScript + "; style-src 'unsafe-inline' https://fonts.googleapis.com; " +
+	"font-src https://fonts.gstatic.com; img-src data: https://cdn.redoc.ly; connect-src 'self'; worker-src blob:; frame-ancestors 'none'"
+
+// SpecHandler serves the OpenAPI document.
+func SpecHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	if _, err := w.Write(Spec); err != nil {
+		log.Printf("Error writing OpenAPI document: %v", err)
+	}
+}
+
+// DocsHandler serves an HTML page rendering the OpenAPI document with Redoc.
+func DocsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.Header().Set("Content-Security-Policy", docsPolicy)
+	if _, err := w.Write(docsPage); err != nil {
+		log.Printf("Error writing docs page: %v", err)
+	}
+}
@@ -0,0 +1,109 @@
+package openapi
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/lep13/golang-restful-api/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func parseSpec(t *testing.T) map[string]interface{} {
+	var spec map[string]interface{}
+	require.NoError(t, json.Unmarshal(Spec, &spec))
+	return spec
+}
+
+// lookup follows a JSON pointer such as "#/components/schemas/User"
+func lookup(spec map[string]interface{}, ref string) (interface{}, bool) {
+	var node interface{} = spec
+	for _, part := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+		object, ok := node.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if node, ok = object[part]; !ok {
+			return nil, false
+		}
+	}
+	return node, true
+}
+
+func collectRefs(node interface{}, refs *[]string) {
+	switch v := node.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			if ref, ok := child.(string); ok && key == "$ref" {
+				*refs = append(*refs, ref)
+			}
+			collectRefs(child, refs)
+		}
+	case []interface{}:
+		for _, child := range v {
+			collectRefs(child, refs)
+		}
+	}
+}
+
+func TestSpec_Version(t *testing.T) {
+	spec := parseSpec(t)
+	assert.Equal(t, "3.1.0", spec["openapi"])
+}
+
+func TestSpec_RefsResolve(t *testing.T) {
+	spec := parseSpec(t)
+	var refs []string
+	collectRefs(spec, &refs)
+	require.NotEmpty(t, refs)
+	for _, ref := range refs {
+		_, ok := lookup(spec, ref)
+		assert.True(t, ok, "unresolved $ref %s", ref)
+	}
+}
+
+// The User schema must list exactly the JSON fields of models.User
+func TestSpec_UserSchemaMatchesModel(t *testing.T) {
+	spec := parseSpec(t)
+	node, ok := lookup(spec, "#/components/schemas/User/properties")
+	require.True(t, ok)
+
+	var documented []string
+	for name := range node.(map[string]interface{}) {
+		documented = append(documented, name)
+	}
+	var fields []string
+	userType := reflect.TypeOf(models.User{})
+	for i := 0; i < userType.NumField(); i++ {
+		name := strings.Split(userType.Field(i).Tag.Get("json"), ",")[0]
+		if name != "" && name != "-" {
+			fields = append(fields, name)
+		}
+	}
+	sort.Strings(documented)
+	sort.Strings(fields)
+	assert.Equal(t, fields, documented)
+}
+
+func TestSpecHandler(t *testing.T) {
+	rr := httptest.NewRecorder()
+	SpecHandler(rr, httptest.NewRequest("GET", "/openapi.json", nil))
+
+	assert.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+	assert.Equal(t, Spec, rr.Body.Bytes())
+}
+
+func TestDocsHandler(t *testing.T) {
+	rr := httptest.NewRecorder()
+	DocsHandler(rr, httptest.NewRequest("GET", "/docs", nil))
+
+	assert.Contains(t, rr.Header().Get("Content-Type"), "text/html")
+	assert.Contains(t, rr.Header().Get("Content-Security-Policy"), "script-src "+redocScript+";")
+	assert.Contains(t, rr.Body.String(), `spec-url="/openapi.json"`)
+	// The page loads the very bundle the policy allows
+	assert.Contains(t, rr.Body.String(), `<script src="`+redocScript+`" crossorigin="anonymous"`)
+}
@@ -0,0 +1,252 @@
+package openapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/mail"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Violation describes one way a request or response breaks the specification.
+type Violation struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// Schema is the subset of JSON Schema used by openapi.json.
+type Schema struct {
+	Ref                  string             `json:"$ref"`
+	Type                 schemaType         `json:"type"`
+	Properties           map[string]*Schema `json:"properties"`
+	Required             []string           `json:"required"`
+	AdditionalProperties *bool              `json:"additionalProperties"`
+	Items                *Schema            `json:"items"`
+	Enum                 []interface{}      `json:"enum"`
+	Const                interface{}        `json:"const"`
+	Pattern              string             `json:"pattern"`
+	Format               string             `json:"format"`
+	MinLength            *int               `json:"minLength"`
+	MaxLength            *int               `json:"maxLength"`
+	Minimum              *float64           `json:"minimum"`
+	Maximum              *float64           `json:"maximum"`
+	MinItems             *int               `json:"minItems"`
+	MaxItems             *int               `json:"maxItems"`
+	ReadOnly             bool               `json:"readOnly"`
+	WriteOnly            bool               `json:"writeOnly"`
+
+	pattern *regexp.Regexp
+}
+
+// schemaType accepts both "string" and ["string", "null"].
+type schemaType []string
+
+func (t *schemaType) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*t = schemaType{single}
+		return nil
+	}
+	var multiple []string
+	if err := json.Unmarshal(data, &multiple); err != nil {
+		return err
+	}
+	*t = multiple
+	return nil
+}
+
+// direction tells the validator whether readOnly or writeOnly properties apply.
+type direction int
+
+const (
+	inRequest direction = iota
+	inResponse
+)
+
+// validate checks value, decoded with json.Decoder.UseNumber, against the schema.
+func (d *document) validate(s *Schema, value interface{}, field string, dir direction) []Violation {
+	if s == nil {
+		return nil
+	}
+	if s.Ref != "" {
+		target, err := d.schema(s.Ref)
+		if err != nil {
+			return []Violation{{Field: field, Message: err.Error()}}
+		}
+		return d.validate(target, value, field, dir)
+	}
+
+	actual := jsonType(value)
+	if len(s.Type) > 0 && !s.Type.allows(actual) {
+		return []Violation{{Field: field, Message: fmt.Sprintf("must be of type %s, got %s", strings.Join(s.Type, " or "), actual)}}
+	}
+	if s.Const != nil && !equalJSON(s.Const, value) {
+		return []Violation{{Field: field, Message: fmt.Sprintf("must be %v", s.Const)}}
+	}
+	if len(s.Enum) > 0 && !containsJSON(s.Enum, value) {
+		return []Violation{{Field: field, Message: fmt.Sprintf("must be one of %v", s.Enum)}}
+	}
+
+	switch v := value.(type) {
+	case string:
+		return s.validateString(v, field)
+	case json.Number:
+		return s.validateNumber(v, field)
+	case []interface{}:
+		var violations []Violation
+		if s.MinItems != nil && len(v) < *s.MinItems {
+			violations = append(violations, Violation{Field: field, Message: fmt.Sprintf("must contain at least %d items", *s.MinItems)})
+		}
+		if s.MaxItems != nil && len(v) > *s.MaxItems {
+			violations = append(violations, Violation{Field: field, Message: fmt.Sprintf("must contain at most %d items", *s.MaxItems)})
+		}
+		for i, item := range v {
+			violations = append(violations, d.validate(s.Items, item, fmt.Sprintf("%s[%d]", field, i), dir)...)
+		}
+		return violations
+	case map[string]interface{}:
+		return d.validateObject(s, v, field, dir)
+	}
+	return nil
+}
+
+func (d *document) validateObject(s *Schema, object map[string]interface{}, field string, dir direction) []Violation {
+	var violations []Violation
+	for _, name := range s.Required {
+		if _, ok := object[name]; !ok && !d.hiddenIn(s.Properties[name], dir) {
+			violations = append(violations, Violation{Field: join(field, name), Message: "is required"})
+		}
+	}
+
+	names := make([]string, 0, len(object))
+	for name := range object {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		property, ok := s.Properties[name]
+		if !ok {
+			if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+				violations = append(violations, Violation{Field: join(field, name), Message: "is not allowed"})
+			}
+			continue
+		}
+		if dir == inResponse && d.hiddenIn(property, inResponse) {
+			violations = append(violations, Violation{Field: join(field, name), Message: "is write-only and must not be returned"})
+			continue
+		}
+		violations = append(violations, d.validate(property, object[name], join(field, name), dir)...)
+	}
+	return violations
+}
+
+// hiddenIn reports whether a property is readOnly in requests or writeOnly in responses.
+func (d *document) hiddenIn(s *Schema, dir direction) bool {
+	for s != nil {
+		if (dir == inRequest && s.ReadOnly) || (dir == inResponse && s.WriteOnly) {
+			return true
+		}
+		if s.Ref == "" {
+			return false
+		}
+		s, _ = d.schema(s.Ref)
+	}
+	return false
+}
+
+func (s *Schema) validateString(value, field string) []Violation {
+	var violations []Violation
+	length := utf8.RuneCountInString(value)
+	if s.MinLength != nil && length < *s.MinLength {
+		violations = append(violations, Violation{Field: field, Message: fmt.Sprintf("must be at least %d characters", *s.MinLength)})
+	}
+	if s.MaxLength != nil && length > *s.MaxLength {
+		violations = append(violations, Violation{Field: field, Message: fmt.Sprintf("must be at most %d characters", *s.MaxLength)})
+	}
+	if s.pattern != nil && !s.pattern.MatchString(value) {
+		violations = append(violations, Violation{Field: field, Message: fmt.Sprintf("must match %s", s.Pattern)})
+	}
+	switch s.Format {
+	case "email":
+		if address, err := mail.ParseAddress(value); err != nil || address.Address != value {
+			violations = append(violations, Violation{Field: field, Message: "must be a valid email address"})
+		}
+	case "date-time":
+		if _, err := time.Parse(time.RFC3339, value); err != nil {
+			violations = append(violations, Violation{Field: field, Message: "must be an RFC 3339 date-time"})
+		}
+	}
+	return violations
+}
+
+func (s *Schema) validateNumber(value json.Number, field string) []Violation {
+	n, err := value.Float64()
+	if err != nil {
+		return []Violation{{Field: field, Message: "must be a number"}}
+	}
+	if s.Minimum != nil && n < *s.Minimum {
+		return []Violation{{Field: field, Message: fmt.Sprintf("must be at least %v", *s.Minimum)}}
+	}
+	if s.Maximum != nil && n > *s.Maximum {
+		return []Violation{{Field: field, Message: fmt.Sprintf("must be at most %v", *s.Maximum)}}
+	}
+	return nil
+}
+
+func (t schemaType) allows(actual string) bool {
+	for _, allowed := range t {
+		if allowed == actual || (allowed == "number" && actual == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+func jsonType(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case json.Number:
+		if _, err := v.Int64(); err == nil {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	default:
+		return "object"
+	}
+}
+
+// equalJSON compares a value from the spec with a value decoded with UseNumber.
+func equalJSON(expected, actual interface{}) bool {
+	if number, ok := actual.(json.Number); ok {
+		f, err := number.Float64()
+		return err == nil && expected == f
+	}
+	return reflect.DeepEqual(expected, actual)
+}
+
+func containsJSON(values []interface{}, actual interface{}) bool {
+	for _, value := range values {
+		if equalJSON(value, actual) {
+			return true
+		}
+	}
+	return false
+}
+
+func join(field, name string) string {
+	if field == "" {
+		return name
+	}
+	return field + "." + name
+}
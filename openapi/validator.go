@@ -0,0 +1,504 @@
+package openapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/lep13/golang-restful-api/middleware"
+)
+
+// Parameter is an operation or path item parameter.
+type Parameter struct {
+	Ref      string  `json:"$ref"`
+	Name     string  `json:"name"`
+	In       string  `json:"in"`
+	Required bool    `json:"required"`
+	Schema   *Schema `json:"schema"`
+}
+
+// MediaType holds the schema of one content type.
+type MediaType struct {
+	Schema *Schema `json:"schema"`
+}
+
+// RequestBody describes the body accepted by an operation.
+type RequestBody struct {
+	Required bool                  `json:"required"`
+	Content  map[string]*MediaType `json:"content"`
+}
+
+// Response describes one documented response.
+type Response struct {
+	Ref     string                `json:"$ref"`
+	Content map[string]*MediaType `json:"content"`
+}
+
+// Operation is a method on a path.
+type Operation struct {
+	OperationID string               `json:"operationId"`
+	Parameters  []*Parameter         `json:"parameters"`
+	RequestBody *RequestBody         `json:"requestBody"`
+	Responses   map[string]*Response `json:"responses"`
+}
+
+type document struct {
+	Paths      map[string]map[string]json.RawMessage `json:"paths"`
+	Components struct {
+		Schemas    map[string]*Schema    `json:"schemas"`
+		Parameters map[string]*Parameter `json:"parameters"`
+		Responses  map[string]*Response  `json:"responses"`
+	} `json:"components"`
+
+	// operations is keyed by "METHOD /path/template"
+	operations map[string]*Operation
+}
+
+var methods = []string{"get", "put", "post", "delete", "patch", "head", "options", "trace"}
+
+// parse decodes the specification and indexes its operations.
+func parse(spec []byte) (*document, error) {
+	var d document
+	if err := json.Unmarshal(spec, &d); err != nil {
+		return nil, err
+	}
+	d.operations = make(map[string]*Operation)
+	for path, item := range d.Paths {
+		var shared []*Parameter
+		if raw, ok := item["parameters"]; ok {
+			if err := json.Unmarshal(raw, &shared); err != nil {
+				return nil, fmt.Errorf("%s parameters: %w", path, err)
+			}
+		}
+		for _, method := range methods {
+			raw, ok := item[method]
+			if !ok {
+				continue
+			}
+			var op Operation
+			if err := json.Unmarshal(raw, &op); err != nil {
+				return nil, fmt.Errorf("%s %s: %w", method, path, err)
+			}
+			op.Parameters = append(append([]*Parameter{}, shared...), op.Parameters...)
+			for i, p := range op.Parameters {
+				resolved, err := d.parameter(p)
+				if err != nil {
+					return nil, err
+				}
+				op.Parameters[i] = resolved
+			}
+			d.operations[strings.ToUpper(method)+" "+path] = &op
+		}
+	}
+	if err := d.compilePatterns(); err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// compilePatterns compiles every "pattern" keyword once up front.
+func (d *document) compilePatterns() error {
+	var compile func(s *Schema) error
+	compile = func(s *Schema) error {
+		if s == nil {
+			return nil
+		}
+		if s.Pattern != "" && s.pattern == nil {
+			re, err := regexp.Compile(s.Pattern)
+			if err != nil {
+				return fmt.Errorf("invalid pattern %q: %w", s.Pattern, err)
+			}
+			s.pattern = re
+		}
+		for _, property := range s.Properties {
+			if err := compile(property); err != nil {
+				return err
+			}
+		}
+		return compile(s.Items)
+	}
+	for _, s := range d.Components.Schemas {
+		if err := compile(s); err != nil {
+			return err
+		}
+	}
+	for _, op := range d.operations {
+		for _, p := range op.Parameters {
+			if err := compile(p.Schema); err != nil {
+				return err
+			}
+		}
+		if op.RequestBody != nil {
+			for _, media := range op.RequestBody.Content {
+				if err := compile(media.Schema); err != nil {
+					return err
+				}
+			}
+		}
+		for _, response := range op.Responses {
+			for _, media := range response.Content {
+				if err := compile(media.Schema); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func refName(ref, prefix string) (string, error) {
+	if !strings.HasPrefix(ref, prefix) {
+		return "", fmt.Errorf("unsupported $ref %q", ref)
+	}
+	return strings.TrimPrefix(ref, prefix), nil
+}
+
+func (d *document) schema(ref string) (*Schema, error) {
+	name, err := refName(ref, "#/components/schemas/")
+	if err != nil {
+		return nil, err
+	}
+	s, ok := d.Components.Schemas[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown schema %q", ref)
+	}
+	return s, nil
+}
+
+func (d *document) parameter(p *Parameter) (*Parameter, error) {
+	if p.Ref == "" {
+		return p, nil
+	}
+	name, err := refName(p.Ref, "#/components/parameters/")
+	if err != nil {
+		return nil, err
+	}
+	resolved, ok := d.Components.Parameters[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown parameter %q", p.Ref)
+	}
+	return resolved, nil
+}
+
+func (d *document) response(r *Response) (*Response, error) {
+	if r.Ref == "" {
+		return r, nil
+	}
+	name, err := refName(r.Ref, "#/components/responses/")
+	if err != nil {
+		return nil, err
+	}
+	resolved, ok := d.Components.Responses[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown response %q", r.Ref)
+	}
+	return resolved, nil
+}
+
+// Validator checks requests, and optionally responses, against the specification.
+type Validator struct {
+	doc *document
+
+	// ValidateResponses buffers every response and checks it against the
+	// specification. It is meant for debugging and tests, not production.
+	ValidateResponses bool
+	// OnResponseViolation is called with the violations of a response. When
+	// nil, violations are logged and the response is replaced by a 500.
+	OnResponseViolation func(r *http.Request, violations []Violation)
+}
+
+// NewValidator creates a validator for the given OpenAPI document.
+func NewValidator(spec []byte) (*Validator, error) {
+	doc, err := parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	return &Validator{doc: doc}, nil
+}
+
+// Operation returns the documented operation for a method and path template.
+func (v *Validator) Operation(method, pathTemplate string) (*Operation, bool) {
+	op, ok := v.doc.operations[method+" "+pathTemplate]
+	return op, ok
+}
+
+// Middleware rejects requests that do not match the specification with a 400
+// listing the violations. It must be installed with Router.Use so the
+// matched route is known; requests to undocumented routes pass through.
+func (v *Validator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := mux.CurrentRoute(r)
+		if route == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		template, err := route.GetPathTemplate()
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		op, ok := v.Operation(r.Method, template)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		violations, err := v.ValidateRequest(r, op, mux.Vars(r))
+		if err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				writeViolations(w, http.StatusRequestEntityTooLarge, "Request body too large", nil)
+			} else {
+				writeViolations(w, http.StatusBadRequest, "Failed to read request body", nil)
+			}
+			return
+		}
+		if len(violations) > 0 {
+			writeViolations(w, http.StatusBadRequest, "Request validation failed", violations)
+			return
+		}
+
+		if !v.ValidateResponses {
+			next.ServeHTTP(w, r)
+			return
+		}
+		recorder := &responseRecorder{header: make(http.Header), status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+		if recorder.header.Get("Content-Type") == "" && recorder.body.Len() > 0 {
+			// Mirror net/http, which sniffs the type of untyped responses
+			recorder.header.Set("Content-Type", http.DetectContentType(recorder.body.Bytes()))
+		}
+		if violations := v.ValidateResponse(op, recorder.status, recorder.header, recorder.body.Bytes()); len(violations) > 0 {
+			if v.OnResponseViolation != nil {
+				v.OnResponseViolation(r, violations)
+			} else {
+				log.Printf("Response to %s %s violates the OpenAPI specification: %+v", r.Method, r.URL.Path, violations)
+				writeViolations(w, http.StatusInternalServerError, "Response validation failed", violations)
+				return
+			}
+		}
+		recorder.flushTo(w)
+	})
+}
+
+// ValidateRequest checks path and query parameters and the JSON body of r.
+// The body is read and replaced so handlers can decode it again. An error is
+// returned only when the body cannot be read.
+func (v *Validator) ValidateRequest(r *http.Request, op *Operation, pathParams map[string]string) ([]Violation, error) {
+	var violations []Violation
+	query := r.URL.Query()
+	for _, p := range op.Parameters {
+		switch p.In {
+		case "path":
+			violations = append(violations, v.validateParameter(p, pathParams[p.Name], true, "path")...)
+		case "query":
+			_, present := query[p.Name]
+			violations = append(violations, v.validateParameter(p, query.Get(p.Name), present, "query")...)
+		}
+	}
+
+	if op.RequestBody == nil {
+		return violations, nil
+	}
+	// Documented uploads such as CSV are streamed by the handler, so only
+	// their presence is checked here
+	if !middleware.IsJSON(r.Header.Get("Content-Type")) {
+		if _, documented := op.RequestBody.Content[mediaType(r.Header.Get("Content-Type"))]; documented {
+			if r.ContentLength == 0 && op.RequestBody.Required {
+				violations = append(violations, Violation{Field: "body", Message: "is required"})
+			}
+			return violations, nil
+		}
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	if len(bytes.TrimSpace(body)) == 0 {
+		if op.RequestBody.Required {
+			violations = append(violations, Violation{Field: "body", Message: "is required"})
+		}
+		return violations, nil
+	}
+	media, ok := op.RequestBody.Content[mediaType(r.Header.Get("Content-Type"))]
+	if !ok {
+		media, ok = op.RequestBody.Content["application/json"]
+	}
+	if !ok || media.Schema == nil {
+		return violations, nil
+	}
+	value, err := decode(body)
+	if err != nil {
+		return append(violations, Violation{Field: "body", Message: "must be valid JSON"}), nil
+	}
+	return append(violations, v.doc.validate(media.Schema, value, "body", inRequest)...), nil
+}
+
+// ValidateSchema checks a value decoded with json.Decoder.UseNumber against a
+// schema of components.schemas, as a request body would be checked. It lets
+// input that does not arrive as a JSON body, such as imported rows, follow the
+// same rules.
+func (v *Validator) ValidateSchema(name string, value interface{}) []Violation {
+	s, err := v.doc.schema("#/components/schemas/" + name)
+	if err != nil {
+		return []Violation{{Message: err.Error()}}
+	}
+	return v.doc.validate(s, value, "", inRequest)
+}
+
+// validateParameter converts a raw string parameter to the type its schema
+// declares before validating it.
+func (v *Validator) validateParameter(p *Parameter, raw string, present bool, location string) []Violation {
+	field := location + "." + p.Name
+	if !present || raw == "" {
+		if p.Required {
+			return []Violation{{Field: field, Message: "is required"}}
+		}
+		return nil
+	}
+	var value interface{} = raw
+	if s := v.resolved(p.Schema); s != nil && len(s.Type) > 0 {
+		switch s.Type[0] {
+		case "integer":
+			if _, err := strconv.ParseInt(raw, 10, 64); err != nil {
+				return []Violation{{Field: field, Message: "must be an integer"}}
+			}
+			value = json.Number(raw)
+		case "number":
+			if _, err := strconv.ParseFloat(raw, 64); err != nil {
+				return []Violation{{Field: field, Message: "must be a number"}}
+			}
+			value = json.Number(raw)
+		case "boolean":
+			b, err := strconv.ParseBool(raw)
+			if err != nil {
+				return []Violation{{Field: field, Message: "must be true or false"}}
+			}
+			value = b
+		}
+	}
+	return v.doc.validate(p.Schema, value, field, inRequest)
+}
+
+func (v *Validator) resolved(s *Schema) *Schema {
+	for s != nil && s.Ref != "" {
+		s, _ = v.doc.schema(s.Ref)
+	}
+	return s
+}
+
+// ValidateResponse checks that the status code is documented for the
+// operation and that a JSON body matches the documented schema.
+func (v *Validator) ValidateResponse(op *Operation, status int, header http.Header, body []byte) []Violation {
+	code := strconv.Itoa(status)
+	response, ok := op.Responses[code]
+	if !ok {
+		response, ok = op.Responses[code[:1]+"XX"]
+	}
+	if !ok {
+		response, ok = op.Responses["default"]
+	}
+	if !ok {
+		return []Violation{{Field: "status", Message: fmt.Sprintf("%d is not documented", status)}}
+	}
+	response, err := v.doc.response(response)
+	if err != nil {
+		return []Violation{{Field: "status", Message: err.Error()}}
+	}
+
+	if len(response.Content) == 0 {
+		if len(body) > 0 {
+			return []Violation{{Field: "body", Message: "no content is documented"}}
+		}
+		return nil
+	}
+	contentType := mediaType(header.Get("Content-Type"))
+	media, ok := response.Content[contentType]
+	if !ok {
+		return []Violation{{Field: "header.Content-Type", Message: fmt.Sprintf("%q is not documented", contentType)}}
+	}
+	if contentType != "application/json" || media.Schema == nil {
+		return nil
+	}
+	value, err := decode(body)
+	if err != nil {
+		return []Violation{{Field: "body", Message: "must be valid JSON"}}
+	}
+	return v.doc.validate(media.Schema, value, "body", inResponse)
+}
+
+func decode(body []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	if decoder.More() {
+		return nil, errors.New("trailing data after JSON value")
+	}
+	return value, nil
+}
+
+func mediaType(contentType string) string {
+	parsed, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return contentType
+	}
+	return parsed
+}
+
+// writeViolations writes {"error": message, "details": violations}.
+func writeViolations(w http.ResponseWriter, status int, message string, violations []Violation) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	response := struct {
+		Error   string      `json:"error"`
+		Details []Violation `json:"details,omitempty"`
+	}{message, violations}
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Println("Error encoding JSON error response:", err)
+	}
+}
+
+// responseRecorder buffers a response until it has been validated.
+type responseRecorder struct {
+	header      http.Header
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (r *responseRecorder) Header() http.Header { return r.header }
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status = status
+		r.wroteHeader = true
+	}
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.wroteHeader = true
+	return r.body.Write(b)
+}
+
+func (r *responseRecorder) flushTo(w http.ResponseWriter) {
+	for key, values := range r.header {
+		w.Header()[key] = values
+	}
+	w.WriteHeader(r.status)
+	if _, err := w.Write(r.body.Bytes()); err != nil {
+		log.Printf("Error writing validated response: %v", err)
+	}
+}
@@ -0,0 +1,296 @@
+package openapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testSpec = `{
+  "openapi": "3.1.0",
+  "paths": {
+    "/items": {
+      "get": {
+        "parameters": [
+          { "name": "limit", "in": "query", "schema": { "type": "integer", "minimum": 1, "maximum": 100 } },
+          { "name": "active", "in": "query", "schema": { "type": "boolean" } },
+          { "name": "sort", "in": "query", "schema": { "type": "string", "enum": ["name", "created"] } }
+        ],
+        "responses": {
+          "200": { "description": "ok", "content": { "application/json": { "schema": { "type": "array", "items": { "$ref": "#/components/schemas/Item" } } } } }
+        }
+      },
+      "post": {
+        "requestBody": { "required": true, "content": { "application/json": { "schema": { "$ref": "#/components/schemas/Item" } } } },
+        "responses": {
+          "201": { "description": "created", "content": { "application/json": { "schema": { "$ref": "#/components/schemas/Item" } } } },
+          "4XX": { "description": "error", "content": { "application/json": { "schema": { "type": "object" } } } }
+        }
+      }
+    },
+    "/uploads": {
+      "post": {
+        "requestBody": { "required": true, "content": { "text/csv": { "schema": { "type": "string" } } } },
+        "responses": { "202": { "description": "accepted" } }
+      }
+    },
+    "/items/{id}": {
+      "parameters": [ { "$ref": "#/components/parameters/ID" } ],
+      "delete": { "responses": { "204": { "description": "deleted" } } }
+    }
+  },
+  "components": {
+    "parameters": {
+      "ID": { "name": "id", "in": "path", "required": true, "schema": { "type": "string", "pattern": "^[0-9a-f]{24}$" } }
+    },
+    "schemas": {
+      "Item": {
+        "type": "object",
+        "required": ["name", "secret", "id"],
+        "additionalProperties": false,
+        "properties": {
+          "id": { "type": "string", "readOnly": true },
+          "name": { "type": "string", "minLength": 2, "maxLength": 10 },
+          "email": { "type": "string", "format": "email" },
+          "count": { "type": ["integer", "null"], "minimum": 0 },
+          "tags": { "type": "array", "maxItems": 2, "items": { "type": "string" } },
+          "secret": { "type": "string", "writeOnly": true }
+        }
+      }
+    }
+  }
+}`
+
+func newTestRouter(t *testing.T, v *Validator, handler http.HandlerFunc) *mux.Router {
+	r := mux.NewRouter()
+	r.Use(v.Middleware)
+	r.HandleFunc("/items", handler).Methods("GET", "POST")
+	r.HandleFunc("/items/{id}", handler).Methods("DELETE")
+	r.HandleFunc("/undocumented", handler).Methods("GET")
+	return r
+}
+
+func serve(r http.Handler, method, target, body string) *httptest.ResponseRecorder {
+	var req *http.Request
+	if body == "" {
+		req = httptest.NewRequest(method, target, nil)
+	} else {
+		req = httptest.NewRequest(method, target, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+	}
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	return rr
+}
+
+func details(t *testing.T, rr *httptest.ResponseRecorder) []Violation {
+	var response struct {
+		Error   string      `json:"error"`
+		Details []Violation `json:"details"`
+	}
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &response))
+	return response.Details
+}
+
+func TestNewValidator_InvalidSpec(t *testing.T) {
+	_, err := NewValidator([]byte("{"))
+	assert.Error(t, err)
+
+	_, err = NewValidator([]byte(`{"paths": {"/x": {"get": {"parameters": [{"$ref": "#/components/parameters/Missing"}]}}}}`))
+	assert.Error(t, err)
+
+	_, err = NewValidator([]byte(`{"components": {"schemas": {"Bad": {"pattern": "("}}}}`))
+	assert.Error(t, err)
+}
+
+func TestNewValidator_ServedSpec(t *testing.T) {
+	v, err := NewValidator(Spec)
+	require.NoError(t, err)
+	_, ok := v.Operation("GET", "/users/{id}")
+	assert.True(t, ok)
+}
+
+func TestValidator_Request(t *testing.T) {
+	v, err := NewValidator([]byte(testSpec))
+	require.NoError(t, err)
+	var received string
+	r := newTestRouter(t, v, func(w http.ResponseWriter, r *http.Request) {
+		var body bytes.Buffer
+		_, _ = body.ReadFrom(r.Body)
+		received = body.String()
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	tests := []struct {
+		name     string
+		method   string
+		target   string
+		body     string
+		expected []Violation
+	}{
+		{"valid query", "GET", "/items?limit=10&active=true&sort=name", "", nil},
+		{"integer query", "GET", "/items?limit=ten", "", []Violation{{"query.limit", "must be an integer"}}},
+		{"query maximum", "GET", "/items?limit=500", "", []Violation{{"query.limit", "must be at most 100"}}},
+		{"boolean query", "GET", "/items?active=maybe", "", []Violation{{"query.active", "must be true or false"}}},
+		{"enum query", "GET", "/items?sort=size", "", []Violation{{"query.sort", "must be one of [name created]"}}},
+		{"path pattern", "DELETE", "/items/not-an-id", "", []Violation{{"path.id", "must match ^[0-9a-f]{24}$"}}},
+		{"valid path", "DELETE", "/items/66f0c2a1e4b0a1b2c3d4e5f6", "", nil},
+		{"valid body", "POST", "/items", `{"name":"pen","secret":"s","count":null,"tags":["a"]}`, nil},
+		{"missing body", "POST", "/items", "", []Violation{{"body", "is required"}}},
+		{"malformed body", "POST", "/items", `{"name":`, []Violation{{"body", "must be valid JSON"}}},
+		{"body rules", "POST", "/items", `{"name":"p","email":"nope","count":-1,"tags":["a","b",3],"extra":true}`, []Violation{
+			{"body.secret", "is required"},
+			{"body.count", "must be at least 0"},
+			{"body.email", "must be a valid email address"},
+			{"body.extra", "is not allowed"},
+			{"body.name", "must be at least 2 characters"},
+			{"body.tags", "must contain at most 2 items"},
+			{"body.tags[2]", "must be of type string, got integer"},
+		}},
+		{"body type", "POST", "/items", `[]`, []Violation{{"body", "must be of type object, got array"}}},
+		{"undocumented route", "GET", "/undocumented?limit=ten", "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := serve(r, tt.method, tt.target, tt.body)
+			if tt.expected == nil {
+				assert.Equal(t, http.StatusNoContent, rr.Code, rr.Body.String())
+				return
+			}
+			assert.Equal(t, http.StatusBadRequest, rr.Code)
+			assert.Equal(t, tt.expected, details(t, rr))
+		})
+	}
+
+	// Handlers can still read a validated body
+	serve(r, "POST", "/items", `{"name":"pen","secret":"s"}`)
+	assert.Equal(t, `{"name":"pen","secret":"s"}`, received)
+}
+
+func TestValidator_RequestBodyTooLarge(t *testing.T) {
+	v, err := NewValidator([]byte(testSpec))
+	require.NoError(t, err)
+	r := mux.NewRouter()
+	r.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.Body = http.MaxBytesReader(w, r.Body, 4)
+			next.ServeHTTP(w, r)
+		})
+	})
+	r.Use(v.Middleware)
+	r.HandleFunc("/items", func(w http.ResponseWriter, r *http.Request) {}).Methods("POST")
+
+	rr := serve(r, "POST", "/items", `{"name":"pen","secret":"s"}`)
+
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rr.Code)
+}
+
+func TestValidator_RequestUpload(t *testing.T) {
+	v, err := NewValidator([]byte(testSpec))
+	require.NoError(t, err)
+	var received string
+	r := mux.NewRouter()
+	r.Use(v.Middleware)
+	r.HandleFunc("/uploads", func(w http.ResponseWriter, r *http.Request) {
+		var body bytes.Buffer
+		_, _ = body.ReadFrom(r.Body)
+		received = body.String()
+		w.WriteHeader(http.StatusAccepted)
+	}).Methods("POST")
+
+	upload := func(contentType, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/uploads", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", contentType)
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// A documented non-JSON body is passed through untouched
+	rr := upload("text/csv", "name\npen\n")
+	assert.Equal(t, http.StatusAccepted, rr.Code)
+	assert.Equal(t, "name\npen\n", received)
+
+	rr = upload("text/csv", "")
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Equal(t, []Violation{{"body", "is required"}}, details(t, rr))
+}
+
+func TestValidator_ValidateSchema(t *testing.T) {
+	v, err := NewValidator([]byte(testSpec))
+	require.NoError(t, err)
+
+	assert.Empty(t, v.ValidateSchema("Item", map[string]interface{}{"id": "1", "name": "pen", "secret": "s"}))
+	assert.Equal(t, []Violation{
+		{"secret", "is required"},
+		{"email", "must be a valid email address"},
+		{"name", "must be at least 2 characters"},
+	}, v.ValidateSchema("Item", map[string]interface{}{"name": "p", "email": "nope"}))
+	assert.Equal(t, []Violation{{"", `unknown schema "#/components/schemas/Missing"`}}, v.ValidateSchema("Missing", nil))
+}
+
+func TestValidator_Response(t *testing.T) {
+	v, err := NewValidator([]byte(testSpec))
+	require.NoError(t, err)
+	v.ValidateResponses = true
+
+	respond := func(status int, contentType, body string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if contentType != "" {
+				w.Header().Set("Content-Type", contentType)
+			}
+			w.WriteHeader(status)
+			_, _ = w.Write([]byte(body))
+		}
+	}
+
+	tests := []struct {
+		name     string
+		handler  http.HandlerFunc
+		expected []Violation
+	}{
+		{"valid", respond(201, "application/json", `{"id":"1","name":"pen"}`), nil},
+		{"range status", respond(404, "application/json", `{}`), nil},
+		{"undocumented status", respond(500, "application/json", `{}`), []Violation{{"status", "500 is not documented"}}},
+		{"wrong content type", respond(201, "text/plain", `pen`), []Violation{{"header.Content-Type", `"text/plain" is not documented`}}},
+		{"write-only field", respond(201, "application/json", `{"id":"1","name":"pen","secret":"s"}`), []Violation{{"body.secret", "is write-only and must not be returned"}}},
+		{"missing read-only field", respond(201, "application/json", `{"name":"pen"}`), []Violation{{"body.id", "is required"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestRouter(t, v, tt.handler)
+			rr := serve(r, "POST", "/items", `{"name":"pen","secret":"s"}`)
+			if tt.expected == nil {
+				assert.NotEqual(t, http.StatusInternalServerError, rr.Code, rr.Body.String())
+				return
+			}
+			assert.Equal(t, http.StatusInternalServerError, rr.Code)
+			assert.Equal(t, tt.expected, details(t, rr))
+		})
+	}
+}
+
+func TestValidator_OnResponseViolation(t *testing.T) {
+	v, err := NewValidator([]byte(testSpec))
+	require.NoError(t, err)
+	v.ValidateResponses = true
+	var reported []Violation
+	v.OnResponseViolation = func(r *http.Request, violations []Violation) { reported = violations }
+	r := newTestRouter(t, v, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("body"))
+	})
+
+	rr := serve(r, "DELETE", "/items/66f0c2a1e4b0a1b2c3d4e5f6", "")
+
+	// The original response is passed through unchanged
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "body", rr.Body.String())
+	assert.Equal(t, []Violation{{"status", "200 is not documented"}}, reported)
+}
@@ -0,0 +1,369 @@
+package router
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lep13/golang-restful-api/config"
+	"github.com/lep13/golang-restful-api/db"
+	"github.com/lep13/golang-restful-api/handlers"
+	"github.com/lep13/golang-restful-api/jwt"
+	"github.com/lep13/golang-restful-api/middleware"
+	"github.com/lep13/golang-restful-api/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// userStore is a collection holding a single user, applying the updates the
+// login and OAuth handlers make, so a flow can run end to end
+type userStore struct {
+	MockCollection
+	mu   sync.Mutex
+	user models.User
+}
+
+type storedResult struct {
+	user models.User
+	err  error
+}
+
+func (r storedResult) Decode(v interface{}) error {
+	if r.err != nil {
+		return r.err
+	}
+	raw, err := bson.Marshal(r.user)
+	if err != nil {
+		return err
+	}
+	return bson.Unmarshal(raw, v)
+}
+
+// matches checks the conditions of filter the handlers use; others are ignored
+func (s *userStore) matches(filter interface{}) bool {
+	for key, value := range filter.(bson.M) {
+		switch key {
+		case "_id":
+			if value != s.user.ID {
+				return false
+			}
+		case "email":
+			if value != s.user.Email {
+				return false
+			}
+		case "sessions._id":
+			if !containsWhere(len(s.user.Sessions), func(i int) bool { return s.user.Sessions[i].ID == value }) {
+				return false
+			}
+		case "oauth_clients.client_id":
+			if !containsWhere(len(s.user.OAuthClients), func(i int) bool { return s.user.OAuthClients[i].ClientID == value }) {
+				return false
+			}
+		case "oauth_codes.hash":
+			if !containsWhere(len(s.user.OAuthCodes), func(i int) bool { return s.user.OAuthCodes[i].Hash == value }) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func containsWhere(n int, match func(i int) bool) bool {
+	for i := 0; i < n; i++ {
+		if match(i) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *userStore) FindOne(ctx context.Context, filter interface{}) db.MongoSingleResultInterface {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.matches(filter) {
+		return storedResult{err: mongo.ErrNoDocuments}
+	}
+	return storedResult{user: s.user}
+}
+
+func (s *userStore) UpdateOne(ctx context.Context, filter interface{}, update interface{}) (*mongo.UpdateResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.matches(filter) {
+		return &mongo.UpdateResult{}, nil
+	}
+	u := update.(bson.M)
+	if push, ok := u["$push"].(bson.M); ok {
+		for field, value := range push {
+			switch field {
+			case "oauth_clients":
+				s.user.OAuthClients = append(s.user.OAuthClients, value.(models.OAuthClient))
+			case "sessions":
+				s.user.Sessions = append(s.user.Sessions, value.(bson.M)["$each"].([]models.Session)...)
+			case "oauth_codes":
+				s.user.OAuthCodes = append(s.user.OAuthCodes, value.(bson.M)["$each"].([]models.OAuthCode)...)
+			}
+		}
+	}
+	if set, ok := u["$set"].(bson.M); ok {
+		for field, value := range set {
+			if clientID, ok := strings.CutPrefix(field, "oauth_consents."); ok {
+				if s.user.OAuthConsents == nil {
+					s.user.OAuthConsents = make(map[string]models.OAuthConsent)
+				}
+				s.user.OAuthConsents[clientID] = value.(models.OAuthConsent)
+			}
+		}
+	}
+	if pull, ok := u["$pull"].(bson.M); ok {
+		if code, ok := pull["oauth_codes"].(bson.M); ok {
+			var kept []models.OAuthCode
+			for _, c := range s.user.OAuthCodes {
+				if c.Hash != code["hash"] {
+					kept = append(kept, c)
+				}
+			}
+			s.user.OAuthCodes = kept
+		}
+	}
+	return &mongo.UpdateResult{MatchedCount: 1, ModifiedCount: 1}, nil
+}
+
+func TestNew_OAuthFlow(t *testing.T) {
+	password, err := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.DefaultCost)
+	require.NoError(t, err)
+	store := &userStore{user: models.User{
+		ID:            primitive.NewObjectID(),
+		Name:          "John",
+		Email:         "john@example.com",
+		EmailVerified: true,
+		Password:      string(password),
+	}}
+	handlers.Initialize(store)
+	// Sessions are looked up on every request, so the store sees them
+	handlers.SetSessionCache(0)
+	defer handlers.SetSessionCache(30 * time.Second)
+
+	// The issuer mounts the provider; the test server's own URL replaces it
+	cfg := config.Config{ValidateResponses: true, OAuth: config.OAuthConfig{Issuer: "https://api.example.com"}}
+	r, err := New(cfg, middleware.NewMemoryStore())
+	require.NoError(t, err)
+	server := httptest.NewTLSServer(r)
+	defer server.Close()
+	client := server.Client()
+	require.NoError(t, handlers.SetOAuth(config.OAuthConfig{Issuer: server.URL}))
+
+	call := func(method, path, token string, body interface{}, out interface{}) int {
+		t.Helper()
+		var payload strings.Builder
+		if body != nil {
+			require.NoError(t, json.NewEncoder(&payload).Encode(body))
+		}
+		req, err := http.NewRequest(method, server.URL+path, strings.NewReader(payload.String()))
+		require.NoError(t, err)
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		if out != nil {
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(out))
+		}
+		return resp.StatusCode
+	}
+
+	// The user logs in and registers an app
+	var login handlers.TokenResponse
+	require.Equal(t, http.StatusOK, call("POST", "/v1/auth/login", "", map[string]string{"email": "john@example.com", "password": "correct horse"}, &login))
+	var app handlers.NewOAuthClient
+	require.Equal(t, http.StatusCreated, call("POST", "/v1/oauth/clients", login.AccessToken, map[string]interface{}{
+		"client_name":   "Example app",
+		"redirect_uris": []string{"https://app.example.com/callback"},
+	}, &app))
+	assert.Equal(t, "client_secret_basic", app.TokenEndpointAuthMethod)
+	assert.NotEmpty(t, app.ClientSecret)
+
+	// The app sends the user to authorize it, with PKCE
+	verifier := strings.Repeat("v", 43)
+	sum := sha256.Sum256([]byte(verifier))
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {app.ClientID},
+		"redirect_uri":          {"https://app.example.com/callback"},
+		"scope":                 {"openid email"},
+		"state":                 {"xyz"},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(sum[:])},
+		"code_challenge_method": {"S256"},
+		"nonce":                 {"n-0S6"},
+	}
+	var authorization handlers.OAuthAuthorization
+	require.Equal(t, http.StatusOK, call("GET", "/v1/oauth/authorize?"+params.Encode(), login.AccessToken, nil, &authorization))
+	assert.Equal(t, handlers.OAuthAuthorization{ConsentRequired: true, ClientID: app.ClientID, ClientName: "Example app", Scopes: []string{"openid", "email"}}, authorization)
+
+	decision := map[string]interface{}{"approve": true}
+	for key := range params {
+		decision[key] = params.Get(key)
+	}
+	authorization = handlers.OAuthAuthorization{}
+	require.Equal(t, http.StatusOK, call("POST", "/v1/oauth/authorize", login.AccessToken, decision, &authorization))
+	redirect, err := url.Parse(authorization.RedirectTo)
+	require.NoError(t, err)
+	assert.Equal(t, "app.example.com", redirect.Host)
+	assert.Equal(t, "xyz", redirect.Query().Get("state"))
+	assert.Equal(t, server.URL, redirect.Query().Get("iss"))
+	code := redirect.Query().Get("code")
+	require.NotEmpty(t, code)
+
+	// The app redeems the code
+	redeem := func() (*http.Response, map[string]interface{}) {
+		form := url.Values{
+			"grant_type":    {"authorization_code"},
+			"code":          {code},
+			"redirect_uri":  {"https://app.example.com/callback"},
+			"code_verifier": {verifier},
+		}
+		req, err := http.NewRequest("POST", server.URL+"/v1/oauth/token", strings.NewReader(form.Encode()))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(app.ClientID, app.ClientSecret)
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		var body map[string]interface{}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		return resp, body
+	}
+	resp, tokens := redeem()
+	require.Equal(t, http.StatusOK, resp.StatusCode, tokens)
+	assert.Equal(t, "no-store", resp.Header.Get("Cache-Control"))
+	assert.Equal(t, "Bearer", tokens["token_type"])
+	assert.Equal(t, "openid email", tokens["scope"])
+	accessToken := tokens["access_token"].(string)
+
+	// A code is redeemed once
+	resp, replay := redeem()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, "invalid_grant", replay["error"])
+
+	// The ID token verifies against the published key
+	var discovery handlers.OpenIDConfiguration
+	require.Equal(t, http.StatusOK, call("GET", "/.well-known/openid-configuration", "", nil, &discovery))
+	assert.Equal(t, server.URL, discovery.Issuer)
+	var jwks struct {
+		Keys []jwt.JWK `json:"keys"`
+	}
+	require.Equal(t, http.StatusOK, call("GET", strings.TrimPrefix(discovery.JWKSURI, server.URL), "", nil, &jwks))
+	require.Len(t, jwks.Keys, 1)
+	key, err := jwks.Keys[0].PublicKey()
+	require.NoError(t, err)
+	var idToken struct {
+		jwt.Claims
+		Nonce         string `json:"nonce"`
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"email_verified"`
+		Name          string `json:"name"`
+	}
+	require.NoError(t, jwt.VerifyRS256(tokens["id_token"].(string), key, &idToken))
+	assert.Equal(t, discovery.Issuer, idToken.Issuer)
+	assert.Equal(t, store.user.ID.Hex(), idToken.Subject)
+	assert.True(t, idToken.Audience.Contains(app.ClientID))
+	assert.Equal(t, "n-0S6", idToken.Nonce)
+	assert.Equal(t, "john@example.com", idToken.Email)
+	assert.True(t, idToken.EmailVerified)
+	assert.Empty(t, idToken.Name, "the profile scope was not granted")
+
+	// The access token reads the claims of its scopes, and nothing else
+	var info handlers.UserInfo
+	require.Equal(t, http.StatusOK, call("GET", "/v1/oauth/userinfo", accessToken, nil, &info))
+	assert.Equal(t, store.user.ID.Hex(), info.Subject)
+	assert.Equal(t, "john@example.com", info.Email)
+	assert.Empty(t, info.Name)
+	var denied map[string]string
+	assert.Equal(t, http.StatusForbidden, call("GET", "/v1/users/"+store.user.ID.Hex(), accessToken, nil, &denied))
+	assert.Equal(t, "Token lacks the users:read scope", denied["error"])
+
+	// The session of the token names the app
+	var sessions []handlers.Session
+	require.Equal(t, http.StatusOK, call("GET", "/v1/users/"+store.user.ID.Hex()+"/sessions", login.AccessToken, nil, &sessions))
+	require.Len(t, sessions, 2)
+	assert.Equal(t, app.ClientID, sessions[1].ClientID)
+
+	// The consent is remembered
+	authorization = handlers.OAuthAuthorization{}
+	require.Equal(t, http.StatusOK, call("GET", "/v1/oauth/authorize?"+params.Encode(), login.AccessToken, nil, &authorization))
+	assert.False(t, authorization.ConsentRequired)
+	assert.Contains(t, authorization.RedirectTo, "code=")
+}
+
+func TestNew_OAuthRoutes(t *testing.T) {
+	handlers.Initialize(new(MockCollection))
+
+	cfg := config.Config{ValidateResponses: true, OAuth: config.OAuthConfig{Issuer: "https://api.example.com"}}
+	r, err := New(cfg, middleware.NewMemoryStore())
+	assert.NoError(t, err)
+
+	// Managing clients and authorizing them need a login
+	for _, tc := range []struct{ method, path, body string }{
+		{"POST", "/v1/oauth/clients", `{"client_name":"app","redirect_uris":["https://app.example.com/cb"]}`},
+		{"GET", "/v1/oauth/clients", ""},
+		{"DELETE", "/v1/oauth/clients/abc", ""},
+		{"GET", "/v1/oauth/authorize?client_id=abc", ""},
+		{"POST", "/v1/oauth/authorize", `{"client_id":"abc","approve":true}`},
+		{"GET", "/v1/oauth/userinfo", ""},
+	} {
+		req := httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body))
+		if tc.body != "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusUnauthorized, rr.Code, tc.path)
+	}
+
+	// The token endpoint takes forms, and rejects other grants
+	req := httptest.NewRequest("POST", "/v1/oauth/token", strings.NewReader("grant_type=password"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.JSONEq(t, `{"error":"unsupported_grant_type","error_description":"Only the authorization_code grant type is supported"}`, rr.Body.String())
+}
+
+func TestNew_OAuthDisabledWithoutIssuer(t *testing.T) {
+	handlers.Initialize(new(MockCollection))
+
+	r, err := New(config.Config{ValidateResponses: true}, middleware.NewMemoryStore())
+	assert.NoError(t, err)
+
+	for _, tc := range []struct{ method, path string }{
+		{"GET", "/.well-known/openid-configuration"},
+		{"GET", "/v1/oauth/jwks"},
+		{"POST", "/v1/oauth/token"},
+		{"OPTIONS", "/v1/oauth/token"},
+	} {
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, httptest.NewRequest(tc.method, tc.path, nil))
+		assert.Equal(t, http.StatusNotFound, rr.Code, tc.path)
+	}
+
+	// The rest of the API is unaffected
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest("GET", "/health", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+}
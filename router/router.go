@@ -0,0 +1,102 @@
+package router
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/lep13/golang-restful-api/config"
+	"github.com/lep13/golang-restful-api/handlers"
+	"github.com/lep13/golang-restful-api/middleware"
+	"github.com/lep13/golang-restful-api/openapi"
+)
+
+// New registers the API routes and middleware. rateLimitStore holds the
+// rate limiter buckets; pass a shared store when running several instances.
+func New(cfg config.Config, rateLimitStore middleware.RateLimitStore) (*mux.Router, error) {
+	proxies, err := middleware.ParseTrustedProxies(cfg.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+
+	r := mux.NewRouter()
+	r.Use(proxies.Middleware)
+	r.Use(middleware.SecurityHeaders(cfg.Security))
+	cors, err := middleware.NewCORS(cfg.CORS)
+	if err != nil {
+		return nil, err
+	}
+	r.Use(cors.Middleware)
+	// Each client IP has a budget across all routes, spent before its
+	// credentials are looked up so guessing them is throttled too
+	limiter := middleware.NewRateLimiter(rateLimitStore, cfg.RateLimit, proxies)
+	r.Use(limiter.ClientMiddleware)
+	// Bearer tokens and API keys identify the caller; requests without either
+	// stay anonymous. API keys and OAuth access tokens only reach the routes
+	// their scopes allow.
+	r.Use(middleware.Authenticate(handlers.AuthenticateToken, handlers.AuthenticateAPIKey))
+	r.Use(middleware.RequireScopes(routeScopes()))
+	// Route limits apply per user once the caller is known, and per IP otherwise
+	r.Use(limiter.Middleware)
+	uploads := middleware.Uploads{
+		"POST /v1/imports": cfg.Security.MaxUploadBytes,
+		// OAuth clients send forms to the token endpoint (RFC 6749, section 4.1.3)
+		"POST /v1/oauth/token": cfg.Security.MaxBodyBytes,
+	}
+	r.Use(middleware.LimitBody(cfg.Security.MaxBodyBytes, uploads))
+	r.Use(middleware.RequireJSON(uploads))
+
+	// Enforce the OpenAPI contract on requests, and on responses when debugging
+	validator, err := openapi.NewValidator(openapi.Spec)
+	if err != nil {
+		return nil, err
+	}
+	validator.ValidateResponses = cfg.ValidateResponses
+	r.Use(validator.Middleware)
+
+	// Each API version lives on its own subrouter. Versions share the storage
+	// layer through the handlers package, so a /v2 with its own representation
+	// of users can be mounted next to /v1.
+	v1 := r.PathPrefix("/v1").Subrouter()
+	registerV1(v1)
+
+	// The unversioned routes predate /v1 and stay as deprecated aliases
+	legacy := r.NewRoute().Subrouter()
+	legacy.Use(middleware.Deprecated(cfg.LegacyRoutes, func(r *http.Request) string {
+		// The successor takes the same query, such as the page of a listing
+		successor := "/v1" + r.URL.Path
+		if r.URL.RawQuery != "" {
+			successor += "?" + r.URL.RawQuery
+		}
+		return successor
+	}))
+	registerLegacy(legacy)
+
+	// SCIM provisioning by identity providers
+	registerSCIM(r.PathPrefix("/scim/v2").Subrouter())
+
+	// Root handler to display confirmation message
+	r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, err := w.Write([]byte("Your API is up and running on port 5000!"))
+		if err != nil {
+			log.Printf("Error writing response: %v", err)
+		}
+	}).Methods("GET")
+
+	// Health check endpoint
+	r.HandleFunc("/health", handlers.HealthCheck).Methods("GET")
+
+	// API documentation
+	r.HandleFunc("/openapi.json", openapi.SpecHandler).Methods("GET")
+	r.HandleFunc("/docs", openapi.DocsHandler).Methods("GET")
+
+	// The OAuth provider is only served once its issuer is configured, with
+	// OpenID Connect discovery at the path clients derive from the issuer
+	if cfg.OAuth.Issuer != "" {
+		registerOAuth(v1)
+		r.HandleFunc("/.well-known/openid-configuration", handlers.GetOpenIDConfiguration).Methods("GET")
+	}
+
+	return r, nil
+}
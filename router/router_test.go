@@ -0,0 +1,984 @@
+package router
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lep13/golang-restful-api/config"
+	"github.com/lep13/golang-restful-api/db"
+	"github.com/lep13/golang-restful-api/handlers"
+	"github.com/lep13/golang-restful-api/jwt"
+	"github.com/lep13/golang-restful-api/middleware"
+	"github.com/lep13/golang-restful-api/models"
+	"github.com/lep13/golang-restful-api/openapi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// MockCollection simulates a MongoDB collection for unit tests
+type MockCollection struct {
+	mock.Mock
+}
+
+func (m *MockCollection) InsertOne(ctx context.Context, document interface{}) (*mongo.InsertOneResult, error) {
+	args := m.Called(ctx, document)
+	return args.Get(0).(*mongo.InsertOneResult), args.Error(1)
+}
+
+func (m *MockCollection) Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error) {
+	args := m.Called(ctx, filter)
+	return args.Get(0).(*mongo.Cursor), args.Error(1)
+}
+
+func (m *MockCollection) FindOne(ctx context.Context, filter interface{}) db.MongoSingleResultInterface {
+	args := m.Called(ctx, filter)
+	return args.Get(0).(db.MongoSingleResultInterface)
+}
+
+func (m *MockCollection) DeleteOne(ctx context.Context, filter interface{}) (*mongo.DeleteResult, error) {
+	args := m.Called(ctx, filter)
+	return args.Get(0).(*mongo.DeleteResult), args.Error(1)
+}
+
+func (m *MockCollection) UpdateOne(ctx context.Context, filter interface{}, update interface{}) (*mongo.UpdateResult, error) {
+	args := m.Called(ctx, filter, update)
+	return args.Get(0).(*mongo.UpdateResult), args.Error(1)
+}
+
+func (m *MockCollection) InsertMany(ctx context.Context, documents []interface{}, opts ...*options.InsertManyOptions) (*mongo.InsertManyResult, error) {
+	args := m.Called(ctx, documents)
+	return args.Get(0).(*mongo.InsertManyResult), args.Error(1)
+}
+
+func (m *MockCollection) BulkWrite(ctx context.Context, models []mongo.WriteModel, opts ...*options.BulkWriteOptions) (*mongo.BulkWriteResult, error) {
+	args := m.Called(ctx, models)
+	return args.Get(0).(*mongo.BulkWriteResult), args.Error(1)
+}
+
+func (m *MockCollection) CountDocuments(ctx context.Context, filter interface{}) (int64, error) {
+	args := m.Called(ctx, filter)
+	return args.Get(0).(int64), args.Error(1)
+}
+
+func (m *MockCollection) WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	return fn(ctx)
+}
+
+// MockSingleResult simulates a MongoDB single result
+type MockSingleResult struct {
+	mock.Mock
+}
+
+func (m *MockSingleResult) Decode(v interface{}) error {
+	args := m.Called(v)
+	return args.Error(0)
+}
+
+// storeAPIKey stores an admin holding an API key with the user scopes in
+// mockCollection and returns the Authorization header that sends the key.
+// Lookups mocked afterwards do not shadow the admin's.
+func storeAPIKey(mockCollection *MockCollection, prefix string) string {
+	key := "ak_" + prefix + "_0123456789abcdefghijklmnopqrstuvwxyzABCDEFG"
+	sum := sha256.Sum256([]byte(key))
+	user := models.User{ID: primitive.NewObjectID(), Name: "Sync", Admin: true, APIKeys: []models.APIKey{{
+		ID:         primitive.NewObjectID(),
+		Prefix:     prefix,
+		Hash:       hex.EncodeToString(sum[:]),
+		Scopes:     []string{handlers.ScopeUsersRead, handlers.ScopeUsersWrite},
+		LastUsedAt: time.Now(),
+	}}}
+	result := new(MockSingleResult)
+	result.On("Decode", mock.AnythingOfType("*models.User")).Run(func(args mock.Arguments) {
+		*args.Get(0).(*models.User) = user
+	}).Return(nil)
+	mockCollection.On("FindOne", mock.Anything, bson.M{"api_keys.prefix": prefix}).Return(result)
+	mockCollection.On("FindOne", mock.Anything, bson.M{"_id": user.ID}).Return(result)
+	return "ApiKey " + key
+}
+
+func TestNew_RateLimit(t *testing.T) {
+	cfg := config.Config{
+		RateLimit: config.RateLimitConfig{
+			Default: config.RateLimit{Requests: 100, Period: time.Minute},
+			Routes:  map[string]config.RateLimit{"GET /health": {Requests: 1, Period: time.Minute}},
+		},
+	}
+	r, err := New(cfg, middleware.NewMemoryStore())
+	assert.NoError(t, err)
+
+	req, _ := http.NewRequest("GET", "/health", nil)
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assert.NotEmpty(t, rr.Header().Get("Retry-After"))
+}
+
+func TestNew_RateLimitPerUser(t *testing.T) {
+	// Two users call from the same IP, each with their own API key
+	mockCollection := new(MockCollection)
+	keys := []string{storeAPIKey(mockCollection, "aaaaaaaa"), storeAPIKey(mockCollection, "bbbbbbbb")}
+	mockSingleResult := new(MockSingleResult)
+	mockSingleResult.On("Decode", mock.Anything).Return(nil)
+	mockCollection.On("FindOne", mock.Anything, mock.Anything).Return(mockSingleResult)
+	handlers.Initialize(mockCollection)
+
+	cfg := config.Config{RateLimit: config.RateLimitConfig{Default: config.RateLimit{Requests: 1, Period: time.Minute}}}
+	r, err := New(cfg, middleware.NewMemoryStore())
+	assert.NoError(t, err)
+
+	serve := func(authorization string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/v1/users/66f0c2a1e4b0a1b2c3d4e5f6", nil)
+		req.RemoteAddr = "203.0.113.7:5555"
+		req.Header.Set("Authorization", authorization)
+		r.ServeHTTP(rr, req)
+		return rr
+	}
+
+	for _, key := range keys {
+		rr := serve(key)
+		assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+		rr = serve(key)
+		assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	}
+}
+
+func TestNew_ClientRateLimitBeforeAuthentication(t *testing.T) {
+	mockCollection := new(MockCollection)
+	mockSingleResult := new(MockSingleResult)
+	mockSingleResult.On("Decode", mock.Anything).Return(mongo.ErrNoDocuments)
+	mockCollection.On("FindOne", mock.Anything, mock.Anything).Return(mockSingleResult)
+	handlers.Initialize(mockCollection)
+
+	cfg := config.Config{RateLimit: config.RateLimitConfig{
+		Default: config.RateLimit{Requests: 100, Period: time.Minute},
+		Client:  config.RateLimit{Requests: 2, Period: time.Minute},
+	}}
+	r, err := New(cfg, middleware.NewMemoryStore())
+	assert.NoError(t, err)
+
+	// Guessed API keys spend the client's budget, and once it is gone they
+	// are no longer looked up
+	for i, want := range []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusTooManyRequests} {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/v1/users/66f0c2a1e4b0a1b2c3d4e5f6", nil)
+		req.RemoteAddr = "203.0.113.7:5555"
+		req.Header.Set("Authorization", fmt.Sprintf("ApiKey ak_guess%03d_0123456789abcdefghijklmnopqrstuvwxyzABCDEFG", i))
+		r.ServeHTTP(rr, req)
+		assert.Equal(t, want, rr.Code, rr.Body.String())
+	}
+	mockCollection.AssertNumberOfCalls(t, "FindOne", 2)
+}
+
+func TestNew_InvalidTrustedProxy(t *testing.T) {
+	_, err := New(config.Config{TrustedProxies: []string{"nope"}}, middleware.NewMemoryStore())
+	assert.Error(t, err)
+}
+
+func TestNew_InvalidCORS(t *testing.T) {
+	cfg := config.Config{CORS: config.CORSConfig{AllowedOrigins: []string{"*"}, AllowCredentials: true}}
+	_, err := New(cfg, middleware.NewMemoryStore())
+	assert.Error(t, err)
+}
+
+func TestNew_CORSPreflight(t *testing.T) {
+	cfg := config.Config{
+		CORS: config.CORSConfig{
+			AllowedOrigins: []string{"https://app.example.com"},
+			AllowedMethods: []string{"GET", "POST", "PUT", "DELETE"},
+			AllowedHeaders: []string{"Content-Type"},
+		},
+	}
+	r, err := New(cfg, middleware.NewMemoryStore())
+	assert.NoError(t, err)
+
+	for _, path := range []string{"/v1/users", "/v1/users/66f0c2a1e4b0a1b2c3d4e5f6", "/users", "/users/66f0c2a1e4b0a1b2c3d4e5f6"} {
+		req, _ := http.NewRequest("OPTIONS", path, nil)
+		req.Header.Set("Origin", "https://app.example.com")
+		req.Header.Set("Access-Control-Request-Method", "DELETE")
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+
+		assert.Equal(t, http.StatusNoContent, rr.Code, path)
+		assert.Equal(t, "https://app.example.com", rr.Header().Get("Access-Control-Allow-Origin"), path)
+		assert.Contains(t, rr.Header().Get("Access-Control-Allow-Methods"), "DELETE", path)
+	}
+}
+
+func TestNew_SecurityMiddleware(t *testing.T) {
+	cfg := config.Config{Security: config.SecurityConfig{MaxBodyBytes: 16}}
+	r, err := New(cfg, middleware.NewMemoryStore())
+	assert.NoError(t, err)
+
+	req, _ := http.NewRequest("GET", "/health", nil)
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	assert.Equal(t, "nosniff", rr.Header().Get("X-Content-Type-Options"))
+	assert.Equal(t, "no-store", rr.Header().Get("Cache-Control"))
+
+	req, _ = http.NewRequest("POST", "/users", strings.NewReader(`{"name":"a very long name indeed"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rr.Code)
+
+	req, _ = http.NewRequest("POST", "/users", strings.NewReader(`name=x`))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusUnsupportedMediaType, rr.Code)
+}
+
+// Every route registered on the router must be documented in the OpenAPI
+// document and every documented operation must be registered.
+func TestNew_MatchesOpenAPISpec(t *testing.T) {
+	r, err := New(config.Config{OAuth: config.OAuthConfig{Issuer: "https://api.example.com"}}, middleware.NewMemoryStore())
+	assert.NoError(t, err)
+
+	registered := map[string]bool{}
+	err = r.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		path, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+		for _, method := range methods {
+			// Preflight routes only exist for CORS and are not part of the contract
+			if method != http.MethodOptions {
+				registered[method+" "+path] = true
+			}
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+
+	var spec struct {
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	assert.NoError(t, json.Unmarshal(openapi.Spec, &spec))
+	documented := map[string]bool{}
+	for path, item := range spec.Paths {
+		for method := range item {
+			switch method {
+			case "get", "put", "post", "delete", "patch", "head", "options", "trace":
+				documented[strings.ToUpper(method)+" "+path] = true
+			}
+		}
+	}
+
+	for route := range registered {
+		assert.True(t, documented[route], "route %s is missing from openapi.json", route)
+	}
+	for route := range documented {
+		assert.True(t, registered[route], "openapi.json documents %s which is not registered", route)
+	}
+}
+
+// Handlers are exercised through the router with response validation enabled;
+// a response drifting from openapi.json is replaced by a 500 and fails the test.
+func TestNew_HandlersHonorOpenAPIContract(t *testing.T) {
+	mockCollection := new(MockCollection)
+	key := storeAPIKey(mockCollection, "abcdefgh")
+	mockSingleResult := new(MockSingleResult)
+	mockCollection.On("InsertOne", mock.Anything, mock.Anything).Return(&mongo.InsertOneResult{}, nil)
+	mockCollection.On("FindOne", mock.Anything, mock.Anything).Return(mockSingleResult)
+	mockSingleResult.On("Decode", mock.Anything).Run(func(args mock.Arguments) {
+		user := args.Get(0).(*models.User)
+		user.ID = primitive.NewObjectID()
+		user.Name = "John Doe"
+		user.Password = "password123"
+	}).Return(nil)
+	handlers.Initialize(mockCollection)
+
+	r, err := New(config.Config{ValidateResponses: true}, middleware.NewMemoryStore())
+	assert.NoError(t, err)
+
+	// Signing up is open to anonymous callers
+	req, _ := http.NewRequest("POST", "/users", strings.NewReader(`{"name":"John Doe","email":"john@example.com","password":"password123"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.NotContains(t, rr.Body.String(), "password")
+
+	req, _ = http.NewRequest("GET", "/users/"+primitive.NewObjectID().Hex(), nil)
+	req.Header.Set("Authorization", key)
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.NotContains(t, rr.Body.String(), "password")
+
+	for _, target := range []string{"/", "/health", "/openapi.json", "/docs"} {
+		req, _ = http.NewRequest("GET", target, nil)
+		rr = httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code, "%s: %s", target, rr.Body.String())
+	}
+}
+
+func TestNew_RejectsRequestsViolatingOpenAPISpec(t *testing.T) {
+	r, err := New(config.Config{}, middleware.NewMemoryStore())
+	assert.NoError(t, err)
+
+	req, _ := http.NewRequest("GET", "/users/invalid-id", nil)
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"field":"path.id"`)
+
+	req, _ = http.NewRequest("POST", "/users", strings.NewReader(`{"name":"John Doe","email":"not-an-email"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"field":"body.email"`)
+}
+
+func TestNew_VersionedRoutes(t *testing.T) {
+	mockCollection := new(MockCollection)
+	key := storeAPIKey(mockCollection, "abcdefgh")
+	mockSingleResult := new(MockSingleResult)
+	mockSingleResult.On("Decode", mock.Anything).Return(nil)
+	mockCollection.On("FindOne", mock.Anything, mock.Anything).Return(mockSingleResult)
+	handlers.Initialize(mockCollection)
+
+	cfg := config.Config{
+		LegacyRoutes: config.DeprecationConfig{
+			Deprecated: time.Date(2026, time.October, 18, 0, 0, 0, 0, time.UTC),
+			Sunset:     time.Date(2027, time.April, 30, 0, 0, 0, 0, time.UTC),
+		},
+	}
+	r, err := New(cfg, middleware.NewMemoryStore())
+	assert.NoError(t, err)
+
+	req, _ := http.NewRequest("GET", "/v1/users/66f0c2a1e4b0a1b2c3d4e5f6", nil)
+	req.Header.Set("Authorization", key)
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Empty(t, rr.Header().Get("Deprecation"))
+	assert.Empty(t, rr.Header().Get("Link"))
+
+	req, _ = http.NewRequest("GET", "/users/66f0c2a1e4b0a1b2c3d4e5f6", nil)
+	req.Header.Set("Authorization", key)
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "@1792281600", rr.Header().Get("Deprecation"))
+	assert.Equal(t, "Fri, 30 Apr 2027 00:00:00 GMT", rr.Header().Get("Sunset"))
+	assert.Equal(t, `</v1/users/66f0c2a1e4b0a1b2c3d4e5f6>; rel="successor-version"`, rr.Header().Get("Link"))
+
+	// The successor keeps the query of the request
+	cursor, _ := mongo.NewCursorFromDocuments([]interface{}{models.User{ID: primitive.NewObjectID(), Name: "John Doe"}}, nil, nil)
+	mockCollection.On("Find", mock.Anything, mock.Anything).Return(cursor, nil)
+	req, _ = http.NewRequest("GET", "/users?limit=1&fields=name", nil)
+	req.Header.Set("Authorization", key)
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, `</v1/users?limit=1&fields=name>; rel="successor-version"`, rr.Header().Values("Link")[0])
+
+	// Unversioned paths other than the legacy aliases are not deprecated
+	req, _ = http.NewRequest("GET", "/health", nil)
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Empty(t, rr.Header().Get("Deprecation"))
+
+	req, _ = http.NewRequest("PATCH", "/users/66f0c2a1e4b0a1b2c3d4e5f6", nil)
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusMethodNotAllowed, rr.Code)
+}
+
+func TestNew_BatchRoutes(t *testing.T) {
+	mockCollection := new(MockCollection)
+	key := storeAPIKey(mockCollection, "abcdefgh")
+	mockCollection.On("InsertMany", mock.Anything, mock.Anything).Return(&mongo.InsertManyResult{}, nil)
+	handlers.Initialize(mockCollection)
+
+	r, err := New(config.Config{ValidateResponses: true}, middleware.NewMemoryStore())
+	assert.NoError(t, err)
+
+	req, _ := http.NewRequest("POST", "/v1/users:batchCreate", strings.NewReader(`{"items": [{"name": "John Doe"}]}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", key)
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+
+	// Items are validated against the User schema before reaching the handler
+	req, _ = http.NewRequest("POST", "/v1/users:batchCreate", strings.NewReader(`{"items": [{"email": "nope"}]}`))
+	req.Header.Set("Content-Type", "application/json")
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Contains(t, rr.Body.String(), "body.items[0].email")
+
+	// Batch endpoints are only served under /v1
+	req, _ = http.NewRequest("POST", "/users:batchCreate", strings.NewReader(`{"items": [{"name": "John Doe"}]}`))
+	req.Header.Set("Content-Type", "application/json")
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	mockCollection.AssertNumberOfCalls(t, "InsertMany", 1)
+}
+
+func TestNew_ImportRoutes(t *testing.T) {
+	mockCollection := new(MockCollection)
+	key := storeAPIKey(mockCollection, "abcdefgh")
+	handlers.Initialize(mockCollection)
+	cfg := config.Config{ValidateResponses: true}
+	cfg.Security.MaxBodyBytes = 16
+	cfg.Security.MaxUploadBytes = 64
+	r, err := New(cfg, middleware.NewMemoryStore())
+	assert.NoError(t, err)
+
+	upload := func(contentType, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/v1/imports?dryRun=true", strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set("Authorization", key)
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Uploads bypass the JSON-only rule and the request body limit
+	rr := upload("text/csv", "name,email\nJohn Doe,john@example.com\n")
+	assert.Equal(t, http.StatusAccepted, rr.Code, rr.Body.String())
+	location := rr.Header().Get("Location")
+	assert.True(t, strings.HasPrefix(location, "/v1/imports/"), location)
+
+	rr = httptest.NewRecorder()
+	req := httptest.NewRequest("GET", location, nil)
+	req.Header.Set("Authorization", key)
+	r.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+
+	rr = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", location+"/errors", nil)
+	req.Header.Set("Authorization", key)
+	r.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.Equal(t, "text/csv; charset=utf-8", rr.Header().Get("Content-Type"))
+
+	// but still have a limit of their own
+	rr = upload("text/csv", "name\n"+strings.Repeat("x", 100)+"\n")
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rr.Code)
+
+	rr = upload("application/json", `{"name":"x"}`)
+	assert.Equal(t, http.StatusUnsupportedMediaType, rr.Code)
+}
+
+func TestNew_UserRoutesRequireAuthentication(t *testing.T) {
+	handlers.Initialize(new(MockCollection))
+
+	r, err := New(config.Config{ValidateResponses: true}, middleware.NewMemoryStore())
+	assert.NoError(t, err)
+
+	id := primitive.NewObjectID().Hex()
+	for _, tc := range []struct{ method, path, body string }{
+		{"GET", "/v1/users", ""},
+		{"GET", "/v1/users/" + id, ""},
+		{"GET", "/v1/users/export", ""},
+		{"GET", "/v1/users/search?q=john", ""},
+		{"POST", "/v1/users:batchCreate", `{"items": [{"name": "John Doe"}]}`},
+		{"GET", "/v1/imports/" + id, ""},
+		{"GET", "/v1/imports/" + id + "/errors", ""},
+		{"GET", "/users", ""},
+		{"GET", "/users/" + id, ""},
+	} {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body))
+		if tc.body != "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		r.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusUnauthorized, rr.Code, tc.path)
+		assert.JSONEq(t, `{"error":"Authentication required"}`, rr.Body.String())
+	}
+}
+
+func TestNew_SearchRoute(t *testing.T) {
+	mockCollection := new(MockCollection)
+	key := storeAPIKey(mockCollection, "abcdefgh")
+	cursor, _ := mongo.NewCursorFromDocuments([]interface{}{models.User{ID: primitive.NewObjectID(), Name: "John Doe"}}, nil, nil)
+	mockCollection.On("Find", mock.Anything, mock.Anything).Return(cursor, nil)
+	handlers.Initialize(mockCollection)
+
+	r, err := New(config.Config{ValidateResponses: true}, middleware.NewMemoryStore())
+	assert.NoError(t, err)
+
+	// Matched before /v1/users/{id}, whose ID pattern would reject "search"
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/v1/users/search?q=jo", nil)
+	req.Header.Set("Authorization", key)
+	r.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var results []handlers.SearchResult
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &results))
+	assert.Equal(t, "<em>Jo</em>hn Doe", results[0].Highlights["name"])
+
+	rr = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", "/v1/users/search", nil)
+	req.Header.Set("Authorization", key)
+	r.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Contains(t, rr.Body.String(), "query.q")
+}
+
+func TestNew_ListFilter(t *testing.T) {
+	mockCollection := new(MockCollection)
+	key := storeAPIKey(mockCollection, "abcdefgh")
+	cursor, _ := mongo.NewCursorFromDocuments([]interface{}{models.User{ID: primitive.NewObjectID(), Name: "John Doe"}}, nil, nil)
+	mockCollection.On("Find", mock.Anything, mock.Anything).Return(cursor, nil)
+	handlers.Initialize(mockCollection)
+
+	r, err := New(config.Config{ValidateResponses: true}, middleware.NewMemoryStore())
+	assert.NoError(t, err)
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/v1/users?filter="+url.QueryEscape(`name sw "j"`), nil)
+	req.Header.Set("Authorization", key)
+	r.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+
+	rr = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", "/v1/users?filter="+url.QueryEscape(`password pr`), nil)
+	req.Header.Set("Authorization", key)
+	r.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.JSONEq(t, `{"error":"Invalid filter: unknown attribute \"password\""}`, rr.Body.String())
+}
+
+func TestNew_VerifyEmailRoutes(t *testing.T) {
+	mockCollection := new(MockCollection)
+	mockSingleResult := new(MockSingleResult)
+	mockCollection.On("FindOne", mock.Anything, mock.Anything).Return(mockSingleResult)
+	mockSingleResult.On("Decode", mock.Anything).Run(func(args mock.Arguments) {
+		*args.Get(0).(*models.User) = models.User{Email: "john@example.com", EmailVerified: true}
+	}).Return(nil)
+	handlers.Initialize(mockCollection)
+
+	r, err := New(config.Config{ValidateResponses: true}, middleware.NewMemoryStore())
+	assert.NoError(t, err)
+	id := primitive.NewObjectID().Hex()
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/v1/users/"+id+"/verify-email", strings.NewReader(`{}`))
+	req.Header.Set("Content-Type", "application/json")
+	r.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Contains(t, rr.Body.String(), "body.token")
+
+	// The resend endpoint takes no body
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest("POST", "/v1/users/"+id+"/verify-email/resend", nil))
+	assert.Equal(t, http.StatusConflict, rr.Code, rr.Body.String())
+	assert.JSONEq(t, `{"error":"Email is already verified"}`, rr.Body.String())
+}
+
+func TestNew_PasswordResetRoutes(t *testing.T) {
+	mockCollection := new(MockCollection)
+	mockSingleResult := new(MockSingleResult)
+	mockCollection.On("FindOne", mock.Anything, mock.Anything).Return(mockSingleResult)
+	mockSingleResult.On("Decode", mock.Anything).Return(mongo.ErrNoDocuments)
+	handlers.Initialize(mockCollection)
+
+	r, err := New(config.Config{ValidateResponses: true}, middleware.NewMemoryStore())
+	assert.NoError(t, err)
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/v1/auth/password-reset/request", strings.NewReader(`{}`))
+	req.Header.Set("Content-Type", "application/json")
+	r.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Contains(t, rr.Body.String(), "body.email")
+
+	rr = httptest.NewRecorder()
+	req = httptest.NewRequest("POST", "/v1/auth/password-reset/confirm", strings.NewReader(`{"token": "unknown", "password": "correct horse battery"}`))
+	req.Header.Set("Content-Type", "application/json")
+	r.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.JSONEq(t, `{"error":"Invalid or expired reset token"}`, rr.Body.String())
+}
+
+func TestNew_LoginRoutes(t *testing.T) {
+	mockCollection := new(MockCollection)
+	mockSingleResult := new(MockSingleResult)
+	mockCollection.On("FindOne", mock.Anything, mock.Anything).Return(mockSingleResult)
+	mockSingleResult.On("Decode", mock.Anything).Return(mongo.ErrNoDocuments)
+	handlers.Initialize(mockCollection)
+
+	r, err := New(config.Config{ValidateResponses: true}, middleware.NewMemoryStore())
+	assert.NoError(t, err)
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/v1/auth/login", strings.NewReader(`{"email": "john@example.com", "password": "wrong"}`))
+	req.Header.Set("Content-Type", "application/json")
+	r.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	assert.JSONEq(t, `{"error":"Invalid email or password"}`, rr.Body.String())
+
+	rr = httptest.NewRecorder()
+	req = httptest.NewRequest("POST", "/v1/auth/login/mfa", strings.NewReader(`{"mfa_token": "forged", "code": "123456"}`))
+	req.Header.Set("Content-Type", "application/json")
+	r.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	assert.JSONEq(t, `{"error":"Invalid or expired MFA token"}`, rr.Body.String())
+
+	// MFA settings require a token of the user
+	id := primitive.NewObjectID().Hex()
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest("GET", "/v1/users/"+id+"/mfa", nil))
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	rr = httptest.NewRecorder()
+	req = httptest.NewRequest("POST", "/v1/users/"+id+"/mfa/totp", nil)
+	req.Header.Set("Authorization", "Bearer forged")
+	r.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	assert.Contains(t, rr.Header().Get("WWW-Authenticate"), `error="invalid_token"`)
+}
+
+func TestNew_LockRoutes(t *testing.T) {
+	handlers.Initialize(new(MockCollection))
+
+	r, err := New(config.Config{ValidateResponses: true}, middleware.NewMemoryStore())
+	assert.NoError(t, err)
+
+	id := primitive.NewObjectID().Hex()
+	for _, method := range []string{"GET", "DELETE"} {
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, httptest.NewRequest(method, "/v1/users/"+id+"/lock", nil))
+		assert.Equal(t, http.StatusUnauthorized, rr.Code)
+		assert.JSONEq(t, `{"error":"Authentication required"}`, rr.Body.String())
+	}
+}
+
+func TestNew_APIKeyRoutes(t *testing.T) {
+	id := primitive.NewObjectID()
+	key := "ak_abcdefgh_0123456789abcdefghijklmnopqrstuvwxyzABCDEFG"
+	sum := sha256.Sum256([]byte(key))
+	user := models.User{ID: id, Name: "John Doe", Email: "john@example.com", APIKeys: []models.APIKey{{
+		ID:         primitive.NewObjectID(),
+		Prefix:     "abcdefgh",
+		Hash:       hex.EncodeToString(sum[:]),
+		Scopes:     []string{handlers.ScopeUsersRead},
+		LastUsedAt: time.Now(),
+	}}}
+	mockCollection := new(MockCollection)
+	mockSingleResult := new(MockSingleResult)
+	mockCollection.On("FindOne", mock.Anything, mock.Anything).Return(mockSingleResult)
+	mockSingleResult.On("Decode", mock.AnythingOfType("*models.User")).Run(func(args mock.Arguments) {
+		*args.Get(0).(*models.User) = user
+	}).Return(nil)
+	handlers.Initialize(mockCollection)
+
+	r, err := New(config.Config{ValidateResponses: true}, middleware.NewMemoryStore())
+	assert.NoError(t, err)
+
+	serve := func(method, path, authorization string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", authorization)
+		r.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// The key reads users, on versioned and legacy routes
+	for _, path := range []string{"/v1/users/" + id.Hex(), "/users/" + id.Hex()} {
+		rr := serve("GET", path, "ApiKey "+key)
+		assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	}
+
+	// but may not write them without the users:write scope
+	rr := serve("DELETE", "/v1/users/"+id.Hex(), "ApiKey "+key)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.JSONEq(t, `{"error":"API key lacks the users:write scope"}`, rr.Body.String())
+	assert.Contains(t, rr.Header().Get("WWW-Authenticate"), `scope="users:write"`)
+
+	// nor manage API keys, even its own
+	rr = serve("GET", "/v1/users/"+id.Hex()+"/api-keys", "ApiKey "+key)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.JSONEq(t, `{"error":"API keys may not call this route"}`, rr.Body.String())
+
+	rr = serve("GET", "/v1/users/"+id.Hex(), "ApiKey "+key+"x")
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	assert.JSONEq(t, `{"error":"Invalid or expired API key"}`, rr.Body.String())
+
+	// Key management requires a login
+	rr = httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/v1/users/"+id.Hex()+"/api-keys", strings.NewReader(`{"name": "sync", "scopes": ["users:read"]}`))
+	req.Header.Set("Content-Type", "application/json")
+	r.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	assert.JSONEq(t, `{"error":"Authentication required"}`, rr.Body.String())
+}
+
+func TestNew_SessionRoutes(t *testing.T) {
+	handlers.Initialize(new(MockCollection))
+
+	r, err := New(config.Config{ValidateResponses: true}, middleware.NewMemoryStore())
+	assert.NoError(t, err)
+
+	id := primitive.NewObjectID().Hex()
+	for _, tc := range []struct{ method, path string }{
+		{"GET", "/v1/users/" + id + "/sessions"},
+		{"DELETE", "/v1/users/" + id + "/sessions"},
+		{"DELETE", "/v1/users/" + id + "/sessions/" + primitive.NewObjectID().Hex()},
+	} {
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, httptest.NewRequest(tc.method, tc.path, nil))
+		assert.Equal(t, http.StatusUnauthorized, rr.Code)
+		assert.JSONEq(t, `{"error":"Authentication required"}`, rr.Body.String())
+	}
+}
+
+func TestNew_SCIMRoutes(t *testing.T) {
+	token := strings.Repeat("t", 32)
+	assert.NoError(t, handlers.SetSCIMTokens([]string{token}))
+	defer handlers.SetSCIMTokens(nil)
+	mockCollection := new(MockCollection)
+	mockSingleResult := new(MockSingleResult)
+	mockCollection.On("CountDocuments", mock.Anything, mock.Anything).Return(int64(0), nil)
+	mockCollection.On("FindOne", mock.Anything, mock.Anything).Return(mockSingleResult)
+	mockSingleResult.On("Decode", mock.Anything).Return(mongo.ErrNoDocuments)
+	mockCollection.On("InsertOne", mock.Anything, mock.Anything).Return(&mongo.InsertOneResult{}, nil)
+	handlers.Initialize(mockCollection)
+
+	r, err := New(config.Config{ValidateResponses: true}, middleware.NewMemoryStore())
+	assert.NoError(t, err)
+
+	serve := func(method, path, authorization, body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if body != "" {
+			req.Header.Set("Content-Type", "application/scim+json")
+		}
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		r.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Discovery needs no credentials
+	rr := serve("GET", "/scim/v2/ServiceProviderConfig", "", "")
+	assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.Equal(t, "application/scim+json", rr.Header().Get("Content-Type"))
+
+	rr = serve("GET", "/scim/v2/Users", "", "")
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	rr = serve("GET", "/scim/v2/Users?filter=userName+eq+%22jane@example.com%22", "Bearer "+token, "")
+	assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.Contains(t, rr.Body.String(), `"totalResults":0`)
+
+	// Identity providers send the read-only attributes back
+	rr = serve("POST", "/scim/v2/Users", "Bearer "+token,
+		`{"schemas": ["urn:ietf:params:scim:schemas:core:2.0:User"], "id": "x", "userName": "jane@example.com", "active": true, "roles": []}`)
+	assert.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+
+	// SCIM tokens reach nothing else
+	rr = serve("GET", "/v1/users", "Bearer "+token, "")
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+}
+
+// A browser app signs a user in with OpenID Connect over a real listener,
+// going through every middleware: CORS, authentication, scopes, the JSON and
+// upload content checks and the OpenAPI validator on requests and responses
+func TestNew_OpenIDConnectEndToEnd(t *testing.T) {
+	password, err := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.DefaultCost)
+	require.NoError(t, err)
+	store := &userStore{user: models.User{
+		ID:            primitive.NewObjectID(),
+		Name:          "John",
+		Email:         "john@example.com",
+		EmailVerified: true,
+		Password:      string(password),
+	}}
+	handlers.Initialize(store)
+	handlers.SetSessionCache(0)
+	defer handlers.SetSessionCache(30 * time.Second)
+
+	const origin = "https://app.example.com"
+	cfg := config.Config{
+		ValidateResponses: true,
+		OAuth:             config.OAuthConfig{Issuer: "http://127.0.0.1"},
+		CORS: config.CORSConfig{
+			AllowedOrigins:   []string{origin},
+			AllowedMethods:   []string{"GET", "POST"},
+			AllowedHeaders:   []string{"Authorization", "Content-Type"},
+			AllowCredentials: true,
+		},
+	}
+	r, err := New(cfg, middleware.NewMemoryStore())
+	require.NoError(t, err)
+	server := httptest.NewServer(r)
+	defer server.Close()
+	require.NoError(t, handlers.SetOAuth(config.OAuthConfig{Issuer: server.URL}))
+
+	// send makes a request from the app's origin and checks CORS allowed it
+	send := func(method, path, token, contentType, body string, out interface{}) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("Origin", origin)
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := server.Client().Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, origin, resp.Header.Get("Access-Control-Allow-Origin"), path)
+		assert.Equal(t, "true", resp.Header.Get("Access-Control-Allow-Credentials"), path)
+		if out != nil {
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(out), path)
+		}
+		return resp
+	}
+	sendJSON := func(method, path, token string, body interface{}, out interface{}) int {
+		t.Helper()
+		payload, err := json.Marshal(body)
+		require.NoError(t, err)
+		return send(method, path, token, "application/json", string(payload), out).StatusCode
+	}
+
+	// The app discovers the provider
+	var discovery handlers.OpenIDConfiguration
+	require.Equal(t, http.StatusOK, send("GET", "/.well-known/openid-configuration", "", "", "", &discovery).StatusCode)
+	assert.Equal(t, server.URL, discovery.Issuer)
+	assert.Equal(t, server.URL+"/v1/oauth/token", discovery.TokenEndpoint)
+
+	// The user logs in and registers the app as a public client
+	var login handlers.TokenResponse
+	require.Equal(t, http.StatusOK, sendJSON("POST", "/v1/auth/login", "", map[string]string{"email": "john@example.com", "password": "correct horse"}, &login))
+	var invalid map[string]interface{}
+	assert.Equal(t, http.StatusBadRequest, sendJSON("POST", "/v1/oauth/clients", login.AccessToken, map[string]interface{}{"client_name": "Example app"}, &invalid),
+		"the OpenAPI validator requires redirect_uris")
+	assert.Equal(t, http.StatusUnsupportedMediaType, send("POST", "/v1/oauth/clients", login.AccessToken, "application/x-www-form-urlencoded", "client_name=Example+app", nil).StatusCode,
+		"only the token endpoint takes forms")
+	var app handlers.NewOAuthClient
+	require.Equal(t, http.StatusCreated, sendJSON("POST", "/v1/oauth/clients", login.AccessToken, map[string]interface{}{
+		"client_name":                "Example app",
+		"redirect_uris":              []string{origin + "/callback"},
+		"token_endpoint_auth_method": "none",
+	}, &app))
+	assert.Empty(t, app.ClientSecret)
+
+	// The user approves the app's request, made with PKCE
+	verifier := strings.Repeat("v", 43)
+	sum := sha256.Sum256([]byte(verifier))
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {app.ClientID},
+		"redirect_uri":          {origin + "/callback"},
+		"scope":                 {"openid email profile"},
+		"state":                 {"xyz"},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(sum[:])},
+		"code_challenge_method": {"S256"},
+		"nonce":                 {"n-0S6"},
+	}
+	var authorization handlers.OAuthAuthorization
+	require.Equal(t, http.StatusOK, send("GET", "/v1/oauth/authorize?"+params.Encode(), login.AccessToken, "", "", &authorization).StatusCode)
+	assert.True(t, authorization.ConsentRequired)
+	decision := map[string]interface{}{"approve": true}
+	for key := range params {
+		decision[key] = params.Get(key)
+	}
+	authorization = handlers.OAuthAuthorization{}
+	require.Equal(t, http.StatusOK, sendJSON("POST", "/v1/oauth/authorize", login.AccessToken, decision, &authorization))
+	redirect, err := url.Parse(authorization.RedirectTo)
+	require.NoError(t, err)
+	assert.Equal(t, "xyz", redirect.Query().Get("state"))
+	code := redirect.Query().Get("code")
+	require.NotEmpty(t, code)
+
+	// The browser asks before sending the token request across origins
+	req, err := http.NewRequest("OPTIONS", server.URL+"/v1/oauth/token", nil)
+	require.NoError(t, err)
+	req.Header.Set("Origin", origin)
+	req.Header.Set("Access-Control-Request-Method", "POST")
+	req.Header.Set("Access-Control-Request-Headers", "content-type")
+	resp, err := server.Client().Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Equal(t, origin, resp.Header.Get("Access-Control-Allow-Origin"))
+
+	// The app redeems the code with a form, proving it holds the verifier
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {origin + "/callback"},
+		"client_id":     {app.ClientID},
+		"code_verifier": {verifier},
+	}
+	var tokens map[string]interface{}
+	resp = send("POST", "/v1/oauth/token", "", "application/x-www-form-urlencoded", form.Encode(), &tokens)
+	require.Equal(t, http.StatusOK, resp.StatusCode, tokens)
+	assert.Equal(t, "no-store", resp.Header.Get("Cache-Control"))
+	assert.Equal(t, "openid profile email", tokens["scope"])
+	accessToken := tokens["access_token"].(string)
+
+	// The access token reads the user's claims, and nothing beyond its scopes
+	var info handlers.UserInfo
+	require.Equal(t, http.StatusOK, send("GET", "/v1/oauth/userinfo", accessToken, "", "", &info).StatusCode)
+	assert.Equal(t, store.user.ID.Hex(), info.Subject)
+	assert.Equal(t, "john@example.com", info.Email)
+	assert.Equal(t, "John", info.Name)
+	var denied map[string]string
+	assert.Equal(t, http.StatusForbidden, send("GET", "/v1/users/"+store.user.ID.Hex(), accessToken, "", "", &denied).StatusCode)
+	assert.Equal(t, "Token lacks the users:read scope", denied["error"])
+
+	// The ID token verifies against the published keys
+	var jwks struct {
+		Keys []jwt.JWK `json:"keys"`
+	}
+	require.Equal(t, server.URL+"/v1/oauth/jwks", discovery.JWKSURI)
+	require.Equal(t, http.StatusOK, send("GET", "/v1/oauth/jwks", "", "", "", &jwks).StatusCode)
+	require.Len(t, jwks.Keys, 1)
+	key, err := jwks.Keys[0].PublicKey()
+	require.NoError(t, err)
+	var idToken struct {
+		jwt.Claims
+		Nonce string `json:"nonce"`
+		Email string `json:"email"`
+		Name  string `json:"name"`
+	}
+	require.NoError(t, jwt.VerifyRS256(tokens["id_token"].(string), key, &idToken))
+	assert.Equal(t, server.URL, idToken.Issuer)
+	assert.Equal(t, info.Subject, idToken.Subject)
+	assert.True(t, idToken.Audience.Contains(app.ClientID))
+	assert.Equal(t, "n-0S6", idToken.Nonce)
+	assert.Equal(t, "john@example.com", idToken.Email)
+	assert.Equal(t, "John", idToken.Name)
+}
@@ -0,0 +1,41 @@
+package router
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/lep13/golang-restful-api/handlers"
+)
+
+// scimRoutes are the SCIM routes, as "METHOD /path/template" relative to
+// /scim/v2. SCIM tokens may call all of them and nothing else.
+var scimRoutes = []string{
+	"POST /Users",
+	"GET /Users",
+	"GET /Users/{id}",
+	"PUT /Users/{id}",
+	"PATCH /Users/{id}",
+	"DELETE /Users/{id}",
+	"GET /ServiceProviderConfig",
+	"GET /Schemas",
+	"GET /Schemas/{id}",
+	"GET /ResourceTypes",
+	"GET /ResourceTypes/{id}",
+}
+
+// registerSCIM mounts the SCIM 2.0 endpoints (RFC 7644) identity providers
+// provision users with, on a subrouter prefixed with /scim/v2. They are not
+// versioned with the rest of the API: the version is SCIM's.
+func registerSCIM(r *mux.Router) {
+	r.HandleFunc("/Users", handlers.CreateSCIMUser).Methods("POST")
+	r.HandleFunc("/Users", handlers.ListSCIMUsers).Methods("GET")
+	r.HandleFunc("/Users/{id}", handlers.GetSCIMUser).Methods("GET")
+	r.HandleFunc("/Users/{id}", handlers.ReplaceSCIMUser).Methods("PUT")
+	r.HandleFunc("/Users/{id}", handlers.PatchSCIMUser).Methods("PATCH")
+	r.HandleFunc("/Users/{id}", handlers.DeleteSCIMUser).Methods("DELETE")
+
+	// Discovery, which needs no credentials (RFC 7644, section 4)
+	r.HandleFunc("/ServiceProviderConfig", handlers.GetSCIMServiceProviderConfig).Methods("GET")
+	r.HandleFunc("/Schemas", handlers.ListSCIMSchemas).Methods("GET")
+	r.HandleFunc("/Schemas/{id}", handlers.GetSCIMSchema).Methods("GET")
+	r.HandleFunc("/ResourceTypes", handlers.ListSCIMResourceTypes).Methods("GET")
+	r.HandleFunc("/ResourceTypes/{id}", handlers.GetSCIMResourceType).Methods("GET")
+}
@@ -0,0 +1,145 @@
+package router
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/lep13/golang-restful-api/handlers"
+	"github.com/lep13/golang-restful-api/middleware"
+)
+
+// registerV1 mounts version 1 of the API on a subrouter prefixed with /v1.
+func registerV1(r *mux.Router) {
+	// Match CORS preflight requests on the users routes, including the batch actions
+	r.Methods(http.MethodOptions).PathPrefix("/users").HandlerFunc(middleware.Preflight)
+	r.Methods(http.MethodOptions).PathPrefix("/imports").HandlerFunc(middleware.Preflight)
+	r.Methods(http.MethodOptions).PathPrefix("/auth").HandlerFunc(middleware.Preflight)
+
+	// Registered before /users/{id}, which would otherwise match them as IDs
+	r.HandleFunc("/users/export", handlers.ExportUsers).Methods("GET")
+	r.HandleFunc("/users/search", handlers.SearchUsers).Methods("GET")
+
+	registerUserRoutes(r)
+
+	// Batch endpoints, named after the collection with a custom method suffix
+	r.HandleFunc("/users:batchCreate", handlers.BatchCreateUsers).Methods("POST")
+	r.HandleFunc("/users:batchUpdate", handlers.BatchUpdateUsers).Methods("PATCH")
+	r.HandleFunc("/users:batchDelete", handlers.BatchDeleteUsers).Methods("POST")
+
+	// Email verification, with the token mailed on creation or email change
+	r.HandleFunc("/users/{id}/verify-email", handlers.VerifyEmail).Methods("POST")
+	r.HandleFunc("/users/{id}/verify-email/resend", handlers.ResendVerificationEmail).Methods("POST")
+
+	// Password reset; requests are answered alike whether or not the email has an account
+	r.HandleFunc("/auth/password-reset/request", handlers.RequestPasswordReset).Methods("POST")
+	r.HandleFunc("/auth/password-reset/confirm", handlers.ConfirmPasswordReset).Methods("POST")
+
+	// Login, with a second step for users with MFA enabled
+	r.HandleFunc("/auth/login", handlers.Login).Methods("POST")
+	r.HandleFunc("/auth/login/mfa", handlers.LoginMFA).Methods("POST")
+
+	// Passwordless login with single-use links mailed to the user; requests
+	// are answered alike whether or not the email has an account
+	r.HandleFunc("/auth/magic-link/request", handlers.RequestMagicLink).Methods("POST")
+	r.HandleFunc("/auth/magic-link/confirm", handlers.ConfirmMagicLink).Methods("POST")
+
+	// Sign-in at upstream OpenID Connect providers, linking identities to users
+	r.HandleFunc("/auth/oidc/providers", handlers.ListOIDCProviders).Methods("GET")
+	r.HandleFunc("/auth/oidc/{provider}/authorize", handlers.StartOIDCLogin).Methods("GET")
+	r.HandleFunc("/auth/oidc/{provider}/callback", handlers.OIDCCallback).Methods("GET")
+	r.HandleFunc("/users/{id}/identities", handlers.ListIdentities).Methods("GET")
+	r.HandleFunc("/users/{id}/identities/{identity_id}", handlers.UnlinkIdentity).Methods("DELETE")
+
+	// MFA settings, managed by the users themselves
+	r.HandleFunc("/users/{id}/mfa", handlers.GetMFA).Methods("GET")
+	r.HandleFunc("/users/{id}/mfa/totp", handlers.EnrollTOTP).Methods("POST")
+	r.HandleFunc("/users/{id}/mfa/totp/confirm", handlers.ConfirmTOTP).Methods("POST")
+
+	// Lockouts after failed logins; only admins may unlock
+	r.HandleFunc("/users/{id}/lock", handlers.GetLock).Methods("GET")
+	r.HandleFunc("/users/{id}/lock", handlers.Unlock).Methods("DELETE")
+
+	// API keys for machine clients; keys cannot call these routes themselves
+	r.HandleFunc("/users/{id}/api-keys", handlers.CreateAPIKey).Methods("POST")
+	r.HandleFunc("/users/{id}/api-keys", handlers.ListAPIKeys).Methods("GET")
+	r.HandleFunc("/users/{id}/api-keys/{key_id}", handlers.DeleteAPIKey).Methods("DELETE")
+
+	// Sessions of the logins of a user
+	r.HandleFunc("/users/{id}/sessions", handlers.ListSessions).Methods("GET")
+	r.HandleFunc("/users/{id}/sessions", handlers.RevokeSessions).Methods("DELETE")
+	r.HandleFunc("/users/{id}/sessions/{session_id}", handlers.RevokeSession).Methods("DELETE")
+
+	// Asynchronous imports; the upload route is exempt from the JSON body rules
+	r.HandleFunc("/imports", handlers.CreateImport).Methods("POST")
+	r.HandleFunc("/imports/{id}", handlers.GetImport).Methods("GET")
+	r.HandleFunc("/imports/{id}/errors", handlers.GetImportErrors).Methods("GET")
+}
+
+// registerOAuth mounts the OAuth 2.0 and OpenID Connect provider on the /v1
+// subrouter; the discovery document is served at the root.
+func registerOAuth(r *mux.Router) {
+	r.Methods(http.MethodOptions).PathPrefix("/oauth").HandlerFunc(middleware.Preflight)
+	r.HandleFunc("/oauth/clients", handlers.RegisterOAuthClient).Methods("POST")
+	r.HandleFunc("/oauth/clients", handlers.ListOAuthClients).Methods("GET")
+	r.HandleFunc("/oauth/clients/{client_id}", handlers.DeleteOAuthClient).Methods("DELETE")
+	r.HandleFunc("/oauth/authorize", handlers.Authorize).Methods("GET")
+	r.HandleFunc("/oauth/authorize", handlers.ApproveAuthorization).Methods("POST")
+	r.HandleFunc("/oauth/token", handlers.Token).Methods("POST")
+	r.HandleFunc("/oauth/userinfo", handlers.GetUserInfo).Methods("GET")
+	r.HandleFunc("/oauth/jwks", handlers.GetJWKS).Methods("GET")
+}
+
+// routeScopes maps the routes scoped credentials may call, as "METHOD
+// /path/template", to the scope they need. API keys reach the user and import
+// routes, OAuth access tokens the userinfo endpoint and SCIM tokens the SCIM
+// routes. None can call any other route, such as those managing logins, MFA
+// and the keys themselves.
+func routeScopes() map[string]string {
+	routes := map[string]string{
+		"GET /users":               handlers.ScopeUsersRead,
+		"GET /users/{id}":          handlers.ScopeUsersRead,
+		"GET /users/export":        handlers.ScopeUsersRead,
+		"GET /users/search":        handlers.ScopeUsersRead,
+		"GET /imports/{id}":        handlers.ScopeUsersRead,
+		"GET /imports/{id}/errors": handlers.ScopeUsersRead,
+		"POST /users":              handlers.ScopeUsersWrite,
+		"PUT /users/{id}":          handlers.ScopeUsersWrite,
+		"DELETE /users/{id}":       handlers.ScopeUsersWrite,
+		"POST /users:batchCreate":  handlers.ScopeUsersWrite,
+		"PATCH /users:batchUpdate": handlers.ScopeUsersWrite,
+		"POST /users:batchDelete":  handlers.ScopeUsersWrite,
+		"POST /imports":            handlers.ScopeUsersWrite,
+	}
+	scopes := make(map[string]string, 2*len(routes))
+	for route, scope := range routes {
+		method, path, _ := strings.Cut(route, " ")
+		scopes[method+" /v1"+path] = scope
+		// The legacy aliases of the user routes need the same scopes
+		scopes[route] = scope
+	}
+	scopes["GET /v1/oauth/userinfo"] = handlers.ScopeOpenID
+	for _, route := range scimRoutes {
+		method, path, _ := strings.Cut(route, " ")
+		scopes[method+" /scim/v2"+path] = handlers.ScopeSCIM
+	}
+	return scopes
+}
+
+// registerLegacy mounts the unversioned aliases of the version 1 routes. They
+// are frozen: new endpoints are only added under /v1.
+func registerLegacy(r *mux.Router) {
+	r.Methods(http.MethodOptions).Path("/users").HandlerFunc(middleware.Preflight)
+	r.Methods(http.MethodOptions).PathPrefix("/users/").HandlerFunc(middleware.Preflight)
+
+	registerUserRoutes(r)
+}
+
+// registerUserRoutes registers the user CRUD endpoints of version 1.
+func registerUserRoutes(r *mux.Router) {
+	r.HandleFunc("/users", handlers.CreateUser).Methods("POST")
+	r.HandleFunc("/users", handlers.GetUsers).Methods("GET")
+	r.HandleFunc("/users/{id}", handlers.GetUser).Methods("GET")
+	r.HandleFunc("/users/{id}", handlers.UpdateUser).Methods("PUT")
+	r.HandleFunc("/users/{id}", handlers.DeleteUser).Methods("DELETE")
+}
@@ -0,0 +1,30 @@
+#!/bin/bash
+# Generates a local CA, a server certificate for localhost and a client
+# certificate for testing TLS and mutual TLS. Do not use these in production.
+
+set -e
+
+OUT_DIR=${1:-certs}
+CLIENT_NAME=${CLIENT_NAME:-"local-service"}
+mkdir -p "$OUT_DIR"
+cd "$OUT_DIR"
+
+echo "Creating local CA..."
+openssl req -x509 -newkey ec -pkeyopt ec_paramgen_curve:prime256v1 -nodes \
+    -keyout ca.key -out ca.crt -days 365 -subj "/CN=Local Dev CA"
+
+echo "Creating server certificate for localhost..."
+openssl req -newkey ec -pkeyopt ec_paramgen_curve:prime256v1 -nodes \
+    -keyout server.key -out server.csr -subj "/CN=localhost"
+openssl x509 -req -in server.csr -CA ca.crt -CAkey ca.key -CAcreateserial \
+    -out server.crt -days 90 \
+    -extfile <(printf "subjectAltName=DNS:localhost,IP:127.0.0.1\nextendedKeyUsage=serverAuth")
+
+echo "Creating client certificate for $CLIENT_NAME..."
+openssl req -newkey ec -pkeyopt ec_paramgen_curve:prime256v1 -nodes \
+    -keyout client.key -out client.csr -subj "/CN=$CLIENT_NAME"
+openssl x509 -req -in client.csr -CA ca.crt -CAkey ca.key -CAcreateserial \
+    -out client.crt -days 90 -extfile <(printf "extendedKeyUsage=clientAuth")
+
+rm -f server.csr client.csr ca.srl
+echo "Certificates written to $OUT_DIR/"
@@ -0,0 +1,264 @@
+package tlsutil
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lep13/golang-restful-api/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testCA issues certificates for tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns PEM encoded certificate and key for commonName
+func (ca *testCA) issue(t *testing.T, commonName string, usage x509.ExtKeyUsage) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func writeFile(t *testing.T, path string, data []byte, modTime time.Time) {
+	require.NoError(t, os.WriteFile(path, data, 0o600))
+	require.NoError(t, os.Chtimes(path, modTime, modTime))
+}
+
+func writeServerCert(t *testing.T, dir string, ca *testCA, commonName string, modTime time.Time) (string, string) {
+	certPEM, keyPEM := ca.issue(t, commonName, x509.ExtKeyUsageServerAuth)
+	certFile, keyFile := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	writeFile(t, certFile, certPEM, modTime)
+	writeFile(t, keyFile, keyPEM, modTime)
+	return certFile, keyFile
+}
+
+func leafCommonName(t *testing.T, cert *tls.Certificate) string {
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	require.NoError(t, err)
+	return leaf.Subject.CommonName
+}
+
+func TestNewCertReloader_MissingFiles(t *testing.T) {
+	_, err := NewCertReloader("missing.crt", "missing.key")
+	assert.Error(t, err)
+}
+
+func TestCertReloader_ReloadsOnChange(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	start := time.Now().Add(-time.Minute)
+	certFile, keyFile := writeServerCert(t, dir, ca, "first", start)
+
+	reloader, err := NewCertReloader(certFile, keyFile)
+	require.NoError(t, err)
+	cert, _ := reloader.GetCertificate(nil)
+	assert.Equal(t, "first", leafCommonName(t, cert))
+
+	// Unchanged files are not reloaded
+	assert.NoError(t, reloader.reloadIfChanged())
+
+	writeServerCert(t, dir, ca, "second", start.Add(time.Second))
+	assert.NoError(t, reloader.reloadIfChanged())
+	cert, _ = reloader.GetCertificate(nil)
+	assert.Equal(t, "second", leafCommonName(t, cert))
+
+	// A broken key pair keeps the previous certificate in place
+	writeFile(t, keyFile, []byte("garbage"), start.Add(2*time.Second))
+	assert.Error(t, reloader.reloadIfChanged())
+	cert, _ = reloader.GetCertificate(nil)
+	assert.Equal(t, "second", leafCommonName(t, cert))
+}
+
+func TestCertReloader_WatchStopsOnCancel(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	certFile, keyFile := writeServerCert(t, dir, ca, "first", time.Now().Add(-time.Minute))
+	reloader, err := NewCertReloader(certFile, keyFile)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		reloader.Watch(ctx, time.Millisecond)
+		close(done)
+	}()
+
+	writeServerCert(t, dir, ca, "rotated", time.Now())
+	assert.Eventually(t, func() bool {
+		cert, _ := reloader.GetCertificate(nil)
+		return leafCommonName(t, cert) == "rotated"
+	}, time.Second, 5*time.Millisecond)
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Watch did not stop after cancellation")
+	}
+}
+
+func TestNewServerConfig(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	certFile, keyFile := writeServerCert(t, dir, ca, "localhost", time.Now())
+	reloader, err := NewCertReloader(certFile, keyFile)
+	require.NoError(t, err)
+	caFile := filepath.Join(dir, "ca.pem")
+	writeFile(t, caFile, ca.pem, time.Now())
+	badCAFile := filepath.Join(dir, "bad-ca.pem")
+	writeFile(t, badCAFile, []byte("not a certificate"), time.Now())
+
+	tlsConfig, err := NewServerConfig(config.TLSConfig{
+		MinVersion:   "1.3",
+		CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"},
+		ClientCAFile: caFile,
+		ClientAuth:   "optional",
+	}, reloader)
+	require.NoError(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS13), tlsConfig.MinVersion)
+	assert.Equal(t, []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}, tlsConfig.CipherSuites)
+	assert.Equal(t, tls.VerifyClientCertIfGiven, tlsConfig.ClientAuth)
+
+	invalid := []config.TLSConfig{
+		{MinVersion: "1.0"},
+		{CipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"}},
+		{ClientCAFile: filepath.Join(dir, "missing.pem")},
+		{ClientCAFile: badCAFile},
+		{ClientCAFile: caFile, ClientAuth: "sometimes"},
+	}
+	for _, cfg := range invalid {
+		_, err := NewServerConfig(cfg, reloader)
+		assert.Error(t, err, "%+v", cfg)
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	certFile, keyFile := writeServerCert(t, dir, ca, "localhost", time.Now())
+	caFile := filepath.Join(dir, "ca.pem")
+	writeFile(t, caFile, ca.pem, time.Now())
+
+	reloader, err := NewCertReloader(certFile, keyFile)
+	require.NoError(t, err)
+	tlsConfig, err := NewServerConfig(config.TLSConfig{ClientCAFile: caFile, ClientAuth: "require"}, reloader)
+	require.NoError(t, err)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+		}),
+		TLSConfig: tlsConfig,
+		ErrorLog:  log.New(io.Discard, "", 0),
+	}
+	go func() { _ = srv.ServeTLS(ln, "", "") }()
+	defer srv.Close()
+	url := "https://" + ln.Addr().String()
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(ca.pem)
+	newClient := func(certs ...tls.Certificate) *http.Client {
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			RootCAs:      roots,
+			Certificates: certs,
+			MinVersion:   tls.VersionTLS12,
+		}}}
+	}
+
+	_, err = newClient().Get(url)
+	assert.Error(t, err, "clients without a certificate must be rejected")
+
+	otherCA := newTestCA(t)
+	strangerPEM, strangerKey := otherCA.issue(t, "stranger", x509.ExtKeyUsageClientAuth)
+	stranger, err := tls.X509KeyPair(strangerPEM, strangerKey)
+	require.NoError(t, err)
+	_, err = newClient(stranger).Get(url)
+	assert.Error(t, err, "certificates from another CA must be rejected")
+
+	clientPEM, clientKey := ca.issue(t, "billing-service", x509.ExtKeyUsageClientAuth)
+	clientCert, err := tls.X509KeyPair(clientPEM, clientKey)
+	require.NoError(t, err)
+	resp, err := newClient(clientCert).Get(url)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "billing-service", string(body))
+}
+
+func TestRedirectHandler(t *testing.T) {
+	tests := []struct {
+		port     string
+		host     string
+		expected string
+	}{
+		{"8443", "api.example.com:8080", "https://api.example.com:8443/users?limit=5"},
+		{"443", "api.example.com", "https://api.example.com/users?limit=5"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("POST", "http://"+tt.host+"/users?limit=5", nil)
+		rr := httptest.NewRecorder()
+
+		RedirectHandler(tt.port).ServeHTTP(rr, req)
+
+		assert.Equal(t, http.StatusPermanentRedirect, rr.Code)
+		assert.Equal(t, tt.expected, rr.Header().Get("Location"))
+	}
+}